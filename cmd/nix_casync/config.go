@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlag loads a configuration file (.toml, .yaml, .yml or .json),
+// providing values for all flags not set on the command line or via environment variables.
+//
+// By default, a flag is looked up by its name at the top level of the configuration file.
+// Flags can specify a different (dotted) key via the `config` tag,
+// to place them in nested sections.
+// A "*" matches any key of a section, which is used to describe tenants:
+// `config:"tenants.*"` resolves to the list of keys in the tenants section,
+// `config:"tenants.*.priority"` to a map from tenant name to its priority.
+type configFlag string
+
+// BeforeResolve loads the configuration file and registers it as a resolver.
+func (c configFlag) BeforeResolve(ctx *kong.Context, trace *kong.Path) error {
+	p, ok := ctx.FlagValue(trace.Flag).(configFlag)
+	if !ok || p == "" {
+		return nil
+	}
+
+	resolver, err := loadConfig(string(p))
+	if err != nil {
+		return err
+	}
+
+	if err := resolver.check(ctx); err != nil {
+		return err
+	}
+
+	ctx.AddResolver(resolver)
+
+	return nil
+}
+
+// configResolver resolves flags from the contents of a configuration file.
+type configResolver struct {
+	path   string
+	values map[string]interface{}
+}
+
+var _ kong.Resolver = &configResolver{}
+
+// loadConfig parses the configuration file at p, choosing the format by its extension.
+func loadConfig(p string) (*configResolver, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	values := make(map[string]interface{})
+
+	switch ext := filepath.Ext(p); ext {
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".json":
+		err = json.Unmarshal(b, &values)
+	default:
+		return nil, fmt.Errorf("unable to determine format of config file %v: unknown extension %v", p, ext)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %v: %w", p, err)
+	}
+
+	return &configResolver{
+		path:   p,
+		values: values,
+	}, nil
+}
+
+// configKey returns the (dotted) key a flag is looked up with in the configuration file.
+func configKey(flag *kong.Flag) string {
+	if key := flag.Tag.Get("config"); key != "" {
+		return key
+	}
+
+	return flag.Name
+}
+
+// isOverridden returns true if flag is set on the command line or via an environment variable,
+// so its value in the configuration file isn't used.
+func isOverridden(ctx *kong.Context, flag *kong.Flag) bool {
+	for _, trace := range ctx.Path {
+		if trace.Flag == flag {
+			return true
+		}
+	}
+
+	if flag.Tag.Env != "" {
+		if _, ok := os.LookupEnv(flag.Tag.Env); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check ensures the values the configuration file provides for the flags of the selected command can be decoded,
+// and are one of the allowed ones if the flag has an enum.
+// Otherwise, kong would report them under the name of the flag, not the key in the configuration file.
+func (c *configResolver) check(ctx *kong.Context) error {
+	for _, flag := range ctx.Flags() {
+		if isOverridden(ctx, flag) {
+			continue
+		}
+
+		key := configKey(flag)
+
+		value := lookupConfigValue(c.values, strings.Split(key, "."))
+		if value == nil {
+			continue
+		}
+
+		// check maps (such as tenant settings) entry by entry, to name the offending key
+		if m, ok := value.(map[string]interface{}); ok && flag.Target.Kind() == reflect.Map {
+			for _, k := range sortedKeys(m) {
+				if err := checkConfigValue(flag, map[string]interface{}{k: m[k]}); err != nil {
+					return fmt.Errorf("config file %v: invalid value for %v: %w", c.path, strings.Replace(key, "*", k, 1), err)
+				}
+			}
+
+			continue
+		}
+
+		if err := checkConfigValue(flag, value); err != nil {
+			return fmt.Errorf("config file %v: invalid value for %v: %w", c.path, key, err)
+		}
+	}
+
+	return nil
+}
+
+// checkConfigValue decodes value for flag into a scratch target, leaving the flag itself untouched.
+func checkConfigValue(flag *kong.Flag, value interface{}) error {
+	target := reflect.New(flag.Target.Type()).Elem()
+
+	err := flag.Mapper.Decode(&kong.DecodeContext{
+		Value: flag.Value,
+		Scan:  kong.Scan().PushTyped(value, kong.FlagValueToken),
+	}, target)
+	if err != nil {
+		return err
+	}
+
+	if flag.Enum != "" && !flag.EnumMap()[fmt.Sprint(target.Interface())] {
+		return fmt.Errorf("must be one of %v but got %q", strings.Join(flag.EnumSlice(), ","), target.Interface())
+	}
+
+	return nil
+}
+
+// Resolve returns the value for flag from the configuration file, or nil if it's not set there.
+// Flags set via an environment variable aren't resolved,
+// so the environment takes precedence over the configuration file.
+func (c *configResolver) Resolve(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+	if isOverridden(context, flag) {
+		return nil, nil
+	}
+
+	return lookupConfigValue(c.values, strings.Split(configKey(flag), ".")), nil
+}
+
+// lookupConfigValue looks up the value described by parts in values.
+// It returns nil if there's no such value.
+func lookupConfigValue(values interface{}, parts []string) interface{} {
+	if len(parts) == 0 {
+		return values
+	}
+
+	section, ok := values.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if parts[0] != "*" {
+		return lookupConfigValue(section[parts[0]], parts[1:])
+	}
+
+	// a trailing "*" returns the (sorted) keys of the section
+	if len(parts) == 1 {
+		keys := make([]interface{}, 0, len(section))
+		for _, k := range sortedKeys(section) {
+			keys = append(keys, k)
+		}
+
+		return keys
+	}
+
+	// otherwise, return a map from each key to the value below it
+	m := make(map[string]interface{})
+
+	for k, v := range section {
+		if value := lookupConfigValue(v, parts[1:]); value != nil {
+			m[k] = value
+		}
+	}
+
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+// Validate ensures all keys in the configuration file are known,
+// and sections aren't used as values and vice versa.
+func (c *configResolver) Validate(app *kong.Application) error {
+	var patterns [][]string
+
+	var collect func(node *kong.Node)
+	collect = func(node *kong.Node) {
+		for _, flag := range node.Flags {
+			patterns = append(patterns, strings.Split(configKey(flag), "."))
+		}
+
+		for _, child := range node.Children {
+			collect(child)
+		}
+	}
+	collect(app.Node)
+
+	return validateConfigSection(c.path, c.values, nil, patterns)
+}
+
+func validateConfigSection(p string, section map[string]interface{}, prefix []string, patterns [][]string) error {
+	for _, k := range sortedKeys(section) {
+		key := append(append([]string{}, prefix...), k)
+		keyStr := strings.Join(key, ".")
+
+		isValue, isSection := false, false
+
+		for _, pattern := range patterns {
+			if !matchesConfigPattern(key, pattern) {
+				continue
+			}
+
+			if len(pattern) == len(key) {
+				isValue = true
+			} else {
+				isSection = true
+			}
+		}
+
+		subSection, ok := section[k].(map[string]interface{})
+
+		switch {
+		case !isValue && !isSection:
+			return fmt.Errorf("config file %v: unknown key %v", p, keyStr)
+		case ok && isSection:
+			if err := validateConfigSection(p, subSection, key, patterns); err != nil {
+				return err
+			}
+		case !ok && !isValue:
+			return fmt.Errorf("config file %v: %v needs to be a section, not a value", p, keyStr)
+		}
+	}
+
+	return nil
+}
+
+// matchesConfigPattern returns true if key matches the beginning of pattern.
+func matchesConfigPattern(key []string, pattern []string) bool {
+	if len(key) > len(pattern) {
+		return false
+	}
+
+	for i, part := range key {
+		if pattern[i] != "*" && pattern[i] != part {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseWithConfig writes config to a file with the given extension,
+// and parses args with --config pointing to it.
+func parseWithConfig(t *testing.T, ext string, config string, args ...string) (*cli, string, error) {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "config"+ext)
+	if err := os.WriteFile(p, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var c cli
+
+	parser, err := kong.New(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = parser.Parse(append([]string{"--config", p}, args...))
+
+	return &c, p, err
+}
+
+// setenv sets the environment variable key to value for the duration of the test.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+
+	prev, ok := os.LookupEnv(key)
+
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfig(t *testing.T) {
+	tt := []struct {
+		Name   string
+		Ext    string
+		Config string
+		Args   []string
+		Env    map[string]string
+		Check  func(t *testing.T, c *cli)
+	}{
+		{
+			Name:   "top-level key",
+			Ext:    ".toml",
+			Config: "priority = 10\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 10, c.Serve.Priority)
+			},
+		},
+		{
+			Name:   "nested key",
+			Ext:    ".toml",
+			Config: "[uploads]\nread-timeout = \"2m\"\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 2*time.Minute, c.Serve.ReadTimeout)
+			},
+		},
+		{
+			Name:   "write timeout",
+			Ext:    ".toml",
+			Config: "write-timeout = \"10m\"\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 10*time.Minute, c.Serve.WriteTimeout)
+			},
+		},
+		{
+			Name:   "write timeout via env",
+			Ext:    ".toml",
+			Config: "write-timeout = \"10m\"\n",
+			Env:    map[string]string{"NIX_CASYNC_WRITE_TIMEOUT": "0"},
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, time.Duration(0), c.Serve.WriteTimeout)
+			},
+		},
+		{
+			Name:   "yaml",
+			Ext:    ".yaml",
+			Config: "priority: 10\nuploads:\n  read-timeout: 2m\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 10, c.Serve.Priority)
+				assert.Equal(t, 2*time.Minute, c.Serve.ReadTimeout)
+			},
+		},
+		{
+			Name:   "json",
+			Ext:    ".json",
+			Config: `{"priority": 10, "uploads": {"read-timeout": "2m"}}`,
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 10, c.Serve.Priority)
+				assert.Equal(t, 2*time.Minute, c.Serve.ReadTimeout)
+			},
+		},
+		{
+			Name:   "defaults apply to keys not in the file",
+			Ext:    ".toml",
+			Config: "priority = 10\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, "[::]:9000", c.Serve.ListenAddr)
+				assert.Equal(t, 100*time.Second, c.Serve.WriteTimeout)
+			},
+		},
+		{
+			Name:   "env takes precedence over the file",
+			Ext:    ".toml",
+			Config: "priority = 10\n",
+			Env:    map[string]string{"NIX_CASYNC_PRIORITY": "20"},
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 20, c.Serve.Priority)
+			},
+		},
+		{
+			Name:   "flag takes precedence over env and the file",
+			Ext:    ".toml",
+			Config: "priority = 10\n",
+			Args:   []string{"--priority", "30"},
+			Env:    map[string]string{"NIX_CASYNC_PRIORITY": "20"},
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 30, c.Serve.Priority)
+			},
+		},
+		{
+			Name:   "flag takes precedence over an invalid value in the file",
+			Ext:    ".toml",
+			Config: "priority = \"high\"\n",
+			Args:   []string{"--priority", "30"},
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, 30, c.Serve.Priority)
+			},
+		},
+		{
+			Name:   "tenants",
+			Ext:    ".toml",
+			Config: "[tenants.team-b]\n[tenants.team-a]\npriority = 50\nnar-compression = \"none\"\n",
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, []string{"team-a", "team-b"}, c.Serve.Tenants)
+				assert.Equal(t, map[string]int{"team-a": 50}, c.Serve.TenantPriority)
+				assert.Equal(t, map[string]string{"team-a": "none"}, c.Serve.TenantNarCompression)
+			},
+		},
+		{
+			Name:   "tenants via env take precedence over the file",
+			Ext:    ".toml",
+			Config: "[tenants.team-a]\npriority = 50\n",
+			Env:    map[string]string{"NIX_CASYNC_TENANTS": "team-c"},
+			Check: func(t *testing.T, c *cli) {
+				assert.Equal(t, []string{"team-c"}, c.Serve.Tenants)
+				assert.Equal(t, map[string]int{"team-a": 50}, c.Serve.TenantPriority)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			for k, v := range tc.Env {
+				setenv(t, k, v)
+			}
+
+			c, _, err := parseWithConfig(t, tc.Ext, tc.Config, append([]string{"serve"}, tc.Args...)...)
+			if assert.NoError(t, err) {
+				tc.Check(t, c)
+			}
+		})
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tt := []struct {
+		Name   string
+		Ext    string
+		Config string
+		// Errors lists substrings of the expected error message, in addition to the path of the file.
+		Errors []string
+	}{
+		{
+			Name:   "unknown extension",
+			Ext:    ".ini",
+			Config: "priority = 10\n",
+			Errors: []string{"unknown extension .ini"},
+		},
+		{
+			Name:   "unparseable",
+			Ext:    ".toml",
+			Config: "priority = \n",
+			Errors: []string{"unable to parse"},
+		},
+		{
+			Name:   "unknown key",
+			Ext:    ".toml",
+			Config: "prio = 10\n",
+			Errors: []string{"unknown key prio"},
+		},
+		{
+			Name:   "unknown nested key",
+			Ext:    ".toml",
+			Config: "[uploads]\ntimeout = \"2m\"\n",
+			Errors: []string{"unknown key uploads.timeout"},
+		},
+		{
+			Name:   "section used as a value",
+			Ext:    ".toml",
+			Config: "uploads = \"2m\"\n",
+			Errors: []string{"uploads needs to be a section"},
+		},
+		{
+			Name:   "invalid int",
+			Ext:    ".toml",
+			Config: "priority = \"high\"\n",
+			Errors: []string{"invalid value for priority"},
+		},
+		{
+			Name:   "invalid duration",
+			Ext:    ".toml",
+			Config: "[uploads]\nread-timeout = \"soon\"\n",
+			Errors: []string{"invalid value for uploads.read-timeout"},
+		},
+		{
+			Name:   "invalid enum",
+			Ext:    ".toml",
+			Config: "nar-compression = \"lzma\"\n",
+			Errors: []string{"invalid value for nar-compression", "must be one of", "lzma"},
+		},
+		{
+			Name:   "invalid tenant value",
+			Ext:    ".toml",
+			Config: "[tenants.team-a]\npriority = 50\n[tenants.team-b]\npriority = \"high\"\n",
+			Errors: []string{"invalid value for tenants.team-b.priority"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, p, err := parseWithConfig(t, tc.Ext, tc.Config, "serve")
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), p)
+
+				for _, e := range tc.Errors {
+					assert.Contains(t, err.Error(), e)
+				}
+
+				assert.NotContains(t, err.Error(), "--", "error should name the config key, not the flag")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/gc"
+	"github.com/flokli/nix-casync/pkg/retention"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+func collectGarbage() int {
+	castrPath := path.Join(CLI.GC.CachePath, "castr")
+	caibxPath := path.Join(CLI.GC.CachePath, "caibx")
+	tmpPath := path.Join(CLI.GC.CachePath, "tmp")
+
+	blobStore, err := blobstore.NewCasyncStore(castrPath, caibxPath, tmpPath, 0, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		log.Errorf("Error initializing blobstore: %v", err)
+
+		return -1
+	}
+	defer blobStore.Close()
+
+	// All caches share the same blob store,
+	// so blobs and chunks referenced by any of them need to be kept.
+	narinfoPaths := []string{path.Join(CLI.GC.CachePath, "narinfo")}
+
+	tenantDirs, err := ioutil.ReadDir(path.Join(CLI.GC.CachePath, "tenants"))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error listing tenants: %v", err)
+
+		return -1
+	}
+
+	for _, tenantDir := range tenantDirs {
+		narinfoPaths = append(narinfoPaths, tenantNarinfoPath(CLI.GC.CachePath, tenantDir.Name()))
+	}
+
+	metadataStores := make([]metadatastore.MetadataStore, 0, len(narinfoPaths))
+
+	for _, narinfoPath := range narinfoPaths {
+		metadataStore, err := metadatastore.NewFileStore(narinfoPath)
+		if err != nil {
+			log.Errorf("Error initializing metadatastore at %v: %v", narinfoPath, err)
+
+			return -1
+		}
+		defer metadataStore.Close()
+
+		metadataStores = append(metadataStores, metadataStore)
+	}
+
+	policy := retention.Policy{
+		KeepNewerThan: CLI.GC.KeepNewerThan,
+		KeepVersions:  CLI.GC.KeepVersions,
+	}
+
+	if policy.Enabled() {
+		for i, metadataStore := range metadataStores {
+			result, err := retention.Apply(context.Background(), metadataStore, policy, time.Now(), CLI.GC.DryRun)
+			if err != nil {
+				log.Errorf("Error applying retention rules to %v: %v", narinfoPaths[i], err)
+
+				return 1
+			}
+
+			for _, pathInfo := range result.PathsRemoved {
+				if CLI.GC.DryRun {
+					lastUsed := "unknown"
+					if !pathInfo.LastUsed().IsZero() {
+						lastUsed = pathInfo.LastUsed().Format(time.RFC3339)
+					}
+
+					log.Infof("Would remove %v (last used %v, %d hits)", pathInfo.StorePath(), lastUsed, pathInfo.Hits)
+				} else {
+					log.Debugf("Removed %v", pathInfo.StorePath())
+				}
+			}
+
+			log.Infof(
+				"%v: keeping %d store paths, removing %d",
+				narinfoPaths[i],
+				result.PathsKept,
+				len(result.PathsRemoved),
+			)
+		}
+	}
+
+	if CLI.GC.DryRun {
+		return 0
+	}
+
+	stats, err := gc.Run(context.Background(), blobStore, metadataStores, CLI.GC.GracePeriod)
+	if err != nil {
+		log.Errorf("Error collecting garbage: %v", err)
+
+		return 1
+	}
+
+	log.Infof(
+		"Removed metadata of %d NARs without .narinfo, %d NARs and %d chunks, freeing %d bytes",
+		stats.NarMetasRemoved,
+		stats.BlobsRemoved,
+		stats.ChunksRemoved,
+		stats.BytesFreed,
+	)
+
+	err = publishGCEvent(CLI.GC.CachePath, &webhook.Event{
+		Type: webhook.EventGC,
+		GC:   stats,
+	})
+	if err != nil {
+		log.Errorf("Error publishing gc event: %v", err)
+	}
+
+	return 0
+}
@@ -1,31 +1,101 @@
 package main
 
 import (
-	"net/http"
 	"os"
-	"os/signal"
-	"path"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"github.com/flokli/nix-casync/pkg/server"
 	"github.com/flokli/nix-casync/pkg/store/blobstore"
-	"github.com/flokli/nix-casync/pkg/store/metadatastore"
-	"github.com/go-chi/chi/middleware"
-	log "github.com/sirupsen/logrus"
 )
 
-var CLI struct { //nolint:gochecknoglobals
+// chunkStoreFlags describe how chunks are stored in the chunk store.
+type chunkStoreFlags struct {
+	ChunkUncompressed     bool `name:"chunk-uncompressed" help:"Store chunks uncompressed. Needs more disk space, but saves decompressing chunks when assembling NAR files. Run recompress after changing this." type:"bool" default:"false" negatable:"" env:"NIX_CASYNC_CHUNK_UNCOMPRESSED" config:"chunk-store.uncompressed"` //nolint:lll
+	ChunkCompressionLevel int  `name:"chunk-compression-level" help:"The zstd level to compress chunks with (1-22). 0 uses the default (3)." type:"int" default:"0" env:"NIX_CASYNC_CHUNK_COMPRESSION_LEVEL" config:"chunk-store.compression-level"`                                                                             //nolint:lll
+	ChunkSkipVerify       bool `name:"chunk-skip-verify" help:"Don't verify chunks match their ID when assembling NAR files. Chunks uploaded by clients are always verified." type:"bool" default:"false" env:"NIX_CASYNC_CHUNK_SKIP_VERIFY" config:"chunk-store.skip-verify"`                                                   //nolint:lll
+}
+
+func (f *chunkStoreFlags) options() blobstore.ChunkStoreOptions {
+	return blobstore.ChunkStoreOptions{
+		Uncompressed:     f.ChunkUncompressed,
+		CompressionLevel: f.ChunkCompressionLevel,
+		SkipVerify:       f.ChunkSkipVerify,
+	}
+}
+
+type cli struct {
+	Config configFlag `name:"config" help:"Path to a configuration file (.toml, .yaml, .yml or .json). Flags take precedence over environment variables, which take precedence over the configuration file." type:"path"` //nolint:lll
+
 	Serve struct {
-		CachePath      string `name:"cache-path" help:"Path to use for a local cache, containing castr, caibx and narinfo files." type:"path" default:"/var/cache/nix-casync"`                                   //nolint:lll
-		NarCompression string `name:"nar-compression" help:"The compression algorithm to advertise .nar files with (zstd,gzip,brotli,none)" enum:"zstd,gzip,brotli,none" type:"string" default:"zstd"`           //nolint:lll
-		ListenAddr     string `name:"listen-addr" help:"The address this service listens on" type:"string" default:"[::]:9000"`                                                                                  //nolint:lll
-		Priority       int    `name:"priority" help:"What priority to advertise in nix-cache-info. Defaults to 40." type:"int" default:"40"`                                                                     //nolint:lll
-		AvgChunkSize   int    `name:"avg-chunk-size" help:"The average chunking size to use when chunking NAR files, in bytes. Max is 4 times that, Min is a quarter of this value." type:"int" default:"65536"` //nolint:lll
-		AccessLog      bool   `name:"access-log" help:"Enable access logging" type:"bool" default:"true" negatable:""`                                                                                           //nolint:lll
+		CachePath                 string         `name:"cache-path" help:"Path to use for a local cache, containing castr, caibx and narinfo files." type:"path" default:"/var/cache/nix-casync" env:"NIX_CASYNC_CACHE_PATH"`                                                                                                                                       //nolint:lll
+		NarCompression            string         `name:"nar-compression" help:"The compression algorithm to advertise .nar files with (zstd,gzip,br,none). brotli is an alias for br." enum:"zstd,gzip,br,brotli,none" type:"string" default:"zstd" env:"NIX_CASYNC_NAR_COMPRESSION"`                                                                               //nolint:lll
+		NarContentEncoding        []string       `name:"nar-content-encoding" help:"Content codings (zstd,br,gzip) to send uncompressed .nar files with, if accepted by the client via Accept-Encoding, in order of preference. Set to an empty string to disable." default:"zstd,br,gzip" env:"NIX_CASYNC_NAR_CONTENT_ENCODING"`                                   //nolint:lll
+		NarCompressionLevel       map[string]int `name:"nar-compression-level" help:"Compression level to compress .nar files with, as type=level (zstd: 1-22, gzip: 1-9, br: 0-11). Defaults to fast levels." env:"NIX_CASYNC_NAR_COMPRESSION_LEVEL"`                                                                                                              //nolint:lll
+		NarCompressionConcurrency int            `name:"nar-compression-concurrency" help:"Number of threads compressing a single .nar file (zstd and gzip). 0 uses all CPUs, 1 disables parallel compression." type:"int" default:"0" env:"NIX_CASYNC_NAR_COMPRESSION_CONCURRENCY"`                                                                                //nolint:lll
+		ListenAddr                string         `name:"listen-addr" help:"The address this service listens on" type:"string" default:"[::]:9000" env:"NIX_CASYNC_LISTEN_ADDR"`                                                                                                                                                                                     //nolint:lll
+		Priority                  int            `name:"priority" help:"What priority to advertise in nix-cache-info. Defaults to 40." type:"int" default:"40" env:"NIX_CASYNC_PRIORITY"`                                                                                                                                                                           //nolint:lll
+		AvgChunkSize              int            `name:"avg-chunk-size" help:"The average chunking size to use when chunking NAR files, in bytes. Max is 4 times that, Min is a quarter of this value." type:"int" default:"65536" env:"NIX_CASYNC_AVG_CHUNK_SIZE" config:"chunk-store.avg-chunk-size"`                                                             //nolint:lll
+		SeedCacheSize             int64          `name:"seed-cache-size" help:"Keep recently served NAR files up to this many bytes, to speed up assembling similar ones (such as new versions of the same package). 0 disables." type:"int" default:"0" env:"NIX_CASYNC_SEED_CACHE_SIZE" config:"chunk-store.seed-cache-size"`                                     //nolint:lll
+		CompressedNarCacheSize    int64          `name:"compressed-nar-cache-size" help:"Keep compressed NAR files up to this many bytes, so popular ones don't need to be compressed on every request. 0 disables." type:"int" default:"0" env:"NIX_CASYNC_COMPRESSED_NAR_CACHE_SIZE"`                                                                             //nolint:lll
+		ShutdownTimeout           time.Duration  `name:"shutdown-timeout" help:"How long to wait for requests in progress (such as uploads) to finish when shutting down, before aborting them." default:"30s" env:"NIX_CASYNC_SHUTDOWN_TIMEOUT"`                                                                                                                   //nolint:lll
+		ReadTimeout               time.Duration  `name:"read-timeout" help:"How long receiving a request (including its body) may take. Bigger NAR files need to be uploaded in multiple requests (see resumable uploads), each received within this. 0 disables." default:"50s" env:"NIX_CASYNC_READ_TIMEOUT" config:"uploads.read-timeout"`                       //nolint:lll
+		WriteTimeout              time.Duration  `name:"write-timeout" help:"How long sending a response may take, counted from receiving the request headers. Big NAR files sent to or received from slow clients need more. Keep above 1m, for long-polling the change feed. 0 disables." default:"100s" env:"NIX_CASYNC_WRITE_TIMEOUT"`                          //nolint:lll
+		UploadSessionTTL          time.Duration  `name:"upload-session-ttl" help:"Remove upload sessions that weren't updated for this long." default:"24h" env:"NIX_CASYNC_UPLOAD_SESSION_TTL" config:"uploads.session-ttl"`                                                                                                                                       //nolint:lll
+		TempDir                   string         `name:"temp-dir" help:"Directory for temporary files while assembling NAR files. Defaults to $cache-path/tmp. Leftover files are removed on start, so it must not be shared with others. Needs to be on the same filesystem as the cache path if --seed-cache-size is set." type:"path" env:"NIX_CASYNC_TEMP_DIR"` //nolint:lll
+		MaxNarSize                int64          `name:"max-nar-size" help:"Reject uploads of NAR files bigger than this many bytes (uncompressed). 0 means unlimited." type:"int" default:"0" env:"NIX_CASYNC_MAX_NAR_SIZE" config:"uploads.max-nar-size"`                                                                                                         //nolint:lll
+		MinFreeSpace              int64          `name:"min-free-space" help:"Reject uploads (and abort them while being received) if less than this many bytes would be left available in the cache path or temp directory. 0 disables the check." type:"int" default:"1073741824" env:"NIX_CASYNC_MIN_FREE_SPACE" config:"uploads.min-free-space"`                //nolint:lll
+		TrustedPublicKey          []string       `name:"trusted-public-key" help:"Reject uploaded .narinfo files with signatures by one of these keys (name:base64, as in nix.conf) that don't match. Can be specified multiple times." env:"NIX_CASYNC_TRUSTED_PUBLIC_KEYS" config:"trusted-public-keys"`                                                          //nolint:lll
+		AccessLog                 bool           `name:"access-log" help:"Enable access logging" type:"bool" default:"true" negatable:"" env:"NIX_CASYNC_ACCESS_LOG"`                                                                                                                                                                                               //nolint:lll
+
+		ChunkStore chunkStoreFlags `embed:""`
+		Webhooks   webhookFlags    `embed:""`
+		Principals principalFlags  `embed:""`
+
+		Tenants              []string          `name:"tenant" help:"Name of an additional cache to serve below /cache/{name}, with its own narinfo namespace, sharing the chunk store. Can be specified multiple times." type:"string" env:"NIX_CASYNC_TENANTS" config:"tenants.*"`      //nolint:lll
+		TenantPriority       map[string]int    `name:"tenant-priority" help:"Priority to advertise in nix-cache-info of a tenant, as name=priority. Defaults to --priority." env:"NIX_CASYNC_TENANT_PRIORITY" config:"tenants.*.priority"`                                               //nolint:lll
+		TenantNarCompression map[string]string `name:"tenant-nar-compression" help:"The compression algorithm to advertise .nar files of a tenant with, as name=compression. Defaults to --nar-compression." env:"NIX_CASYNC_TENANT_NAR_COMPRESSION" config:"tenants.*.nar-compression"` //nolint:lll
 	} `cmd:"" serve:"Serve a local nix cache."`
+
+	GC struct {
+		CachePath     string        `name:"cache-path" help:"Path to use for a local cache, containing castr, caibx and narinfo files." type:"path" default:"/var/cache/nix-casync" env:"NIX_CASYNC_CACHE_PATH"`                                                                                   //nolint:lll
+		GracePeriod   time.Duration `name:"grace-period" help:"Never remove NARs and chunks that were written or reused more recently than this, to not interfere with uploads in progress." default:"1h" env:"NIX_CASYNC_GC_GRACE_PERIOD" config:"gc.grace-period"`                               //nolint:lll
+		KeepNewerThan time.Duration `name:"keep-newer-than" help:"Remove store paths not uploaded or accessed within this duration first, unless kept by another rule. 0 disables this rule." default:"0" env:"NIX_CASYNC_RETENTION_KEEP_NEWER_THAN" config:"retention.keep-newer-than"`           //nolint:lll
+		KeepVersions  int           `name:"keep-versions" help:"Remove all but the most recently uploaded store paths of each package first, unless kept by another rule. 0 disables this rule." type:"int" default:"0" env:"NIX_CASYNC_RETENTION_KEEP_VERSIONS" config:"retention.keep-versions"` //nolint:lll
+		DryRun        bool          `name:"dry-run" help:"Only list the store paths retention would remove, don't remove anything." type:"bool" default:"false"`                                                                                                                                   //nolint:lll
+	} `cmd:"" name:"gc" help:"Remove store paths not kept by the retention rules (if any), then NARs and chunks no longer referenced by any cache (including all tenants). Pinned store paths and their closures are always kept."` //nolint:lll
+
+	Recompress struct {
+		CachePath  string          `name:"cache-path" help:"Path to use for a local cache, containing castr, caibx and narinfo files." type:"path" default:"/var/cache/nix-casync" env:"NIX_CASYNC_CACHE_PATH"` //nolint:lll
+		ChunkStore chunkStoreFlags `embed:""`
+	} `cmd:"" help:"Rewrite all chunks with the current chunk store options, and report the disk space and CPU time trade-off. Stop serve before switching between compressed and uncompressed chunks."` //nolint:lll
+
+	Rechunk struct {
+		CachePath    string          `name:"cache-path" help:"Path to use for a local cache, containing castr, caibx and narinfo files." type:"path" default:"/var/cache/nix-casync" env:"NIX_CASYNC_CACHE_PATH"`                                                                       //nolint:lll
+		AvgChunkSize int             `name:"avg-chunk-size" help:"The average chunking size to re-chunk NAR files with, in bytes. Max is 4 times that, Min is a quarter of this value." type:"int" default:"65536" env:"NIX_CASYNC_AVG_CHUNK_SIZE" config:"chunk-store.avg-chunk-size"` //nolint:lll
+		RateLimit    int64           `name:"rate-limit" help:"Limit reading NAR files to this many bytes per second, to not starve a cache being served. 0 means unlimited." type:"int" default:"0" env:"NIX_CASYNC_RECHUNK_RATE_LIMIT" config:"rechunk.rate-limit"`                    //nolint:lll
+		GracePeriod  time.Duration   `name:"grace-period" help:"Never remove chunks that were written or reused more recently than this, to not interfere with uploads in progress." default:"1h" env:"NIX_CASYNC_GC_GRACE_PERIOD" config:"gc.grace-period"`                            //nolint:lll
+		ChunkStore   chunkStoreFlags `embed:""`
+	} `cmd:"" help:"Re-chunk all NAR files chunked with a different --avg-chunk-size, then remove chunks no longer used. Can be run on a live cache, and resumed if interrupted."` //nolint:lll
+
+	Push struct {
+		URL          string   `name:"url" help:"URL of the nix-casync server to push to. Use $url/cache/$tenant to push to a tenant." type:"string" default:"http://localhost:9000" env:"NIX_CASYNC_URL" config:"push.url"`                                         //nolint:lll
+		AvgChunkSize int      `name:"avg-chunk-size" help:"The average chunking size to use when chunking NAR files, in bytes. Should match the one of the server." type:"int" default:"65536" env:"NIX_CASYNC_AVG_CHUNK_SIZE" config:"chunk-store.avg-chunk-size"` //nolint:lll
+		Nars         []string `arg:"" name:"nar" help:"Uncompressed NAR files to push." type:"existingfile"`
+	} `cmd:"" help:"Push NAR files to a nix-casync server, only uploading chunks it doesn't have yet."`
+
+	Mirror struct {
+		From             string        `name:"from" help:"URL of the nix-casync server to copy from. Use $url/cache/$tenant to copy from a tenant." type:"string" required:"" env:"NIX_CASYNC_MIRROR_FROM" config:"mirror.from"`                                            //nolint:lll
+		To               string        `name:"to" help:"URL of the nix-casync server to copy to, or the path of a local cache (as used by serve)." type:"string" required:"" env:"NIX_CASYNC_MIRROR_TO" config:"mirror.to"`                                                 //nolint:lll
+		Closure          []string      `name:"closure" help:"Only copy the closures of these store paths (or their hashes). Can be specified multiple times." env:"NIX_CASYNC_MIRROR_CLOSURE" config:"mirror.closure"`                                                      //nolint:lll
+		Name             []string      `name:"name" help:"Only copy store paths whose name (without the hash) matches one of these glob patterns, and their references. Can be specified multiple times." env:"NIX_CASYNC_MIRROR_NAME" config:"mirror.name"`                //nolint:lll
+		TrustedPublicKey []string      `name:"trusted-public-key" help:"Only copy store paths signed by one of these keys (name:base64, as in nix.conf). Can be specified multiple times." env:"NIX_CASYNC_MIRROR_TRUSTED_PUBLIC_KEYS" config:"mirror.trusted-public-keys"` //nolint:lll
+		Checkpoint       string        `name:"checkpoint" help:"File to record copied store paths in, so later runs skip them. Only valid for one destination." type:"path" env:"NIX_CASYNC_MIRROR_CHECKPOINT" config:"mirror.checkpoint"`                                  //nolint:lll
+		Interval         time.Duration `name:"interval" help:"Keep running, and copy new store paths at this interval. 0 copies once, and exits." default:"0" env:"NIX_CASYNC_MIRROR_INTERVAL" config:"mirror.interval"`                                                    //nolint:lll
+	} `cmd:"" help:"Copy store paths from one nix-casync server to another (or a local cache), only transferring chunks the destination doesn't have yet."` //nolint:lll
 }
 
+var CLI cli //nolint:gochecknoglobals
+
 func main() {
 	retcode := 0
 
@@ -34,67 +104,17 @@ func main() {
 	ctx := kong.Parse(&CLI)
 	switch ctx.Command() {
 	case "serve":
-		// initialize casync store
-		castrPath := path.Join(CLI.Serve.CachePath, "castr")
-		caibxPath := path.Join(CLI.Serve.CachePath, "caibx")
-
-		blobStore, err := blobstore.NewCasyncStore(castrPath, caibxPath, CLI.Serve.AvgChunkSize)
-		if err != nil {
-			log.Errorf("Error initializing blobstore: %v", err)
-
-			retcode = -1
-
-			return
-		}
-
-		// initialize narinfo store
-		narinfoPath := path.Join(CLI.Serve.CachePath, "narinfo")
-
-		metadataStore, err := metadatastore.NewFileStore(narinfoPath)
-		if err != nil {
-			log.Errorf("Error initializing metadatastore: %v", err)
-
-			retcode = -1
-
-			return
-		}
-
-		s := server.NewServer(blobStore, metadataStore, CLI.Serve.NarCompression, CLI.Serve.Priority)
-		defer s.Close()
-
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-
-		go func() {
-			for range c {
-				log.Info("Received Signal, shutting down…")
-				s.Close()
-				os.Exit(1)
-			}
-		}()
-
-		log.Printf("Starting Server at %v", CLI.Serve.ListenAddr)
-
-		srv := &http.Server{
-			Addr:         CLI.Serve.ListenAddr,
-			Handler:      s.Handler,
-			ReadTimeout:  50 * time.Second,
-			WriteTimeout: 100 * time.Second,
-			IdleTimeout:  150 * time.Second,
-		}
-
-		if CLI.Serve.AccessLog {
-			srv.Handler = middleware.Logger(s.Handler)
-		}
-
-		err = srv.ListenAndServe()
-		if err != nil {
-			log.Errorf("Error listening: %v", err)
-
-			retcode = 1
-
-			return
-		}
+		retcode = serve()
+	case "gc":
+		retcode = collectGarbage()
+	case "recompress":
+		retcode = recompress()
+	case "rechunk":
+		retcode = rechunk()
+	case "push <nar>":
+		retcode = push()
+	case "mirror":
+		retcode = mirrorCmd()
 	default:
 		panic(ctx.Command())
 	}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/client"
+	"github.com/flokli/nix-casync/pkg/mirror"
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+func mirrorCmd() int {
+	filter, err := mirrorFilter()
+	if err != nil {
+		log.Error(err)
+
+		return 1
+	}
+
+	// The average chunk size is only used when chunking NAR files,
+	// chunks are copied as they are.
+	source := client.NewClient(CLI.Mirror.From, nil, 0)
+
+	var destination mirror.Destination
+
+	if strings.HasPrefix(CLI.Mirror.To, "http://") || strings.HasPrefix(CLI.Mirror.To, "https://") {
+		destination = client.NewClient(CLI.Mirror.To, nil, 0)
+	} else {
+		blobStore, err := blobstore.NewCasyncStore(
+			path.Join(CLI.Mirror.To, "castr"),
+			path.Join(CLI.Mirror.To, "caibx"),
+			path.Join(CLI.Mirror.To, "tmp"),
+			0,
+			blobstore.ChunkStoreOptions{},
+		)
+		if err != nil {
+			log.Errorf("Error initializing blobstore: %v", err)
+
+			return -1
+		}
+		defer blobStore.Close()
+
+		metadataStore, err := metadatastore.NewFileStore(path.Join(CLI.Mirror.To, "narinfo"))
+		if err != nil {
+			log.Errorf("Error initializing metadatastore: %v", err)
+
+			return -1
+		}
+		defer metadataStore.Close()
+
+		destination = mirror.NewLocalDestination(blobStore, metadataStore)
+	}
+
+	var checkpoint *mirror.Checkpoint
+
+	if CLI.Mirror.Checkpoint != "" {
+		checkpoint, err = mirror.OpenCheckpoint(CLI.Mirror.Checkpoint)
+		if err != nil {
+			log.Errorf("Error opening checkpoint: %v", err)
+
+			return -1
+		}
+		defer checkpoint.Close()
+	}
+
+	m := mirror.New(source, destination, *filter, checkpoint)
+
+	// stop after the chunk currently being copied on SIGINT/SIGTERM,
+	// the next run continues where this one stopped.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	for {
+		stats, err := m.Run(ctx)
+		if stats != nil {
+			log.Infof(
+				"Copied %d store paths (%d bytes), transferring %d chunks (%d bytes). %d were already there, %d filtered, %d failed",
+				stats.PathsCopied,
+				stats.NarBytes,
+				stats.ChunksCopied,
+				stats.ChunkBytes,
+				stats.PathsPresent,
+				stats.PathsFiltered,
+				stats.PathsFailed,
+			)
+		}
+
+		if err != nil {
+			log.Errorf("Error mirroring: %v", err)
+
+			// in continuous mode, try again on the next run.
+			if CLI.Mirror.Interval == 0 {
+				return 1
+			}
+		}
+
+		if CLI.Mirror.Interval == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(CLI.Mirror.Interval):
+		}
+	}
+}
+
+// mirrorFilter assembles the filter from the command line flags.
+func mirrorFilter() (*mirror.Filter, error) {
+	filter := &mirror.Filter{
+		Names: CLI.Mirror.Name,
+	}
+
+	for _, pattern := range CLI.Mirror.Name {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %v: %w", pattern, err)
+		}
+	}
+
+	for _, storePath := range CLI.Mirror.Closure {
+		// accept store paths, their basename, or just the hash
+		base := path.Base(storePath)
+		if len(base) < 32 {
+			return nil, fmt.Errorf("invalid store path %v", storePath)
+		}
+
+		outputHash, err := nixbase32.DecodeString(base[:32])
+		if err != nil {
+			return nil, fmt.Errorf("invalid store path %v: %w", storePath, err)
+		}
+
+		filter.Closures = append(filter.Closures, outputHash)
+	}
+
+	for _, s := range CLI.Mirror.TrustedPublicKey {
+		key, err := signing.ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %v: %w", s, err)
+		}
+
+		filter.TrustedKeys = append(filter.TrustedKeys, key)
+	}
+
+	return filter, nil
+}
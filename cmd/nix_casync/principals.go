@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/quota"
+)
+
+// principalFlags configure who may modify the cache, and how much they may upload.
+type principalFlags struct {
+	PrincipalToken map[string]string `name:"principal-token" help:"Token a principal (such as a team) authenticates with, as name=token. Once any is set, all requests modifying the cache need to send one, as bearer token or basic auth password." env:"NIX_CASYNC_PRINCIPAL_TOKEN" config:"principals.*.token"` //nolint:lll
+	PrincipalQuota map[string]int64  `name:"principal-quota" help:"Maximum size (sum of uncompressed NAR sizes, in bytes) of the store paths a principal may upload, as name=bytes. Unlimited if not set." env:"NIX_CASYNC_PRINCIPAL_QUOTA" config:"principals.*.quota"`                                            //nolint:lll
+}
+
+// setup returns an Authenticator accepting the configured tokens, and a Tracker enforcing the quotas,
+// or nil for both if no principals are configured.
+func (f *principalFlags) setup() (*auth.Authenticator, *quota.Tracker, error) {
+	// principals without a quota are unlimited, but still listed in the usage.
+	quotas := make(map[string]uint64)
+	for name := range f.PrincipalToken {
+		quotas[name] = 0
+	}
+
+	for name, q := range f.PrincipalQuota {
+		if _, ok := f.PrincipalToken[name]; !ok {
+			return nil, nil, fmt.Errorf("quota set for unknown principal %v", name)
+		}
+
+		if q < 0 {
+			return nil, nil, fmt.Errorf("invalid quota for principal %v: %v", name, q)
+		}
+
+		quotas[name] = uint64(q)
+	}
+
+	if len(f.PrincipalToken) == 0 {
+		return nil, nil, nil
+	}
+
+	names := make([]string, 0, len(f.PrincipalToken))
+	for name := range f.PrincipalToken {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	principals := make([]*auth.Principal, 0, len(names))
+	for _, name := range names {
+		principals = append(principals, &auth.Principal{Name: name, Token: f.PrincipalToken[name]})
+	}
+
+	authenticator, err := auth.New(principals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return authenticator, quota.NewTracker(quotas), nil
+}
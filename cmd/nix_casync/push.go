@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/flokli/nix-casync/pkg/client"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+func push() int {
+	c := client.NewClient(CLI.Push.URL, nil, CLI.Push.AvgChunkSize)
+
+	for _, narPath := range CLI.Push.Nars {
+		err := pushNar(c, narPath)
+		if err != nil {
+			log.Errorf("Error pushing %v: %v", narPath, err)
+
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func pushNar(c *client.Client, narPath string) error {
+	f, err := os.Open(narPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	res, err := c.PushNar(context.Background(), f, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	log.Infof(
+		"Pushed %v as sha256:%v (%d bytes), uploaded %d of %d chunks",
+		narPath,
+		nixbase32.EncodeToString(res.NarHash),
+		res.NarSize,
+		res.ChunksUploaded,
+		res.ChunksTotal,
+	)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	log "github.com/sirupsen/logrus"
+)
+
+func rechunk() int {
+	castrPath := path.Join(CLI.Rechunk.CachePath, "castr")
+	caibxPath := path.Join(CLI.Rechunk.CachePath, "caibx")
+	tmpPath := path.Join(CLI.Rechunk.CachePath, "tmp")
+
+	blobStore, err := blobstore.NewCasyncStore(
+		castrPath,
+		caibxPath,
+		tmpPath,
+		CLI.Rechunk.AvgChunkSize,
+		CLI.Rechunk.ChunkStore.options(),
+	)
+	if err != nil {
+		log.Errorf("Error initializing blobstore: %v", err)
+
+		return -1
+	}
+	defer blobStore.Close()
+
+	// stop after the NAR file currently being re-chunked on SIGINT/SIGTERM,
+	// the next run continues where this one stopped.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	stats, err := blobStore.Rechunk(ctx, CLI.Rechunk.RateLimit, CLI.Rechunk.GracePeriod)
+	if stats != nil {
+		log.Infof(
+			"Re-chunked %d NARs (%d bytes), %d NARs were already up to date",
+			stats.BlobsRechunked,
+			stats.BytesRechunked,
+			stats.BlobsSkipped,
+		)
+
+		if stats.GC != nil {
+			log.Infof("Removed %d chunks, freeing %d bytes", stats.GC.ChunksRemoved, stats.GC.BytesFreed)
+		}
+	}
+
+	if err != nil {
+		log.Errorf("Error re-chunking: %v", err)
+
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"path"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	log "github.com/sirupsen/logrus"
+)
+
+func recompress() int {
+	castrPath := path.Join(CLI.Recompress.CachePath, "castr")
+	caibxPath := path.Join(CLI.Recompress.CachePath, "caibx")
+	tmpPath := path.Join(CLI.Recompress.CachePath, "tmp")
+
+	blobStore, err := blobstore.NewCasyncStore(castrPath, caibxPath, tmpPath, 0, CLI.Recompress.ChunkStore.options())
+	if err != nil {
+		log.Errorf("Error initializing blobstore: %v", err)
+
+		return -1
+	}
+	defer blobStore.Close()
+
+	stats, err := blobStore.Recompress(context.Background())
+	if err != nil {
+		log.Errorf("Error recompressing chunks: %v", err)
+
+		return 1
+	}
+
+	ratio := 0.0
+	if stats.BytesBefore > 0 {
+		ratio = float64(stats.BytesAfter) / float64(stats.BytesBefore)
+	}
+
+	log.Infof(
+		"Rewrote %d chunks: %d bytes before, %d bytes after (%.2f%%), compressing took %v, decompressing all chunks takes %v",
+		stats.Chunks,
+		stats.BytesBefore,
+		stats.BytesAfter,
+		ratio*100,
+		stats.CompressTime,
+		stats.DecompressTime,
+	)
+
+	if stats.ChunksInvalid > 0 {
+		log.Warnf("%d chunks don't match their ID, and were left untouched", stats.ChunksInvalid)
+
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/flokli/nix-casync/pkg/server"
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/store/renditionstore"
+	"github.com/flokli/nix-casync/pkg/store/uploadstore"
+	"github.com/flokli/nix-casync/pkg/webhook"
+	"github.com/go-chi/chi/middleware"
+	log "github.com/sirupsen/logrus"
+)
+
+// narCompressions contains the supported values for --nar-compression.
+var narCompressions = []string{"zstd", "gzip", "br", "brotli", "none"} //nolint:gochecknoglobals
+
+// narContentEncodings contains the supported values for --nar-content-encoding.
+var narContentEncodings = []string{"zstd", "br", "gzip"} //nolint:gochecknoglobals
+
+// compressorOptions returns the options to compress .nar files with.
+func compressorOptions(c *cli) (compression.CompressorOptions, error) {
+	opts := compression.CompressorOptions{
+		Levels:      c.Serve.NarCompressionLevel,
+		Concurrency: c.Serve.NarCompressionConcurrency,
+	}
+
+	if err := opts.Validate(); err != nil {
+		return opts, fmt.Errorf("invalid nar compression options: %w", err)
+	}
+
+	return opts, nil
+}
+
+// narCompressionType returns the compression type for a value of --nar-compression.
+// Earlier versions only accepted brotli, which isn't what Nix calls it.
+func narCompressionType(narCompression string) string {
+	if narCompression == "brotli" {
+		return "br"
+	}
+
+	return narCompression
+}
+
+// contentEncodings returns the content codings to offer for .nar files,
+// ignoring empty values, so an empty string disables content negotiation.
+func contentEncodings(c *cli) ([]string, error) {
+	var encodings []string
+
+	for _, encoding := range c.Serve.NarContentEncoding {
+		if encoding == "" {
+			continue
+		}
+
+		if !contains(narContentEncodings, encoding) {
+			return nil, fmt.Errorf("invalid nar content encoding: %v", encoding)
+		}
+
+		encodings = append(encodings, encoding)
+	}
+
+	return encodings, nil
+}
+
+// tempPath returns the path to the temp directory.
+func tempPath(c *cli) string {
+	if c.Serve.TempDir != "" {
+		return c.Serve.TempDir
+	}
+
+	return path.Join(c.Serve.CachePath, "tmp")
+}
+
+// uploadLimits returns the limits of uploads.
+// Free space is checked in the cache path and the temp directory, which might be on different filesystems.
+func uploadLimits(c *cli) (server.UploadLimits, error) {
+	if c.Serve.MaxNarSize < 0 {
+		return server.UploadLimits{}, fmt.Errorf("invalid max nar size: %d", c.Serve.MaxNarSize)
+	}
+
+	if c.Serve.MinFreeSpace < 0 {
+		return server.UploadLimits{}, fmt.Errorf("invalid min free space: %d", c.Serve.MinFreeSpace)
+	}
+
+	return server.UploadLimits{
+		MaxNarSize:   uint64(c.Serve.MaxNarSize),
+		MinFreeSpace: uint64(c.Serve.MinFreeSpace),
+		Paths:        []string{c.Serve.CachePath, tempPath(c)},
+	}, nil
+}
+
+// trustedKeys returns the keys to check signatures of uploaded .narinfo files with.
+func trustedKeys(c *cli) ([]*signing.PublicKey, error) {
+	keys := make([]*signing.PublicKey, 0, len(c.Serve.TrustedPublicKey))
+
+	for _, k := range c.Serve.TrustedPublicKey {
+		key, err := signing.ParsePublicKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %v: %w", k, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// tenantNarinfoPath returns the path to the narinfo directory of a tenant.
+func tenantNarinfoPath(cachePath, name string) string {
+	return path.Join(cachePath, "tenants", name, "narinfo")
+}
+
+// tenantUploadsPath returns the path to the upload sessions directory of a tenant.
+func tenantUploadsPath(cachePath, name string) string {
+	return path.Join(cachePath, "tenants", name, "uploads")
+}
+
+// tenantSettings returns the priority and nar compression of a tenant,
+// falling back to the ones of the default cache.
+func tenantSettings(c *cli, name string) (int, string, error) {
+	priority := c.Serve.Priority
+	if p, ok := c.Serve.TenantPriority[name]; ok {
+		priority = p
+	}
+
+	narCompression := c.Serve.NarCompression
+	if nc, ok := c.Serve.TenantNarCompression[name]; ok {
+		narCompression = nc
+	}
+
+	if !contains(narCompressions, narCompression) {
+		return 0, "", fmt.Errorf("invalid nar compression for tenant %v: %v", name, narCompression)
+	}
+
+	return priority, narCompressionType(narCompression), nil
+}
+
+// checkTenantSettings ensures per-tenant settings only refer to configured tenants.
+func checkTenantSettings(c *cli) error {
+	for name := range c.Serve.TenantPriority {
+		if !contains(c.Serve.Tenants, name) {
+			return fmt.Errorf("priority set for unknown tenant %v", name)
+		}
+	}
+
+	for name := range c.Serve.TenantNarCompression {
+		if !contains(c.Serve.Tenants, name) {
+			return fmt.Errorf("nar compression set for unknown tenant %v", name)
+		}
+	}
+
+	for _, name := range c.Serve.Tenants {
+		if err := server.CheckTenantName(name); err != nil {
+			return err
+		}
+
+		if _, _, err := tenantSettings(c, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newTenantServer initializes a server for a tenant, which uses its own metadata store,
+// but shares blobStore with all other tenants.
+func newTenantServer(
+	blobStore blobstore.BlobStore,
+	renditionStore *renditionstore.FileStore,
+	outbox *webhook.Outbox,
+	name string,
+) (*server.Server, error) {
+	priority, narCompression, err := tenantSettings(&CLI, name)
+	if err != nil {
+		return nil, err
+	}
+
+	encodings, err := contentEncodings(&CLI)
+	if err != nil {
+		return nil, err
+	}
+
+	compressorOpts, err := compressorOptions(&CLI)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := uploadLimits(&CLI)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := trustedKeys(&CLI)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataStore, err := metadatastore.NewFileStore(tenantNarinfoPath(CLI.Serve.CachePath, name))
+	if err != nil {
+		return nil, err
+	}
+
+	s := server.NewServer(blobStore, metadataStore, narCompression, priority)
+	s.SetNarContentEncodings(encodings)
+	s.SetCompressorOptions(compressorOpts)
+	s.SetUploadLimits(limits)
+	s.SetTrustedKeys(keys)
+
+	if renditionStore != nil {
+		s.SetRenditionStore(renditionStore)
+	}
+
+	if outbox != nil {
+		s.SetWebhooks(outbox, name)
+	}
+
+	uploadStore, err := uploadstore.NewFileStore(tenantUploadsPath(CLI.Serve.CachePath, name))
+	if err != nil {
+		s.Close()
+
+		return nil, err
+	}
+
+	err = s.RegisterUploadHandlers(uploadStore, CLI.Serve.UploadSessionTTL)
+	if err != nil {
+		s.Close()
+
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// tenants returns the servers of all tenants mounted in s.
+func tenants(s *server.Server) []*server.Server {
+	servers := make([]*server.Server, 0, len(CLI.Serve.Tenants))
+	for _, name := range CLI.Serve.Tenants {
+		servers = append(servers, s.Tenant(name))
+	}
+
+	return servers
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reloadConfig parses the command line (and configuration file) again,
+// and applies all settings that can be changed while serving.
+// Changes to all other settings are logged, as they require a restart.
+func reloadConfig(s *server.Server, accessLog *int32) error {
+	var c cli
+
+	parser, err := kong.New(&c)
+	if err != nil {
+		return err
+	}
+
+	_, err = parser.Parse(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	err = checkTenantSettings(&c)
+	if err != nil {
+		return err
+	}
+
+	if c.Serve.CachePath != CLI.Serve.CachePath ||
+		c.Serve.ListenAddr != CLI.Serve.ListenAddr ||
+		c.Serve.ReadTimeout != CLI.Serve.ReadTimeout ||
+		c.Serve.WriteTimeout != CLI.Serve.WriteTimeout ||
+		c.Serve.TempDir != CLI.Serve.TempDir ||
+		c.Serve.AvgChunkSize != CLI.Serve.AvgChunkSize ||
+		c.Serve.SeedCacheSize != CLI.Serve.SeedCacheSize ||
+		c.Serve.CompressedNarCacheSize != CLI.Serve.CompressedNarCacheSize ||
+		c.Serve.ChunkStore != CLI.Serve.ChunkStore ||
+		!reflect.DeepEqual(c.Serve.Tenants, CLI.Serve.Tenants) ||
+		!reflect.DeepEqual(c.Serve.Webhooks, CLI.Serve.Webhooks) ||
+		!reflect.DeepEqual(c.Serve.Principals, CLI.Serve.Principals) {
+		log.Warn("cache-path, listen-addr, read-timeout, write-timeout, temp-dir, avg-chunk-size, seed-cache-size, compressed-nar-cache-size, chunk store options, tenants, webhooks and principals can't be changed without a restart, ignoring")
+	}
+
+	encodings, err := contentEncodings(&c)
+	if err != nil {
+		return err
+	}
+
+	compressorOpts, err := compressorOptions(&c)
+	if err != nil {
+		return err
+	}
+
+	limits, err := uploadLimits(&c)
+	if err != nil {
+		return err
+	}
+
+	keys, err := trustedKeys(&c)
+	if err != nil {
+		return err
+	}
+
+	s.SetPriority(c.Serve.Priority)
+	s.SetNarServeCompression(narCompressionType(c.Serve.NarCompression))
+	s.SetNarContentEncodings(encodings)
+	s.SetCompressorOptions(compressorOpts)
+	s.SetUploadLimits(limits)
+	s.SetTrustedKeys(keys)
+
+	for _, name := range CLI.Serve.Tenants {
+		priority, narCompression, err := tenantSettings(&c, name)
+		if err != nil {
+			return err
+		}
+
+		tenant := s.Tenant(name)
+		tenant.SetPriority(priority)
+		tenant.SetNarServeCompression(narCompression)
+		tenant.SetNarContentEncodings(encodings)
+		tenant.SetCompressorOptions(compressorOpts)
+		tenant.SetUploadLimits(limits)
+		tenant.SetTrustedKeys(keys)
+	}
+
+	if c.Serve.AccessLog {
+		atomic.StoreInt32(accessLog, 1)
+	} else {
+		atomic.StoreInt32(accessLog, 0)
+	}
+
+	return nil
+}
+
+func serve() int {
+	err := checkTenantSettings(&CLI)
+	if err != nil {
+		log.Errorf("Invalid tenant configuration: %v", err)
+
+		return -1
+	}
+
+	encodings, err := contentEncodings(&CLI)
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+
+		return -1
+	}
+
+	compressorOpts, err := compressorOptions(&CLI)
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+
+		return -1
+	}
+
+	limits, err := uploadLimits(&CLI)
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+
+		return -1
+	}
+
+	keys, err := trustedKeys(&CLI)
+	if err != nil {
+		log.Errorf("Invalid configuration: %v", err)
+
+		return -1
+	}
+
+	// initialize casync store
+	castrPath := path.Join(CLI.Serve.CachePath, "castr")
+	caibxPath := path.Join(CLI.Serve.CachePath, "caibx")
+	tmpPath := tempPath(&CLI)
+
+	blobStore, err := blobstore.NewCasyncStore(
+		castrPath,
+		caibxPath,
+		tmpPath,
+		CLI.Serve.AvgChunkSize,
+		CLI.Serve.ChunkStore.options(),
+	)
+	if err != nil {
+		log.Errorf("Error initializing blobstore: %v", err)
+
+		return -1
+	}
+
+	if CLI.Serve.SeedCacheSize > 0 {
+		err = blobStore.EnableSeedCache(path.Join(CLI.Serve.CachePath, "seeds"), CLI.Serve.SeedCacheSize)
+		if err != nil {
+			log.Errorf("Error initializing seed cache: %v", err)
+
+			return -1
+		}
+	}
+
+	// initialize narinfo store
+	narinfoPath := path.Join(CLI.Serve.CachePath, "narinfo")
+
+	metadataStore, err := metadatastore.NewFileStore(narinfoPath)
+	if err != nil {
+		log.Errorf("Error initializing metadatastore: %v", err)
+
+		return -1
+	}
+
+	s := server.NewServer(blobStore, metadataStore, narCompressionType(CLI.Serve.NarCompression), CLI.Serve.Priority)
+	defer s.Close()
+
+	s.SetNarContentEncodings(encodings)
+	s.SetCompressorOptions(compressorOpts)
+	s.SetUploadLimits(limits)
+	s.SetTrustedKeys(keys)
+
+	// initialize upload session store
+	uploadStore, err := uploadstore.NewFileStore(path.Join(CLI.Serve.CachePath, "uploads"))
+	if err != nil {
+		log.Errorf("Error initializing uploadstore: %v", err)
+
+		return -1
+	}
+
+	err = s.RegisterUploadHandlers(uploadStore, CLI.Serve.UploadSessionTTL)
+	if err != nil {
+		log.Errorf("Error registering upload handlers: %v", err)
+
+		return -1
+	}
+
+	// initialize the store for compressed NAR files, shared by all tenants
+	var renditionStore *renditionstore.FileStore
+
+	if CLI.Serve.CompressedNarCacheSize > 0 {
+		renditionStore, err = renditionstore.NewFileStore(
+			path.Join(CLI.Serve.CachePath, "renditions"),
+			CLI.Serve.CompressedNarCacheSize,
+		)
+		if err != nil {
+			log.Errorf("Error initializing renditionstore: %v", err)
+
+			return -1
+		}
+
+		s.SetRenditionStore(renditionStore)
+	}
+
+	// initialize the webhook outbox, shared by all tenants
+	outbox, err := openWebhookOutbox(CLI.Serve.CachePath, &CLI.Serve.Webhooks)
+	if err != nil {
+		log.Errorf("Error initializing webhooks: %v", err)
+
+		return -1
+	}
+
+	if outbox != nil {
+		s.SetWebhooks(outbox, "")
+
+		// events not delivered yet stay in the outbox, and are sent after the next start.
+		outboxCtx, outboxCancel := context.WithCancel(context.Background())
+
+		var outboxDone sync.WaitGroup
+
+		outboxDone.Add(1)
+
+		go func() {
+			defer outboxDone.Done()
+			outbox.Run(outboxCtx)
+		}()
+
+		defer outboxDone.Wait()
+		defer outboxCancel()
+	}
+
+	for _, name := range CLI.Serve.Tenants {
+		tenant, err := newTenantServer(blobStore, renditionStore, outbox, name)
+		if err != nil {
+			log.Errorf("Error initializing tenant %v: %v", name, err)
+
+			return -1
+		}
+
+		err = s.MountTenant(name, tenant)
+		if err != nil {
+			log.Errorf("Error mounting tenant %v: %v", name, err)
+
+			return -1
+		}
+	}
+
+	// with principals configured, requests modifying the cache need to be authenticated,
+	// and uploads count towards their quotas.
+	authenticator, tracker, err := CLI.Serve.Principals.setup()
+	if err != nil {
+		log.Errorf("Invalid principal configuration: %v", err)
+
+		return -1
+	}
+
+	var handler http.Handler = s.Handler
+
+	if authenticator != nil {
+		handler = authenticator.Middleware(handler)
+
+		for _, srv := range append([]*server.Server{s}, tenants(s)...) {
+			err = srv.SetQuotas(context.Background(), tracker)
+			if err != nil {
+				log.Errorf("Error determining usage: %v", err)
+
+				return -1
+			}
+		}
+	}
+
+	// access logging can be toggled on reload
+	var accessLog int32
+	if CLI.Serve.AccessLog {
+		accessLog = 1
+	}
+
+	loggingHandler := middleware.Logger(handler)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP, reloading configuration…")
+
+			if err := reloadConfig(s, &accessLog); err != nil {
+				log.Errorf("Error reloading configuration, keeping the current one: %v", err)
+			}
+		}
+	}()
+
+	// Request contexts are derived from baseCtx.
+	// Cancelling it aborts all requests still in progress (such as chunking uploads)
+	// when they didn't finish within the shutdown timeout.
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// inFlight tracks all handlers still running,
+	// so stores are only closed once all of them returned.
+	// Once stopping is set (while holding inFlightMu), no handlers are added anymore,
+	// so none can start while waiting for them.
+	var (
+		inFlight   sync.WaitGroup
+		inFlightMu sync.Mutex
+		stopping   bool
+	)
+
+	srv := &http.Server{
+		Addr: CLI.Serve.ListenAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlightMu.Lock()
+
+			if stopping {
+				inFlightMu.Unlock()
+				http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+
+				return
+			}
+
+			inFlight.Add(1)
+			inFlightMu.Unlock()
+
+			defer inFlight.Done()
+
+			if atomic.LoadInt32(&accessLog) == 1 {
+				loggingHandler.ServeHTTP(w, r)
+			} else {
+				handler.ServeHTTP(w, r)
+			}
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+		ConnContext:  server.ConnContext,
+		ReadTimeout:  CLI.Serve.ReadTimeout,
+		WriteTimeout: CLI.Serve.WriteTimeout,
+		IdleTimeout:  150 * time.Second,
+	}
+
+	// long-lived responses (such as the change feed) don't finish on their own.
+	srv.RegisterOnShutdown(s.StopStreams)
+
+	// Remove what a crashed process left in the temp directory.
+	// Temp files still in use (by a rechunk or recompress sharing it) are locked, and kept.
+	n, err := blobStore.RemoveTempFiles()
+	if err != nil {
+		log.Errorf("Error removing leftover temporary files: %v", err)
+
+		return -1
+	}
+
+	if n > 0 {
+		log.Infof("Removed %d leftover temporary files", n)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		log.Printf("Starting Server at %v", CLI.Serve.ListenAddr)
+
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Errorf("Error listening: %v", err)
+
+		return 1
+	case <-sig:
+	}
+
+	log.Infof("Received Signal, shutting down (waiting up to %v for requests to finish)…", CLI.Serve.ShutdownTimeout)
+
+	// a second signal skips waiting
+	go func() {
+		<-sig
+		log.Warn("Received second signal, aborting requests in progress…")
+		cancel()
+	}()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(baseCtx, CLI.Serve.ShutdownTimeout)
+	defer shutdownCancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Warnf("Not all requests finished in time, aborting them: %v", err)
+	}
+
+	cancel()
+
+	inFlightMu.Lock()
+	stopping = true
+	inFlightMu.Unlock()
+
+	inFlight.Wait()
+
+	// the stores are closed by the deferred s.Close()
+	return 0
+}
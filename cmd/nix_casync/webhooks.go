@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/flokli/nix-casync/pkg/webhook"
+)
+
+// webhookFlags configure where events about uploads, deletions and garbage collection are sent to.
+type webhookFlags struct {
+	WebhookURL         []string `name:"webhook-url" help:"URL to POST events (uploads, deletions and garbage collection runs) to, as JSON. Can be specified multiple times." env:"NIX_CASYNC_WEBHOOK_URLS" config:"webhooks.urls"`                                             //nolint:lll
+	WebhookSecret      string   `name:"webhook-secret" help:"Secret to sign webhook requests with (HMAC-SHA256, sent in X-Nix-Casync-Signature)." type:"string" env:"NIX_CASYNC_WEBHOOK_SECRET" config:"webhooks.secret"`                                                      //nolint:lll
+	WebhookEvents      []string `name:"webhook-events" help:"Only send these events (narinfo.put, narinfo.delete, nar.ingest, gc). Defaults to all." env:"NIX_CASYNC_WEBHOOK_EVENTS" config:"webhooks.events"`                                                                 //nolint:lll
+	WebhookMaxAttempts int      `name:"webhook-max-attempts" help:"How often to try delivering an event, with exponential backoff (up to an hour) in between, before giving up." type:"int" default:"10" env:"NIX_CASYNC_WEBHOOK_MAX_ATTEMPTS" config:"webhooks.max-attempts"` //nolint:lll
+}
+
+// webhookOutboxPath returns the path to the webhook outbox of a cache.
+func webhookOutboxPath(cachePath string) string {
+	return path.Join(cachePath, "webhooks")
+}
+
+// openWebhookOutbox opens the outbox delivering events to the configured webhooks,
+// or returns nil if there are none.
+func openWebhookOutbox(cachePath string, f *webhookFlags) (*webhook.Outbox, error) {
+	if len(f.WebhookURL) == 0 {
+		return nil, nil
+	}
+
+	events := make([]webhook.EventType, 0, len(f.WebhookEvents))
+
+	for _, s := range f.WebhookEvents {
+		eventType, err := webhook.ParseEventType(s)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, eventType)
+	}
+
+	opts := webhook.Options{
+		MaxAttempts: f.WebhookMaxAttempts,
+	}
+
+	for _, url := range f.WebhookURL {
+		opts.Endpoints = append(opts.Endpoints, &webhook.Endpoint{
+			URL:    url,
+			Secret: f.WebhookSecret,
+			Events: events,
+		})
+	}
+
+	return webhook.OpenOutbox(webhookOutboxPath(cachePath), opts)
+}
+
+// publishGCEvent adds an event to the webhook outbox of the cache at cachePath, if there is one.
+// The event is delivered by serve, which creates the outbox if webhooks are configured.
+func publishGCEvent(cachePath string, e *webhook.Event) error {
+	p := webhookOutboxPath(cachePath)
+
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return nil
+	}
+
+	outbox, err := webhook.OpenOutbox(p, webhook.Options{})
+	if err != nil {
+		return fmt.Errorf("unable to open webhook outbox: %w", err)
+	}
+
+	return outbox.Publish(e)
+}
@@ -3,6 +3,7 @@ module github.com/flokli/nix-casync
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/alecthomas/kong v0.5.0
 	github.com/andybalholm/brotli v1.0.4
 	github.com/folbricht/desync v0.9.0
@@ -10,9 +11,11 @@ require (
 	github.com/go-chi/chi v1.5.4
 	github.com/go-chi/chi/v5 v5.0.7
 	github.com/klauspost/compress v1.15.3
+	github.com/klauspost/pgzip v1.2.5
 	github.com/nix-community/go-nix v0.0.0-20220502083308-687fc4730510
 	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/ulikunitz/xz v0.5.10
+	gopkg.in/yaml.v3 v3.0.1
 )
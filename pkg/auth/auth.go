@@ -0,0 +1,134 @@
+// Package auth identifies who sends a request, by the token passed along with it.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// principalNameRegexp describes the allowed names for principals.
+var principalNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`) //nolint:gochecknoglobals
+
+// Principal is someone allowed to modify the cache, such as a team or a CI job.
+type Principal struct {
+	Name  string
+	Token string
+}
+
+// Authenticator checks the tokens sent with requests.
+type Authenticator struct {
+	principals []*Principal
+}
+
+// New returns an Authenticator accepting the tokens of principals.
+// Names and tokens need to be unique.
+func New(principals []*Principal) (*Authenticator, error) {
+	names := make(map[string]struct{})
+	tokens := make(map[string]struct{})
+
+	for _, p := range principals {
+		if !principalNameRegexp.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid principal name: %v", p.Name)
+		}
+
+		if p.Token == "" {
+			return nil, fmt.Errorf("no token set for principal %v", p.Name)
+		}
+
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate principal %v", p.Name)
+		}
+
+		if _, ok := tokens[p.Token]; ok {
+			return nil, fmt.Errorf("principal %v uses the same token as another one", p.Name)
+		}
+
+		names[p.Name] = struct{}{}
+		tokens[p.Token] = struct{}{}
+	}
+
+	return &Authenticator{principals: principals}, nil
+}
+
+// Authenticate returns the principal whose token was sent with r, or nil if there's none.
+// The token is either sent as a bearer token,
+// or as the password of HTTP basic authentication (which is what Nix sends, via netrc),
+// in which case the user name needs to be the name of the principal.
+// It returns an error if an unknown token was sent.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+
+	var name, token string
+
+	if user, password, ok := r.BasicAuth(); ok {
+		name, token = user, password
+	} else if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	} else {
+		return nil, fmt.Errorf("unsupported authorization scheme")
+	}
+
+	for _, p := range a.principals {
+		if subtle.ConstantTimeCompare([]byte(p.Token), []byte(token)) == 1 && (name == "" || name == p.Name) {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid token")
+}
+
+// Middleware authenticates all requests passed to next,
+// making the name of the principal available via FromContext.
+// Requests other than GET and HEAD, which modify the cache, need to be authenticated.
+// Requests with invalid tokens are rejected.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		if err != nil {
+			unauthorized(w, err.Error())
+
+			return
+		}
+
+		if p == nil {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				unauthorized(w, "Authentication required")
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p.Name)))
+	})
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="nix-casync"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+type contextKey struct{}
+
+// WithPrincipal returns a copy of ctx, carrying the name of a principal.
+func WithPrincipal(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext returns the name of the principal that sent the request ctx belongs to,
+// or an empty string if it wasn't authenticated.
+func FromContext(ctx context.Context) string {
+	name, _ := ctx.Value(contextKey{}).(string)
+
+	return name
+}
@@ -0,0 +1,75 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	_, err := auth.New([]*auth.Principal{{Name: "a", Token: "x"}, {Name: "b", Token: "x"}})
+	assert.Error(t, err, "tokens need to be unique")
+
+	_, err = auth.New([]*auth.Principal{{Name: "a", Token: "x"}, {Name: "a", Token: "y"}})
+	assert.Error(t, err, "names need to be unique")
+
+	_, err = auth.New([]*auth.Principal{{Name: "a"}})
+	assert.Error(t, err, "tokens can't be empty")
+
+	_, err = auth.New([]*auth.Principal{{Name: "a/b", Token: "x"}})
+	assert.Error(t, err)
+}
+
+func TestMiddleware(t *testing.T) {
+	authenticator, err := auth.New([]*auth.Principal{
+		{Name: "team-a", Token: "secret-a"},
+		{Name: "team-b", Token: "secret-b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(auth.FromContext(r.Context())))
+	}))
+
+	for _, tc := range []struct {
+		name      string
+		method    string
+		setAuth   func(r *http.Request)
+		status    int
+		principal string
+	}{
+		{"anonymous GET", http.MethodGet, func(r *http.Request) {}, http.StatusOK, ""},
+		{"anonymous PUT", http.MethodPut, func(r *http.Request) {}, http.StatusUnauthorized, ""},
+		{"bearer", http.MethodPut, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer secret-b")
+		}, http.StatusOK, "team-b"},
+		{"basic", http.MethodPut, func(r *http.Request) { r.SetBasicAuth("team-a", "secret-a") }, http.StatusOK, "team-a"},
+		{"basic with wrong name", http.MethodPut, func(r *http.Request) {
+			r.SetBasicAuth("team-b", "secret-a")
+		}, http.StatusUnauthorized, ""},
+		{"invalid token on GET", http.MethodGet, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer foo")
+		}, http.StatusUnauthorized, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "/", nil)
+			tc.setAuth(req)
+
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tc.status, rr.Code)
+
+			if tc.status == http.StatusOK {
+				assert.Equal(t, tc.principal, rr.Body.String())
+			} else {
+				assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
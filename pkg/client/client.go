@@ -0,0 +1,254 @@
+// Package client implements a client for nix-casync servers.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/folbricht/desync"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// Client talks to a nix-casync server (or one of its tenants).
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+
+	chunkSizeMin uint64
+	chunkSizeAvg uint64
+	chunkSizeMax uint64
+}
+
+// NewClient returns a client for the server at baseURL.
+// NAR files are chunked with the passed average chunk size,
+// which should match the one of the server, to get the most deduplication.
+func NewClient(baseURL string, httpClient *http.Client, avgChunkSize int) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+
+		chunkSizeMin: uint64(avgChunkSize) / 4,
+		chunkSizeAvg: uint64(avgChunkSize),
+		chunkSizeMax: uint64(avgChunkSize) * 4,
+	}
+}
+
+// PushResult describes a pushed NAR file.
+type PushResult struct {
+	NarHash        []byte
+	NarSize        uint64
+	ChunksTotal    int
+	ChunksUploaded int
+}
+
+// PushNar uploads the NAR file in r, which has the passed size.
+// It's chunked locally, and only the chunks missing on the server are sent.
+func (c *Client) PushNar(ctx context.Context, r io.ReaderAt, size int64) (*PushResult, error) {
+	index, narHash, err := c.chunk(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, fmt.Errorf("error chunking NAR file: %w", err)
+	}
+
+	missing, err := c.MissingChunks(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+
+	// look up where to read each missing chunk from
+	indexChunks := make(map[desync.ChunkID]desync.IndexChunk, len(index.Chunks))
+	for _, indexChunk := range index.Chunks {
+		indexChunks[indexChunk.ID] = indexChunk
+	}
+
+	for _, id := range missing {
+		indexChunk, ok := indexChunks[id]
+		if !ok {
+			return nil, fmt.Errorf("server requested unknown chunk %v", id)
+		}
+
+		b := make([]byte, indexChunk.Size)
+
+		_, err := r.ReadAt(b, int64(indexChunk.Start))
+		if err != nil {
+			return nil, fmt.Errorf("error reading chunk %v: %w", id, err)
+		}
+
+		compressed, err := desync.Compress(b)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing chunk %v: %w", id, err)
+		}
+
+		err = c.PutChunk(ctx, id, compressed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// commit the index, which makes the server assemble and verify the NAR file.
+	_, err = c.PutIndex(ctx, narHash, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushResult{
+		NarHash:        narHash,
+		NarSize:        uint64(size),
+		ChunksTotal:    len(index.Chunks),
+		ChunksUploaded: len(missing),
+	}, nil
+}
+
+// chunk chunks the contents of r, and returns the index and sha256 of the contents.
+func (c *Client) chunk(r io.Reader) (desync.Index, []byte, error) {
+	h := sha256.New()
+
+	chunker, err := desync.NewChunker(io.TeeReader(r, h), c.chunkSizeMin, c.chunkSizeAvg, c.chunkSizeMax)
+	if err != nil {
+		return desync.Index{}, nil, err
+	}
+
+	index := desync.Index{
+		Index: desync.FormatIndex{
+			FeatureFlags: desync.CaFormatExcludeNoDump | desync.CaFormatSHA512256,
+			ChunkSizeMin: c.chunkSizeMin,
+			ChunkSizeAvg: c.chunkSizeAvg,
+			ChunkSizeMax: c.chunkSizeMax,
+		},
+	}
+
+	for {
+		start, b, err := chunker.Next()
+		if err != nil {
+			return desync.Index{}, nil, err
+		}
+
+		if len(b) == 0 {
+			break
+		}
+
+		index.Chunks = append(index.Chunks, desync.IndexChunk{
+			ID:    desync.NewChunkFromUncompressed(b).ID(),
+			Start: start,
+			Size:  uint64(len(b)),
+		})
+	}
+
+	return index, h.Sum(nil), nil
+}
+
+// MissingChunks sends the index to the server, which responds with the chunks it doesn't have yet.
+func (c *Client) MissingChunks(ctx context.Context, index desync.Index) ([]desync.ChunkID, error) {
+	var indexBuf bytes.Buffer
+
+	_, err := index.WriteTo(&indexBuf)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing index: %w", err)
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/_chunks/missing", indexBuf.Bytes(), http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting missing chunks: %w", err)
+	}
+
+	var resp struct {
+		Missing []string `json:"missing"`
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing missing chunks: %w", err)
+	}
+
+	missing := make([]desync.ChunkID, 0, len(resp.Missing))
+
+	for _, s := range resp.Missing {
+		id, err := desync.ChunkIDFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing missing chunks: %w", err)
+		}
+
+		missing = append(missing, id)
+	}
+
+	return missing, nil
+}
+
+// PutChunk uploads a single (compressed) chunk.
+func (c *Client) PutChunk(ctx context.Context, id desync.ChunkID, compressed []byte) error {
+	_, err := c.do(ctx, http.MethodPut, "/_chunks/"+id.String(), compressed, http.StatusNoContent)
+	if err != nil {
+		return fmt.Errorf("error uploading chunk %v: %w", id, err)
+	}
+
+	return nil
+}
+
+// PutIndex sends the index of a NAR file, and returns its size.
+// The server assembles the NAR file from its chunks, and only stores it if it matches narHash.
+func (c *Client) PutIndex(ctx context.Context, narHash []byte, index desync.Index) (uint64, error) {
+	var indexBuf bytes.Buffer
+
+	_, err := index.WriteTo(&indexBuf)
+	if err != nil {
+		return 0, fmt.Errorf("error serializing index: %w", err)
+	}
+
+	body, err := c.do(ctx, http.MethodPut, "/_index/"+nixbase32.EncodeToString(narHash), indexBuf.Bytes(), http.StatusOK)
+	if err != nil {
+		return 0, fmt.Errorf("error committing index: %w", err)
+	}
+
+	var resp struct {
+		NarSize uint64 `json:"narSize"`
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing index response: %w", err)
+	}
+
+	return resp.NarSize, nil
+}
+
+// do sends a request, and returns the response body.
+// An error is returned if the response status doesn't match expectedStatus,
+// wrapping os.ErrNotExist if it's a 404.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, expectedStatus int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound && expectedStatus != http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %v", os.ErrNotExist, strings.TrimSpace(string(respBody)))
+	}
+
+	if resp.StatusCode != expectedStatus {
+		return nil, fmt.Errorf("unexpected status %v: %v", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return respBody, nil
+}
@@ -0,0 +1,94 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/client"
+	"github.com/flokli/nix-casync/pkg/server"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/test"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushNar(t *testing.T) {
+	castrDir, err := ioutil.TempDir("", "castr")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(castrDir)
+	})
+
+	caidxDir, err := ioutil.TempDir("", "caidx")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(caidxDir)
+	})
+
+	blobStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, "", 65536, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		panic(err)
+	}
+
+	metadataStore := metadatastore.NewMemoryStore()
+
+	s := server.NewServer(blobStore, metadataStore, "zstd", 40)
+	defer s.Close()
+
+	srv := httptest.NewServer(s.Handler)
+	defer srv.Close()
+
+	tdB, exists := test.GetTestDataTable()["b"]
+	if !exists {
+		panic("testData[b] doesn't exist")
+	}
+
+	// use small chunks, so the test NAR files consist of more than one chunk
+	c := client.NewClient(srv.URL, srv.Client(), 192)
+
+	t.Run("push", func(t *testing.T) {
+		res, err := c.PushNar(context.Background(), bytes.NewReader(tdB.NarContents), int64(len(tdB.NarContents)))
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdB.Narinfo.NarHash.Digest, res.NarHash)
+			assert.Equal(t, tdB.Narinfo.NarSize, res.NarSize)
+			assert.Greater(t, res.ChunksTotal, 1)
+			assert.Equal(t, res.ChunksTotal, res.ChunksUploaded)
+		}
+
+		narMeta, err := metadataStore.GetNarMeta(context.Background(), tdB.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdB.Narinfo.NarSize, narMeta.Size)
+		}
+	})
+
+	t.Run("push again", func(t *testing.T) {
+		res, err := c.PushNar(context.Background(), bytes.NewReader(tdB.NarContents), int64(len(tdB.NarContents)))
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, res.ChunksUploaded, "no chunks should be uploaded twice")
+		}
+	})
+
+	t.Run("GET NAR", func(t *testing.T) {
+		resp, err := srv.Client().Get(srv.URL + "/nar/" + nixbase32.EncodeToString(tdB.Narinfo.NarHash.Digest) + ".nar")
+		if assert.NoError(t, err) {
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tdB.NarContents, body)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/folbricht/desync"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// ListStorePaths returns the store paths of all .narinfo files on the server, sorted.
+func (c *Client) ListStorePaths(ctx context.Context) ([]string, error) {
+	body, err := c.do(ctx, http.MethodGet, "/_narinfos", nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("error listing store paths: %w", err)
+	}
+
+	var resp struct {
+		StorePaths []string `json:"storePaths"`
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing store paths: %w", err)
+	}
+
+	return resp.StorePaths, nil
+}
+
+// ClosureStorePaths returns the store paths in the closure of the store path with the passed outputHash,
+// sorted.
+func (c *Client) ClosureStorePaths(ctx context.Context, outputHash []byte) ([]string, error) {
+	body, err := c.do(ctx, http.MethodGet, "/_closure/"+nixbase32.EncodeToString(outputHash), nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("error getting closure: %w", err)
+	}
+
+	var resp struct {
+		Paths []struct {
+			StorePath string `json:"storePath"`
+		} `json:"paths"`
+	}
+
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing closure: %w", err)
+	}
+
+	storePaths := make([]string, 0, len(resp.Paths))
+	for _, p := range resp.Paths {
+		storePaths = append(storePaths, p.StorePath)
+	}
+
+	return storePaths, nil
+}
+
+// GetNarinfo returns the .narinfo of the store path with the passed outputHash.
+// If there's none, an error wrapping os.ErrNotExist is returned.
+func (c *Client) GetNarinfo(ctx context.Context, outputHash []byte) (*narinfo.NarInfo, error) {
+	body, err := c.do(ctx, http.MethodGet, "/"+nixbase32.EncodeToString(outputHash)+".narinfo", nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("error getting .narinfo: %w", err)
+	}
+
+	ni, err := narinfo.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing .narinfo: %w", err)
+	}
+
+	return ni, nil
+}
+
+// HasNarinfo checks whether there's a .narinfo for the store path with the passed outputHash.
+func (c *Client) HasNarinfo(ctx context.Context, outputHash []byte) (bool, error) {
+	_, err := c.do(ctx, http.MethodHead, "/"+nixbase32.EncodeToString(outputHash)+".narinfo", nil, http.StatusOK)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("error checking for .narinfo: %w", err)
+	}
+
+	return true, nil
+}
+
+// PutNarinfo uploads a .narinfo.
+// The NAR file it refers to needs to be uploaded first.
+func (c *Client) PutNarinfo(ctx context.Context, ni *narinfo.NarInfo) error {
+	outputHash, err := util.GetHashFromStorePath(ni.StorePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(ctx, http.MethodPut, "/"+nixbase32.EncodeToString(outputHash)+".narinfo", []byte(ni.String()), http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("error uploading .narinfo: %w", err)
+	}
+
+	return nil
+}
+
+// GetIndex returns the index of the NAR file with the passed narHash.
+func (c *Client) GetIndex(ctx context.Context, narHash []byte) (desync.Index, error) {
+	body, err := c.do(ctx, http.MethodGet, "/caibx/"+nixbase32.EncodeToString(narHash)+".caibx", nil, http.StatusOK)
+	if err != nil {
+		return desync.Index{}, fmt.Errorf("error getting index: %w", err)
+	}
+
+	index, err := desync.IndexFromReader(bytes.NewReader(body))
+	if err != nil {
+		return desync.Index{}, fmt.Errorf("error parsing index: %w", err)
+	}
+
+	return index, nil
+}
+
+// GetChunk returns a single (compressed) chunk.
+// It's not verified against its id, PutChunk on the receiving side does that.
+func (c *Client) GetChunk(ctx context.Context, id desync.ChunkID) ([]byte, error) {
+	idStr := id.String()
+
+	body, err := c.do(ctx, http.MethodGet, "/castr/"+idStr[:4]+"/"+idStr+".cacnk", nil, http.StatusOK)
+	if err != nil {
+		return nil, fmt.Errorf("error getting chunk %v: %w", idStr, err)
+	}
+
+	return body, nil
+}
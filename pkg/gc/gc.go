@@ -0,0 +1,108 @@
+// Package gc removes blobs from a blob store that are no longer referenced by any metadata store.
+package gc
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+)
+
+// Run removes all NarMeta no PathInfo (or pin) refers to from the passed metadata stores,
+// then all blobs from blobStore that aren't referenced by a remaining NarMeta.
+// Multiple caches (tenants) can share the same blob store,
+// so the metadata stores of all of them need to be passed,
+// or blobs still in use by another cache will be removed.
+//
+// NarMeta, blobs and chunks written within gracePeriod are kept,
+// as they might belong to an upload with its .narinfo still to come.
+func Run(
+	ctx context.Context,
+	blobStore blobstore.BlobStore,
+	metadataStores []metadatastore.MetadataStore,
+	gracePeriod time.Duration,
+) (*blobstore.GCStats, error) {
+	cutoff := time.Now().Add(-gracePeriod)
+	keep := make(map[string]struct{})
+
+	var narMetasRemoved uint64
+
+	for _, metadataStore := range metadataStores {
+		roots, err := roots(ctx, metadataStore)
+		if err != nil {
+			return nil, err
+		}
+
+		narMetas, err := metadataStore.ListNarMeta(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, narMeta := range narMetas {
+			k := hex.EncodeToString(narMeta.NarHash)
+
+			if _, ok := roots[k]; ok || narMeta.UploadedAt.After(cutoff) {
+				keep[k] = struct{}{}
+
+				continue
+			}
+
+			err := metadataStore.DeleteNarMeta(ctx, narMeta.NarHash)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("error removing NarMeta: %w", err)
+			}
+
+			narMetasRemoved++
+		}
+	}
+
+	stats, err := blobStore.CollectGarbage(ctx, keep, gracePeriod)
+	if stats != nil {
+		stats.NarMetasRemoved = narMetasRemoved
+	}
+
+	return stats, err
+}
+
+// roots returns the (hex-encoded) NAR hashes referred to by a PathInfo in metadataStore,
+// or by the closure of a pin.
+func roots(ctx context.Context, metadataStore metadatastore.MetadataStore) (map[string]struct{}, error) {
+	roots := make(map[string]struct{})
+
+	pathInfos, err := metadataStore.ListPathInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pathInfo := range pathInfos {
+		roots[hex.EncodeToString(pathInfo.NarHash)] = struct{}{}
+	}
+
+	// pinned store paths can't be deleted, so they're usually included above already.
+	pins, err := metadataStore.ListPins(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, outputHash := range pins {
+		entries, _, err := metadatastore.Closure(ctx, metadataStore, outputHash)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("error getting closure of pin %v: %w", name, err)
+		}
+
+		for _, entry := range entries {
+			roots[hex.EncodeToString(entry.PathInfo.NarHash)] = struct{}{}
+		}
+	}
+
+	return roots, nil
+}
@@ -0,0 +1,234 @@
+package gc_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/gc"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/flokli/nix-casync/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func putBlob(t *testing.T, blobStore blobstore.BlobStore, contents []byte) {
+	t.Helper()
+
+	w, err := blobStore.PutBlob(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.Copy(w, bytes.NewReader(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putPathInfo adds the NarMeta (without references) and PathInfo of td to metadataStore.
+func putPathInfo(t *testing.T, metadataStore metadatastore.MetadataStore, td test.Data) {
+	t.Helper()
+
+	pathInfo, narMeta, err := metadatastore.ParseNarinfo(td.Narinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	narMeta.References = nil
+	narMeta.ReferencesStr = nil
+	narMeta.UploadedAt = time.Now()
+
+	err = metadataStore.PutNarMeta(context.Background(), narMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = metadataStore.PutPathInfo(context.Background(), pathInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	testDataT := test.GetTestDataTable()
+
+	tdA, exists := testDataT["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	tdB, exists := testDataT["b"]
+	if !exists {
+		panic("testData[b] doesn't exist")
+	}
+
+	blobStore := blobstore.NewMemoryStore()
+	defer blobStore.Close()
+
+	// two tenants, sharing the same blob store
+	metadataStoreA := metadatastore.NewMemoryStore()
+	defer metadataStoreA.Close()
+
+	metadataStoreB := metadatastore.NewMemoryStore()
+	defer metadataStoreB.Close()
+
+	putBlob(t, blobStore, tdA.NarContents)
+	putBlob(t, blobStore, tdB.NarContents)
+
+	putPathInfo(t, metadataStoreA, tdA)
+	putPathInfo(t, metadataStoreB, tdB)
+
+	t.Run("keep blobs referenced by any tenant", func(t *testing.T) {
+		stats, err := gc.Run(
+			context.Background(),
+			blobStore,
+			[]metadatastore.MetadataStore{metadataStoreA, metadataStoreB},
+			0,
+		)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(0), stats.BlobsRemoved)
+		}
+	})
+
+	t.Run("remove blobs not referenced", func(t *testing.T) {
+		stats, err := gc.Run(
+			context.Background(),
+			blobStore,
+			[]metadatastore.MetadataStore{metadataStoreA},
+			0,
+		)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(1), stats.BlobsRemoved)
+		}
+
+		_, _, err = blobStore.GetBlob(context.Background(), tdA.Narinfo.NarHash.Digest)
+		assert.NoError(t, err)
+
+		_, _, err = blobStore.GetBlob(context.Background(), tdB.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestRunDeletedNarinfo(t *testing.T) {
+	castrDir, err := ioutil.TempDir("", "castr")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(castrDir)
+
+	caidxDir, err := ioutil.TempDir("", "caidx")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(caidxDir)
+
+	blobStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, "", 256, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		panic(err)
+	}
+	defer blobStore.Close()
+
+	metadataStore := metadatastore.NewMemoryStore()
+	defer metadataStore.Close()
+
+	ctx := context.Background()
+	tdA := test.GetTestDataTable()["a"]
+
+	putBlob(t, blobStore, tdA.NarContents)
+	putPathInfo(t, metadataStore, tdA)
+
+	// a NAR file just uploaded, with its .narinfo still to come
+	tdC := test.GetTestDataTable()["c"]
+
+	putBlob(t, blobStore, tdC.NarContents)
+
+	err = metadataStore.PutNarMeta(ctx, &metadatastore.NarMeta{
+		NarHash:    tdC.Narinfo.NarHash.Digest,
+		Size:       tdC.Narinfo.NarSize,
+		UploadedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(t *testing.T, gracePeriod time.Duration) *blobstore.GCStats {
+		t.Helper()
+
+		stats, err := gc.Run(ctx, blobStore, []metadatastore.MetadataStore{metadataStore}, gracePeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return stats
+	}
+
+	t.Run("keep the NAR file of an existing .narinfo", func(t *testing.T) {
+		stats := run(t, time.Hour)
+		assert.Equal(t, uint64(0), stats.NarMetasRemoved)
+		assert.Equal(t, uint64(0), stats.BlobsRemoved)
+		assert.Equal(t, uint64(0), stats.ChunksRemoved)
+	})
+
+	err = metadataStore.DeletePathInfo(ctx, mustOutputHash(tdA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("keep recent NarMeta without PathInfo", func(t *testing.T) {
+		stats := run(t, time.Hour)
+		assert.Equal(t, uint64(0), stats.NarMetasRemoved)
+		assert.Equal(t, uint64(0), stats.BlobsRemoved)
+
+		_, err := metadataStore.GetNarMeta(ctx, tdA.Narinfo.NarHash.Digest)
+		assert.NoError(t, err)
+	})
+
+	t.Run("remove the NAR file of a deleted .narinfo", func(t *testing.T) {
+		stats := run(t, 0)
+		assert.Equal(t, uint64(2), stats.NarMetasRemoved)
+		assert.Equal(t, uint64(2), stats.BlobsRemoved)
+		assert.NotEqual(t, uint64(0), stats.ChunksRemoved)
+		assert.NotEqual(t, uint64(0), stats.BytesFreed)
+
+		_, err := metadataStore.GetNarMeta(ctx, tdA.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, _, err = blobStore.GetBlob(ctx, tdA.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		// no chunks are left
+		var chunks int
+
+		err = filepath.Walk(castrDir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				chunks++
+			}
+
+			return err
+		})
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, chunks)
+		}
+	})
+}
+
+func mustOutputHash(td test.Data) []byte {
+	outputHash, err := util.GetHashFromStorePath(td.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	return outputHash
+}
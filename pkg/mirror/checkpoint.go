@@ -0,0 +1,89 @@
+package mirror
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// Checkpoint records the store paths that were copied, in a file,
+// so interrupted or repeated runs can skip them without asking the destination.
+// It's only valid for one destination, and needs to be removed if that's reset.
+type Checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]struct{}
+}
+
+// OpenCheckpoint opens the checkpoint at path, creating it if it doesn't exist.
+// The file contains the output hashes of the store paths copied, one per line.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Checkpoint{
+		f:    f,
+		done: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// a line might be cut off if we crashed while writing it
+		outputHash, err := nixbase32.DecodeString(line)
+		if err != nil || len(outputHash) != 20 {
+			continue
+		}
+
+		c.done[string(outputHash)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		f.Close()
+
+		return nil, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+
+	return c, nil
+}
+
+// Has checks whether the store path with the passed outputHash was copied already.
+func (c *Checkpoint) Has(outputHash []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.done[string(outputHash)]
+
+	return ok
+}
+
+// Add records the store path with the passed outputHash as copied.
+func (c *Checkpoint) Add(outputHash []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.done[string(outputHash)]; ok {
+		return nil
+	}
+
+	_, err := c.f.WriteString(nixbase32.EncodeToString(outputHash) + "\n")
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+
+	c.done[string(outputHash)] = struct{}{}
+
+	return nil
+}
+
+// Close closes the checkpoint file.
+func (c *Checkpoint) Close() error {
+	return c.f.Close()
+}
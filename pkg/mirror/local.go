@@ -0,0 +1,111 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/narcheck"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/folbricht/desync"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+)
+
+// LocalDestination copies store paths into a local cache, using its stores directly.
+type LocalDestination struct {
+	blobstore.ChunkedBlobStore
+	metadataStore metadatastore.MetadataStore
+}
+
+var _ Destination = &LocalDestination{}
+
+// NewLocalDestination returns a Destination writing to the passed stores.
+func NewLocalDestination(
+	blobStore blobstore.ChunkedBlobStore,
+	metadataStore metadatastore.MetadataStore,
+) *LocalDestination {
+	return &LocalDestination{
+		ChunkedBlobStore: blobStore,
+		metadataStore:    metadataStore,
+	}
+}
+
+// HasNarinfo checks whether there's a PathInfo for the store path with the passed outputHash.
+func (d *LocalDestination) HasNarinfo(ctx context.Context, outputHash []byte) (bool, error) {
+	_, err := d.metadataStore.GetPathInfo(ctx, outputHash)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// PutIndex adds a NAR file described by index, after verifying it matches narHash,
+// and that it's well-formed (unless there's a NarMeta for it already), and returns its size.
+func (d *LocalDestination) PutIndex(ctx context.Context, narHash []byte, index desync.Index) (uint64, error) {
+	_, err := d.metadataStore.GetNarMeta(ctx, narHash)
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = narcheck.Check(d.ReadIndex(ctx, index))
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return d.ChunkedBlobStore.PutIndex(ctx, narHash, index)
+}
+
+// PutNarinfo stores the PathInfo and NarMeta described by ni.
+// The NAR file needs to be in the blob store already.
+func (d *LocalDestination) PutNarinfo(ctx context.Context, ni *narinfo.NarInfo) error {
+	pathInfo, sentNarMeta, err := metadatastore.ParseNarinfo(ni)
+	if err != nil {
+		return err
+	}
+
+	narMeta, err := d.metadataStore.GetNarMeta(ctx, pathInfo.NarHash)
+	if errors.Is(err, os.ErrNotExist) {
+		// create the NarMeta without references first, as the PathInfo might be referenced by itself.
+		narMeta = &metadatastore.NarMeta{
+			NarHash:    sentNarMeta.NarHash,
+			Size:       sentNarMeta.Size,
+			UploadedAt: time.Now(),
+		}
+
+		err = d.metadataStore.PutNarMeta(ctx, narMeta)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !narMeta.IsEqualTo(sentNarMeta, false) {
+		return fmt.Errorf("conflicting NarMeta for %v", ni.StorePath)
+	}
+
+	err = metadatastore.SetTimestamps(ctx, d.metadataStore, pathInfo, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = d.metadataStore.PutPathInfo(ctx, pathInfo)
+	if err != nil {
+		return err
+	}
+
+	if len(narMeta.References) == 0 && len(sentNarMeta.References) != 0 {
+		narMeta.References = sentNarMeta.References
+		narMeta.ReferencesStr = sentNarMeta.ReferencesStr
+
+		return d.metadataStore.PutNarMeta(ctx, narMeta)
+	}
+
+	if len(narMeta.References) != len(sentNarMeta.References) || !narMeta.IsEqualTo(sentNarMeta, true) {
+		return fmt.Errorf("conflicting references for %v", ni.StorePath)
+	}
+
+	return nil
+}
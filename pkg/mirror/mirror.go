@@ -0,0 +1,353 @@
+// Package mirror copies store paths from one nix-casync cache to another,
+// only transferring the chunks the destination doesn't have yet.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/flokli/nix-casync/pkg/client"
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/folbricht/desync"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+// Destination is a cache store paths are copied to.
+// It's implemented by *client.Client (a remote nix-casync server), and LocalDestination.
+type Destination interface {
+	// HasNarinfo checks whether there's a .narinfo for the store path with the passed outputHash.
+	HasNarinfo(ctx context.Context, outputHash []byte) (bool, error)
+
+	// MissingChunks returns the IDs of all chunks referenced by index that aren't in the destination.
+	MissingChunks(ctx context.Context, index desync.Index) ([]desync.ChunkID, error)
+
+	// PutChunk adds a (compressed) chunk, after ensuring its contents match id.
+	PutChunk(ctx context.Context, id desync.ChunkID, compressed []byte) error
+
+	// PutIndex adds a NAR file described by index, after verifying it matches narHash,
+	// and returns its size.
+	PutIndex(ctx context.Context, narHash []byte, index desync.Index) (uint64, error)
+
+	// PutNarinfo adds a .narinfo. The NAR file and all references need to exist already.
+	PutNarinfo(ctx context.Context, ni *narinfo.NarInfo) error
+}
+
+var _ Destination = &client.Client{}
+
+// Filter selects the store paths to mirror.
+// Store paths are always copied with their references,
+// as a cache can't contain a store path without them.
+type Filter struct {
+	// Closures restricts mirroring to the closures of the store paths with these output hashes.
+	// If empty, all store paths of the source are considered.
+	Closures [][]byte
+
+	// Names are glob patterns (as understood by path.Match), matched against the name
+	// of a store path (without the hash). If not empty, one of them needs to match.
+	Names []string
+
+	// TrustedKeys are the public keys to accept signatures from.
+	// If not empty, store paths without a valid signature by one of them are skipped,
+	// and store paths referring to such a store path fail.
+	TrustedKeys []*signing.PublicKey
+}
+
+// Stats describes what was done during a Run.
+type Stats struct {
+	PathsCopied   int // store paths copied (including references)
+	PathsPresent  int // store paths already in the destination
+	PathsFiltered int // store paths skipped due to the filter
+	PathsFailed   int // store paths that couldn't be copied
+
+	ChunksCopied int    // chunks transferred
+	ChunkBytes   uint64 // (compressed) bytes of the chunks transferred
+	NarBytes     uint64 // total size of the NAR files copied
+}
+
+// errUntrusted is returned if a store path isn't signed by any of the trusted keys.
+var errUntrusted = errors.New("not signed by a trusted key")
+
+// Mirror copies store paths from source to destination.
+type Mirror struct {
+	source      *client.Client
+	destination Destination
+	filter      Filter
+	checkpoint  *Checkpoint
+}
+
+// New returns a Mirror copying store paths selected by filter from source to destination.
+// If checkpoint is not nil, store paths that were copied are recorded there,
+// and skipped in further runs.
+func New(source *client.Client, destination Destination, filter Filter, checkpoint *Checkpoint) *Mirror {
+	return &Mirror{
+		source:      source,
+		destination: destination,
+		filter:      filter,
+		checkpoint:  checkpoint,
+	}
+}
+
+// run holds the state of a single Run.
+type run struct {
+	*Mirror
+
+	stats *Stats
+
+	// results contains the result of copying each store path visited,
+	// so failing references are only tried once.
+	results map[string]error
+}
+
+// Run copies all selected store paths not in the destination yet.
+// A store path that fails to copy doesn't stop the run, but an error is returned in the end.
+// If the context is cancelled, the run stops after the chunk currently being transferred.
+func (m *Mirror) Run(ctx context.Context) (*Stats, error) {
+	r := &run{
+		Mirror:  m,
+		stats:   &Stats{},
+		results: make(map[string]error),
+	}
+
+	storePaths, err := m.candidates(ctx)
+	if err != nil {
+		return r.stats, err
+	}
+
+	for _, storePath := range storePaths {
+		if err := ctx.Err(); err != nil {
+			return r.stats, err
+		}
+
+		outputHash, err := util.GetHashFromStorePath(storePath)
+		if err != nil {
+			return r.stats, fmt.Errorf("invalid store path %v: %w", storePath, err)
+		}
+
+		if m.checkpoint != nil && m.checkpoint.Has(outputHash) {
+			continue
+		}
+
+		if !m.matchesName(storePath) {
+			r.stats.PathsFiltered++
+
+			continue
+		}
+
+		err = r.copyPath(ctx, outputHash)
+		if errors.Is(err, errUntrusted) {
+			log.Debugf("Skipping %v: %v", storePath, err)
+
+			continue
+		}
+
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return r.stats, ctxErr
+			}
+
+			log.Errorf("Error copying %v: %v", storePath, err)
+		}
+	}
+
+	if r.stats.PathsFailed > 0 {
+		return r.stats, fmt.Errorf("%d store paths failed to copy", r.stats.PathsFailed)
+	}
+
+	return r.stats, nil
+}
+
+// candidates returns the store paths to consider, either all of the source,
+// or the closures configured in the filter.
+func (m *Mirror) candidates(ctx context.Context) ([]string, error) {
+	if len(m.filter.Closures) == 0 {
+		return m.source.ListStorePaths(ctx)
+	}
+
+	seen := make(map[string]struct{})
+	storePaths := []string{}
+
+	for _, outputHash := range m.filter.Closures {
+		closure, err := m.source.ClosureStorePaths(ctx, outputHash)
+		if err != nil {
+			return nil, fmt.Errorf("closure of %v: %w", nixbase32.EncodeToString(outputHash), err)
+		}
+
+		for _, storePath := range closure {
+			if _, ok := seen[storePath]; !ok {
+				seen[storePath] = struct{}{}
+				storePaths = append(storePaths, storePath)
+			}
+		}
+	}
+
+	return storePaths, nil
+}
+
+// matchesName checks the name of storePath against the glob patterns in the filter.
+func (m *Mirror) matchesName(storePath string) bool {
+	if len(m.filter.Names) == 0 {
+		return true
+	}
+
+	name := util.GetNameFromStorePath(storePath)
+
+	for _, pattern := range m.filter.Names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verify checks ni is signed by one of the trusted keys, if any are configured.
+func (m *Mirror) verify(ni *narinfo.NarInfo) error {
+	if len(m.filter.TrustedKeys) == 0 {
+		return nil
+	}
+
+	for _, key := range m.filter.TrustedKeys {
+		if key.Verify(ni) {
+			return nil
+		}
+	}
+
+	return errUntrusted
+}
+
+// copyPath copies the store path with the passed outputHash, after copying all its references.
+func (r *run) copyPath(ctx context.Context, outputHash []byte) error {
+	if err, ok := r.results[string(outputHash)]; ok {
+		return err
+	}
+
+	if r.checkpoint != nil && r.checkpoint.Has(outputHash) {
+		return nil
+	}
+
+	// references can't be cyclic (except for self-references),
+	// this only guards against a broken source.
+	r.results[string(outputHash)] = nil
+
+	err := r.doCopyPath(ctx, outputHash)
+	r.results[string(outputHash)] = err
+
+	if err != nil && ctx.Err() == nil {
+		if errors.Is(err, errUntrusted) {
+			r.stats.PathsFiltered++
+		} else {
+			r.stats.PathsFailed++
+		}
+	}
+
+	return err
+}
+
+func (r *run) doCopyPath(ctx context.Context, outputHash []byte) error {
+	ni, err := r.source.GetNarinfo(ctx, outputHash)
+	if err != nil {
+		return err
+	}
+
+	err = r.verify(ni)
+	if err != nil {
+		return err
+	}
+
+	for _, reference := range ni.References {
+		referenceHash, err := util.GetHashFromStorePath(path.Join(path.Dir(ni.StorePath), reference))
+		if err != nil {
+			return fmt.Errorf("invalid reference %v: %w", reference, err)
+		}
+
+		if string(referenceHash) == string(outputHash) {
+			continue
+		}
+
+		err = r.copyPath(ctx, referenceHash)
+		if errors.Is(err, errUntrusted) {
+			// this is a failure, not just filtered, as the store path can't be copied without it.
+			return fmt.Errorf("reference %v is %v", reference, err.Error())
+		}
+
+		if err != nil {
+			return fmt.Errorf("reference %v: %w", reference, err)
+		}
+	}
+
+	present, err := r.destination.HasNarinfo(ctx, outputHash)
+	if err != nil {
+		return err
+	}
+
+	if !present {
+		err = r.copyNar(ctx, ni)
+		if err != nil {
+			return err
+		}
+
+		err = r.destination.PutNarinfo(ctx, ni)
+		if err != nil {
+			return err
+		}
+
+		r.stats.PathsCopied++
+		r.stats.NarBytes += ni.NarSize
+
+		log.Infof("Copied %v", ni.StorePath)
+	} else {
+		r.stats.PathsPresent++
+	}
+
+	if r.checkpoint != nil {
+		return r.checkpoint.Add(outputHash)
+	}
+
+	return nil
+}
+
+// copyNar copies the NAR file of ni, by transferring its index,
+// and all chunks referenced by it the destination doesn't have.
+// The destination assembles the NAR file, and verifies it against the NarHash.
+func (r *run) copyNar(ctx context.Context, ni *narinfo.NarInfo) error {
+	index, err := r.source.GetIndex(ctx, ni.NarHash.Digest)
+	if err != nil {
+		return err
+	}
+
+	missing, err := r.destination.MissingChunks(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range missing {
+		compressed, err := r.source.GetChunk(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		err = r.destination.PutChunk(ctx, id, compressed)
+		if err != nil {
+			return err
+		}
+
+		r.stats.ChunksCopied++
+		r.stats.ChunkBytes += uint64(len(compressed))
+	}
+
+	narSize, err := r.destination.PutIndex(ctx, ni.NarHash.Digest, index)
+	if err != nil {
+		return err
+	}
+
+	if narSize != ni.NarSize {
+		return fmt.Errorf("NarSize mismatch: expected %d, got %d", ni.NarSize, narSize)
+	}
+
+	return nil
+}
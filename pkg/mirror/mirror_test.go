@@ -0,0 +1,302 @@
+package mirror_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/client"
+	"github.com/flokli/nix-casync/pkg/mirror"
+	"github.com/flokli/nix-casync/pkg/server"
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/flokli/nix-casync/test"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+	"github.com/stretchr/testify/assert"
+)
+
+// newBlobStore returns a chunked blob store in a temporary directory.
+func newBlobStore(t *testing.T) *blobstore.CasyncStore {
+	t.Helper()
+
+	tmpDir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// use small chunks, so the test NAR files consist of more than one chunk
+	blobStore, err := blobstore.NewCasyncStore(
+		path.Join(tmpDir, "castr"),
+		path.Join(tmpDir, "caibx"),
+		"",
+		192,
+		blobstore.ChunkStoreOptions{},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	return blobStore
+}
+
+// newServer starts a nix-casync server, and returns a client for it.
+func newServer(t *testing.T) *client.Client {
+	t.Helper()
+
+	s := server.NewServer(newBlobStore(t), metadatastore.NewMemoryStore(), "none", 40)
+	srv := httptest.NewServer(s.Handler)
+
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+
+	return client.NewClient(srv.URL, srv.Client(), 192)
+}
+
+func outputHash(storePath string) []byte {
+	h, err := util.GetHashFromStorePath(storePath)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	testDataT := test.GetTestDataTable()
+
+	newKey := func(name string) (*signing.PublicKey, ed25519.PrivateKey) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+
+		publicKey, err := signing.ParsePublicKey(name + ":" + base64.StdEncoding.EncodeToString(pub))
+		if err != nil {
+			panic(err)
+		}
+
+		return publicKey, priv
+	}
+
+	key1, priv1 := newKey("test-1")
+	key2, priv2 := newKey("test-2")
+
+	// populate the source with A, B (referring to A) and C (referring to itself).
+	// A and C are signed by key1, B by key2.
+	source := newServer(t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		td := testDataT[name]
+
+		_, err := source.PushNar(ctx, bytes.NewReader(td.NarContents), int64(len(td.NarContents)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ni := *td.Narinfo
+		if name == "b" {
+			ni.Signatures = []*narinfo.Signature{{
+				KeyName: "test-2",
+				Digest:  ed25519.Sign(priv2, []byte(signing.Fingerprint(&ni))),
+			}}
+		} else {
+			ni.Signatures = []*narinfo.Signature{{
+				KeyName: "test-1",
+				Digest:  ed25519.Sign(priv1, []byte(signing.Fingerprint(&ni))),
+			}}
+		}
+
+		err = source.PutNarinfo(ctx, &ni)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tdA, tdB, tdC := testDataT["a"], testDataT["b"], testDataT["c"]
+
+	t.Run("remote destination", func(t *testing.T) {
+		destination := newServer(t)
+
+		stats, err := mirror.New(source, destination, mirror.Filter{}, nil).Run(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 3, stats.PathsCopied)
+		assert.Greater(t, stats.ChunksCopied, 3)
+		assert.Equal(t, tdA.Narinfo.NarSize+tdB.Narinfo.NarSize+tdC.Narinfo.NarSize, stats.NarBytes)
+
+		for _, td := range []test.Data{tdA, tdB, tdC} {
+			ni, err := destination.GetNarinfo(ctx, outputHash(td.Narinfo.StorePath))
+			if assert.NoError(t, err) {
+				assert.Equal(t, td.Narinfo.NarHash, ni.NarHash)
+				assert.Equal(t, td.Narinfo.References, ni.References)
+			}
+		}
+
+		// the NAR file can be assembled from the copied chunks
+		index, err := destination.GetIndex(ctx, tdB.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			var size uint64
+			for _, chunk := range index.Chunks {
+				size += chunk.Size
+			}
+
+			assert.Equal(t, tdB.Narinfo.NarSize, size)
+		}
+
+		t.Run("again", func(t *testing.T) {
+			stats, err := mirror.New(source, destination, mirror.Filter{}, nil).Run(ctx)
+			if assert.NoError(t, err) {
+				assert.Equal(t, 0, stats.PathsCopied)
+				assert.Equal(t, 3, stats.PathsPresent)
+				assert.Equal(t, 0, stats.ChunksCopied)
+			}
+		})
+	})
+
+	t.Run("local destination", func(t *testing.T) {
+		metadataStore := metadatastore.NewMemoryStore()
+		destination := mirror.NewLocalDestination(newBlobStore(t), metadataStore)
+
+		stats, err := mirror.New(source, destination, mirror.Filter{}, nil).Run(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 3, stats.PathsCopied)
+		}
+
+		narMeta, err := metadataStore.GetNarMeta(ctx, tdB.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdB.Narinfo.References, narMeta.ReferencesStr)
+		}
+
+		narMeta, err = metadataStore.GetNarMeta(ctx, tdC.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdC.Narinfo.References, narMeta.ReferencesStr, "self-references should be kept")
+		}
+	})
+
+	t.Run("name filter", func(t *testing.T) {
+		destination := newServer(t)
+
+		// B matches, A is copied as its reference
+		stats, err := mirror.New(source, destination, mirror.Filter{Names: []string{"hel*"}}, nil).Run(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 2, stats.PathsCopied)
+
+		has, err := destination.HasNarinfo(ctx, outputHash(tdC.Narinfo.StorePath))
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+
+	t.Run("closure filter", func(t *testing.T) {
+		destination := newServer(t)
+
+		filter := mirror.Filter{Closures: [][]byte{outputHash(tdB.Narinfo.StorePath)}}
+
+		stats, err := mirror.New(source, destination, filter, nil).Run(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 2, stats.PathsCopied)
+		assert.Equal(t, 0, stats.PathsFiltered)
+	})
+
+	t.Run("trusted keys", func(t *testing.T) {
+		destination := newServer(t)
+
+		filter := mirror.Filter{TrustedKeys: []*signing.PublicKey{key1}}
+
+		stats, err := mirror.New(source, destination, filter, nil).Run(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 2, stats.PathsCopied)
+		assert.Equal(t, 1, stats.PathsFiltered)
+
+		has, err := destination.HasNarinfo(ctx, outputHash(tdB.Narinfo.StorePath))
+		assert.NoError(t, err)
+		assert.False(t, has, "unsigned store paths should be skipped")
+	})
+
+	t.Run("untrusted reference", func(t *testing.T) {
+		destination := newServer(t)
+
+		// B is trusted, but refers to A, which isn't.
+		filter := mirror.Filter{TrustedKeys: []*signing.PublicKey{key2}}
+
+		stats, err := mirror.New(source, destination, filter, nil).Run(ctx)
+		assert.Error(t, err)
+		assert.Equal(t, 0, stats.PathsCopied)
+		assert.Equal(t, 1, stats.PathsFailed)
+		assert.Equal(t, 2, stats.PathsFiltered)
+	})
+
+	t.Run("checkpoint", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "checkpoint")
+		if err != nil {
+			panic(err)
+		}
+
+		t.Cleanup(func() {
+			os.RemoveAll(tmpDir)
+		})
+
+		checkpointPath := path.Join(tmpDir, "checkpoint")
+		filter := mirror.Filter{Closures: [][]byte{outputHash(tdB.Narinfo.StorePath)}}
+		destination := newServer(t)
+
+		checkpoint, err := mirror.OpenCheckpoint(checkpointPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := mirror.New(source, destination, filter, checkpoint).Run(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, stats.PathsCopied)
+		assert.NoError(t, checkpoint.Close())
+
+		checkpoint, err = mirror.OpenCheckpoint(checkpointPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer checkpoint.Close()
+
+		assert.True(t, checkpoint.Has(outputHash(tdA.Narinfo.StorePath)))
+		assert.True(t, checkpoint.Has(outputHash(tdB.Narinfo.StorePath)))
+		assert.False(t, checkpoint.Has(outputHash(tdC.Narinfo.StorePath)))
+
+		// store paths in the checkpoint aren't looked at again
+		stats, err = mirror.New(source, destination, mirror.Filter{}, checkpoint).Run(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, stats.PathsCopied)
+		assert.Equal(t, 0, stats.PathsPresent)
+	})
+
+	t.Run("unreachable source", func(t *testing.T) {
+		unreachable := client.NewClient("http://127.0.0.1:0", nil, 192)
+
+		_, err := mirror.New(unreachable, newServer(t), mirror.Filter{}, nil).Run(ctx)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,194 @@
+// Package narcheck ensures NAR files are well-formed, as they're received.
+package narcheck
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/nix-community/go-nix/pkg/nar"
+)
+
+// ErrInvalidNar is returned if a NAR file isn't a well-formed NAR archive.
+var ErrInvalidNar = errors.New("invalid nar")
+
+// Stats describes the contents of a NAR file.
+type Stats struct {
+	// Files is the number of regular files.
+	Files uint64
+	// LargestFile is the path of the largest regular file, and LargestFileSize its size.
+	LargestFile     string
+	LargestFileSize uint64
+}
+
+// narDir is a directory in a NAR file, and the name of the last entry seen in it.
+type narDir struct {
+	path     string
+	lastName string
+}
+
+// Copy copies a NAR file from r to w, while checking it's well-formed.
+// Copying stops as soon as it isn't, with an error wrapping ErrInvalidNar.
+func Copy(w io.Writer, r io.Reader) (*Stats, error) {
+	pr, pw := io.Pipe()
+
+	type result struct {
+		stats *Stats
+		err   error
+	}
+
+	checked := make(chan result, 1)
+
+	go func() {
+		stats, err := checkNar(pr)
+		checked <- result{stats: stats, err: err}
+	}()
+
+	// If checking fails, writing to pw fails with its error, which stops copying.
+	_, err := io.Copy(w, io.TeeReader(r, pw))
+
+	// with err being nil, the checker reads EOF.
+	pw.CloseWithError(err)
+
+	res := <-checked
+	if err != nil {
+		return nil, err
+	}
+
+	return res.stats, res.err
+}
+
+// Check reads a NAR file from r, until EOF, and returns its stats,
+// or an error wrapping ErrInvalidNar if it isn't well-formed.
+func Check(r io.Reader) (*Stats, error) {
+	return Copy(ioutil.Discard, r)
+}
+
+// checkNar reads a NAR file from pr, until EOF, and returns its stats.
+// In addition to what nar.Reader checks (such as padding),
+// directory entries need to be sorted, unique, and not be named "", "." or "..",
+// and nothing may follow the root node.
+// On errors, pr is closed with it.
+func checkNar(pr *io.PipeReader) (*Stats, error) {
+	nr, err := nar.NewReader(unexpectedEOFReader{pr})
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidNar, err)
+		pr.CloseWithError(err)
+
+		return nil, err
+	}
+	defer nr.Close()
+
+	stats, err := checkNarEntries(nr)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidNar, err)
+		pr.CloseWithError(err)
+
+		// The parser might still be waiting for the next call, or reading.
+		// Reading fails now, so this returns once it stopped.
+		for {
+			if _, err := nr.Next(); err != nil {
+				break
+			}
+		}
+
+		return nil, err
+	}
+
+	// nothing may follow the root node
+	var b [1]byte
+
+	_, err = io.ReadFull(pr, b[:])
+	if !errors.Is(err, io.EOF) {
+		if err == nil {
+			err = fmt.Errorf("%w: trailing data after the root node", ErrInvalidNar)
+		}
+
+		pr.CloseWithError(err)
+
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// unexpectedEOFReader returns io.ErrUnexpectedEOF instead of io.EOF.
+// nar.Reader never reads beyond the end of the root node,
+// but reports a NAR file ending before that as io.EOF, same as reaching the end of it.
+type unexpectedEOFReader struct {
+	r io.Reader
+}
+
+func (r unexpectedEOFReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// checkNarEntries reads all entries from nr, and ensures the entries of each directory are sorted.
+// nar.Reader joins the names of entries with the path of their directory,
+// so names like "", "." or ".." end up as an entry that's not sorted (or outside the directory).
+func checkNarEntries(nr *nar.Reader) (*Stats, error) {
+	stats := &Stats{}
+
+	// dirs contains the directories the current entry is in, innermost last.
+	var dirs []*narDir
+
+	for i := 0; ; i++ {
+		hdr, err := nr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return stats, nil
+			}
+
+			return nil, err
+		}
+
+		err = hdr.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %v: %w", hdr.Path, err)
+		}
+
+		if i > 0 {
+			if hdr.Path == "/" {
+				return nil, fmt.Errorf("invalid entry name in /")
+			}
+
+			parent, name := path.Dir(hdr.Path), path.Base(hdr.Path)
+
+			// leave all directories this entry isn't in
+			for len(dirs) > 0 && dirs[len(dirs)-1].path != parent {
+				dirs = dirs[:len(dirs)-1]
+			}
+
+			if len(dirs) == 0 {
+				return nil, fmt.Errorf("invalid entry name in %v", parent)
+			}
+
+			dir := dirs[len(dirs)-1]
+			if name <= dir.lastName {
+				return nil, fmt.Errorf("entries of %v are not sorted, duplicate, or have invalid names, at %v", dir.path, name)
+			}
+
+			dir.lastName = name
+		}
+
+		switch hdr.Type {
+		case nar.TypeDirectory:
+			dirs = append(dirs, &narDir{path: hdr.Path})
+		case nar.TypeRegular:
+			stats.Files++
+
+			if uint64(hdr.Size) > stats.LargestFileSize || stats.Files == 1 {
+				stats.LargestFile = hdr.Path
+				stats.LargestFileSize = uint64(hdr.Size)
+			}
+		case nar.TypeSymlink:
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package narcheck_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/narcheck"
+	"github.com/flokli/nix-casync/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	for name, td := range test.GetTestDataTable() {
+		name, td := name, td
+
+		t.Run("test data/"+name, func(t *testing.T) {
+			stats, err := narcheck.Check(bytes.NewReader(td.NarContents))
+			assert.NoError(t, err)
+			assert.NotNil(t, stats)
+		})
+	}
+
+	for _, tc := range []struct {
+		name  string
+		nar   []byte
+		stats narcheck.Stats
+	}{
+		{
+			name:  "file",
+			nar:   test.EncodeNar(test.NarFile("hello")),
+			stats: narcheck.Stats{Files: 1, LargestFile: "/", LargestFileSize: 5},
+		},
+		{
+			name:  "symlink",
+			nar:   test.EncodeNar(test.NarSymlink("/nix/store/foo")),
+			stats: narcheck.Stats{},
+		},
+		{
+			name:  "empty directory",
+			nar:   test.EncodeNar(test.NarDirectory()),
+			stats: narcheck.Stats{},
+		},
+		{
+			name: "directory",
+			nar: test.EncodeNar(test.NarDirectory(
+				test.NarEntry{Name: "a", Node: test.NarFile("abc")},
+				test.NarEntry{Name: "b", Node: test.NarDirectory(
+					test.NarEntry{Name: "c", Node: test.NarFile("0123456789")},
+					test.NarEntry{Name: "d", Node: test.NarSymlink("../a")},
+				)},
+				test.NarEntry{Name: "b.txt", Node: test.NarFile("")},
+			)),
+			stats: narcheck.Stats{Files: 3, LargestFile: "/b/c", LargestFileSize: 10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stats, err := narcheck.Check(bytes.NewReader(tc.nar))
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.stats, *stats)
+			}
+		})
+	}
+}
+
+func TestCheckInvalid(t *testing.T) {
+	validFile := test.EncodeNar(test.NarFile("abc"))
+
+	badPadding := test.EncodeNar(test.NarFile("abc"))
+	badPadding[bytes.Index(badPadding, []byte("abc"))+3] = 'x'
+
+	for _, tc := range []struct {
+		name string
+		nar  []byte
+	}{
+		{name: "empty", nar: []byte{}},
+		{name: "garbage", nar: []byte("this is not a nar file")},
+		{name: "wrong magic", nar: validFile[8:]},
+		{name: "truncated", nar: validFile[:len(validFile)-8]},
+		{name: "truncated in contents", nar: validFile[:bytes.Index(validFile, []byte("abc"))+1]},
+		{name: "truncated test data", nar: test.GetTestDataTable()["b"].NarContents[:100]},
+		{name: "trailing data", nar: append(test.EncodeNar(test.NarFile("abc")), test.EncodeNar(nil)...)},
+		{name: "trailing byte", nar: append(test.EncodeNar(test.NarFile("abc")), 0x00)},
+		{name: "bad padding", nar: badPadding},
+		{name: "unknown type", nar: test.EncodeNar([]string{"(", "type", "fifo", ")"})},
+		{name: "unsorted entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "b", Node: test.NarFile("b")},
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+		))},
+		{name: "unsorted nested entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarDirectory(
+				test.NarEntry{Name: "y", Node: test.NarFile("y")},
+				test.NarEntry{Name: "x", Node: test.NarFile("x")},
+			)},
+		))},
+		{name: "duplicate entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+		))},
+		{name: "empty name", nar: test.EncodeNar(test.NarDirectory(test.NarEntry{Name: "", Node: test.NarFile("a")}))},
+		{name: "name .", nar: test.EncodeNar(test.NarDirectory(test.NarEntry{Name: ".", Node: test.NarFile("a")}))},
+		{name: "name ..", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarDirectory(test.NarEntry{Name: "..", Node: test.NarFile("a")})},
+		))},
+		{name: "name with slash", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a/b", Node: test.NarFile("a")},
+		))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := narcheck.Check(bytes.NewReader(tc.nar))
+			assert.ErrorIs(t, err, narcheck.ErrInvalidNar)
+		})
+	}
+}
+
+// errReader returns err once all of r was read.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		err = r.err
+	}
+
+	return n, err
+}
+
+func TestCopy(t *testing.T) {
+	td := test.GetTestDataTable()["b"]
+
+	t.Run("valid", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		_, err := narcheck.Copy(&buf, bytes.NewReader(td.NarContents))
+		assert.NoError(t, err)
+		assert.Equal(t, td.NarContents, buf.Bytes(), "the NAR file should be passed through unchanged")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var buf bytes.Buffer
+
+		// the contents of the root node are followed by another NAR file
+		nar := append(test.EncodeNar(test.NarFile("abc")), td.NarContents...)
+
+		_, err := narcheck.Copy(&buf, bytes.NewReader(nar))
+		assert.ErrorIs(t, err, narcheck.ErrInvalidNar)
+		assert.Less(t, buf.Len(), len(nar), "copying should stop once the NAR file is invalid")
+	})
+
+	t.Run("read error", func(t *testing.T) {
+		readErr := errors.New("connection reset")
+
+		_, err := narcheck.Copy(io.Discard, &errReader{r: bytes.NewReader(td.NarContents[:100]), err: readErr})
+		assert.ErrorIs(t, err, readErr)
+		assert.NotErrorIs(t, err, narcheck.ErrInvalidNar, "read errors should be passed through")
+	})
+}
@@ -0,0 +1,542 @@
+// Package quota keeps track of the storage used by each principal, and enforces limits on it.
+//
+// Usage is counted in logical bytes: the sum of the (uncompressed) NAR sizes
+// of all store paths a principal uploaded first, across all caches (tenants),
+// and of all NAR files it uploaded that no store path refers to (yet).
+// It doesn't account for deduplication, so it's an upper bound of the disk space used.
+package quota
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+)
+
+// ErrQuotaExceeded is returned by Check if an upload would exceed the quota of a principal.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// reconcileInterval describes how often pending NAR files are checked for being removed (by gc).
+const reconcileInterval = time.Minute
+
+// Usage describes the storage used by a principal.
+type Usage struct {
+	// Bytes is the sum of the NAR sizes of all store paths uploaded,
+	// and of NAR files uploaded that no store path refers to (yet).
+	Bytes uint64 `json:"bytes"`
+	// Paths is the number of store paths uploaded.
+	Paths int `json:"paths"`
+	// Quota is the maximum of Bytes, or 0 if unlimited.
+	Quota uint64 `json:"quota,omitempty"`
+}
+
+// path is a store path counted towards the usage of a principal.
+type path struct {
+	principal string
+	size      uint64
+}
+
+// trackedStore is a metadata store whose PathInfo are counted.
+type trackedStore struct {
+	metadataStore metadatastore.MetadataStore
+	// seq is the sequence number of the last change applied.
+	seq uint64
+	// paths contains all PathInfo with an UploadedBy, keyed by (hex-encoded) output hash.
+	paths map[string]*path
+	// narHashes contains the NAR hash of all PathInfo, narRefs the number of PathInfo referring to each NAR hash
+	// (all hex-encoded).
+	narHashes map[string]string
+	narRefs   map[string]int
+	// pending contains NAR files uploaded by a principal no PathInfo refers to, keyed by (hex-encoded) NAR hash.
+	// They count towards the usage of who uploaded them, until a PathInfo refers to them, or they're removed by gc.
+	pending map[string]*path
+}
+
+// Tracker keeps track of the usage of all principals, across multiple metadata stores.
+// It's updated from the change feed of the metadata stores,
+// so it includes uploads and deletions by other processes (such as gc).
+type Tracker struct {
+	quotas map[string]uint64
+	stores []*trackedStore
+	// used is the sum of all paths (and pending NAR files) of all stores, per principal.
+	used map[string]*Usage
+	// reconciled is when pending NAR files were last checked for being removed.
+	reconciled time.Time
+	mu         sync.Mutex
+}
+
+// NewTracker returns a Tracker enforcing quotas, mapping from the name of a principal
+// to the maximum number of bytes it may use. Principals without a quota (or 0) are unlimited.
+func NewTracker(quotas map[string]uint64) *Tracker {
+	return &Tracker{
+		quotas: quotas,
+		used:   make(map[string]*Usage),
+	}
+}
+
+// Track adds the PathInfo in metadataStore to the usage.
+func (t *Tracker) Track(ctx context.Context, metadataStore metadatastore.MetadataStore) error {
+	seq, err := metadatastore.LatestSeq(ctx, metadataStore)
+	if err != nil {
+		return err
+	}
+
+	pathInfos, err := metadataStore.ListPathInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	narMetas, err := metadataStore.ListNarMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	narSizes := make(map[string]uint64, len(narMetas))
+	for _, narMeta := range narMetas {
+		narSizes[hex.EncodeToString(narMeta.NarHash)] = narMeta.Size
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ts := &trackedStore{
+		metadataStore: metadataStore,
+		seq:           seq,
+		paths:         make(map[string]*path),
+		narHashes:     make(map[string]string),
+		narRefs:       make(map[string]int),
+		pending:       make(map[string]*path),
+	}
+
+	for _, pathInfo := range pathInfos {
+		k := hex.EncodeToString(pathInfo.OutputHash)
+		narHash := hex.EncodeToString(pathInfo.NarHash)
+
+		ts.narHashes[k] = narHash
+		ts.narRefs[narHash]++
+
+		if pathInfo.UploadedBy != "" {
+			t.add(ts, k, &path{
+				principal: pathInfo.UploadedBy,
+				size:      narSizes[narHash],
+			})
+		}
+	}
+
+	for _, narMeta := range narMetas {
+		narHash := hex.EncodeToString(narMeta.NarHash)
+
+		if narMeta.UploadedBy != "" && ts.narRefs[narHash] == 0 {
+			t.addPending(ts, narHash, &path{principal: narMeta.UploadedBy, size: narMeta.Size})
+		}
+	}
+
+	t.stores = append(t.stores, ts)
+
+	return nil
+}
+
+// AddNar counts the NAR file described by narMeta, just added to metadataStore,
+// towards the usage of the principal that uploaded it, until a PathInfo refers to it.
+func (t *Tracker) AddNar(metadataStore metadatastore.MetadataStore, narMeta *metadatastore.NarMeta) {
+	if narMeta.UploadedBy == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	narHash := hex.EncodeToString(narMeta.NarHash)
+
+	for _, ts := range t.stores {
+		if ts.metadataStore == metadataStore && ts.narRefs[narHash] == 0 {
+			t.addPending(ts, narHash, &path{principal: narMeta.UploadedBy, size: narMeta.Size})
+		}
+	}
+}
+
+// usage returns the Usage of principal, creating it if needed. t.mu needs to be held.
+func (t *Tracker) usage(principal string) *Usage {
+	u, ok := t.used[principal]
+	if !ok {
+		u = &Usage{}
+		t.used[principal] = u
+	}
+
+	return u
+}
+
+// add counts p, with the (hex-encoded) output hash k, towards the usage. t.mu needs to be held.
+func (t *Tracker) add(ts *trackedStore, k string, p *path) {
+	ts.paths[k] = p
+
+	u := t.usage(p.principal)
+	u.Bytes += p.size
+	u.Paths++
+}
+
+// remove stops counting the path with the (hex-encoded) output hash k, if it was. t.mu needs to be held.
+func (t *Tracker) remove(ts *trackedStore, k string) {
+	p, ok := ts.paths[k]
+	if !ok {
+		return
+	}
+
+	delete(ts.paths, k)
+
+	u := t.used[p.principal]
+	u.Bytes -= p.size
+	u.Paths--
+}
+
+// addPending counts the NAR file p with the (hex-encoded) NAR hash k towards the usage,
+// unless it already is. t.mu needs to be held.
+func (t *Tracker) addPending(ts *trackedStore, k string, p *path) {
+	if _, ok := ts.pending[k]; ok {
+		return
+	}
+
+	ts.pending[k] = p
+	t.usage(p.principal).Bytes += p.size
+}
+
+// removePending stops counting the NAR file with the (hex-encoded) NAR hash k, if it was. t.mu needs to be held.
+func (t *Tracker) removePending(ts *trackedStore, k string) {
+	p, ok := ts.pending[k]
+	if !ok {
+		return
+	}
+
+	delete(ts.pending, k)
+	t.used[p.principal].Bytes -= p.size
+}
+
+// setNarHash records the PathInfo with the (hex-encoded) output hash k refers to narHash, or nothing if it's empty.
+// A NAR file is no longer pending once referred to. If it's not referred to anymore,
+// it's pending again (as long as its NarMeta exists), counting towards the usage of who uploaded it.
+// t.mu needs to be held.
+func (t *Tracker) setNarHash(ctx context.Context, ts *trackedStore, k string, narHash string) error {
+	previous, ok := ts.narHashes[k]
+	if ok {
+		delete(ts.narHashes, k)
+
+		ts.narRefs[previous]--
+		if ts.narRefs[previous] == 0 {
+			delete(ts.narRefs, previous)
+		}
+	}
+
+	if narHash != "" {
+		ts.narHashes[k] = narHash
+		ts.narRefs[narHash]++
+		t.removePending(ts, narHash)
+	}
+
+	if !ok || previous == narHash || ts.narRefs[previous] != 0 {
+		return nil
+	}
+
+	narHashBytes, _ := hex.DecodeString(previous)
+
+	narMeta, err := ts.metadataStore.GetNarMeta(ctx, narHashBytes)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	if narMeta.UploadedBy != "" {
+		t.addPending(ts, previous, &path{principal: narMeta.UploadedBy, size: narMeta.Size})
+	}
+
+	return nil
+}
+
+// Reconcile stops counting pending NAR files whose NarMeta was removed (by gc, possibly in another process).
+// This happens automatically (at most once every reconcileInterval) while checking quotas.
+func (t *Tracker) Reconcile(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.reconcile(ctx)
+}
+
+// reconcile implements Reconcile. t.mu needs to be held.
+func (t *Tracker) reconcile(ctx context.Context) error {
+	for _, ts := range t.stores {
+		for k := range ts.pending {
+			narHash, _ := hex.DecodeString(k)
+
+			_, err := ts.metadataStore.GetNarMeta(ctx, narHash)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					t.removePending(ts, k)
+
+					continue
+				}
+
+				return fmt.Errorf("unable to update usage: %w", err)
+			}
+		}
+	}
+
+	t.reconciled = time.Now()
+
+	return nil
+}
+
+// update applies the changes made to all stores since the last call. t.mu needs to be held.
+func (t *Tracker) update(ctx context.Context) error {
+	const pageSize = 1000
+
+	for _, ts := range t.stores {
+		for {
+			changes, err := ts.metadataStore.Changes(ctx, ts.seq, pageSize)
+			if err != nil {
+				return fmt.Errorf("unable to update usage: %w", err)
+			}
+
+			if len(changes) == 0 {
+				break
+			}
+
+			for _, change := range changes {
+				k := hex.EncodeToString(change.OutputHash)
+
+				t.remove(ts, k)
+
+				narHash := ""
+				if change.Type == metadatastore.ChangeAdd {
+					narHash = hex.EncodeToString(change.NarHash)
+				}
+
+				err := t.setNarHash(ctx, ts, k, narHash)
+				if err != nil {
+					return fmt.Errorf("unable to update usage: %w", err)
+				}
+
+				if change.Type == metadatastore.ChangeAdd {
+					p, err := ts.lookup(ctx, change.OutputHash)
+					if err != nil {
+						return fmt.Errorf("unable to update usage: %w", err)
+					}
+
+					if p != nil {
+						t.add(ts, k, p)
+					}
+				}
+
+				ts.seq = change.Seq
+			}
+		}
+	}
+
+	if time.Since(t.reconciled) >= reconcileInterval {
+		return t.reconcile(ctx)
+	}
+
+	return nil
+}
+
+// lookup returns the principal and size of the PathInfo with outputHash,
+// or nil if it wasn't attributed to a principal, or was removed since.
+func (ts *trackedStore) lookup(ctx context.Context, outputHash []byte) (*path, error) {
+	pathInfo, err := ts.metadataStore.GetPathInfo(ctx, outputHash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if pathInfo.UploadedBy == "" {
+		return nil, nil
+	}
+
+	narMeta, err := ts.metadataStore.GetNarMeta(ctx, pathInfo.NarHash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &path{principal: pathInfo.UploadedBy, size: narMeta.Size}, nil
+}
+
+// Usage returns the usage of all principals in quotas, or with any store paths (or NAR files) uploaded,
+// keyed by their name.
+func (t *Tracker) Usage(ctx context.Context) (map[string]*Usage, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.update(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]*Usage)
+
+	for principal, quota := range t.quotas {
+		usage[principal] = &Usage{Quota: quota}
+	}
+
+	for principal, used := range t.used {
+		if used.Paths == 0 && used.Bytes == 0 {
+			continue
+		}
+
+		u, ok := usage[principal]
+		if !ok {
+			u = &Usage{}
+			usage[principal] = u
+		}
+
+		u.Bytes = used.Bytes
+		u.Paths = used.Paths
+	}
+
+	return usage, nil
+}
+
+// Check returns ErrQuotaExceeded if principal uploading additional bytes would exceed its quota,
+// or if it already did, even without any additional bytes.
+// Requests without a principal, and principals without a quota, are always allowed.
+func (t *Tracker) Check(ctx context.Context, principal string, additional uint64) error {
+	quota := t.quotas[principal]
+	if principal == "" || quota == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.check(ctx, principal, quota, additional)
+}
+
+// Remaining returns how many more bytes principal may upload before exceeding its quota,
+// and false if it's unlimited (as with Check).
+func (t *Tracker) Remaining(ctx context.Context, principal string) (uint64, bool, error) {
+	quota := t.quotas[principal]
+	if principal == "" || quota == 0 {
+		return 0, false, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.update(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var used uint64
+	if u, ok := t.used[principal]; ok {
+		used = u.Bytes
+	}
+
+	if used >= quota {
+		return 0, true, nil
+	}
+
+	return quota - used, true, nil
+}
+
+// CheckPath is Check for principal uploading a .narinfo referring to narMeta, to metadataStore.
+// If principal uploaded the NAR file itself, and no other PathInfo refers to it, it's already counted,
+// so this is allowed even if it used up the quota.
+func (t *Tracker) CheckPath(
+	ctx context.Context,
+	principal string,
+	metadataStore metadatastore.MetadataStore,
+	narMeta *metadatastore.NarMeta,
+) error {
+	quota := t.quotas[principal]
+	if principal == "" || quota == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	err := t.update(ctx)
+	if err != nil {
+		return err
+	}
+
+	narHash := hex.EncodeToString(narMeta.NarHash)
+
+	for _, ts := range t.stores {
+		if ts.metadataStore != metadataStore {
+			continue
+		}
+
+		if p, ok := ts.pending[narHash]; ok && p.principal == principal {
+			return nil
+		}
+	}
+
+	return t.check(ctx, principal, quota, narMeta.Size)
+}
+
+// hasPending returns true if principal uploaded any NAR files no PathInfo refers to. t.mu needs to be held.
+func (t *Tracker) hasPending(principal string) bool {
+	for _, ts := range t.stores {
+		for _, p := range ts.pending {
+			if p.principal == principal {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// check implements Check. t.mu needs to be held.
+func (t *Tracker) check(ctx context.Context, principal string, quota uint64, additional uint64) error {
+	err := t.update(ctx)
+	if err != nil {
+		return err
+	}
+
+	var used uint64
+	if u, ok := t.used[principal]; ok {
+		used = u.Bytes
+	}
+
+	// pending NAR files might have been removed by gc since, so check before rejecting.
+	if (used+additional > quota || used >= quota) && t.hasPending(principal) {
+		err := t.reconcile(ctx)
+		if err != nil {
+			return err
+		}
+
+		used = t.used[principal].Bytes
+	}
+
+	if additional == 0 && used >= quota {
+		return fmt.Errorf("%w: %v already uses %d of %d bytes", ErrQuotaExceeded, principal, used, quota)
+	}
+
+	if used+additional > quota {
+		return fmt.Errorf(
+			"%w: %v uses %d of %d bytes, uploading %d more bytes isn't allowed",
+			ErrQuotaExceeded,
+			principal,
+			used,
+			quota,
+			additional,
+		)
+	}
+
+	return nil
+}
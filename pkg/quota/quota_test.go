@@ -0,0 +1,133 @@
+package quota_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/quota"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	ctx := context.Background()
+
+	tdAPathInfo, tdANarMeta, err := metadatastore.ParseNarinfo(test.GetTestDataTable()["a"].Narinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tdCPathInfo, tdCNarMeta, err := metadatastore.ParseNarinfo(test.GetTestDataTable()["c"].Narinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// c refers to itself, so its NarMeta can only be put with references once its PathInfo exists.
+	tdCReferences, tdCReferencesStr := tdCNarMeta.References, tdCNarMeta.ReferencesStr
+	tdCNarMeta.References, tdCNarMeta.ReferencesStr = nil, nil
+
+	store1 := metadatastore.NewMemoryStore()
+	store2 := metadatastore.NewMemoryStore()
+
+	put := func(store metadatastore.MetadataStore, pathInfo *metadatastore.PathInfo, narMeta *metadatastore.NarMeta, principal string) {
+		p := *pathInfo
+		p.UploadedBy = principal
+
+		assert.NoError(t, store.PutNarMeta(ctx, narMeta))
+		assert.NoError(t, store.PutPathInfo(ctx, &p))
+	}
+
+	// uploaded before tracking started
+	put(store1, tdAPathInfo, tdANarMeta, "team-a")
+
+	tracker := quota.NewTracker(map[string]uint64{
+		"team-a": tdANarMeta.Size + tdCNarMeta.Size,
+		"team-b": 0,
+	})
+
+	assert.NoError(t, tracker.Track(ctx, store1))
+	assert.NoError(t, tracker.Track(ctx, store2))
+
+	usage, err := tracker.Usage(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]*quota.Usage{
+			"team-a": {Bytes: tdANarMeta.Size, Paths: 1, Quota: tdANarMeta.Size + tdCNarMeta.Size},
+			"team-b": {},
+		}, usage)
+	}
+
+	assert.NoError(t, tracker.Check(ctx, "team-a", tdCNarMeta.Size))
+	assert.ErrorIs(t, tracker.Check(ctx, "team-a", tdCNarMeta.Size+1), quota.ErrQuotaExceeded)
+	assert.NoError(t, tracker.Check(ctx, "team-b", 1<<40), "principals without quota are unlimited")
+	assert.NoError(t, tracker.Check(ctx, "", 1<<40), "anonymous uploads are unlimited")
+
+	remaining, hasQuota, err := tracker.Remaining(ctx, "team-a")
+	if assert.NoError(t, err) {
+		assert.True(t, hasQuota)
+		assert.Equal(t, tdCNarMeta.Size, remaining)
+	}
+
+	_, hasQuota, err = tracker.Remaining(ctx, "team-b")
+	if assert.NoError(t, err) {
+		assert.False(t, hasQuota, "principals without quota are unlimited")
+	}
+
+	t.Run("changes in all stores count", func(t *testing.T) {
+		// uploading the same store path to another store counts again
+		put(store2, tdAPathInfo, tdANarMeta, "team-a")
+		put(store2, tdCPathInfo, tdCNarMeta, "team-b")
+
+		tdCNarMeta.References, tdCNarMeta.ReferencesStr = tdCReferences, tdCReferencesStr
+		assert.NoError(t, store2.PutNarMeta(ctx, tdCNarMeta))
+
+		usage, err := tracker.Usage(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdANarMeta.Size*2, usage["team-a"].Bytes)
+			assert.Equal(t, 2, usage["team-a"].Paths)
+			assert.Equal(t, tdCNarMeta.Size, usage["team-b"].Bytes)
+		}
+
+		assert.ErrorIs(t, tracker.Check(ctx, "team-a", tdCNarMeta.Size), quota.ErrQuotaExceeded)
+	})
+
+	t.Run("deletions free up space", func(t *testing.T) {
+		assert.NoError(t, store1.DeletePathInfo(ctx, tdAPathInfo.OutputHash))
+
+		usage, err := tracker.Usage(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdANarMeta.Size, usage["team-a"].Bytes)
+			assert.Equal(t, 1, usage["team-a"].Paths)
+		}
+
+		assert.NoError(t, tracker.Check(ctx, "team-a", tdCNarMeta.Size))
+	})
+
+	t.Run("NAR files without .narinfo count", func(t *testing.T) {
+		narMeta := *tdCNarMeta
+		narMeta.References, narMeta.ReferencesStr = nil, nil
+		narMeta.UploadedBy = "team-a"
+
+		assert.NoError(t, store1.PutNarMeta(ctx, &narMeta))
+		tracker.AddNar(store1, &narMeta)
+
+		usage, err := tracker.Usage(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdANarMeta.Size+tdCNarMeta.Size, usage["team-a"].Bytes)
+			assert.Equal(t, 1, usage["team-a"].Paths)
+		}
+
+		assert.ErrorIs(t, tracker.Check(ctx, "team-a", 1), quota.ErrQuotaExceeded)
+		assert.NoError(t, tracker.CheckPath(ctx, "team-a", store1, &narMeta), "its own NAR file is counted already")
+		assert.ErrorIs(t, tracker.CheckPath(ctx, "team-a", store2, &narMeta), quota.ErrQuotaExceeded)
+
+		// once removed by gc, it doesn't count anymore.
+		assert.NoError(t, store1.DeleteNarMeta(ctx, narMeta.NarHash))
+		assert.NoError(t, tracker.Check(ctx, "team-a", tdCNarMeta.Size))
+
+		usage, err = tracker.Usage(ctx)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdANarMeta.Size, usage["team-a"].Bytes)
+		}
+	})
+}
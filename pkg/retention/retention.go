@@ -0,0 +1,252 @@
+// Package retention removes store paths from a cache that aren't kept by any retention rule.
+// Blobs only referenced by removed store paths are left to garbage collection.
+package retention
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// Policy describes which store paths to keep.
+// Pinned store paths, and the closures of all store paths kept, are always kept.
+type Policy struct {
+	// KeepNewerThan keeps store paths uploaded or accessed within this duration.
+	// Store paths without timestamps (uploaded by older versions) are kept as well.
+	// 0 disables this rule.
+	KeepNewerThan time.Duration
+
+	// KeepVersions keeps the most recently uploaded store paths of each package
+	// (as determined by PackageKey). 0 disables this rule.
+	KeepVersions int
+}
+
+// Enabled returns true if any rule is configured.
+// Without any, everything is kept.
+func (p *Policy) Enabled() bool {
+	return p.KeepNewerThan > 0 || p.KeepVersions > 0
+}
+
+// Result describes what was removed (or would be, on a dry run).
+type Result struct {
+	PathsKept       int
+	PathsRemoved    []*metadatastore.PathInfo
+	NarMetasRemoved int
+}
+
+// Apply removes all PathInfo from metadataStore not kept by policy,
+// as well as the NarMeta only referred to by them.
+// With dryRun, nothing is removed, but the result describes what would be.
+func Apply(
+	ctx context.Context,
+	metadataStore metadatastore.MetadataStore,
+	policy Policy,
+	now time.Time,
+	dryRun bool,
+) (*Result, error) {
+	if !policy.Enabled() {
+		return nil, errors.New("no retention rules configured")
+	}
+
+	pathInfos, err := metadataStore.ListPathInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	narMetas, err := metadataStore.ListNarMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := metadataStore.ListPins(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pathInfoByHash := make(map[string]*metadatastore.PathInfo, len(pathInfos))
+	for _, pathInfo := range pathInfos {
+		pathInfoByHash[hex.EncodeToString(pathInfo.OutputHash)] = pathInfo
+	}
+
+	narMetaByHash := make(map[string]*metadatastore.NarMeta, len(narMetas))
+	for _, narMeta := range narMetas {
+		narMetaByHash[hex.EncodeToString(narMeta.NarHash)] = narMeta
+	}
+
+	roots := []*metadatastore.PathInfo{}
+
+	for name, outputHash := range pins {
+		if pathInfo, ok := pathInfoByHash[hex.EncodeToString(outputHash)]; ok {
+			roots = append(roots, pathInfo)
+		} else {
+			log.Warnf("Pin %v points to %v, which doesn't exist", name, hex.EncodeToString(outputHash))
+		}
+	}
+
+	if policy.KeepNewerThan > 0 {
+		for _, pathInfo := range pathInfos {
+			lastUsed := pathInfo.LastUsed()
+			if lastUsed.IsZero() || now.Sub(lastUsed) < policy.KeepNewerThan {
+				roots = append(roots, pathInfo)
+			}
+		}
+	}
+
+	if policy.KeepVersions > 0 {
+		roots = append(roots, latestVersions(pathInfos, policy.KeepVersions)...)
+	}
+
+	keep := closure(roots, pathInfoByHash, narMetaByHash)
+
+	result := &Result{
+		PathsKept: len(keep),
+	}
+
+	// NarMeta still referred to by a PathInfo that's kept
+	narHashesKept := make(map[string]struct{})
+	for _, pathInfo := range keep {
+		narHashesKept[hex.EncodeToString(pathInfo.NarHash)] = struct{}{}
+	}
+
+	narHashesRemoved := make(map[string][]byte)
+
+	for k, pathInfo := range pathInfoByHash {
+		if _, ok := keep[k]; ok {
+			continue
+		}
+
+		result.PathsRemoved = append(result.PathsRemoved, pathInfo)
+
+		if _, ok := narHashesKept[hex.EncodeToString(pathInfo.NarHash)]; !ok {
+			narHashesRemoved[hex.EncodeToString(pathInfo.NarHash)] = pathInfo.NarHash
+		}
+	}
+
+	sort.Slice(result.PathsRemoved, func(i, j int) bool {
+		return result.PathsRemoved[i].StorePath() < result.PathsRemoved[j].StorePath()
+	})
+
+	result.NarMetasRemoved = len(narHashesRemoved)
+
+	if dryRun {
+		return result, nil
+	}
+
+	for _, pathInfo := range result.PathsRemoved {
+		err := metadataStore.DeletePathInfo(ctx, pathInfo.OutputHash)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error removing %v: %w", pathInfo.StorePath(), err)
+		}
+	}
+
+	// Only NarMeta referred to by removed PathInfo are removed.
+	// Others might belong to a NAR file that was just uploaded, with its .narinfo still to come.
+	for _, narHash := range narHashesRemoved {
+		err := metadataStore.DeleteNarMeta(ctx, narHash)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error removing NarMeta: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// latestVersions returns the n most recently uploaded store paths of each package.
+func latestVersions(pathInfos []*metadatastore.PathInfo, n int) []*metadatastore.PathInfo {
+	packages := make(map[string][]*metadatastore.PathInfo)
+
+	for _, pathInfo := range pathInfos {
+		key := PackageKey(pathInfo.Name)
+		packages[key] = append(packages[key], pathInfo)
+	}
+
+	latest := []*metadatastore.PathInfo{}
+
+	for _, versions := range packages {
+		// newest first, store paths without upload time last
+		sort.Slice(versions, func(i, j int) bool {
+			if !versions[i].UploadedAt.Equal(versions[j].UploadedAt) {
+				return versions[i].UploadedAt.After(versions[j].UploadedAt)
+			}
+
+			return versions[i].StorePath() < versions[j].StorePath()
+		})
+
+		if len(versions) > n {
+			versions = versions[:n]
+		}
+
+		latest = append(latest, versions...)
+	}
+
+	return latest
+}
+
+// closure returns roots, and everything they refer to, recursively, keyed by (hex-encoded) output hash.
+func closure(
+	roots []*metadatastore.PathInfo,
+	pathInfoByHash map[string]*metadatastore.PathInfo,
+	narMetaByHash map[string]*metadatastore.NarMeta,
+) map[string]*metadatastore.PathInfo {
+	keep := make(map[string]*metadatastore.PathInfo)
+	queue := roots
+
+	for len(queue) > 0 {
+		pathInfo := queue[0]
+		queue = queue[1:]
+
+		k := hex.EncodeToString(pathInfo.OutputHash)
+		if _, ok := keep[k]; ok {
+			continue
+		}
+
+		keep[k] = pathInfo
+
+		narMeta, ok := narMetaByHash[hex.EncodeToString(pathInfo.NarHash)]
+		if !ok {
+			continue
+		}
+
+		for _, reference := range narMeta.References {
+			if referenced, ok := pathInfoByHash[hex.EncodeToString(reference)]; ok {
+				queue = append(queue, referenced)
+			}
+		}
+	}
+
+	return keep
+}
+
+// PackageKey returns the name of a store path without its version,
+// so different versions of the same package share the same key.
+// Like builtins.parseDrvName in Nix, the version starts after the first dash not followed by a letter.
+// Output names (such as -man) after the version are kept, as they're a different package.
+//
+// For example, hello-2.12 and hello-2.10 have the key hello,
+// hello-2.12-man has hello-man.
+func PackageKey(name string) string {
+	pname, version := name, ""
+
+	for i := 0; i+1 < len(name); i++ {
+		if name[i] == '-' && !unicode.IsLetter(rune(name[i+1])) {
+			pname, version = name[:i], name[i+1:]
+
+			break
+		}
+	}
+
+	if i := strings.LastIndex(version, "-"); i >= 0 && i+1 < len(version) && unicode.IsLetter(rune(version[i+1])) {
+		return pname + version[i:]
+	}
+
+	return pname
+}
@@ -0,0 +1,178 @@
+package retention_test
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/retention"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPackageKey(t *testing.T) {
+	for name, key := range map[string]string{
+		"hello-2.12":              "hello",
+		"hello-2.12-man":          "hello-man",
+		"firefox-unwrapped-100.0": "firefox-unwrapped",
+		"foo-unstable-2022-01-01": "foo-unstable",
+		"source":                  "source",
+		"linux-5.15.0-modules":    "linux-modules",
+	} {
+		assert.Equal(t, key, retention.PackageKey(name), name)
+	}
+}
+
+//nolint:gochecknoglobals
+var now = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// newStore returns a metadata store with the following store paths,
+// uploaded the given number of days ago:
+//   - lib-1.0 (30), lib-2.0 (10)
+//   - hello-2.10 (30, referring to lib-1.0), hello-2.11 (20), hello-2.12 (10, referring to lib-2.0)
+//   - hello-2.12-man (10)
+//   - legacy-1.0 (unknown)
+func newStore(t *testing.T) (*metadatastore.MemoryStore, map[string]*metadatastore.PathInfo) {
+	t.Helper()
+
+	metadataStore := metadatastore.NewMemoryStore()
+	pathInfos := make(map[string]*metadatastore.PathInfo)
+
+	add := func(name string, daysAgo int, references ...string) {
+		outputHash := sha1.Sum([]byte(name)) //nolint:gosec
+		narHash := sha256.Sum256([]byte(name))
+
+		narMeta := &metadatastore.NarMeta{
+			NarHash: narHash[:],
+			Size:    42,
+		}
+
+		for _, reference := range references {
+			narMeta.References = append(narMeta.References, pathInfos[reference].OutputHash)
+			narMeta.ReferencesStr = append(narMeta.ReferencesStr, pathInfos[reference].StorePath()[len("/nix/store/"):])
+		}
+
+		pathInfo := &metadatastore.PathInfo{
+			OutputHash: outputHash[:],
+			Name:       name,
+			NarHash:    narHash[:],
+		}
+
+		if daysAgo >= 0 {
+			pathInfo.UploadedAt = now.AddDate(0, 0, -daysAgo)
+		}
+
+		if err := metadataStore.PutNarMeta(context.Background(), narMeta); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := metadataStore.PutPathInfo(context.Background(), pathInfo); err != nil {
+			t.Fatal(err)
+		}
+
+		pathInfos[name] = pathInfo
+	}
+
+	add("lib-1.0", 30)
+	add("lib-2.0", 10)
+	add("hello-2.10", 30, "lib-1.0")
+	add("hello-2.11", 20)
+	add("hello-2.12", 10, "lib-2.0")
+	add("hello-2.12-man", 10)
+	add("legacy-1.0", -1)
+
+	return metadataStore, pathInfos
+}
+
+// removedNames returns the names of the removed store paths.
+func removedNames(result *retention.Result) []string {
+	names := []string{}
+	for _, pathInfo := range result.PathsRemoved {
+		names = append(names, pathInfo.Name)
+	}
+
+	return names
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("no rules", func(t *testing.T) {
+		metadataStore, _ := newStore(t)
+
+		_, err := retention.Apply(ctx, metadataStore, retention.Policy{}, now, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("keep versions", func(t *testing.T) {
+		metadataStore, pathInfos := newStore(t)
+
+		result, err := retention.Apply(ctx, metadataStore, retention.Policy{KeepVersions: 1}, now, false)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.ElementsMatch(t, []string{"hello-2.10", "hello-2.11", "lib-1.0"}, removedNames(result))
+		assert.Equal(t, 4, result.PathsKept)
+		assert.Equal(t, 3, result.NarMetasRemoved)
+
+		_, err = metadataStore.GetPathInfo(ctx, pathInfos["hello-2.10"].OutputHash)
+		assert.Error(t, err)
+
+		_, err = metadataStore.GetNarMeta(ctx, pathInfos["hello-2.10"].NarHash)
+		assert.Error(t, err, "NarMeta only referred to by removed store paths should be removed")
+
+		_, err = metadataStore.GetPathInfo(ctx, pathInfos["hello-2.12"].OutputHash)
+		assert.NoError(t, err)
+	})
+
+	t.Run("keep newer than", func(t *testing.T) {
+		metadataStore, _ := newStore(t)
+
+		result, err := retention.Apply(ctx, metadataStore, retention.Policy{KeepNewerThan: 15 * 24 * time.Hour}, now, false)
+		if assert.NoError(t, err) {
+			// legacy-1.0 has no upload time, and is kept
+			assert.ElementsMatch(t, []string{"hello-2.10", "hello-2.11", "lib-1.0"}, removedNames(result))
+		}
+	})
+
+	t.Run("last access counts", func(t *testing.T) {
+		metadataStore, pathInfos := newStore(t)
+
+		assert.NoError(t, metadataStore.RecordAccess(ctx, []*metadatastore.Access{
+			{OutputHash: pathInfos["hello-2.11"].OutputHash, Time: now.AddDate(0, 0, -1), Hits: 1},
+		}))
+
+		result, err := retention.Apply(ctx, metadataStore, retention.Policy{KeepNewerThan: 15 * 24 * time.Hour}, now, false)
+		if assert.NoError(t, err) {
+			assert.ElementsMatch(t, []string{"hello-2.10", "lib-1.0"}, removedNames(result))
+		}
+	})
+
+	t.Run("pins keep their closure", func(t *testing.T) {
+		metadataStore, pathInfos := newStore(t)
+
+		assert.NoError(t, metadataStore.PutPin(ctx, "release", pathInfos["hello-2.10"].OutputHash))
+
+		result, err := retention.Apply(ctx, metadataStore, retention.Policy{KeepVersions: 1}, now, false)
+		if assert.NoError(t, err) {
+			assert.ElementsMatch(t, []string{"hello-2.11"}, removedNames(result))
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		metadataStore, _ := newStore(t)
+
+		result, err := retention.Apply(ctx, metadataStore, retention.Policy{KeepVersions: 1}, now, true)
+		if assert.NoError(t, err) {
+			assert.Len(t, result.PathsRemoved, 3)
+		}
+
+		pathInfos, err := metadataStore.ListPathInfo(ctx)
+		if assert.NoError(t, err) {
+			assert.Len(t, pathInfos, 7, "nothing should be removed")
+		}
+	})
+}
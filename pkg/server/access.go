@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	log "github.com/sirupsen/logrus"
+)
+
+// accessFlushInterval describes how often accesses are written to the metadata store.
+const accessFlushInterval = 30 * time.Second
+
+// accessLog collects requests for .narinfo and NAR files in memory,
+// so serving them doesn't write to the metadata store every time.
+// They're written to it in batches, by FlushAccess.
+type accessLog struct {
+	// narinfos and nars contain the requests since the last flush,
+	// keyed by (hex-encoded) output and NAR hash.
+	narinfos map[string]*metadatastore.Access
+	nars     map[string]*metadatastore.Access
+	mu       sync.Mutex
+
+	// narHashes maps from NAR hash to the output hashes of all PathInfo referring to it
+	// (all hex-encoded), so NAR requests can be attributed to store paths.
+	// narHashByOutputHash is the reverse.
+	// Both are built on the first flush with NAR requests, and kept up to date by following the change feed,
+	// which includes changes made by other processes.
+	narHashes           map[string]map[string][]byte
+	narHashByOutputHash map[string]string
+	seq                 uint64
+	muFlush             sync.Mutex
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{
+		narinfos: make(map[string]*metadatastore.Access),
+		nars:     make(map[string]*metadatastore.Access),
+	}
+}
+
+// record adds a request at now to m, counting it as hit if hit is set.
+func (a *accessLog) record(m map[string]*metadatastore.Access, hash []byte, now time.Time, hit bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	k := hex.EncodeToString(hash)
+
+	access, ok := m[k]
+	if !ok {
+		access = &metadatastore.Access{}
+		m[k] = access
+	}
+
+	access.Time = now
+
+	if hit {
+		access.Hits++
+	}
+}
+
+// recordNarinfoAccess records a request for the .narinfo of the store path with outputHash.
+func (s *Server) recordNarinfoAccess(outputHash []byte) {
+	s.access.record(s.access.narinfos, outputHash, time.Now(), false)
+}
+
+// recordNarAccess records a download of the NAR file with narHash,
+// which counts as a hit for all store paths referring to it.
+func (s *Server) recordNarAccess(narHash []byte) {
+	s.access.record(s.access.nars, narHash, time.Now(), true)
+}
+
+// runAccessLog flushes accesses every accessFlushInterval, and once more on Close.
+func (s *Server) runAccessLog() {
+	s.bg.Add(1)
+
+	go func() {
+		defer s.bg.Done()
+
+		ticker := time.NewTicker(accessFlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.bgCtx.Done():
+				if err := s.FlushAccess(context.Background()); err != nil {
+					log.Errorf("Error recording accesses: %v", err)
+				}
+
+				return
+			case <-ticker.C:
+				if err := s.FlushAccess(s.bgCtx); err != nil {
+					log.Errorf("Error recording accesses: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// FlushAccess writes all requests for .narinfo and NAR files collected since the last call
+// to the metadata store. This happens periodically while serving, and when closing the server.
+func (s *Server) FlushAccess(ctx context.Context) error {
+	a := s.access
+
+	a.muFlush.Lock()
+	defer a.muFlush.Unlock()
+
+	a.mu.Lock()
+	narinfos, nars := a.narinfos, a.nars
+	a.narinfos = make(map[string]*metadatastore.Access)
+	a.nars = make(map[string]*metadatastore.Access)
+	a.mu.Unlock()
+
+	if len(narinfos) == 0 && len(nars) == 0 {
+		return nil
+	}
+
+	if len(nars) > 0 {
+		err := a.updateNarHashes(ctx, s.metadataStore)
+		if err != nil {
+			return fmt.Errorf("unable to look up store paths of NAR files: %w", err)
+		}
+	}
+
+	accesses := make([]*metadatastore.Access, 0, len(narinfos)+len(nars))
+
+	for outputHash, access := range narinfos {
+		access.OutputHash, _ = hex.DecodeString(outputHash)
+		accesses = append(accesses, access)
+	}
+
+	for narHash, narAccess := range nars {
+		for _, outputHash := range a.narHashes[narHash] {
+			accesses = append(accesses, &metadatastore.Access{
+				OutputHash: outputHash,
+				Time:       narAccess.Time,
+				Hits:       narAccess.Hits,
+			})
+		}
+	}
+
+	return s.metadataStore.RecordAccess(ctx, accesses)
+}
+
+// updateNarHashes builds narHashes, or applies the changes since it was last updated.
+// muFlush needs to be held.
+func (a *accessLog) updateNarHashes(ctx context.Context, metadataStore metadatastore.MetadataStore) error {
+	const pageSize = 1000
+
+	if a.narHashes == nil {
+		seq, err := metadatastore.LatestSeq(ctx, metadataStore)
+		if err != nil {
+			return err
+		}
+
+		pathInfos, err := metadataStore.ListPathInfo(ctx)
+		if err != nil {
+			return err
+		}
+
+		a.narHashes = make(map[string]map[string][]byte)
+		a.narHashByOutputHash = make(map[string]string)
+		a.seq = seq
+
+		for _, pathInfo := range pathInfos {
+			a.setNarHash(pathInfo.OutputHash, pathInfo.NarHash)
+		}
+	}
+
+	for {
+		changes, err := metadataStore.Changes(ctx, a.seq, pageSize)
+		if err != nil {
+			return err
+		}
+
+		if len(changes) == 0 {
+			return nil
+		}
+
+		for _, change := range changes {
+			if change.Type == metadatastore.ChangeAdd {
+				a.setNarHash(change.OutputHash, change.NarHash)
+			} else {
+				a.setNarHash(change.OutputHash, nil)
+			}
+
+			a.seq = change.Seq
+		}
+	}
+}
+
+// setNarHash records the PathInfo with outputHash refers to narHash, replacing what it referred to before.
+// With narHash nil, it's removed.
+func (a *accessLog) setNarHash(outputHash, narHash []byte) {
+	k := hex.EncodeToString(outputHash)
+
+	if previous, ok := a.narHashByOutputHash[k]; ok {
+		delete(a.narHashes[previous], k)
+
+		if len(a.narHashes[previous]) == 0 {
+			delete(a.narHashes, previous)
+		}
+
+		delete(a.narHashByOutputHash, k)
+	}
+
+	if narHash == nil {
+		return
+	}
+
+	narHashStr := hex.EncodeToString(narHash)
+
+	if _, ok := a.narHashes[narHashStr]; !ok {
+		a.narHashes[narHashStr] = make(map[string][]byte)
+	}
+
+	a.narHashes[narHashStr][k] = outputHash
+	a.narHashByOutputHash[k] = narHashStr
+}
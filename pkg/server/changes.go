@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// changesDefaultLimit is the number of changes returned if no limit is requested.
+	changesDefaultLimit = 1000
+	// changesMaxWait caps how long a long-polling request waits for changes.
+	// It needs to be below the write timeout of the HTTP server.
+	changesMaxWait = 60 * time.Second
+	// changesWriteTimeout is how long writing to an event stream may take, before the client is considered gone.
+	// Event streams replace the write timeout of the HTTP server with it, renewed on every write.
+	changesWriteTimeout = 60 * time.Second
+	// changesPollInterval is how often the metadata store is checked for changes
+	// made by other processes, which don't trigger ChangesNotify.
+	changesPollInterval = 2 * time.Second
+	// changesHeartbeatInterval is how often a comment is sent on idle event streams,
+	// so proxies don't close the connection.
+	changesHeartbeatInterval = 15 * time.Second
+)
+
+// RegisterChangesHandlers registers the change feed:
+//   - GET /_changes?since=N returns the store paths added or deleted after the change with sequence number N,
+//     and the sequence number to pass as since in the next request.
+//   - With &wait=30s, the request blocks until there are changes, or the duration passed.
+//   - With Accept: text/event-stream, changes are pushed as Server-Sent Events,
+//     continuing at Last-Event-ID when reconnecting.
+func (s *Server) RegisterChangesHandlers() {
+	s.Handler.Get("/_changes", s.handleChanges)
+}
+
+type changeEvent struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	StorePath string    `json:"storePath"`
+	NarHash   string    `json:"narHash"`
+}
+
+func newChangeEvent(c *metadatastore.Change) *changeEvent {
+	return &changeEvent{
+		Seq:       c.Seq,
+		Type:      string(c.Type),
+		Time:      c.Time,
+		StorePath: c.StorePath(),
+		NarHash:   "sha256:" + nixbase32.EncodeToString(c.NarHash),
+	}
+}
+
+type changesResponse struct {
+	Changes []*changeEvent `json:"changes"`
+	// Next is the sequence number of the last change returned (or since, if there were none).
+	Next uint64 `json:"next"`
+}
+
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	since, err := parseUintParam(query.Get("since"), 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid since: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	limit, err := parseUintParam(query.Get("limit"), changesDefaultLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, fmt.Sprintf("Invalid limit: %v", query.Get("limit")), http.StatusBadRequest)
+
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		// clients reconnecting send the ID of the last event they received.
+		if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+			since, err = strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid Last-Event-ID: %v", err), http.StatusBadRequest)
+
+				return
+			}
+		}
+
+		s.streamChanges(w, r, since, int(limit))
+
+		return
+	}
+
+	var wait time.Duration
+
+	if waitStr := query.Get("wait"); waitStr != "" {
+		wait, err = time.ParseDuration(waitStr)
+		if err != nil || wait < 0 {
+			http.Error(w, fmt.Sprintf("Invalid wait: %v", waitStr), http.StatusBadRequest)
+
+			return
+		}
+
+		if wait > changesMaxWait {
+			wait = changesMaxWait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	var changes []*metadatastore.Change
+
+	for {
+		// get the channel before looking for changes, so none made in between are missed.
+		notify := s.metadataStore.ChangesNotify()
+
+		changes, err = s.metadataStore.Changes(r.Context(), since, int(limit))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting changes: %v", err), http.StatusInternalServerError)
+
+			return
+		}
+
+		if len(changes) > 0 || !s.waitForChanges(ctx, notify, changesPollInterval) {
+			break
+		}
+	}
+
+	resp := &changesResponse{
+		Changes: make([]*changeEvent, 0, len(changes)),
+		Next:    since,
+	}
+
+	for _, c := range changes {
+		resp.Changes = append(resp.Changes, newChangeEvent(c))
+		resp.Next = c.Seq
+	}
+
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// connContextKey is the key ConnContext stores the connection of a request at.
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context of its requests,
+// so event streams can extend its write deadline beyond the WriteTimeout of the HTTP server.
+// It's meant to be used as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// streamChanges sends all changes after since as Server-Sent Events,
+// and keeps sending new ones until the client disconnects or the server shuts down.
+func (s *Server) streamChanges(w http.ResponseWriter, r *http.Request, since uint64, limit int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+
+	// extendDeadline allows writing for another changesWriteTimeout,
+	// so the stream outlives the write timeout of the HTTP server.
+	// Without the connection in the request context (see ConnContext), the write timeout still applies.
+	extendDeadline := func() bool {
+		if conn == nil {
+			return true
+		}
+
+		err := conn.SetWriteDeadline(time.Now().Add(changesWriteTimeout))
+		if err != nil {
+			log.Errorf("Unable to extend write deadline: %v", err)
+
+			return false
+		}
+
+		return true
+	}
+
+	if !extendDeadline() {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastWrite := time.Now()
+
+	for {
+		if !extendDeadline() {
+			return
+		}
+
+		notify := s.metadataStore.ChangesNotify()
+
+		changes, err := s.metadataStore.Changes(r.Context(), since, limit)
+		if err != nil {
+			// the status was already sent, all we can do is ending the stream.
+			log.Errorf("Error getting changes: %v", err)
+
+			return
+		}
+
+		for _, c := range changes {
+			b, err := json.Marshal(newChangeEvent(c))
+			if err != nil {
+				log.Errorf("Unable to serialize change: %v", err)
+
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Type, b)
+			if err != nil {
+				return
+			}
+
+			since = c.Seq
+		}
+
+		if len(changes) == limit {
+			// there might be more
+			continue
+		}
+
+		if len(changes) > 0 {
+			flusher.Flush()
+
+			lastWrite = time.Now()
+		} else if time.Since(lastWrite) >= changesHeartbeatInterval {
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+
+			flusher.Flush()
+
+			lastWrite = time.Now()
+		}
+
+		if !s.waitForChanges(r.Context(), notify, changesPollInterval) {
+			return
+		}
+	}
+}
+
+// waitForChanges waits until notify is closed or pollInterval passed,
+// and returns true then. It returns false if ctx is done, or the server stops streaming.
+func (s *Server) waitForChanges(ctx context.Context, notify <-chan struct{}, pollInterval time.Duration) bool {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+
+	select {
+	case <-notify:
+		return true
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-s.streamsCtx.Done():
+		return false
+	}
+}
+
+// parseUintParam parses a query parameter, returning def if it's empty.
+func parseUintParam(s string, def uint64) (uint64, error) {
+	if s == "" {
+		return def, nil
+	}
+
+	return strconv.ParseUint(s, 10, 64)
+}
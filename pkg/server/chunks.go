@@ -0,0 +1,370 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/flokli/nix-casync/pkg/narcheck"
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/webhook"
+	"github.com/folbricht/desync"
+	"github.com/go-chi/chi/v5"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxChunkUploadSize limits the size of a single (compressed) chunk upload.
+const maxChunkUploadSize = 16 << 20
+
+// RegisterChunkHandlers registers handlers allowing clients to chunk NAR files themselves,
+// and only upload chunks not already in the store:
+//   - POST /_chunks/missing receives an index (caibx), and returns the IDs of all
+//     chunks referenced by it that are missing in the store.
+//   - PUT /_chunks/{chunkid} uploads a single (zstd-compressed) chunk.
+//   - PUT /_index/{narhash} receives the index of the NAR file.
+//     It's assembled from the chunks in the store, and stored if its hash matches narhash.
+//
+// This is only available if the blob store implements blobstore.ChunkedBlobStore.
+func (s *Server) RegisterChunkHandlers() {
+	if _, ok := s.blobStore.(blobstore.ChunkedBlobStore); !ok {
+		return
+	}
+
+	s.Handler.Post("/_chunks/missing", s.handleMissingChunks)
+	s.Handler.Put("/_chunks/{chunkid:^[0-9a-f]{64}$}", s.handleChunk)
+	s.Handler.Put("/_index/{narhash:^["+nixbase32.Alphabet+"]{52}$}", s.handleIndex)
+}
+
+func (s *Server) handleMissingChunks(w http.ResponseWriter, r *http.Request) {
+	chunkedBlobStore, _ := s.blobStore.(blobstore.ChunkedBlobStore)
+
+	index, err := desync.IndexFromReader(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse index: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	missing, err := chunkedBlobStore.MissingChunks(r.Context(), index)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error looking up chunks: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	resp := struct {
+		Missing []string `json:"missing"`
+	}{
+		Missing: make([]string, 0, len(missing)),
+	}
+
+	for _, id := range missing {
+		resp.Missing = append(resp.Missing, id.String())
+	}
+
+	writeJSON(w, resp, http.StatusOK)
+}
+
+func (s *Server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	chunkedBlobStore, _ := s.blobStore.(blobstore.ChunkedBlobStore)
+
+	if !s.checkQuota(w, r, contentLength(r)) || !s.admitUpload(w, 0) {
+		return
+	}
+
+	id, err := desync.ChunkIDFromString(chi.URLParam(r, "chunkid"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode chunk id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxChunkUploadSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading chunk: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	err = chunkedBlobStore.PutChunk(r.Context(), id, compressed)
+	if err != nil {
+		// the chunk didn't decompress, or didn't match its id.
+		var chunkInvalid desync.ChunkInvalid
+		if errors.As(err, &chunkInvalid) {
+			http.Error(w, fmt.Sprintf("Invalid chunk: %v", err), http.StatusBadRequest)
+
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("Error storing chunk: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	chunkedBlobStore, _ := s.blobStore.(blobstore.ChunkedBlobStore)
+
+	narhashStr := chi.URLParam(r, "narhash")
+
+	narhash, err := nixbase32.DecodeString(narhashStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode narHash %v: %v", narhashStr, err), http.StatusBadRequest)
+
+		return
+	}
+
+	index, err := desync.IndexFromReader(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to parse index: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	// the NAR file is assembled in the temp directory.
+	if !s.checkQuota(w, r, uint64(index.Length())) || !s.admitUpload(w, uint64(index.Length())) {
+		return
+	}
+
+	// the NAR file needs to be well-formed, which is checked before storing the index.
+	stats, err := s.checkIndexedNar(r.Context(), chunkedBlobStore, narhash, index)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error checking NAR file: %v", err), indexErrorStatus(err))
+
+		return
+	}
+
+	narSize, err := chunkedBlobStore.PutIndex(r.Context(), narhash, index)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error storing index: %v", err), indexErrorStatus(err))
+
+		return
+	}
+
+	narMeta, err := s.ensureNarMeta(r.Context(), narhash, narSize, stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// the chunks were uploaded before, so there are no dedup stats.
+	s.publish(&webhook.Event{
+		Type:    webhook.EventNarIngest,
+		NarHash: "sha256:" + nixbase32.EncodeToString(narMeta.NarHash),
+		NarSize: narMeta.Size,
+	})
+
+	writeJSON(w, struct {
+		NarHash string `json:"narHash"`
+		NarSize uint64 `json:"narSize"`
+	}{
+		NarHash: "sha256:" + nixbase32.EncodeToString(narMeta.NarHash),
+		NarSize: narMeta.Size,
+	}, http.StatusOK)
+}
+
+// checkIndexedNar reads the NAR file described by index from the chunks in the store, and returns its stats,
+// or an error wrapping narcheck.ErrInvalidNar if it isn't well-formed.
+// NAR files with a NarMeta were checked when they were uploaded, so nil is returned for them.
+func (s *Server) checkIndexedNar(
+	ctx context.Context,
+	chunkedBlobStore blobstore.ChunkedBlobStore,
+	narhash []byte,
+	index desync.Index,
+) (*narcheck.Stats, error) {
+	_, err := s.metadataStore.GetNarMeta(ctx, narhash)
+	if err == nil {
+		return nil, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error checking for existing NarMeta: %w", err)
+	}
+
+	return narcheck.Check(chunkedBlobStore.ReadIndex(ctx, index))
+}
+
+// indexErrorStatus returns the status code to respond with if checking or storing an index failed with err.
+func indexErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, blobstore.ErrChunksMissing):
+		return http.StatusConflict
+	case errors.Is(err, blobstore.ErrBlobMismatch), errors.Is(err, narcheck.ErrInvalidNar):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// RegisterCasyncHandlers registers handlers exposing chunks and indexes in the layout
+// desync and casync expect, so these clients can fetch only the chunks they lack:
+//   - GET/HEAD /castr/{xxxx}/{chunkid}.cacnk returns a (compressed) chunk.
+//     This allows using $url/castr as a chunk store.
+//   - GET/HEAD /caibx/{narhash}.caibx returns the index of a NAR file.
+//   - GET/HEAD /{outputhash}.caibx returns the index of the NAR file the .narinfo
+//     of the same name refers to.
+//
+// This is only available if the blob store implements blobstore.ChunkedBlobStore.
+func (s *Server) RegisterCasyncHandlers() {
+	if _, ok := s.blobStore.(blobstore.ChunkedBlobStore); !ok {
+		return
+	}
+
+	chunkPattern := "/castr/{prefix:^[0-9a-f]{4}$}/{chunkid:^[0-9a-f]{64}$}.cacnk"
+	s.Handler.Get(chunkPattern, s.handleCastrChunk)
+	s.Handler.Head(chunkPattern, s.handleCastrChunk)
+
+	indexPattern := "/caibx/{narhash:^[" + nixbase32.Alphabet + "]{52}$}.caibx"
+	s.Handler.Get(indexPattern, s.handleCaibx)
+	s.Handler.Head(indexPattern, s.handleCaibx)
+
+	narinfoIndexPattern := "/{outputhash:^[" + nixbase32.Alphabet + "]{32}}.caibx"
+	s.Handler.Get(narinfoIndexPattern, s.handleNarinfoCaibx)
+	s.Handler.Head(narinfoIndexPattern, s.handleNarinfoCaibx)
+}
+
+func (s *Server) handleCastrChunk(w http.ResponseWriter, r *http.Request) {
+	chunkedBlobStore, _ := s.blobStore.(blobstore.ChunkedBlobStore)
+
+	chunkidStr := chi.URLParam(r, "chunkid")
+	if chi.URLParam(r, "prefix") != chunkidStr[:4] {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+
+		return
+	}
+
+	id, err := desync.ChunkIDFromString(chunkidStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode chunk id: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	chunkReader, size, err := chunkedBlobStore.GetChunk(r.Context(), id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error retrieving chunk %v: %v", chunkidStr, err), notFoundOr500(err))
+
+		return
+	}
+	defer chunkReader.Close()
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Length", fmt.Sprintf("%d", size))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = io.Copy(w, chunkReader)
+	if err != nil {
+		log.Errorf("Error sending chunk to client: %v", err)
+	}
+}
+
+func (s *Server) handleCaibx(w http.ResponseWriter, r *http.Request) {
+	narhashStr := chi.URLParam(r, "narhash")
+
+	narhash, err := nixbase32.DecodeString(narhashStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode narHash %v: %v", narhashStr, err), http.StatusBadRequest)
+
+		return
+	}
+
+	s.serveIndex(w, r, narhash)
+}
+
+func (s *Server) handleNarinfoCaibx(w http.ResponseWriter, r *http.Request) {
+	outputhashStr := chi.URLParam(r, "outputhash")
+
+	outputhash, err := nixbase32.DecodeString(outputhashStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode outputhash: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	pathInfo, err := s.metadataStore.GetPathInfo(r.Context(), outputhash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting PathInfo: %v", err), notFoundOr500(err))
+
+		return
+	}
+
+	s.serveIndex(w, r, pathInfo.NarHash)
+}
+
+// serveIndex sends the index of the NAR file with the passed narhash.
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request, narhash []byte) {
+	chunkedBlobStore, _ := s.blobStore.(blobstore.ChunkedBlobStore)
+
+	index, err := chunkedBlobStore.GetIndex(r.Context(), narhash)
+	if err != nil {
+		http.Error(
+			w,
+			fmt.Sprintf("Error retrieving index for %v: %v", nixbase32.EncodeToString(narhash), err),
+			notFoundOr500(err),
+		)
+
+		return
+	}
+
+	var buf bytes.Buffer
+
+	_, err = index.WriteTo(&buf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to serialize index: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Length", fmt.Sprintf("%d", buf.Len()))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		log.Errorf("Unable to write index: %v", err)
+	}
+}
+
+// notFoundOr500 returns http.StatusNotFound if err is caused by something not existing,
+// http.StatusInternalServerError otherwise.
+func notFoundOr500(err error) int {
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// writeJSON sends v as JSON, with the passed status code.
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to serialize response: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_, err = w.Write(b)
+	if err != nil {
+		log.Errorf("Unable to write response: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/folbricht/desync"
+	"github.com/go-chi/chi/v5"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// RegisterClosureHandlers registers handlers reporting on the size of closures:
+//   - GET /_closure/{outputhash} returns all store paths in the closure of a store path,
+//     with their NAR sizes, the total size of the closure, and the bytes of all distinct chunks.
+//   - GET /_closure/{outputhash}?diff={otherhash} additionally returns the store paths
+//     and bytes that are only in one of both closures.
+//
+// Chunk bytes (the uncompressed size of all distinct chunks) are only reported
+// if the blob store implements blobstore.ChunkedBlobStore.
+// They show how much data actually needs to be stored or transferred,
+// as chunks shared between store paths only count once.
+func (s *Server) RegisterClosureHandlers() {
+	s.Handler.Get("/_closure/{outputhash:^["+nixbase32.Alphabet+"]{32}$}", s.handleClosure)
+}
+
+type closurePath struct {
+	StorePath string `json:"storePath"`
+	NarHash   string `json:"narHash"`
+	NarSize   uint64 `json:"narSize"`
+}
+
+type closureDiff struct {
+	StorePath string `json:"storePath"`
+
+	// Added are the store paths only in this closure, Removed the ones only in the other one.
+	Added          []string `json:"added"`
+	Removed        []string `json:"removed"`
+	AddedNarSize   uint64   `json:"addedNarSize"`
+	RemovedNarSize uint64   `json:"removedNarSize"`
+
+	// AddedChunkBytes are the bytes of chunks only in this closure,
+	// RemovedChunkBytes the ones of chunks only in the other one.
+	AddedChunkBytes   *uint64 `json:"addedChunkBytes,omitempty"`
+	RemovedChunkBytes *uint64 `json:"removedChunkBytes,omitempty"`
+}
+
+type closureResponse struct {
+	StorePath  string         `json:"storePath"`
+	Paths      []*closurePath `json:"paths"`
+	Missing    []string       `json:"missing"`
+	NarSize    uint64         `json:"narSize"`
+	ChunkBytes *uint64        `json:"chunkBytes,omitempty"`
+	Diff       *closureDiff   `json:"diff,omitempty"`
+}
+
+// closureInfo describes a closure, as used to compute the response.
+type closureInfo struct {
+	storePath string
+	entries   []*metadatastore.ClosureEntry
+	missing   []string
+
+	// chunks maps from the ID of all distinct chunks to their (uncompressed) size.
+	// It's nil if the blob store isn't chunked.
+	chunks map[desync.ChunkID]uint64
+}
+
+func (s *Server) handleClosure(w http.ResponseWriter, r *http.Request) {
+	outputhash, err := nixbase32.DecodeString(chi.URLParam(r, "outputhash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to decode outputhash: %v", err), http.StatusBadRequest)
+
+		return
+	}
+
+	closure, err := s.closureInfo(r.Context(), outputhash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting closure: %v", err), notFoundOr500(err))
+
+		return
+	}
+
+	resp := &closureResponse{
+		StorePath: closure.storePath,
+		Paths:     make([]*closurePath, 0, len(closure.entries)),
+		Missing:   closure.missing,
+	}
+
+	for _, entry := range closure.entries {
+		resp.Paths = append(resp.Paths, &closurePath{
+			StorePath: entry.PathInfo.StorePath(),
+			NarHash:   "sha256:" + nixbase32.EncodeToString(entry.NarMeta.NarHash),
+			NarSize:   entry.NarMeta.Size,
+		})
+		resp.NarSize += entry.NarMeta.Size
+	}
+
+	if closure.chunks != nil {
+		chunkBytes := sumChunks(closure.chunks, nil)
+		resp.ChunkBytes = &chunkBytes
+	}
+
+	if otherhashStr := r.URL.Query().Get("diff"); otherhashStr != "" {
+		otherhash, err := nixbase32.DecodeString(otherhashStr)
+		if err != nil || len(otherhash) != len(outputhash) {
+			http.Error(w, fmt.Sprintf("Unable to decode diff outputhash: %v", otherhashStr), http.StatusBadRequest)
+
+			return
+		}
+
+		other, err := s.closureInfo(r.Context(), otherhash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting closure to diff against: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		resp.Diff = diffClosures(closure, other)
+	}
+
+	writeJSON(w, resp, http.StatusOK)
+}
+
+// closureInfo walks the closure of outputhash,
+// and collects the chunks of all NAR files in it if the blob store is chunked.
+func (s *Server) closureInfo(ctx context.Context, outputhash []byte) (*closureInfo, error) {
+	entries, missing, err := metadatastore.Closure(ctx, s.metadataStore, outputhash)
+	if err != nil {
+		return nil, err
+	}
+
+	closure := &closureInfo{
+		entries: entries,
+		missing: missing,
+	}
+
+	// entries are sorted, look up the store path we were asked for
+	for _, entry := range entries {
+		if string(entry.PathInfo.OutputHash) == string(outputhash) {
+			closure.storePath = entry.PathInfo.StorePath()
+
+			break
+		}
+	}
+
+	chunkedBlobStore, ok := s.blobStore.(blobstore.ChunkedBlobStore)
+	if !ok {
+		return closure, nil
+	}
+
+	closure.chunks = make(map[desync.ChunkID]uint64)
+
+	for _, entry := range entries {
+		index, err := chunkedBlobStore.GetIndex(ctx, entry.NarMeta.NarHash)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get index of %v: %w", entry.PathInfo.StorePath(), err)
+		}
+
+		for _, chunk := range index.Chunks {
+			closure.chunks[chunk.ID] = chunk.Size
+		}
+	}
+
+	return closure, nil
+}
+
+// diffClosures returns the store paths and chunk bytes only in closure, or only in other.
+func diffClosures(closure, other *closureInfo) *closureDiff {
+	diff := &closureDiff{
+		StorePath: other.storePath,
+		Added:     []string{},
+		Removed:   []string{},
+	}
+
+	storePaths := func(c *closureInfo) map[string]struct{} {
+		m := make(map[string]struct{}, len(c.entries))
+		for _, entry := range c.entries {
+			m[entry.PathInfo.StorePath()] = struct{}{}
+		}
+
+		return m
+	}
+
+	closurePaths := storePaths(closure)
+	otherPaths := storePaths(other)
+
+	for _, entry := range closure.entries {
+		if _, ok := otherPaths[entry.PathInfo.StorePath()]; !ok {
+			diff.Added = append(diff.Added, entry.PathInfo.StorePath())
+			diff.AddedNarSize += entry.NarMeta.Size
+		}
+	}
+
+	for _, entry := range other.entries {
+		if _, ok := closurePaths[entry.PathInfo.StorePath()]; !ok {
+			diff.Removed = append(diff.Removed, entry.PathInfo.StorePath())
+			diff.RemovedNarSize += entry.NarMeta.Size
+		}
+	}
+
+	if closure.chunks != nil && other.chunks != nil {
+		addedChunkBytes := sumChunks(closure.chunks, other.chunks)
+		removedChunkBytes := sumChunks(other.chunks, closure.chunks)
+		diff.AddedChunkBytes = &addedChunkBytes
+		diff.RemovedChunkBytes = &removedChunkBytes
+	}
+
+	return diff
+}
+
+// sumChunks returns the total size of all chunks in chunks that aren't in exclude.
+func sumChunks(chunks, exclude map[desync.ChunkID]uint64) uint64 {
+	var sum uint64
+
+	for id, size := range chunks {
+		if _, ok := exclude[id]; !ok {
+			sum += size
+		}
+	}
+
+	return sum
+}
@@ -4,25 +4,109 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"runtime"
 
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 )
 
-// NewCompressor returns an io.WriteCloser that compresses its input.
+// CompressorOptions configures the compressors returned by NewCompressorWithOptions.
+type CompressorOptions struct {
+	// Levels maps from compression type to the compression level to use.
+	// Compression types not set use fast levels.
+	Levels map[string]int
+
+	// Concurrency is the number of goroutines compressing a single stream (zstd and gzip only).
+	// 0 uses GOMAXPROCS, 1 disables parallel compression.
+	Concurrency int
+}
+
+// compressionLevels contains the default, minimum and maximum compression level per compression type.
+var compressionLevels = map[string]struct{ def, min, max int }{ //nolint:gochecknoglobals
+	"br":   {def: brotli.BestSpeed, min: brotli.BestSpeed, max: brotli.BestCompression},
+	"gzip": {def: gzip.BestSpeed, min: gzip.BestSpeed, max: gzip.BestCompression},
+	"zstd": {def: 3, min: 1, max: 22},
+}
+
+// Validate checks the compression levels are valid for their compression types.
+func (o CompressorOptions) Validate() error {
+	for compressionType, level := range o.Levels {
+		levels, ok := compressionLevels[compressionType]
+		if !ok {
+			return fmt.Errorf("unsupported compression type: %v", compressionType)
+		}
+
+		if level < levels.min || level > levels.max {
+			return fmt.Errorf("invalid compression level for %v: %d (needs to be between %d and %d)",
+				compressionType, level, levels.min, levels.max)
+		}
+	}
+
+	if o.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency: %d", o.Concurrency)
+	}
+
+	return nil
+}
+
+func (o CompressorOptions) level(compressionType string) int {
+	if level, ok := o.Levels[compressionType]; ok {
+		return level
+	}
+
+	return compressionLevels[compressionType].def
+}
+
+func (o CompressorOptions) concurrency() int {
+	if o.Concurrency == 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+
+	return o.Concurrency
+}
+
+// NewCompressor returns an io.WriteCloser that compresses its input, using the default options.
 // The compression type needs to be specified upfront.
 // Only cheap compression is supported, as this is assembled on the fly, and acts as a poorman's content-encoding.
 // It's the callers responsibility to close the reader when done.
 func NewCompressor(w io.Writer, compressionType string) (io.WriteCloser, error) {
+	return NewCompressorWithOptions(w, compressionType, CompressorOptions{})
+}
+
+// NewCompressorWithOptions returns an io.WriteCloser that compresses its input,
+// with the compression level and concurrency configured in opts.
+// zstd and gzip compress in parallel, so a single download isn't limited by the speed of one core.
+func NewCompressorWithOptions(w io.Writer, compressionType string, opts CompressorOptions) (io.WriteCloser, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
 	switch compressionType {
 	case "br":
-		b := brotli.NewWriterLevel(w, brotli.BestSpeed)
-
-		return b, nil
+		return brotli.NewWriterLevel(w, opts.level("br")), nil
 	case "gzip":
-		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+		if opts.concurrency() == 1 {
+			return gzip.NewWriterLevel(w, opts.level("gzip"))
+		}
+
+		gzipWriter, err := pgzip.NewWriterLevel(w, opts.level("gzip"))
+		if err != nil {
+			return nil, err
+		}
+
+		// compress blocks of 1MiB in parallel
+		err = gzipWriter.SetConcurrency(1<<20, opts.concurrency())
+		if err != nil {
+			return nil, err
+		}
+
+		return gzipWriter, nil
 	case "zstd":
-		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.level("zstd"))),
+			zstd.WithEncoderConcurrency(opts.concurrency()),
+		)
 	}
 
 	return nil, fmt.Errorf("unsupported compression type: %v", compressionType)
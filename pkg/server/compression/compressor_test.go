@@ -0,0 +1,148 @@
+package compression_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/stretchr/testify/assert"
+)
+
+// compressibleData returns size bytes of pseudo-random words, which compress about as well as usual NAR files.
+func compressibleData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1)) //nolint:gosec
+
+	words := make([][]byte, 4096)
+	for i := range words {
+		words[i] = make([]byte, 2+rnd.Intn(10))
+		rnd.Read(words[i])
+	}
+
+	b := make([]byte, 0, size+16)
+	for len(b) < size {
+		b = append(b, words[rnd.Intn(len(words))]...)
+	}
+
+	return b[:size]
+}
+
+func TestCompressor(t *testing.T) {
+	data := compressibleData(4 << 20)
+
+	for _, compressionType := range []string{"br", "gzip", "zstd"} {
+		for _, concurrency := range []int{1, 4} {
+			compressionType, concurrency := compressionType, concurrency
+
+			t.Run(fmt.Sprintf("%v/concurrency=%d", compressionType, concurrency), func(t *testing.T) {
+				var buf bytes.Buffer
+
+				w, err := compression.NewCompressorWithOptions(&buf, compressionType, compression.CompressorOptions{
+					Levels:      map[string]int{compressionType: 5},
+					Concurrency: concurrency,
+				})
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				_, err = w.Write(data)
+				assert.NoError(t, err)
+				assert.NoError(t, w.Close())
+				assert.Less(t, buf.Len(), len(data))
+
+				r, err := compression.NewDecompressor(&buf, compressionType)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer r.Close()
+
+				b, err := io.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, data, b)
+			})
+		}
+	}
+
+	t.Run("invalid options", func(t *testing.T) {
+		for _, opts := range []compression.CompressorOptions{
+			{Levels: map[string]int{"zstd": 23}},
+			{Levels: map[string]int{"gzip": 0}},
+			{Levels: map[string]int{"br": 12}},
+			{Levels: map[string]int{"xz": 6}},
+			{Concurrency: -1},
+		} {
+			assert.Error(t, opts.Validate(), opts)
+
+			_, err := compression.NewCompressorWithOptions(io.Discard, "zstd", opts)
+			assert.Error(t, err, opts)
+		}
+	})
+}
+
+// BenchmarkCompressor measures the throughput of compressing a NAR file with each compression type,
+// at various levels, with and without parallel compression.
+// Run with `go test -bench=Compressor ./pkg/server/compression`.
+func BenchmarkCompressor(b *testing.B) {
+	data := compressibleData(16 << 20)
+
+	for _, bm := range []struct {
+		compressionType string
+		levels          []int
+		concurrencies   []int
+	}{
+		{compressionType: "zstd", levels: []int{1, 3, 7, 11, 19}, concurrencies: []int{1, 0}},
+		{compressionType: "gzip", levels: []int{1, 6, 9}, concurrencies: []int{1, 0}},
+		{compressionType: "br", levels: []int{0, 4, 6}, concurrencies: []int{1}}, // brotli is single-threaded
+	} {
+		for _, level := range bm.levels {
+			for _, concurrency := range bm.concurrencies {
+				opts := compression.CompressorOptions{
+					Levels:      map[string]int{bm.compressionType: level},
+					Concurrency: concurrency,
+				}
+
+				name := fmt.Sprintf("%v/level=%d/concurrency=%d", bm.compressionType, level, concurrency)
+
+				b.Run(name, func(b *testing.B) {
+					b.SetBytes(int64(len(data)))
+
+					var compressedSize int
+
+					for i := 0; i < b.N; i++ {
+						cw := &countingWriter{}
+
+						w, err := compression.NewCompressorWithOptions(cw, bm.compressionType, opts)
+						if err != nil {
+							b.Fatal(err)
+						}
+
+						if _, err := w.Write(data); err != nil {
+							b.Fatal(err)
+						}
+
+						if err := w.Close(); err != nil {
+							b.Fatal(err)
+						}
+
+						compressedSize = cw.n
+					}
+
+					b.ReportMetric(float64(compressedSize)/float64(len(data)), "ratio")
+				})
+			}
+		}
+	}
+}
+
+// countingWriter discards everything written to it, but counts the number of bytes.
+type countingWriter struct {
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+
+	return len(p), nil
+}
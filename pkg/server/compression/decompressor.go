@@ -1,6 +1,8 @@
 package compression
 
 import (
+	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"fmt"
@@ -10,20 +12,33 @@ import (
 	"github.com/klauspost/compress/zstd"
 	"github.com/pierrec/lz4"
 	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
 )
 
 // compressionSuffixToType maps from the compression suffix Nix uses when uploading to the compression type.
 var compressionSuffixToType = map[string]string{ //nolint:gochecknoglobals
 	"":      "none",
+	".Z":    "compress",
 	".br":   "br",
 	".bz2":  "bzip2",
 	".gz":   "gzip", // keep in mind nix defaults to gzip if Compression: field is unset or empty string
 	".lz4":  "lz4",
 	".lzip": "lzip",
+	".lzma": "lzma",
+	".lzo":  "lzop",
 	".xz":   "xz",
 	".zst":  "zstd",
 }
 
+// SuffixToType returns the compression type for a compression suffix.
+func SuffixToType(compressionSuffix string) (string, error) {
+	if compressionType, ok := compressionSuffixToType[compressionSuffix]; ok {
+		return compressionType, nil
+	}
+
+	return "", fmt.Errorf("unknown compression suffix: %v", compressionSuffix)
+}
+
 func TypeToSuffix(compressionType string) (string, error) {
 	for compressionSuffix, aCompressionType := range compressionSuffixToType {
 		if aCompressionType == compressionType {
@@ -49,6 +64,13 @@ func NewDecompressor(r io.Reader, compressionType string) (io.ReadCloser, error)
 		return io.NopCloser(brotli.NewReader(r)), nil
 	case "bzip2":
 		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "compress":
+		lzwReader, err := newLzwReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(lzwReader), nil
 	case "gzip":
 		gzipReader, err := gzip.NewReader(r)
 		if err != nil {
@@ -58,6 +80,27 @@ func NewDecompressor(r io.Reader, compressionType string) (io.ReadCloser, error)
 		return gzipReader, nil
 	case "lz4":
 		return io.NopCloser(lz4.NewReader(r)), nil
+	case "lzip":
+		lzipReader, err := newLzipReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(lzipReader), nil
+	case "lzma":
+		lzmaReader, err := lzma.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(lzmaReader), nil
+	case "lzop":
+		lzopReader, err := newLzopReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return io.NopCloser(lzopReader), nil
 	case "xz":
 		xzReader, err := xz.NewReader(r)
 		if err != nil {
@@ -74,10 +117,49 @@ func NewDecompressor(r io.Reader, compressionType string) (io.ReadCloser, error)
 		return io.NopCloser(zstdr), nil
 	}
 
-	// compress, grzip, lzrzip, lzip, lzop, lzma
+	// grzip and lrzip are not supported, as they're rarely used, and there's no pure Go implementation.
 	return nil, fmt.Errorf("unsupported compression type: %v", compressionType)
 }
 
+// compressionMagics maps from the magic bytes at the start of a file to the compression type.
+// Uncompressed NAR files start with the NAR magic.
+var compressionMagics = []struct { //nolint:gochecknoglobals
+	magic           []byte
+	compressionType string
+}{
+	{[]byte("\x0d\x00\x00\x00\x00\x00\x00\x00nix-archive-1"), "none"},
+	{[]byte("\x1f\x8b"), "gzip"},
+	{[]byte("\x1f\x9d"), "compress"},
+	{[]byte("\x89LZO\x00\x0d\x0a\x1a\x0a"), "lzop"},
+	{[]byte("LZIP"), "lzip"},
+	{[]byte("\xfd7zXZ\x00"), "xz"},
+	{[]byte("BZh"), "bzip2"},
+	{[]byte("\x28\xb5\x2f\xfd"), "zstd"},
+	{[]byte("\x04\x22\x4d\x18"), "lz4"},
+	// lzma has no magic, but the default properties (lc=3, lp=0, pb=2) and a dictionary size of at least 64KiB
+	{[]byte("\x5d\x00\x00"), "lzma"},
+}
+
+// NewDecompressorByMagic decompresses contents from an io.Reader,
+// detecting the compression type by the first bytes.
+// Nix doesn't add a suffix when uploading with some compression types (such as gzip, lzma, lzop or compress),
+// so this is used for uploads without a suffix.
+// Contents not matching any known magic are assumed to be uncompressed.
+func NewDecompressorByMagic(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	// errors are returned on the first read, short contents are fine.
+	header, _ := br.Peek(len(compressionMagics[0].magic))
+
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(header, m.magic) {
+			return NewDecompressor(br, m.compressionType)
+		}
+	}
+
+	return NewDecompressor(br, "none")
+}
+
 func NewDecompressorBySuffix(r io.Reader, compressionSuffix string) (io.ReadCloser, error) {
 	// try to lookup the compression type from compressionSuffixToType
 	if compressionType, ok := compressionSuffixToType[compressionSuffix]; ok {
@@ -0,0 +1,122 @@
+package compression_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func decompress(compressed []byte, compressionType string) ([]byte, error) {
+	r, err := compression.NewDecompressor(bytes.NewReader(compressed), compressionType)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// TestDecompressor decompresses the fixtures in //test/nar,
+// see //test/generator/compress-nars.sh.
+func TestDecompressor(t *testing.T) {
+	for name, td := range test.GetTestDataTable() {
+		for compressionType, compressed := range td.CompressedNarContents {
+			compressionType, compressed := compressionType, compressed
+
+			t.Run(name+"/"+compressionType, func(t *testing.T) {
+				b, err := decompress(compressed, compressionType)
+				if assert.NoError(t, err) {
+					assert.Equal(t, td.NarContents, b)
+				}
+			})
+		}
+	}
+
+	tdB, exists := test.GetTestDataTable()["b"]
+	if !exists {
+		panic("testData[b] doesn't exist")
+	}
+
+	for _, compressionType := range []string{"lzip", "lzma", "lzop", "compress"} {
+		compressed := tdB.CompressedNarContents[compressionType]
+
+		t.Run("truncated/"+compressionType, func(t *testing.T) {
+			b, err := decompress(compressed[:len(compressed)/2], compressionType)
+			// compress has no checksum or end marker, so it can't detect truncation.
+			if compressionType == "compress" {
+				assert.NoError(t, err)
+				assert.Equal(t, tdB.NarContents[:len(b)], b)
+
+				return
+			}
+
+			assert.Error(t, err)
+		})
+
+		t.Run("invalid header/"+compressionType, func(t *testing.T) {
+			_, err := decompress([]byte("foobarbaz"), compressionType)
+			assert.Error(t, err)
+		})
+	}
+
+	// lzip and lzop contain checksums, so corruption is detected
+	t.Run("corrupt/lzip", func(t *testing.T) {
+		compressed := append([]byte{}, tdB.CompressedNarContents["lzip"]...)
+		compressed[len(compressed)-20] ^= 0xff // the CRC32 in the trailer
+
+		_, err := decompress(compressed, "lzip")
+		assert.Error(t, err)
+	})
+
+	t.Run("corrupt/lzop", func(t *testing.T) {
+		compressed := append([]byte{}, tdB.CompressedNarContents["lzop"]...)
+		compressed[len(compressed)-5] ^= 0xff // the end of the last block, before the end marker
+
+		_, err := decompress(compressed, "lzop")
+		assert.Error(t, err)
+	})
+
+	t.Run("by magic", func(t *testing.T) {
+		for compressionType, compressed := range tdB.CompressedNarContents {
+			r, err := compression.NewDecompressorByMagic(bytes.NewReader(compressed))
+			if !assert.NoError(t, err, compressionType) {
+				continue
+			}
+
+			b, err := io.ReadAll(r)
+			assert.NoError(t, err, compressionType)
+			assert.Equal(t, tdB.NarContents, b, compressionType)
+		}
+
+		// uncompressed NAR files are passed through
+		r, err := compression.NewDecompressorByMagic(bytes.NewReader(tdB.NarContents))
+		if assert.NoError(t, err) {
+			b, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tdB.NarContents, b)
+		}
+	})
+
+	// see test.LargeNar for what it covers.
+	largeNar := test.LargeNar()
+
+	for compressionType, compressed := range test.GetCompressedLargeNar() {
+		compressionType, compressed := compressionType, compressed
+
+		t.Run("large/"+compressionType, func(t *testing.T) {
+			b, err := decompress(compressed, compressionType)
+			if assert.NoError(t, err) {
+				assert.Equal(t, largeNar, b)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := compression.NewDecompressor(bytes.NewReader(nil), "lrzip")
+		assert.Error(t, err)
+	})
+}
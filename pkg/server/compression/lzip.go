@@ -0,0 +1,226 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// lzipMagic is at the start of every lzip member.
+var lzipMagic = []byte("LZIP") //nolint:gochecknoglobals
+
+const (
+	lzipHeaderLen  = 6
+	lzipTrailerLen = 20
+)
+
+var errLzipTrailingData = errors.New("lzip: trailing data after last member")
+
+// lzipReader decompresses lzip files, which consist of one or more members,
+// each containing a LZMA stream, followed by a trailer with the CRC32 and size of the uncompressed data.
+type lzipReader struct {
+	r *countingReader
+
+	member   *lzma.Reader
+	crc      hash.Hash32
+	dataSize uint64
+}
+
+func newLzipReader(r io.Reader) (*lzipReader, error) {
+	lr := &lzipReader{
+		r:   &countingReader{r: bufio.NewReader(r)},
+		crc: crc32.NewIEEE(),
+	}
+
+	if err := lr.nextMember(true); err != nil {
+		return nil, err
+	}
+
+	return lr, nil
+}
+
+// nextMember reads the header of the next member, and sets up decompression.
+// It returns io.EOF if there's no other member (and this isn't the first one).
+func (lr *lzipReader) nextMember(first bool) error {
+	// the member size in the trailer includes the header
+	lr.r.n = 0
+
+	header := make([]byte, lzipHeaderLen)
+
+	n, err := io.ReadFull(lr.r, header)
+	if err != nil {
+		if !first && n == 0 && errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+
+		return fmt.Errorf("lzip: unable to read header: %w", err)
+	}
+
+	if !bytes.Equal(header[:4], lzipMagic) {
+		if !first {
+			return errLzipTrailingData
+		}
+
+		return errors.New("lzip: invalid magic")
+	}
+
+	if header[4] != 1 {
+		return fmt.Errorf("lzip: unsupported version %d", header[4])
+	}
+
+	// The dictionary size is a power of two (between 4KiB and 512MiB),
+	// minus 0-7 sixteenths of it.
+	exp := uint(header[5] & 0x1f)
+	if exp < 12 || exp > 29 {
+		return fmt.Errorf("lzip: invalid dictionary size")
+	}
+
+	dictSize := uint32(1) << exp
+	dictSize -= (dictSize / 16) * uint32(header[5]>>5)
+
+	// lzip uses LZMA with fixed properties (lc=3, lp=0, pb=2) and an end marker,
+	// so we can prepend a header in the classic LZMA format with unknown size.
+	lzmaHeader := make([]byte, lzma.HeaderLen)
+	lzmaHeader[0] = 0x5d
+	binary.LittleEndian.PutUint32(lzmaHeader[1:5], dictSize)
+	binary.LittleEndian.PutUint64(lzmaHeader[5:], ^uint64(0))
+
+	// The LZMA reader reads byte by byte if it can,
+	// so it doesn't consume anything of the trailer.
+	lr.member, err = lzma.NewReader(&prefixedByteReader{prefix: lzmaHeader, r: lr.r})
+	if err != nil {
+		return fmt.Errorf("lzip: %w", err)
+	}
+
+	lr.crc.Reset()
+	lr.dataSize = 0
+
+	return nil
+}
+
+// checkTrailer reads the trailer of the current member, and compares it with what was read.
+func (lr *lzipReader) checkTrailer() error {
+	memberSize := lr.r.n + lzipTrailerLen
+
+	trailer := make([]byte, lzipTrailerLen)
+	if _, err := io.ReadFull(lr.r, trailer); err != nil {
+		return fmt.Errorf("lzip: unable to read trailer: %w", err)
+	}
+
+	if binary.LittleEndian.Uint32(trailer[0:4]) != lr.crc.Sum32() {
+		return errors.New("lzip: CRC mismatch")
+	}
+
+	if binary.LittleEndian.Uint64(trailer[4:12]) != lr.dataSize {
+		return errors.New("lzip: data size mismatch")
+	}
+
+	if binary.LittleEndian.Uint64(trailer[12:20]) != memberSize {
+		return errors.New("lzip: member size mismatch")
+	}
+
+	return nil
+}
+
+func (lr *lzipReader) Read(p []byte) (int, error) {
+	for {
+		if lr.member == nil {
+			return 0, io.EOF
+		}
+
+		n, err := lr.member.Read(p)
+		lr.crc.Write(p[:n])
+		lr.dataSize += uint64(n)
+
+		if errors.Is(err, io.EOF) {
+			if err := lr.checkTrailer(); err != nil {
+				return n, err
+			}
+
+			if err := lr.nextMember(false); err != nil {
+				lr.member = nil
+
+				if errors.Is(err, io.EOF) {
+					if n > 0 {
+						return n, nil
+					}
+
+					return 0, io.EOF
+				}
+
+				return n, err
+			}
+
+			if n > 0 {
+				return n, nil
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return n, fmt.Errorf("lzip: %w", err)
+		}
+
+		return n, nil
+	}
+}
+
+// countingReader is a io.ByteReader, which counts the number of bytes read.
+type countingReader struct {
+	r *bufio.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+
+	return b, err
+}
+
+// prefixedByteReader returns the bytes of prefix, then the ones from r.
+type prefixedByteReader struct {
+	prefix []byte
+	r      io.ByteReader
+}
+
+func (p *prefixedByteReader) ReadByte() (byte, error) {
+	if len(p.prefix) > 0 {
+		b := p.prefix[0]
+		p.prefix = p.prefix[1:]
+
+		return b, nil
+	}
+
+	return p.r.ReadByte()
+}
+
+func (p *prefixedByteReader) Read(b []byte) (int, error) {
+	for i := range b {
+		c, err := p.ReadByte()
+		if err != nil {
+			return i, err
+		}
+
+		b[i] = c
+	}
+
+	return len(b), nil
+}
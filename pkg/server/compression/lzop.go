@@ -0,0 +1,516 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"io"
+)
+
+// lzopMagic is at the start of every lzop file.
+var lzopMagic = []byte{0x89, 'L', 'Z', 'O', 0x00, 0x0d, 0x0a, 0x1a, 0x0a} //nolint:gochecknoglobals
+
+// flags in the lzop header.
+const (
+	lzopFlagAdler32D    = 0x00000001
+	lzopFlagAdler32C    = 0x00000002
+	lzopFlagExtraField  = 0x00000040
+	lzopFlagCRC32D      = 0x00000100
+	lzopFlagCRC32C      = 0x00000200
+	lzopFlagFilter      = 0x00000800
+	lzopFlagHeaderCRC32 = 0x00001000
+)
+
+// lzopMaxBlockSize is the maximum size of an uncompressed block, as defined by lzop.
+const lzopMaxBlockSize = 64 * 1024 * 1024
+
+var errLzopCorrupt = errors.New("lzop: corrupt input")
+
+// lzopReader decompresses files created by lzop.
+// These consist of a header, followed by blocks compressed with LZO1X.
+type lzopReader struct {
+	r     *bufio.Reader
+	flags uint32
+
+	// buf contains the remaining contents of the current block.
+	buf []byte
+
+	// uncompressed and compressed keep the memory of the last blocks around.
+	uncompressed []byte
+	compressed   []byte
+
+	eof bool
+}
+
+func newLzopReader(r io.Reader) (*lzopReader, error) {
+	lr := &lzopReader{
+		r: bufio.NewReader(r),
+	}
+
+	if err := lr.readHeader(); err != nil {
+		return nil, err
+	}
+
+	return lr, nil
+}
+
+// readHeader reads and checks the lzop header.
+func (lr *lzopReader) readHeader() error {
+	magic := make([]byte, len(lzopMagic))
+	if _, err := io.ReadFull(lr.r, magic); err != nil {
+		return fmt.Errorf("lzop: unable to read header: %w", err)
+	}
+
+	if !bytes.Equal(magic, lzopMagic) {
+		return errors.New("lzop: invalid magic")
+	}
+
+	// The header checksum covers everything from the version field up to the file name,
+	// so keep what's read in a buffer.
+	var header bytes.Buffer
+
+	hr := io.TeeReader(lr.r, &header)
+
+	var err error
+
+	// read reads a big endian field, unless a previous one failed.
+	read := func(v interface{}) {
+		if err == nil {
+			err = binary.Read(hr, binary.BigEndian, v)
+		}
+	}
+
+	var version, libVersion, versionNeeded uint16
+
+	var method, level, nameLen uint8
+
+	var flags, filter, mode, mtimeLow, mtimeHigh uint32
+
+	read(&version)
+	read(&libVersion)
+
+	if version >= 0x0940 {
+		read(&versionNeeded)
+	}
+
+	read(&method)
+
+	if version >= 0x0940 {
+		read(&level)
+	}
+
+	read(&flags)
+
+	if flags&lzopFlagFilter != 0 {
+		read(&filter)
+	}
+
+	read(&mode)
+	read(&mtimeLow)
+
+	if version >= 0x0940 {
+		read(&mtimeHigh)
+	}
+
+	read(&nameLen)
+
+	if err == nil {
+		_, err = io.CopyN(io.Discard, hr, int64(nameLen))
+	}
+
+	if err != nil {
+		return fmt.Errorf("lzop: unable to read header: %w", noEOF(err))
+	}
+
+	if versionNeeded > 0x1040 {
+		return fmt.Errorf("lzop: unsupported version %x", versionNeeded)
+	}
+
+	// All methods (LZO1X-1, LZO1X-1(15) and LZO1X-999) produce LZO1X.
+	if method < 1 || method > 3 {
+		return fmt.Errorf("lzop: unsupported method %d", method)
+	}
+
+	if flags&lzopFlagFilter != 0 {
+		return errors.New("lzop: filters are not supported")
+	}
+
+	var headerChecksum uint32
+	if err := binary.Read(lr.r, binary.BigEndian, &headerChecksum); err != nil {
+		return fmt.Errorf("lzop: unable to read header: %w", err)
+	}
+
+	if newLzopChecksum(flags&lzopFlagHeaderCRC32 != 0, header.Bytes()) != headerChecksum {
+		return errors.New("lzop: header checksum mismatch")
+	}
+
+	if flags&lzopFlagExtraField != 0 {
+		var extraLen uint32
+		if err := binary.Read(lr.r, binary.BigEndian, &extraLen); err != nil {
+			return fmt.Errorf("lzop: unable to read extra field: %w", err)
+		}
+
+		// skip the extra field, and its checksum
+		if _, err := io.CopyN(io.Discard, lr.r, int64(extraLen)+4); err != nil {
+			return fmt.Errorf("lzop: unable to read extra field: %w", err)
+		}
+	}
+
+	lr.flags = flags
+
+	return nil
+}
+
+// newLzopChecksum calculates the checksum lzop uses for b (adler32 or crc32).
+func newLzopChecksum(useCRC32 bool, b []byte) uint32 {
+	var h hash.Hash32
+	if useCRC32 {
+		h = crc32.NewIEEE()
+	} else {
+		h = adler32.New()
+	}
+
+	h.Write(b)
+
+	return h.Sum32()
+}
+
+// readChecksums reads the checksums present according to the adler32 and crc32 flag.
+func (lr *lzopReader) readChecksums(adler32Flag, crc32Flag uint32) (*uint32, *uint32, error) {
+	var adler, crc *uint32
+
+	for _, c := range []struct {
+		flag uint32
+		dst  **uint32
+	}{{adler32Flag, &adler}, {crc32Flag, &crc}} {
+		if lr.flags&c.flag == 0 {
+			continue
+		}
+
+		var v uint32
+		if err := binary.Read(lr.r, binary.BigEndian, &v); err != nil {
+			return nil, nil, err
+		}
+
+		*c.dst = &v
+	}
+
+	return adler, crc, nil
+}
+
+// verifyLzopChecksums compares b with the checksums read by readChecksums.
+func verifyLzopChecksums(b []byte, adler, crc *uint32) error {
+	if adler != nil && *adler != newLzopChecksum(false, b) {
+		return errors.New("lzop: adler32 mismatch")
+	}
+
+	if crc != nil && *crc != newLzopChecksum(true, b) {
+		return errors.New("lzop: crc32 mismatch")
+	}
+
+	return nil
+}
+
+// nextBlock reads and decompresses the next block into lr.buf.
+func (lr *lzopReader) nextBlock() error {
+	var dstLen uint32
+	if err := binary.Read(lr.r, binary.BigEndian, &dstLen); err != nil {
+		return fmt.Errorf("lzop: unable to read block: %w", noEOF(err))
+	}
+
+	// a block with size 0 marks the end of the file
+	if dstLen == 0 {
+		lr.eof = true
+
+		return nil
+	}
+
+	var srcLen uint32
+	if err := binary.Read(lr.r, binary.BigEndian, &srcLen); err != nil {
+		return fmt.Errorf("lzop: unable to read block: %w", noEOF(err))
+	}
+
+	if dstLen > lzopMaxBlockSize || srcLen > dstLen {
+		return errLzopCorrupt
+	}
+
+	dAdler, dCRC, err := lr.readChecksums(lzopFlagAdler32D, lzopFlagCRC32D)
+	if err != nil {
+		return fmt.Errorf("lzop: unable to read block: %w", noEOF(err))
+	}
+
+	// compressed checksums are only present for compressed blocks
+	var cAdler, cCRC *uint32
+
+	if srcLen < dstLen {
+		cAdler, cCRC, err = lr.readChecksums(lzopFlagAdler32C, lzopFlagCRC32C)
+		if err != nil {
+			return fmt.Errorf("lzop: unable to read block: %w", noEOF(err))
+		}
+	}
+
+	if cap(lr.compressed) < int(srcLen) {
+		lr.compressed = make([]byte, srcLen)
+	}
+
+	src := lr.compressed[:srcLen]
+	if _, err := io.ReadFull(lr.r, src); err != nil {
+		return fmt.Errorf("lzop: unable to read block: %w", noEOF(err))
+	}
+
+	if srcLen == dstLen {
+		// stored uncompressed
+		lr.buf = src
+	} else {
+		if err := verifyLzopChecksums(src, cAdler, cCRC); err != nil {
+			return err
+		}
+
+		if cap(lr.uncompressed) < int(dstLen) {
+			lr.uncompressed = make([]byte, dstLen)
+		}
+
+		lr.buf = lr.uncompressed[:dstLen]
+
+		if err := lzo1xDecompress(src, lr.buf); err != nil {
+			return err
+		}
+	}
+
+	return verifyLzopChecksums(lr.buf, dAdler, dCRC)
+}
+
+func (lr *lzopReader) Read(p []byte) (int, error) {
+	for len(lr.buf) == 0 {
+		if lr.eof {
+			return 0, io.EOF
+		}
+
+		if err := lr.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, lr.buf)
+	lr.buf = lr.buf[n:]
+
+	return n, nil
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for places where more data is expected.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// lzo1xDecompress decompresses LZO1X compressed data from src into dst,
+// which needs to have exactly the size of the uncompressed data.
+func lzo1xDecompress(src, dst []byte) error {
+	var ip, op int
+
+	// The decoder needs to keep track of how many literals were copied after the last match,
+	// as short matches are encoded differently after literals.
+	// state is 0 (no literals), 1-3 or 4 (more than 3 literals).
+	var state int
+
+	readByte := func() (int, error) {
+		if ip >= len(src) {
+			return 0, errLzopCorrupt
+		}
+
+		b := src[ip]
+		ip++
+
+		return int(b), nil
+	}
+
+	// readLength reads the zero-extended part of a length, and adds base to it.
+	readLength := func(base int) (int, error) {
+		length := base
+
+		for {
+			b, err := readByte()
+			if err != nil {
+				return 0, err
+			}
+
+			if b != 0 {
+				return length + b, nil
+			}
+
+			length += 255
+			if length > len(dst) {
+				return 0, errLzopCorrupt
+			}
+		}
+	}
+
+	copyLiterals := func(n int) error {
+		if ip+n > len(src) || op+n > len(dst) {
+			return errLzopCorrupt
+		}
+
+		copy(dst[op:], src[ip:ip+n])
+		ip += n
+		op += n
+
+		return nil
+	}
+
+	copyMatch := func(distance, length int) error {
+		if distance <= 0 || distance > op || op+length > len(dst) {
+			return errLzopCorrupt
+		}
+
+		// matches can overlap with their output, so copy byte by byte
+		for i := 0; i < length; i++ {
+			dst[op] = dst[op-distance]
+			op++
+		}
+
+		return nil
+	}
+
+	t, err := readByte()
+	if err != nil {
+		return err
+	}
+
+	// the first byte can encode a literal run
+	if t > 17 {
+		t -= 17
+		if err := copyLiterals(t); err != nil {
+			return err
+		}
+
+		if t < 4 {
+			state = t
+		} else {
+			state = 4
+		}
+	} else {
+		ip--
+	}
+
+	for {
+		t, err := readByte()
+		if err != nil {
+			return err
+		}
+
+		var distance, length, next int
+
+		switch {
+		case t < 16 && state == 0:
+			// a run of literals
+			length = t + 3
+			if t == 0 {
+				if length, err = readLength(18); err != nil {
+					return err
+				}
+			}
+
+			if err := copyLiterals(length); err != nil {
+				return err
+			}
+
+			state = 4
+
+			continue
+		case t < 16:
+			// a short match, with different meanings after 1-3 or more literals
+			b, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			next = t & 3
+			distance = 1 + t>>2 + b<<2
+			length = 2
+
+			if state == 4 {
+				distance += 0x0800
+				length = 3
+			}
+		case t >= 64:
+			b, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			next = t & 3
+			distance = 1 + (t>>2)&7 + b<<3
+			length = t>>5 + 1
+		case t >= 32:
+			length = t&31 + 2
+			if length == 2 {
+				if length, err = readLength(33); err != nil {
+					return err
+				}
+			}
+
+			b0, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			b1, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			next = b0 & 3
+			distance = 1 + (b0>>2 | b1<<6)
+		default: // 16-31
+			length = t&7 + 2
+			if length == 2 {
+				if length, err = readLength(9); err != nil {
+					return err
+				}
+			}
+
+			b0, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			b1, err := readByte()
+			if err != nil {
+				return err
+			}
+
+			next = b0 & 3
+			distance = (t&8)<<11 + (b0>>2 | b1<<6)
+
+			// a distance of 0 marks the end of the stream
+			if distance == 0 {
+				if length != 3 || ip != len(src) || op != len(dst) {
+					return errLzopCorrupt
+				}
+
+				return nil
+			}
+
+			distance += 0x4000
+		}
+
+		if err := copyMatch(distance, length); err != nil {
+			return err
+		}
+
+		// up to 3 literals can follow a match
+		if err := copyLiterals(next); err != nil {
+			return err
+		}
+
+		state = next
+	}
+}
@@ -0,0 +1,251 @@
+package compression
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// compressMagic is at the start of files created by Unix compress.
+var compressMagic = []byte{0x1f, 0x9d} //nolint:gochecknoglobals
+
+const (
+	lzwInitBits = 9
+	lzwMaxBits  = 16
+	lzwClear    = 256
+)
+
+var errLzwCorrupt = errors.New("compress: corrupt input")
+
+// lzwReader decompresses files created by Unix compress (.Z).
+// This uses LZW with variable code widths of 9 to 16 bits, so Go's compress/lzw can't be used.
+type lzwReader struct {
+	r *bufio.Reader
+
+	maxBits   int
+	blockMode bool // whether a clear code resets the table
+
+	// bit buffer, and number of bits read since the code width last changed.
+	bits    uint32
+	nBits   int
+	bitPos  uint64
+	eof     bool
+	started bool
+
+	codeWidth int
+	freeEnt   int
+	oldCode   int
+	finChar   byte
+
+	prefix []uint16
+	suffix []byte
+
+	// stack contains the decoded string of the last code, in reverse.
+	stack []byte
+}
+
+func newLzwReader(r io.Reader) (*lzwReader, error) {
+	lr := &lzwReader{
+		r:      bufio.NewReader(r),
+		prefix: make([]uint16, 1<<lzwMaxBits),
+		suffix: make([]byte, 1<<lzwMaxBits),
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(lr.r, header); err != nil {
+		return nil, fmt.Errorf("compress: unable to read header: %w", err)
+	}
+
+	if header[0] != compressMagic[0] || header[1] != compressMagic[1] {
+		return nil, errors.New("compress: invalid magic")
+	}
+
+	if header[2]&0x60 != 0 {
+		return nil, errors.New("compress: unknown flags")
+	}
+
+	lr.maxBits = int(header[2] & 0x1f)
+	lr.blockMode = header[2]&0x80 != 0
+
+	if lr.maxBits < lzwInitBits || lr.maxBits > lzwMaxBits {
+		return nil, fmt.Errorf("compress: unsupported number of bits: %d", lr.maxBits)
+	}
+
+	for i := 0; i < 256; i++ {
+		lr.suffix[i] = byte(i)
+	}
+
+	lr.reset()
+
+	return lr, nil
+}
+
+// reset starts over with an empty table.
+func (lr *lzwReader) reset() {
+	lr.codeWidth = lzwInitBits
+	lr.freeEnt = 256
+
+	if lr.blockMode {
+		lr.freeEnt = lzwClear + 1
+	}
+
+	lr.started = false
+}
+
+// readBits reads n bits, LSB first.
+// It returns io.EOF if there are not enough bits left.
+func (lr *lzwReader) readBits(n int) (int, error) {
+	for lr.nBits < n {
+		b, err := lr.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		lr.bits |= uint32(b) << lr.nBits
+		lr.nBits += 8
+	}
+
+	v := int(lr.bits & (1<<n - 1))
+	lr.bits >>= n
+	lr.nBits -= n
+	lr.bitPos += uint64(n)
+
+	return v, nil
+}
+
+// align skips to the end of the current group of 8 codes.
+// compress writes codes in such groups, and pads the last one when the code width changes,
+// or the table is cleared.
+func (lr *lzwReader) align() error {
+	groupBits := uint64(lr.codeWidth * 8)
+
+	for rem := lr.bitPos % groupBits; rem != 0; rem = lr.bitPos % groupBits {
+		n := groupBits - rem
+		if n > 16 {
+			n = 16
+		}
+
+		if _, err := lr.readBits(int(n)); err != nil {
+			return err
+		}
+	}
+
+	lr.bitPos = 0
+
+	return nil
+}
+
+// nextCode reads the next code, and puts the string it decodes to on the stack.
+func (lr *lzwReader) nextCode() error {
+	maxCode := 1<<lr.codeWidth - 1
+	if lr.codeWidth == lr.maxBits {
+		maxCode = 1 << lr.maxBits
+	}
+
+	if lr.freeEnt > maxCode {
+		if err := lr.align(); err != nil {
+			return err
+		}
+
+		lr.codeWidth++
+	}
+
+	code, err := lr.readBits(lr.codeWidth)
+	if err != nil {
+		return err
+	}
+
+	if code == lzwClear && lr.blockMode {
+		if err := lr.align(); err != nil {
+			return err
+		}
+
+		lr.reset()
+
+		return nil
+	}
+
+	if !lr.started {
+		if code >= 256 {
+			return errLzwCorrupt
+		}
+
+		lr.started = true
+		lr.oldCode = code
+		lr.finChar = byte(code)
+		lr.stack = append(lr.stack[:0], byte(code))
+
+		return nil
+	}
+
+	inCode := code
+	lr.stack = lr.stack[:0]
+
+	if code >= lr.freeEnt {
+		// the code which is about to be defined (KwKwK)
+		if code > lr.freeEnt {
+			return errLzwCorrupt
+		}
+
+		lr.stack = append(lr.stack, lr.finChar)
+		code = lr.oldCode
+	}
+
+	for code >= 256 {
+		lr.stack = append(lr.stack, lr.suffix[code])
+		code = int(lr.prefix[code])
+	}
+
+	lr.finChar = lr.suffix[code]
+	lr.stack = append(lr.stack, lr.finChar)
+
+	if lr.freeEnt < 1<<lr.maxBits {
+		lr.prefix[lr.freeEnt] = uint16(lr.oldCode)
+		lr.suffix[lr.freeEnt] = lr.finChar
+		lr.freeEnt++
+	}
+
+	lr.oldCode = inCode
+
+	return nil
+}
+
+func (lr *lzwReader) Read(p []byte) (int, error) {
+	n := 0
+
+	for n < len(p) {
+		if len(lr.stack) == 0 {
+			if lr.eof {
+				break
+			}
+
+			err := lr.nextCode()
+			if errors.Is(err, io.EOF) {
+				// compress pads the last code to a full byte
+				lr.eof = true
+
+				break
+			}
+
+			if err != nil {
+				return n, err
+			}
+
+			continue
+		}
+
+		// the stack is in reverse order
+		for len(lr.stack) > 0 && n < len(p) {
+			p[n] = lr.stack[len(lr.stack)-1]
+			lr.stack = lr.stack[:len(lr.stack)-1]
+			n++
+		}
+	}
+
+	if n == 0 && lr.eof {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
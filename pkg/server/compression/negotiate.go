@@ -0,0 +1,64 @@
+package compression
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NegotiateEncoding picks the content coding to send a response with,
+// based on the Accept-Encoding header sent by the client.
+// offered lists the content codings (which are also compression types) the server is willing to use,
+// in order of preference. An empty string means the response should be sent without encoding.
+func NegotiateEncoding(acceptEncoding string, offered []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err != nil {
+				// ignore codings with invalid qualities
+				q = 0
+
+				break
+			}
+
+			q = parsed
+		}
+
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+
+	for _, coding := range offered {
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+
+		// on equal quality, the earlier (preferred) coding wins
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
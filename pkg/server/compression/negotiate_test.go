@@ -0,0 +1,38 @@
+package compression_test
+
+import (
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"zstd", "br", "gzip"}
+
+	for _, tc := range []struct {
+		name           string
+		acceptEncoding string
+		expected       string
+	}{
+		{name: "no header", acceptEncoding: "", expected: ""},
+		{name: "identity only", acceptEncoding: "identity", expected: ""},
+		{name: "single", acceptEncoding: "gzip", expected: "gzip"},
+		{name: "server preference", acceptEncoding: "gzip, br, zstd", expected: "zstd"},
+		{name: "quality", acceptEncoding: "zstd;q=0.5, br;q=0.8, gzip", expected: "gzip"},
+		{name: "excluded", acceptEncoding: "zstd;q=0, br", expected: "br"},
+		{name: "wildcard", acceptEncoding: "*", expected: "zstd"},
+		{name: "wildcard with exclusion", acceptEncoding: "*, zstd;q=0", expected: "br"},
+		{name: "case insensitive", acceptEncoding: "GZIP", expected: "gzip"},
+		{name: "unsupported", acceptEncoding: "deflate, compress", expected: ""},
+		{name: "invalid quality", acceptEncoding: "zstd;q=foo, gzip", expected: "gzip"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, compression.NegotiateEncoding(tc.acceptEncoding, offered))
+		})
+	}
+
+	t.Run("nothing offered", func(t *testing.T) {
+		assert.Equal(t, "", compression.NegotiateEncoding("zstd", nil))
+	})
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"syscall"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/narcheck"
+	"github.com/flokli/nix-casync/pkg/quota"
+	log "github.com/sirupsen/logrus"
+)
+
+// freeSpaceCheckInterval describes after how many bytes received
+// the free space is checked again while ingesting an upload.
+const freeSpaceCheckInterval = 16 << 20
+
+var (
+	// ErrNarTooLarge is returned if an upload exceeds the maximum NAR size.
+	ErrNarTooLarge = errors.New("nar too large")
+	// ErrInsufficientSpace is returned if there's not enough free disk space to receive an upload.
+	ErrInsufficientSpace = errors.New("insufficient space")
+)
+
+// UploadLimits restricts what uploads are accepted.
+type UploadLimits struct {
+	// MaxNarSize is the maximum size of a (uncompressed) NAR file, in bytes. 0 means unlimited.
+	MaxNarSize uint64
+	// MinFreeSpace is the number of bytes that need to stay available
+	// on the filesystems of all Paths while receiving uploads. 0 disables the check.
+	MinFreeSpace uint64
+	// Paths are the directories uploads are written to, such as the temp directory and the chunk store.
+	Paths []string
+}
+
+// UploadLimits returns the limits of uploads.
+func (s *Server) UploadLimits() UploadLimits {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.uploadLimits
+}
+
+// SetUploadLimits changes the limits of uploads.
+// Uploads already being received keep the limits they started with.
+func (s *Server) SetUploadLimits(uploadLimits UploadLimits) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.uploadLimits = uploadLimits
+}
+
+// admit returns an error if an upload of size bytes (or 0, if unknown)
+// would exceed the maximum NAR size, or there isn't enough free space to receive it.
+func (l UploadLimits) admit(size uint64) error {
+	if l.MaxNarSize > 0 && size > l.MaxNarSize {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d bytes", ErrNarTooLarge, size, l.MaxNarSize)
+	}
+
+	return l.checkFreeSpace(size)
+}
+
+// checkFreeSpace returns ErrInsufficientSpace if writing additional bytes
+// would leave less than MinFreeSpace available on any of the filesystems of Paths.
+func (l UploadLimits) checkFreeSpace(additional uint64) error {
+	if l.MinFreeSpace == 0 {
+		return nil
+	}
+
+	for _, p := range l.Paths {
+		var st syscall.Statfs_t
+
+		err := syscall.Statfs(p, &st)
+		if err != nil {
+			return fmt.Errorf("unable to determine free space of %v: %w", p, err)
+		}
+
+		free := st.Bavail * uint64(st.Bsize)
+		if free < l.MinFreeSpace+additional {
+			return fmt.Errorf("%w: only %d bytes available in %v", ErrInsufficientSpace, free, p)
+		}
+	}
+
+	return nil
+}
+
+// admitUpload responds with an error and returns false if an upload of size bytes (or 0, if unknown)
+// isn't accepted, because it's too large, or there isn't enough free space.
+func (s *Server) admitUpload(w http.ResponseWriter, size uint64) bool {
+	err := s.UploadLimits().admit(size)
+	if err != nil {
+		http.Error(w, err.Error(), ingestErrorStatus(err))
+
+		return false
+	}
+
+	return true
+}
+
+// contentLength returns the Content-Length of r, or 0 if it's unknown.
+func contentLength(r *http.Request) uint64 {
+	if r.ContentLength < 0 {
+		return 0
+	}
+
+	return uint64(r.ContentLength)
+}
+
+// ingestErrorStatus returns the status code to respond with if ingesting an upload failed with err.
+func ingestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNarTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInsufficientSpace), errors.Is(err, quota.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, narcheck.ErrInvalidNar):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// limitReader returns an error once more than MaxNarSize bytes were read from r,
+// or more than the principal sending it may upload before exceeding its quota,
+// or free space drops below MinFreeSpace while reading.
+// It never returns bytes beyond those limits, so nothing past them is written anywhere.
+type limitReader struct {
+	r      io.Reader
+	limits UploadLimits
+
+	// limit is the number of bytes that may be read in total, if hasLimit is set.
+	// Reading more fails with limitErr.
+	limit    uint64
+	hasLimit bool
+	limitErr error
+
+	// n is the number of bytes read so far.
+	n uint64
+	// nextCheck is the value of n at which free space is checked again.
+	nextCheck uint64
+}
+
+// limitUpload limits reading an upload from r, of which offset bytes were already received before.
+// The quota of the principal in ctx applies to all of it, including these offset bytes.
+func (s *Server) limitUpload(ctx context.Context, r io.Reader, offset uint64) (io.Reader, error) {
+	l := &limitReader{
+		r:         r,
+		limits:    s.UploadLimits(),
+		n:         offset,
+		nextCheck: offset + freeSpaceCheckInterval,
+	}
+
+	if maxNarSize := l.limits.MaxNarSize; maxNarSize > 0 {
+		l.limit, l.hasLimit = maxNarSize, true
+		l.limitErr = fmt.Errorf("%w: more than %d bytes", ErrNarTooLarge, maxNarSize)
+	}
+
+	if s.quotas != nil {
+		principal := auth.FromContext(ctx)
+
+		remaining, hasQuota, err := s.quotas.Remaining(ctx, principal)
+		if err != nil {
+			return nil, fmt.Errorf("error checking quota: %w", err)
+		}
+
+		if hasQuota && (!l.hasLimit || remaining < l.limit) {
+			l.limit, l.hasLimit = remaining, true
+			l.limitErr = fmt.Errorf("%w: %v can only upload %d more bytes", quota.ErrQuotaExceeded, principal, remaining)
+		}
+	}
+
+	if !l.hasLimit && l.limits.MinFreeSpace == 0 {
+		return r, nil
+	}
+
+	return l, nil
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.hasLimit {
+		if l.n > l.limit {
+			return 0, l.limitErr
+		}
+
+		// read at most one byte more than allowed, to detect crossing the limit.
+		if uint64(len(p)) > l.limit-l.n+1 {
+			p = p[:l.limit-l.n+1]
+		}
+	}
+
+	n, err := l.r.Read(p)
+
+	if l.hasLimit && l.n+uint64(n) > l.limit {
+		n = int(l.limit - l.n)
+		l.n = l.limit
+
+		log.Warnf("Aborted upload: %v", l.limitErr)
+
+		return n, l.limitErr
+	}
+
+	l.n += uint64(n)
+
+	if l.n >= l.nextCheck {
+		l.nextCheck = l.n + freeSpaceCheckInterval
+
+		if checkErr := l.limits.checkFreeSpace(0); checkErr != nil {
+			log.Warnf("Aborted upload: %v", checkErr)
+
+			return n, checkErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/nix-community/go-nix/pkg/hash"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	"github.com/nix-community/go-nix/pkg/nixpath"
+)
+
+// caHashSizes maps from the hash algorithms allowed in the CA field to their digest size.
+var caHashSizes = map[string]int{ //nolint:gochecknoglobals
+	"md5":    16,
+	"sha1":   20,
+	"sha256": 32,
+	"sha512": 64,
+}
+
+// TrustedKeys returns the keys whose signatures on uploaded .narinfo files need to be valid.
+func (s *Server) TrustedKeys() []*signing.PublicKey {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.trustedKeys
+}
+
+// SetTrustedKeys changes the keys whose signatures on uploaded .narinfo files need to be valid.
+// Signatures by other keys can't be verified, and are kept as-is.
+func (s *Server) SetTrustedKeys(trustedKeys []*signing.PublicKey) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.trustedKeys = trustedKeys
+}
+
+// narinfoViolation describes a field of an uploaded .narinfo that's rejected, and why.
+type narinfoViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// narinfoError is the response to uploading a .narinfo that's rejected, listing all violations.
+type narinfoError struct {
+	Error      string              `json:"error"`
+	Violations []*narinfoViolation `json:"violations"`
+}
+
+// narinfoCheck collects the violations found in a .narinfo.
+type narinfoCheck struct {
+	violations []*narinfoViolation
+}
+
+func (c *narinfoCheck) reject(field string, format string, a ...interface{}) {
+	c.violations = append(c.violations, &narinfoViolation{
+		Field:   field,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// checkNarinfo validates ni, uploaded as the .narinfo of outputHash.
+// It returns all violations found, and the NarMeta of the NAR file ni describes, if it exists.
+// Errors are only returned if the metadata store couldn't be queried.
+//
+// The NAR file needs to be uploaded already, with the NarHash (sha256) and NarSize of ni,
+// and all references (except a self-reference) need to exist in the metadata store.
+// If the references of the NAR file were recorded before, ni needs to have the same.
+// Deriver, CA and signatures by any of the trusted keys (see SetTrustedKeys) need to be valid.
+func (s *Server) checkNarinfo(
+	ctx context.Context,
+	outputHash []byte,
+	ni *narinfo.NarInfo,
+) ([]*narinfoViolation, *metadatastore.NarMeta, error) {
+	c := &narinfoCheck{}
+
+	storePath, err := nixpath.FromString(ni.StorePath)
+	if err != nil {
+		c.reject("StorePath", "invalid store path: %v", ni.StorePath)
+	} else if !bytes.Equal(storePath.Digest, outputHash) {
+		c.reject("StorePath", "%v doesn't match the .narinfo, %v", ni.StorePath, nixbase32.EncodeToString(outputHash))
+	}
+
+	narMeta, err := s.checkNarinfoNar(ctx, c, ni)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.checkNarinfoReferences(ctx, c, outputHash, ni, narMeta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ni.Deriver != "" {
+		_, err := nixpath.FromString(nixpath.StoreDir + "/" + ni.Deriver)
+		if err != nil || !strings.HasSuffix(ni.Deriver, ".drv") {
+			c.reject("Deriver", "invalid derivation path: %v", ni.Deriver)
+		}
+	}
+
+	if ni.CA != "" {
+		if err := checkCA(ni.CA); err != nil {
+			c.reject("CA", "%v", err)
+		}
+	}
+
+	checkSignatures(c, ni, s.TrustedKeys())
+
+	return c.violations, narMeta, nil
+}
+
+// checkNarinfoNar ensures the NAR file ni describes was uploaded, with the same NarSize,
+// and returns its NarMeta, or nil if it doesn't exist.
+func (s *Server) checkNarinfoNar(
+	ctx context.Context,
+	c *narinfoCheck,
+	ni *narinfo.NarInfo,
+) (*metadatastore.NarMeta, error) {
+	if ni.NarHash.HashType != hash.HashTypeSha256 {
+		c.reject("NarHash", "unsupported hash algorithm %v, must be sha256", ni.NarHash.HashType)
+
+		return nil, nil
+	}
+
+	narMeta, err := s.metadataStore.GetNarMeta(ctx, ni.NarHash.Digest)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.reject("NarHash", "no NAR file with NarHash %v was uploaded", ni.NarHash)
+
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("unable to get NarMeta: %w", err)
+	}
+
+	if ni.NarSize != narMeta.Size {
+		c.reject("NarSize", "%d doesn't match the size of the NAR file, %d bytes", ni.NarSize, narMeta.Size)
+	}
+
+	return narMeta, nil
+}
+
+// checkNarinfoReferences ensures all references of ni are valid store paths, and exist (except for a self-reference).
+// If narMeta is set, and its references are known, they need to be the same.
+func (s *Server) checkNarinfoReferences(
+	ctx context.Context,
+	c *narinfoCheck,
+	outputHash []byte,
+	ni *narinfo.NarInfo,
+	narMeta *metadatastore.NarMeta,
+) error {
+	valid := true
+
+	for _, reference := range ni.References {
+		referencePath, err := nixpath.FromString(nixpath.StoreDir + "/" + reference)
+		if err != nil {
+			c.reject("References", "invalid store path: %v", reference)
+
+			valid = false
+
+			continue
+		}
+
+		if bytes.Equal(referencePath.Digest, outputHash) {
+			continue
+		}
+
+		_, err = s.metadataStore.GetPathInfo(ctx, referencePath.Digest)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				c.reject("References", "%v doesn't exist, it needs to be uploaded first", reference)
+
+				continue
+			}
+
+			return fmt.Errorf("unable to get PathInfo of reference %v: %w", reference, err)
+		}
+	}
+
+	if valid && narMeta != nil && len(narMeta.ReferencesStr) != 0 && !equalStrings(narMeta.ReferencesStr, ni.References) {
+		c.reject(
+			"References",
+			"%v don't match the references of the NAR file, %v",
+			strings.Join(ni.References, " "),
+			strings.Join(narMeta.ReferencesStr, " "),
+		)
+	}
+
+	return nil
+}
+
+// checkCA ensures ca describes the content address of a store path,
+// as text:$algo:$hash (only sha256) or fixed:[r:]$algo:$hash, with $hash in nixbase32.
+func checkCA(ca string) error {
+	var h string
+
+	switch {
+	case strings.HasPrefix(ca, "text:"):
+		h = strings.TrimPrefix(ca, "text:")
+		if !strings.HasPrefix(h, "sha256:") {
+			return fmt.Errorf("invalid content address %v, text needs to use sha256", ca)
+		}
+	case strings.HasPrefix(ca, "fixed:"):
+		h = strings.TrimPrefix(strings.TrimPrefix(ca, "fixed:"), "r:")
+	default:
+		return fmt.Errorf("invalid content address %v, needs to start with text: or fixed:", ca)
+	}
+
+	fields := strings.Split(h, ":")
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid content address %v, unexpected number of colons", ca)
+	}
+
+	size, ok := caHashSizes[fields[0]]
+	if !ok {
+		return fmt.Errorf("invalid content address %v, unsupported hash algorithm %v", ca, fields[0])
+	}
+
+	digest, err := nixbase32.DecodeString(fields[1])
+	if err != nil || len(digest) != size {
+		return fmt.Errorf("invalid content address %v, invalid %v hash", ca, fields[0])
+	}
+
+	return nil
+}
+
+// checkSignatures ensures all signatures have a key name, and signatures by any of trustedKeys
+// match the fingerprint of ni. Signatures by other keys can't be verified, and are kept as-is.
+func checkSignatures(c *narinfoCheck, ni *narinfo.NarInfo, trustedKeys []*signing.PublicKey) {
+	fingerprint := []byte(signing.Fingerprint(ni))
+
+	for _, sig := range ni.Signatures {
+		if sig.KeyName == "" {
+			c.reject("Sig", "signature without key name")
+
+			continue
+		}
+
+		for _, key := range trustedKeys {
+			if sig.KeyName == key.Name && !ed25519.Verify(key.Key, fingerprint, sig.Digest) {
+				c.reject("Sig", "signature by %v doesn't match the fingerprint of the .narinfo", sig.KeyName)
+			}
+		}
+	}
+}
+
+// equalStrings returns true if a and b contain the same strings, in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/go-chi/chi/v5"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// RegisterPinHandlers registers handlers managing pins.
+// A pin is a name pointing to a store path,
+// which (with its closure) is never removed by retention:
+//   - GET /_pins lists all pins.
+//   - GET /_pins/{name} returns the store path a pin points to.
+//   - PUT /_pins/{name} points a pin to the store path (or its hash) sent in the body.
+//   - DELETE /_pins/{name} removes a pin.
+func (s *Server) RegisterPinHandlers() {
+	s.Handler.Get("/_pins", s.handleListPins)
+	s.Handler.Get("/_pins/{name}", s.handlePin)
+	s.Handler.Put("/_pins/{name}", s.handlePin)
+	s.Handler.Delete("/_pins/{name}", s.handlePin)
+}
+
+type pin struct {
+	Name      string `json:"name"`
+	StorePath string `json:"storePath"`
+}
+
+func (s *Server) handleListPins(w http.ResponseWriter, r *http.Request) {
+	pins, err := s.pins(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing pins: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, struct {
+		Pins []*pin `json:"pins"`
+	}{
+		Pins: pins,
+	}, http.StatusOK)
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	if err := metadatastore.CheckPinName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pins, err := s.pins(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing pins: %v", err), http.StatusInternalServerError)
+
+			return
+		}
+
+		for _, p := range pins {
+			if p.Name == name {
+				writeJSON(w, p, http.StatusOK)
+
+				return
+			}
+		}
+
+		http.Error(w, "Pin not found", http.StatusNotFound)
+	case http.MethodPut:
+		// accept store paths, their basename, or just the hash
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading body: %v", err), http.StatusBadRequest)
+
+			return
+		}
+
+		base := path.Base(string(bytes.TrimSpace(body)))
+		if len(base) < 32 {
+			http.Error(w, fmt.Sprintf("Invalid store path: %v", base), http.StatusBadRequest)
+
+			return
+		}
+
+		outputHash, err := nixbase32.DecodeString(base[:32])
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid store path %v: %v", base, err), http.StatusBadRequest)
+
+			return
+		}
+
+		err = s.metadataStore.PutPin(r.Context(), name, outputHash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error putting pin: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		pathInfo, err := s.metadataStore.GetPathInfo(r.Context(), outputHash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting PathInfo: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		writeJSON(w, &pin{
+			Name:      name,
+			StorePath: pathInfo.StorePath(),
+		}, http.StatusOK)
+	case http.MethodDelete:
+		err := s.metadataStore.DeletePin(r.Context(), name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting pin: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// pins returns all pins, sorted by name.
+// Pins pointing to a store path that doesn't exist anymore are skipped.
+func (s *Server) pins(ctx context.Context) ([]*pin, error) {
+	pinHashes, err := s.metadataStore.ListPins(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make([]*pin, 0, len(pinHashes))
+
+	for name, outputHash := range pinHashes {
+		pathInfo, err := s.metadataStore.GetPathInfo(ctx, outputHash)
+		if err != nil {
+			continue
+		}
+
+		pins = append(pins, &pin{
+			Name:      name,
+			StorePath: pathInfo.StorePath(),
+		})
+	}
+
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Name < pins[j].Name
+	})
+
+	return pins, nil
+}
+
+// pinnedBy returns the name of a pin pointing to outputHash, or an empty string if there's none.
+func (s *Server) pinnedBy(ctx context.Context, outputHash []byte) (string, error) {
+	pins, err := s.metadataStore.ListPins(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	names := make([]string, 0, len(pins))
+
+	for name, pinned := range pins {
+		if bytes.Equal(pinned, outputHash) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(names)
+
+	return names[0], nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/quota"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+)
+
+// SetQuotas counts the store paths uploaded to this server towards the usage in tracker,
+// and rejects uploads by principals exceeding their quota with 507 Insufficient Storage.
+// GET /_usage returns the usage of all principals to authenticated requests.
+// It needs to be called before serving requests.
+func (s *Server) SetQuotas(ctx context.Context, tracker *quota.Tracker) error {
+	err := tracker.Track(ctx, s.metadataStore)
+	if err != nil {
+		return err
+	}
+
+	s.quotas = tracker
+	s.Handler.Get("/_usage", s.handleUsage)
+
+	return nil
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if auth.FromContext(r.Context()) == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+
+		return
+	}
+
+	usage, err := s.quotas.Usage(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error determining usage: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, struct {
+		Principals map[string]*quota.Usage `json:"principals"`
+	}{
+		Principals: usage,
+	}, http.StatusOK)
+}
+
+// checkQuota responds with 507 Insufficient Storage and returns false
+// if the principal sending r can't upload additional bytes.
+// With additional set to 0, only principals already exceeding their quota are rejected.
+func (s *Server) checkQuota(w http.ResponseWriter, r *http.Request, additional uint64) bool {
+	if s.quotas == nil {
+		return true
+	}
+
+	err := s.quotas.Check(r.Context(), auth.FromContext(r.Context()), additional)
+
+	return quotaResult(w, err)
+}
+
+// quotaResult responds with an error and returns false if checking the quota failed with err.
+func quotaResult(w http.ResponseWriter, err error) bool {
+	if err != nil {
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		} else {
+			http.Error(w, fmt.Sprintf("Error checking quota: %v", err), http.StatusInternalServerError)
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// checkNarinfoQuota is checkQuota for the upload of a .narinfo,
+// which adds the size of its NAR file to the usage, unless it was uploaded before,
+// or the NAR file was uploaded by the same principal (and is counted already).
+func (s *Server) checkNarinfoQuota(
+	w http.ResponseWriter,
+	r *http.Request,
+	pathInfo *metadatastore.PathInfo,
+	narMeta *metadatastore.NarMeta,
+) bool {
+	if s.quotas == nil {
+		return true
+	}
+
+	existing, err := s.metadataStore.GetPathInfo(r.Context(), pathInfo.OutputHash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Error getting PathInfo: %v", err), http.StatusInternalServerError)
+
+		return false
+	}
+
+	// it's already counted towards the usage of whoever uploaded it first.
+	if existing != nil && existing.UploadedBy != "" {
+		return true
+	}
+
+	err = s.quotas.CheckPath(r.Context(), auth.FromContext(r.Context()), s.metadataStore, narMeta)
+
+	return quotaResult(w, err)
+}
+
+// addNarUsage counts a NAR file just uploaded towards the usage of the principal that uploaded it.
+func (s *Server) addNarUsage(narMeta *metadatastore.NarMeta) {
+	if s.quotas != nil {
+		s.quotas.AddNar(s.metadataStore, narMeta)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/pkg/store/renditionstore"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetRenditionStore configures a store keeping compressed renditions of NAR files.
+// Popular NAR files are then compressed only once, and served from there,
+// with a Content-Length.
+// The store can be shared between tenants.
+// It must be called before serving requests.
+func (s *Server) SetRenditionStore(renditionStore *renditionstore.FileStore) {
+	s.renditionStore = renditionStore
+}
+
+// serveCompressedNar sends the NAR file read from blobReader, compressed with compressionType.
+// If there's a rendition store, the compressed NAR file is served from there if possible,
+// or added to it while being sent.
+func (s *Server) serveCompressedNar(
+	w http.ResponseWriter,
+	r *http.Request,
+	narhash []byte,
+	blobReader io.Reader,
+	compressionType string,
+) {
+	if s.renditionStore != nil {
+		f, size, err := s.renditionStore.Get(narhash, compressionType)
+		if err == nil {
+			defer f.Close()
+
+			w.Header().Add("Content-Type", "application/x-nix-nar")
+			w.Header().Add("Content-Length", fmt.Sprintf("%d", size))
+
+			if r.Method == http.MethodHead {
+				return
+			}
+
+			// this uses sendfile, as f is a *os.File
+			_, err = io.Copy(w, f)
+			if err != nil {
+				log.Errorf("Error sending Narfile to client: %v", err)
+			}
+
+			return
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Error looking up compressed NAR file: %v", err)
+		}
+	}
+
+	tee := &renditionTee{w: w}
+
+	if s.renditionStore != nil {
+		rw, err := s.renditionStore.Create(narhash, compressionType)
+		if err == nil {
+			tee.rw = rw
+		} else if !errors.Is(err, renditionstore.ErrInProgress) {
+			log.Warnf("Unable to create compressed NAR file: %v", err)
+		}
+	}
+
+	// We only support zstd, gzip, brotli and none, as the others are way too CPU-intensive,
+	// and never advertised anyways.
+	compressedWriter, err := compression.NewCompressorWithOptions(tee, compressionType, s.CompressorOptions())
+	if err != nil {
+		tee.abort()
+
+		// We still serve a 404 (as Nix might send a HEAD request while trying to upload xz, for example)
+		http.Error(w, fmt.Sprintf("Unsupported compression type: %v", compressionType), http.StatusNotFound)
+
+		return
+	}
+
+	// We can't advertise a content-length, as we don't know the compressed size yet.
+	w.Header().Add("Content-Type", "application/x-nix-nar")
+
+	_, err = io.Copy(compressedWriter, blobReader)
+	if closeErr := compressedWriter.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		tee.abort()
+		log.Errorf("Error sending Narfile to client: %v", err)
+
+		return
+	}
+
+	tee.commit()
+}
+
+// compressedFileHash returns the sha256 and size of the NAR file with the passed NarHash,
+// compressed with compressionType, if it's in the rendition store.
+// Otherwise, fileHash is nil, and they're omitted from the .narinfo.
+// The NAR file is never compressed just for this, as .narinfo files are requested a lot more often,
+// and compressing again could produce different bytes than served later (with changed options).
+func (s *Server) compressedFileHash(narhash []byte, compressionType string) ([]byte, uint64, error) {
+	if s.renditionStore == nil {
+		return nil, 0, nil
+	}
+
+	fileHash, size, err := s.renditionStore.Stat(narhash, compressionType)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, nil
+		}
+
+		return nil, 0, err
+	}
+
+	return fileHash, uint64(size), nil
+}
+
+// renditionTee writes to w, and to rw (if set) as long as that doesn't fail.
+// A failing rendition (for example because it's too big) doesn't affect the client.
+type renditionTee struct {
+	w  io.Writer
+	rw *renditionstore.Writer
+}
+
+func (t *renditionTee) Write(p []byte) (int, error) {
+	if t.rw != nil {
+		if _, err := t.rw.Write(p); err != nil {
+			log.Debugf("Not keeping compressed NAR file: %v", err)
+			t.abort()
+		}
+	}
+
+	return t.w.Write(p)
+}
+
+func (t *renditionTee) abort() {
+	if t.rw != nil {
+		t.rw.Abort()
+		t.rw = nil
+	}
+}
+
+func (t *renditionTee) commit() {
+	if t.rw != nil {
+		if err := t.rw.Commit(); err != nil {
+			log.Warnf("Unable to store compressed NAR file: %v", err)
+		}
+
+		t.rw = nil
+	}
+}
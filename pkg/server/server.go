@@ -1,15 +1,28 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/narcheck"
+	"github.com/flokli/nix-casync/pkg/quota"
 	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/pkg/signing"
 	"github.com/flokli/nix-casync/pkg/store/blobstore"
 	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/store/renditionstore"
+	"github.com/flokli/nix-casync/pkg/store/uploadstore"
+	"github.com/flokli/nix-casync/pkg/webhook"
 	"github.com/go-chi/chi/v5"
 	"github.com/nix-community/go-nix/pkg/nar/narinfo"
 	"github.com/nix-community/go-nix/pkg/nixbase32"
@@ -21,12 +34,51 @@ type Server struct {
 
 	blobStore     blobstore.BlobStore
 	metadataStore metadatastore.MetadataStore
+	uploadStore   *uploadstore.FileStore
+
+	// renditionStore keeps compressed renditions of NAR files, if set.
+	renditionStore *renditionstore.FileStore
+
+	// settings which can be changed while serving
+	narServeCompression string   // zstd,gzip,br,none
+	narContentEncodings []string // content codings offered for .nar files, in order of preference
+	compressorOptions   compression.CompressorOptions
+	priority            int
+	uploadLimits        UploadLimits
+	trustedKeys         []*signing.PublicKey
+	muSettings          sync.RWMutex
+
+	// tenants are additional caches served below /cache/{name},
+	// usually sharing blobStore with this one.
+	tenants map[string]*Server
+
+	// background work (such as committing uploads) uses bgCtx,
+	// which is cancelled on Close.
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bg       sync.WaitGroup
+
+	// streamsCtx is cancelled by StopStreams,
+	// ending long-lived responses such as the change feed.
+	streamsCtx    context.Context
+	streamsCancel context.CancelFunc
+
+	// webhooks receives events about uploads and deletions, if set.
+	webhooks     *webhook.Outbox
+	webhookCache string
+
+	// access collects requests for store paths, until they're written to metadataStore.
+	access *accessLog
 
-	narServeCompression string // zstd,gzip,brotli,none
+	// quotas tracks the storage used by principals, and limits it, if set.
+	quotas *quota.Tracker
 
 	io.Closer
 }
 
+// tenantNameRegexp describes the allowed names for tenants.
+var tenantNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`) //nolint:gochecknoglobals
+
 func NewServer(blobStore blobstore.BlobStore,
 	metadataStore metadatastore.MetadataStore,
 	narServeCompression string,
@@ -40,27 +92,173 @@ func NewServer(blobStore blobstore.BlobStore,
 		}
 	})
 
-	r.Get("/nix-cache-info", func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte(fmt.Sprintf("StoreDir: /nix/store\nWantMassQuery: 1\nPriority: %d\n", priority)))
-		if err != nil {
-			log.Errorf("Unable to write response: %v", err)
-		}
-	})
+	bgCtx, bgCancel := context.WithCancel(context.Background())
+	streamsCtx, streamsCancel := context.WithCancel(context.Background())
 
 	s := &Server{
 		Handler:             r,
 		blobStore:           blobStore,
 		metadataStore:       metadataStore,
 		narServeCompression: narServeCompression,
+		priority:            priority,
+		tenants:             make(map[string]*Server),
+		bgCtx:               bgCtx,
+		bgCancel:            bgCancel,
+		streamsCtx:          streamsCtx,
+		streamsCancel:       streamsCancel,
+		access:              newAccessLog(),
 	}
 
+	r.Get("/nix-cache-info", func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte(fmt.Sprintf("StoreDir: /nix/store\nWantMassQuery: 1\nPriority: %d\n", s.Priority())))
+		if err != nil {
+			log.Errorf("Unable to write response: %v", err)
+		}
+	})
+
 	s.RegisterNarHandlers()
 	s.RegisterNarinfoHandlers()
+	s.RegisterChunkHandlers()
+	s.RegisterCasyncHandlers()
+	s.RegisterClosureHandlers()
+	s.RegisterChangesHandlers()
+	s.RegisterPinHandlers()
+
+	s.runAccessLog()
 
 	return s
 }
 
+// Priority returns the priority advertised in nix-cache-info.
+func (s *Server) Priority() int {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.priority
+}
+
+// SetPriority changes the priority advertised in nix-cache-info.
+func (s *Server) SetPriority(priority int) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.priority = priority
+}
+
+// NarServeCompression returns the compression .nar files are advertised with in .narinfo files.
+func (s *Server) NarServeCompression() string {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.narServeCompression
+}
+
+// SetNarServeCompression changes the compression .nar files are advertised with in .narinfo files.
+func (s *Server) SetNarServeCompression(narServeCompression string) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.narServeCompression = narServeCompression
+}
+
+// NarContentEncodings returns the content codings .nar files can be sent with,
+// if requested by the client via Accept-Encoding.
+func (s *Server) NarContentEncodings() []string {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.narContentEncodings
+}
+
+// SetNarContentEncodings changes the content codings .nar files can be sent with,
+// in order of preference. Content negotiation is disabled if empty.
+func (s *Server) SetNarContentEncodings(narContentEncodings []string) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.narContentEncodings = narContentEncodings
+}
+
+// CompressorOptions returns the options (such as compression levels) .nar files are compressed with.
+func (s *Server) CompressorOptions() compression.CompressorOptions {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return s.compressorOptions
+}
+
+// SetCompressorOptions changes the options (such as compression levels) .nar files are compressed with.
+// Compressed .nar files already in the rendition store are kept.
+func (s *Server) SetCompressorOptions(compressorOptions compression.CompressorOptions) {
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+
+	s.compressorOptions = compressorOptions
+}
+
+// CheckTenantName returns an error if name can't be used as a tenant name.
+// Tenant names show up in URLs and paths on disk,
+// so only alphanumerics, dots, dashes and underscores are allowed.
+func CheckTenantName(name string) error {
+	if !tenantNameRegexp.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid tenant name: %v", name)
+	}
+
+	return nil
+}
+
+// MountTenant serves another cache below /cache/{name}.
+// The tenant is expected to share the BlobStore of this server, but use its own MetadataStore.
+// Closing this server also closes the MetadataStore of all mounted tenants.
+func (s *Server) MountTenant(name string, tenant *Server) error {
+	if err := CheckTenantName(name); err != nil {
+		return err
+	}
+
+	if _, exists := s.tenants[name]; exists {
+		return fmt.Errorf("tenant %v already mounted", name)
+	}
+
+	s.tenants[name] = tenant
+	s.Handler.Mount("/cache/"+name, tenant.Handler)
+
+	return nil
+}
+
+// Tenant returns the tenant mounted at name, or nil if there is none.
+func (s *Server) Tenant(name string) *Server {
+	return s.tenants[name]
+}
+
+// StopStreams ends all long-lived responses (of this server and its tenants), such as the change feed.
+// It should be called when shutting down, as these responses don't finish on their own.
+func (s *Server) StopStreams() {
+	s.streamsCancel()
+
+	for _, tenant := range s.tenants {
+		tenant.StopStreams()
+	}
+}
+
+// stopBackground aborts all background work, and waits for it to return.
+func (s *Server) stopBackground() {
+	s.bgCancel()
+	s.bg.Wait()
+}
+
 func (s *Server) Close() error {
+	s.StopStreams()
+	s.stopBackground()
+
+	// tenants share the blob store, so only their metadata stores need to be closed.
+	for _, tenant := range s.tenants {
+		tenant.stopBackground()
+
+		if err := tenant.metadataStore.Close(); err != nil {
+			return err
+		}
+	}
+
 	if err := s.blobStore.Close(); err != nil {
 		return err
 	}
@@ -73,6 +271,68 @@ func (s *Server) RegisterNarinfoHandlers() {
 	s.Handler.Get(pattern, s.handleNarinfo)
 	s.Handler.Head(pattern, s.handleNarinfo)
 	s.Handler.Put(pattern, s.handleNarinfo)
+	s.Handler.Delete(pattern, s.handleNarinfo)
+
+	s.Handler.Get("/_narinfos", s.handleListNarinfos)
+}
+
+// handleListNarinfos returns the store paths of all .narinfo files, sorted.
+// With ?details=1, paths contains when each was uploaded and last accessed, and how often its NAR file was downloaded.
+func (s *Server) handleListNarinfos(w http.ResponseWriter, r *http.Request) {
+	pathInfos, err := s.metadataStore.ListPathInfo(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing PathInfo: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	sort.Slice(pathInfos, func(i, j int) bool {
+		return pathInfos[i].StorePath() < pathInfos[j].StorePath()
+	})
+
+	storePaths := make([]string, 0, len(pathInfos))
+	for _, pathInfo := range pathInfos {
+		storePaths = append(storePaths, pathInfo.StorePath())
+	}
+
+	type pathDetails struct {
+		StorePath      string     `json:"storePath"`
+		UploadedAt     *time.Time `json:"uploadedAt,omitempty"`
+		LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+		Hits           uint64     `json:"hits"`
+	}
+
+	var paths []*pathDetails
+
+	if details, _ := strconv.ParseBool(r.URL.Query().Get("details")); details {
+		paths = make([]*pathDetails, 0, len(pathInfos))
+
+		for _, pathInfo := range pathInfos {
+			p := &pathDetails{
+				StorePath: pathInfo.StorePath(),
+				Hits:      pathInfo.Hits,
+			}
+
+			// timestamps are unknown for store paths uploaded by older versions
+			if !pathInfo.UploadedAt.IsZero() {
+				p.UploadedAt = &pathInfo.UploadedAt
+			}
+
+			if !pathInfo.LastAccessedAt.IsZero() {
+				p.LastAccessedAt = &pathInfo.LastAccessedAt
+			}
+
+			paths = append(paths, p)
+		}
+	}
+
+	writeJSON(w, struct {
+		StorePaths []string       `json:"storePaths"`
+		Paths      []*pathDetails `json:"paths,omitempty"`
+	}{
+		StorePaths: storePaths,
+		Paths:      paths,
+	}, http.StatusOK)
 }
 
 func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
@@ -81,6 +341,8 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 	outputhash, err := nixbase32.DecodeString(outputhashStr)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to decode outputhash: %v", err), http.StatusBadRequest)
+
+		return
 	}
 
 	//nolint:nestif
@@ -108,9 +370,32 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 				nixbase32.EncodeToString(pathInfo.OutputHash),
 			)
 			http.Error(w, fmt.Sprintf("Error getting NarMeta: %v", err), http.StatusInternalServerError)
+
+			return
 		}
 
-		narinfoContent, err := metadatastore.RenderNarinfo(pathInfo, narMeta, s.narServeCompression)
+		if r.Method == http.MethodGet {
+			s.recordNarinfoAccess(outputhash)
+		}
+
+		// Without compression, FileHash and FileSize are the NarHash and NarSize.
+		// Otherwise, they describe the compressed NAR file in the rendition store,
+		// and are omitted if it's not there (yet).
+		compressionType := s.NarServeCompression()
+
+		var (
+			fileHash []byte
+			fileSize uint64
+		)
+
+		if compressionType != "none" {
+			fileHash, fileSize, err = s.compressedFileHash(pathInfo.NarHash, compressionType)
+			if err != nil {
+				log.Warnf("Unable to determine FileHash of %s: %v", nixbase32.EncodeToString(pathInfo.NarHash), err)
+			}
+		}
+
+		narinfoContent, err := metadatastore.RenderNarinfo(pathInfo, narMeta, compressionType, fileHash, fileSize)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Unable to render .narinfo: %v", err), http.StatusInternalServerError)
 
@@ -138,11 +423,17 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// retrieve the NarMeta
-		narMeta, err := s.metadataStore.GetNarMeta(r.Context(), ni.NarHash.Digest)
-		if errors.Is(err, os.ErrNotExist) {
-			log.Error("Rejected uploading a .narinfo pointing to a non-existent narhash")
-			http.Error(w, "Narinfo points to non-existent NarHash", http.StatusBadRequest)
+		// check the .narinfo against the NAR file and the other store paths, before storing anything
+		violations, narMeta, err := s.checkNarinfo(r.Context(), outputhash, ni)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error checking .narinfo: %v", err), http.StatusInternalServerError)
+
+			return
+		}
+
+		if len(violations) != 0 {
+			log.Warnf("Rejected invalid .narinfo for %v, with %d violations", ni.StorePath, len(violations))
+			writeJSON(w, &narinfoError{Error: "invalid .narinfo", Violations: violations}, http.StatusBadRequest)
 
 			return
 		}
@@ -151,13 +442,23 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 		sentPathInfo, sentNarMeta, err := metadatastore.ParseNarinfo(ni)
 		if err != nil {
 			log.Errorf("Unable to parse narinfo into PathInfo and NarMeta: %v", err)
-			http.Error(w, "Unable to parse narinfo into PathInfo and NarMeta: %v", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Unable to parse narinfo into PathInfo and NarMeta: %v", err), http.StatusBadRequest)
+
+			return
 		}
 
-		// Compare narMeta generated out of the .narinfo with the one in the store
-		if !narMeta.IsEqualTo(sentNarMeta, false) {
-			log.Error("Sent .narinfo with conflicting NarMeta")
-			http.Error(w, "NarMeta is conflicting", http.StatusBadRequest)
+		if !s.checkNarinfoQuota(w, r, sentPathInfo, narMeta) {
+			return
+		}
+
+		sentPathInfo.UploadedBy = auth.FromContext(r.Context())
+
+		// keep the timestamps if the .narinfo was uploaded before
+		err = metadatastore.SetTimestamps(r.Context(), s.metadataStore, sentPathInfo, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting PathInfo: %v", err), http.StatusInternalServerError)
+
+			return
 		}
 
 		// HACK: until we implement our own reference scanner on NAR upload, we
@@ -184,12 +485,7 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		} else {
-			// Do full comparison of NarMeta, including references
-			if !narMeta.IsEqualTo(sentNarMeta, true) {
-				log.Error("Sent .narinfo with conflicting NarMeta (References)")
-				http.Error(w, "NarMeta (References) is conflicting", http.StatusBadRequest)
-			}
-
+			// checkNarinfo ensured the references are the same
 			err = s.metadataStore.PutPathInfo(r.Context(), sentPathInfo)
 			if err != nil {
 				http.Error(w, fmt.Sprintf("Error putting PathInfo: %v", err), http.StatusInternalServerError)
@@ -198,6 +494,45 @@ func (s *Server) handleNarinfo(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		s.publishPathInfo(webhook.EventNarinfoPut, sentPathInfo, narMeta)
+
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		pathInfo, err := s.metadataStore.GetPathInfo(r.Context(), outputhash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting PathInfo: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		pinned, err := s.pinnedBy(r.Context(), outputhash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error listing pins: %v", err), http.StatusInternalServerError)
+
+			return
+		}
+
+		if pinned != "" {
+			http.Error(w, fmt.Sprintf("Store path is pinned by %v", pinned), http.StatusConflict)
+
+			return
+		}
+
+		// The NAR file and its NarMeta are kept, other PathInfo might refer to them.
+		// gc removes them once none does.
+		err = s.metadataStore.DeletePathInfo(r.Context(), outputhash)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting PathInfo: %v", err), notFoundOr500(err))
+
+			return
+		}
+
+		s.publishPathInfo(webhook.EventNarinfoDelete, pathInfo, nil)
+
+		w.WriteHeader(http.StatusNoContent)
+
 		return
 	}
 
@@ -237,6 +572,8 @@ func (s *Server) handleNar(w http.ResponseWriter, r *http.Request) {
 		narhash, err := nixbase32.DecodeString(narhashStr)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Unable to decode narHash %v: %v", narhashStr, err), http.StatusBadRequest)
+
+			return
 		}
 
 		blobReader, size, err := s.blobStore.GetBlob(r.Context(), narhash)
@@ -252,31 +589,44 @@ func (s *Server) handleNar(w http.ResponseWriter, r *http.Request) {
 		}
 		defer blobReader.Close()
 
+		if r.Method == http.MethodGet {
+			s.recordNarAccess(narhash)
+		}
+
 		// check compression suffix, and serve a compressed file depending on that.
 		compressionSuffix := chi.URLParam(r, "compressionSuffix")
 
-		var writer io.Writer = w
-
 		if compressionSuffix != "" {
-			// We only support zstd, gzip, brotli and none, as the others are way too CPU-intensive,
-			// and never advertised anyways.
-			compressedWriter, err := compression.NewCompressorBySuffix(w, compressionSuffix)
+			compressionType, err := compression.SuffixToType(compressionSuffix)
 			if err != nil {
-				// We still serve a 404 (as Nix might send a HEAD request while trying to upload xz, for example)
 				http.Error(w, fmt.Sprintf("Unsupported compression suffix: %v", compressionSuffix), http.StatusNotFound)
+
+				return
 			}
-			defer compressedWriter.Close()
-			writer = compressedWriter
+
+			s.serveCompressedNar(w, r, narhash, blobReader, compressionType)
+
+			return
 		}
 
-		w.Header().Add("Content-Type", "application/x-nix-nar")
+		// Otherwise, the NAR file might still be compressed on the wire,
+		// if the client asks for it via Accept-Encoding.
+		if contentEncodings := s.NarContentEncodings(); len(contentEncodings) > 0 {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			contentEncoding := compression.NegotiateEncoding(r.Header.Get("Accept-Encoding"), contentEncodings)
+			if contentEncoding != "" {
+				w.Header().Add("Content-Encoding", contentEncoding)
+				s.serveCompressedNar(w, r, narhash, blobReader, contentEncoding)
 
-		// We can only advertise a content-length when we serve uncompressed Narfiles
-		if compressionSuffix == "" {
-			w.Header().Add("Content-Length", fmt.Sprintf("%d", size))
+				return
+			}
 		}
 
-		_, err = io.Copy(writer, blobReader)
+		w.Header().Add("Content-Type", "application/x-nix-nar")
+		w.Header().Add("Content-Length", fmt.Sprintf("%d", size))
+
+		_, err = io.Copy(w, blobReader)
 
 		if err != nil {
 			log.Errorf("Error sending Narfile to client: %v", err)
@@ -287,59 +637,150 @@ func (s *Server) handleNar(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//nolint:nestif
 	if r.Method == http.MethodPut {
-		blobWriter, err := s.blobStore.PutBlob(r.Context())
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error initializing blobWriter: %v", err), http.StatusInternalServerError)
-
+		if !s.checkQuota(w, r, contentLength(r)) || !s.admitUpload(w, contentLength(r)) {
 			return
 		}
-		defer blobWriter.Close()
 
-		// There might be suffixes indicating compression, wrap the request body via the generic decompressor
-		reader, err := compression.NewDecompressorBySuffix(r.Body, chi.URLParam(r, "compressionSuffix"))
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error initializing decompressor: %v", err), http.StatusInternalServerError)
+		// There might be suffixes indicating compression, wrap the request body via the generic decompressor.
+		// Without a suffix, the compression is detected, as Nix doesn't add one for all compression types.
+		var reader io.ReadCloser
+
+		var err error
+
+		if compressionSuffix := chi.URLParam(r, "compressionSuffix"); compressionSuffix != "" {
+			reader, err = compression.NewDecompressorBySuffix(r.Body, compressionSuffix)
+		} else {
+			reader, err = compression.NewDecompressorByMagic(r.Body)
 		}
 
-		// copy the body of the request into blobWriter
-		_, err = io.Copy(blobWriter, reader)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error copying to blobWriter: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error initializing decompressor: %v", err), http.StatusInternalServerError)
+
+			return
 		}
+		defer reader.Close()
 
-		err = blobWriter.Close()
+		_, err = s.ingestNar(r.Context(), reader)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Error closing blobWriter: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), ingestErrorStatus(err))
+
+			return
 		}
 
-		// Check if that NarMeta already exists
-		_, err = s.metadataStore.GetNarMeta(r.Context(), blobWriter.Sha256Sum())
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				http.Error(w, fmt.Sprintf("Error checking for existing NarMeta: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-				return
-			}
-			// We don't have this NarMeta yet, store it.
-			narMeta := &metadatastore.NarMeta{
-				NarHash: blobWriter.Sha256Sum(),
-				Size:    blobWriter.BytesWritten(),
-				// TODO: Scan for references, add them here instead of filling on the first .narinfo file upload
-			}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
 
-			err = s.metadataStore.PutNarMeta(r.Context(), narMeta)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error putting NarMeta: %v", err), http.StatusInternalServerError)
+// ingestNar reads a NAR file from r, and adds it to the blob store.
+// It creates a NarMeta for it, unless it already exists.
+// The NarMeta is returned.
+func (s *Server) ingestNar(ctx context.Context, r io.Reader) (*metadatastore.NarMeta, error) {
+	limited, err := s.limitUpload(ctx, r, 0)
+	if err != nil {
+		return nil, err
+	}
 
-				return
-			}
-		}
+	blobWriter, err := s.blobStore.PutBlob(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error initializing blobWriter: %w", err)
+	}
+
+	// copy the NAR file into blobWriter, ensuring it's a NAR file
+	stats, err := narcheck.Copy(blobWriter, limited)
+	if err != nil {
+		abortBlob(blobWriter)
+
+		return nil, fmt.Errorf("error copying to blobWriter: %w", err)
+	}
+
+	// This waits for the remaining chunks to be stored, which is aborted if the context is cancelled.
+	// In that case, we must not create a NarMeta.
+	err = blobWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error closing blobWriter: %w", err)
+	}
+
+	narMeta, err := s.ensureNarMeta(ctx, blobWriter.Sha256Sum(), blobWriter.BytesWritten(), stats)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &webhook.Event{
+		Type:    webhook.EventNarIngest,
+		NarHash: "sha256:" + nixbase32.EncodeToString(narMeta.NarHash),
+		NarSize: narMeta.Size,
+	}
 
+	if dedupStatser, ok := blobWriter.(blobstore.DedupStatser); ok {
+		dedupStats := dedupStatser.DedupStats()
+		e.Dedup = &dedupStats
+	}
+
+	s.publish(e)
+
+	return narMeta, nil
+}
+
+// abortBlob discards what was written to blobWriter so far, if the blob store supports it.
+// Otherwise, it's stored, and removed by the next gc run, as no NarMeta refers to it.
+func abortBlob(blobWriter blobstore.WriteCloseHasher) {
+	var err error
+
+	if aborter, ok := blobWriter.(blobstore.Aborter); ok {
+		err = aborter.Abort()
+	} else {
+		err = blobWriter.Close()
+	}
+
+	if err != nil {
+		log.Warnf("Error discarding incomplete blob: %v", err)
+	}
+}
+
+// ensureNarMeta creates a NarMeta for a NAR file already in the blob store, unless it already exists.
+// stats describes its contents, if known.
+// The NarMeta is returned.
+func (s *Server) ensureNarMeta(
+	ctx context.Context,
+	narHash []byte,
+	narSize uint64,
+	stats *narcheck.Stats,
+) (*metadatastore.NarMeta, error) {
+	// Check if that NarMeta already exists
+	narMeta, err := s.metadataStore.GetNarMeta(ctx, narHash)
+	if err == nil {
 		// We already had that NarMeta, nothing to be done
-		return
+		return narMeta, nil
 	}
 
-	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error checking for existing NarMeta: %w", err)
+	}
+
+	// We don't have this NarMeta yet, store it.
+	narMeta = &metadatastore.NarMeta{
+		NarHash:    narHash,
+		Size:       narSize,
+		UploadedBy: auth.FromContext(ctx),
+		UploadedAt: time.Now(),
+		// TODO: Scan for references, add them here instead of filling on the first .narinfo file upload
+	}
+
+	if stats != nil {
+		narMeta.Files = stats.Files
+		narMeta.LargestFile = stats.LargestFile
+		narMeta.LargestFileSize = stats.LargestFileSize
+	}
+
+	err = s.metadataStore.PutNarMeta(ctx, narMeta)
+	if err != nil {
+		return nil, fmt.Errorf("error putting NarMeta: %w", err)
+	}
+
+	s.addNarUsage(narMeta)
+
+	return narMeta, nil
 }
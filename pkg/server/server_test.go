@@ -3,19 +3,38 @@ package server_test
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/gc"
+	"github.com/flokli/nix-casync/pkg/quota"
 	"github.com/flokli/nix-casync/pkg/server"
 	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/pkg/signing"
 	"github.com/flokli/nix-casync/pkg/store/blobstore"
 	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/store/renditionstore"
+	"github.com/flokli/nix-casync/pkg/store/uploadstore"
 	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/flokli/nix-casync/pkg/webhook"
 	"github.com/flokli/nix-casync/test"
+	"github.com/folbricht/desync"
 	"github.com/klauspost/compress/zstd"
+	"github.com/nix-community/go-nix/pkg/hash"
 	"github.com/nix-community/go-nix/pkg/nar/narinfo"
 	"github.com/nix-community/go-nix/pkg/nixbase32"
 	"github.com/stretchr/testify/assert"
@@ -204,6 +223,7 @@ func TestHandler(t *testing.T) {
 		smallNarinfo := tdA.Narinfo
 		smallNarinfo.URL += ".zst"
 
+		// FileHash and FileSize are omitted, as there's no rendition store.
 		smallNarinfo.FileHash = nil
 		smallNarinfo.FileSize = 0
 		smallNarinfo.Compression = "zstd"
@@ -444,3 +464,2148 @@ func TestHandler(t *testing.T) {
 		assert.Equal(t, tdC.Narinfo.References, ni.References)
 	})
 }
+
+// TestTenants tests serving multiple caches sharing the same BlobStore.
+func TestTenants(t *testing.T) {
+	blobStore := blobstore.NewMemoryStore()
+	metadataStore := metadatastore.NewMemoryStore()
+	tenantMetadataStore := metadatastore.NewMemoryStore()
+
+	s := server.NewServer(blobStore, metadataStore, "zstd", 40)
+	defer s.Close()
+
+	err := s.MountTenant("team-a", server.NewServer(blobStore, tenantMetadataStore, "none", 30))
+	assert.NoError(t, err)
+
+	assert.Error(t, s.MountTenant("team-a", server.NewServer(blobStore, tenantMetadataStore, "none", 30)),
+		"mounting the same tenant twice should fail")
+	assert.Error(t, s.MountTenant("team/b", server.NewServer(blobStore, tenantMetadataStore, "none", 30)),
+		"mounting a tenant with an invalid name should fail")
+
+	testDataT := test.GetTestDataTable()
+
+	tdA, exists := testDataT["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+	narinfoPath := "/" + nixbase32.EncodeToString(tdAOutputHash) + ".narinfo"
+
+	t.Run("GET nix-cache-info", func(t *testing.T) {
+		resp := do("GET", "/cache/team-a/nix-cache-info", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), "Priority: 30\n")
+	})
+
+	t.Run("PUT .nar and .narinfo to tenant", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("PUT", "/cache/team-a"+narPath, tdA.NarContents).StatusCode)
+		assert.Equal(t, http.StatusOK, do("PUT", "/cache/team-a"+narinfoPath, tdA.NarinfoContents).StatusCode)
+		assert.Equal(t, http.StatusOK, do("GET", "/cache/team-a"+narinfoPath, nil).StatusCode)
+	})
+
+	t.Run("narinfo is not visible in other caches", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, do("GET", narinfoPath, nil).StatusCode)
+	})
+
+	t.Run("blob is shared", func(t *testing.T) {
+		_, _, err := blobStore.GetBlob(context.Background(), tdA.Narinfo.NarHash.Digest)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, do("GET", narPath, nil).StatusCode)
+	})
+}
+
+// TestUploads tests resumable uploads via upload sessions.
+func TestUploads(t *testing.T) {
+	blobStore := blobstore.NewMemoryStore()
+	metadataStore := metadatastore.NewMemoryStore()
+
+	s := server.NewServer(blobStore, metadataStore, "zstd", 40)
+	defer s.Close()
+
+	tmpDir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	uploadStore, err := uploadstore.NewFileStore(tmpDir)
+	if err != nil {
+		panic(err)
+	}
+
+	err = s.RegisterUploadHandlers(uploadStore, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDataT := test.GetTestDataTable()
+
+	tdA, exists := testDataT["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	do := func(method, path string, body []byte, header http.Header) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	resp := do("POST", "/_upload", nil, nil)
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+		return
+	}
+
+	location := resp.Header.Get("Location")
+	half := len(tdA.NarContents) / 2
+
+	t.Run("PATCH first half", func(t *testing.T) {
+		resp := do("PATCH", location, tdA.NarContents[:half], http.Header{"Upload-Offset": {"0"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("%d", half), resp.Header.Get("Upload-Offset"))
+	})
+
+	t.Run("PATCH at wrong offset", func(t *testing.T) {
+		resp := do("PATCH", location, tdA.NarContents[half:], http.Header{"Upload-Offset": {"0"}})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("%d", half), resp.Header.Get("Upload-Offset"))
+	})
+
+	t.Run("HEAD to resume", func(t *testing.T) {
+		resp := do("HEAD", location, nil, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("%d", half), resp.Header.Get("Upload-Offset"))
+	})
+
+	t.Run("PATCH second half", func(t *testing.T) {
+		resp := do("PATCH", location, tdA.NarContents[half:], http.Header{"Upload-Offset": {fmt.Sprintf("%d", half)}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		resp := do("POST", location+"/commit", nil, nil)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+		// poll until the commit finished
+		var status struct {
+			State   string `json:"state"`
+			NarHash string `json:"narHash"`
+		}
+
+		for i := 0; i < 100 && status.State != "committed"; i++ {
+			time.Sleep(10 * time.Millisecond)
+
+			resp := do("GET", location, nil, nil)
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		}
+
+		assert.Equal(t, "committed", status.State)
+		assert.Equal(t, tdA.Narinfo.NarHash.String(), status.NarHash)
+
+		narMeta, err := metadataStore.GetNarMeta(context.Background(), tdA.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdA.Narinfo.NarSize, narMeta.Size)
+		}
+	})
+
+	t.Run("PATCH after commit", func(t *testing.T) {
+		resp := do("PATCH", location, []byte{0x00}, http.Header{"Upload-Offset": {fmt.Sprintf("%d", tdA.Narinfo.NarSize)}})
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("DELETE", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do("DELETE", location, nil, nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do("GET", location, nil, nil).StatusCode)
+	})
+}
+
+// TestChunks tests the error cases of client-side chunked uploads
+// (the happy path is tested together with the client),
+// and fetching chunks and indexes via the casync-native endpoints.
+func TestChunks(t *testing.T) {
+	castrDir, err := ioutil.TempDir("", "castr")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(castrDir)
+	})
+
+	caidxDir, err := ioutil.TempDir("", "caidx")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(caidxDir)
+	})
+
+	blobStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, "", 65536, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		panic(err)
+	}
+
+	s := server.NewServer(blobStore, metadatastore.NewMemoryStore(), "zstd", 40)
+	defer s.Close()
+
+	tdA, exists := test.GetTestDataTable()["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	chunk := desync.NewChunkFromUncompressed(tdA.NarContents)
+	compressed, err := chunk.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := desync.Index{
+		Index: desync.FormatIndex{
+			FeatureFlags: desync.CaFormatExcludeNoDump | desync.CaFormatSHA512256,
+			ChunkSizeMin: 16384,
+			ChunkSizeAvg: 65536,
+			ChunkSizeMax: 262144,
+		},
+		Chunks: []desync.IndexChunk{{ID: chunk.ID(), Start: 0, Size: uint64(len(tdA.NarContents))}},
+	}
+
+	var indexBuf bytes.Buffer
+
+	_, err = index.WriteTo(&indexBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	narhashStr := nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest)
+
+	t.Run("missing chunks", func(t *testing.T) {
+		resp := do("POST", "/_chunks/missing", indexBuf.Bytes())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var missing struct {
+			Missing []string `json:"missing"`
+		}
+
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&missing))
+		assert.Equal(t, []string{chunk.ID().String()}, missing.Missing)
+	})
+
+	t.Run("PUT index before chunks", func(t *testing.T) {
+		resp := do("PUT", "/_index/"+narhashStr, indexBuf.Bytes())
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("PUT chunk with wrong id", func(t *testing.T) {
+		wrongID := desync.NewChunkFromUncompressed([]byte("foo")).ID()
+		resp := do("PUT", "/_chunks/"+wrongID.String(), compressed)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("PUT chunk", func(t *testing.T) {
+		resp := do("PUT", "/_chunks/"+chunk.ID().String(), compressed)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("PUT index with wrong narhash", func(t *testing.T) {
+		tdB := test.GetTestDataTable()["b"]
+		resp := do("PUT", "/_index/"+nixbase32.EncodeToString(tdB.Narinfo.NarHash.Digest), indexBuf.Bytes())
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("PUT index", func(t *testing.T) {
+		resp := do("PUT", "/_index/"+narhashStr, indexBuf.Bytes())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = do("GET", "/nar/"+narhashStr+".nar", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("PUT index of invalid NAR file", func(t *testing.T) {
+		invalid := test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "b", Node: test.NarFile("b")},
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+		))
+		invalidSum := sha256.Sum256(invalid)
+		invalidHashStr := nixbase32.EncodeToString(invalidSum[:])
+
+		invalidChunk := desync.NewChunkFromUncompressed(invalid)
+
+		invalidCompressed, err := invalidChunk.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		invalidIndex := index
+		invalidIndex.Chunks = []desync.IndexChunk{{ID: invalidChunk.ID(), Start: 0, Size: uint64(len(invalid))}}
+
+		var invalidIndexBuf bytes.Buffer
+
+		_, err = invalidIndex.WriteTo(&invalidIndexBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := do("PUT", "/_chunks/"+invalidChunk.ID().String(), invalidCompressed)
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = do("PUT", "/_index/"+invalidHashStr, invalidIndexBuf.Bytes())
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "invalid nar")
+
+		resp = do("GET", "/nar/"+invalidHashStr+".nar", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	// the chunk and index are now available via the casync-native endpoints,
+	// using desync as a client.
+	srv := httptest.NewServer(s.Handler)
+	defer srv.Close()
+
+	t.Run("desync chunk store", func(t *testing.T) {
+		u, err := url.Parse(srv.URL + "/castr/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remoteStore, err := desync.NewRemoteHTTPStore(u, desync.StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hasChunk, err := remoteStore.HasChunk(chunk.ID())
+		if assert.NoError(t, err) {
+			assert.True(t, hasChunk)
+		}
+
+		remoteChunk, err := remoteStore.GetChunk(chunk.ID())
+		if assert.NoError(t, err) {
+			b, err := remoteChunk.Uncompressed()
+			assert.NoError(t, err)
+			assert.Equal(t, tdA.NarContents, b)
+		}
+
+		hasChunk, err = remoteStore.HasChunk(desync.NewChunkFromUncompressed([]byte("foo")).ID())
+		if assert.NoError(t, err) {
+			assert.False(t, hasChunk)
+		}
+	})
+
+	t.Run("desync index store", func(t *testing.T) {
+		u, err := url.Parse(srv.URL + "/caibx/")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remoteIndexStore, err := desync.NewRemoteHTTPIndexStore(u, desync.StoreOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		remoteIndex, err := remoteIndexStore.GetIndex(narhashStr + ".caibx")
+		if assert.NoError(t, err) {
+			assert.Equal(t, index.Chunks, remoteIndex.Chunks)
+		}
+	})
+
+	t.Run("GET castr with wrong prefix", func(t *testing.T) {
+		resp := do("GET", "/castr/0000/"+chunk.ID().String()+".cacnk", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("GET index for narinfo", func(t *testing.T) {
+		outputhash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+		if err != nil {
+			panic(err)
+		}
+
+		outputhashStr := nixbase32.EncodeToString(outputhash)
+
+		resp := do("GET", "/"+outputhashStr+".caibx", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, "without a .narinfo, there should be no index")
+
+		resp = do("PUT", "/"+outputhashStr+".narinfo", tdA.NarinfoContents)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = do("GET", "/"+outputhashStr+".caibx", nil)
+		if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			remoteIndex, err := desync.IndexFromReader(resp.Body)
+			if assert.NoError(t, err) {
+				assert.Equal(t, index.Chunks, remoteIndex.Chunks)
+			}
+		}
+	})
+}
+
+// TestRenditions tests serving compressed NAR files from a rendition store.
+func TestRenditions(t *testing.T) {
+	s := server.NewServer(blobstore.NewMemoryStore(), metadatastore.NewMemoryStore(), "zstd", 40)
+	defer s.Close()
+
+	tmpDir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	renditionStore, err := renditionstore.NewFileStore(tmpDir, 1024*1024)
+	if err != nil {
+		panic(err)
+	}
+
+	s.SetRenditionStore(renditionStore)
+
+	tdA, exists := test.GetTestDataTable()["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	if resp := do("PUT", narPath, tdA.NarContents); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	getDecompressed := func(t *testing.T, resp *http.Response) []byte {
+		t.Helper()
+
+		dec, err := zstd.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dec.Close()
+
+		b, err := ioutil.ReadAll(dec)
+		assert.NoError(t, err)
+
+		return b
+	}
+
+	t.Run("GET populates the rendition store", func(t *testing.T) {
+		resp := do("GET", narPath+".zst", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Length"))
+		assert.Equal(t, tdA.NarContents, getDecompressed(t, resp))
+	})
+
+	t.Run("GET from the rendition store", func(t *testing.T) {
+		resp := do("GET", narPath+".zst", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Content-Length"))
+		assert.Equal(t, tdA.NarContents, getDecompressed(t, resp))
+	})
+
+	t.Run("HEAD from the rendition store", func(t *testing.T) {
+		resp := do("HEAD", narPath+".zst", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Content-Length"))
+	})
+
+	t.Run("unsupported compression", func(t *testing.T) {
+		resp := do("GET", narPath+".xz", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	narinfoPath := "/" + nixbase32.EncodeToString(tdAOutputHash) + ".narinfo"
+
+	if resp := do("PUT", narinfoPath, []byte(tdA.Narinfo.String())); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	getNarinfo := func(t *testing.T) *narinfo.NarInfo {
+		t.Helper()
+
+		resp := do("GET", narinfoPath, nil)
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			t.FailNow()
+		}
+
+		ni, err := narinfo.Parse(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ni
+	}
+
+	t.Run("narinfo describes the rendition", func(t *testing.T) {
+		resp := do("GET", narPath+".zst", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fileHash := sha256.Sum256(b)
+
+		ni := getNarinfo(t)
+		if assert.NotNil(t, ni.FileHash) {
+			assert.Equal(t, fileHash[:], ni.FileHash.Digest)
+		}
+
+		assert.Equal(t, uint64(len(b)), ni.FileSize)
+	})
+
+	t.Run("narinfo without rendition", func(t *testing.T) {
+		s.SetNarServeCompression("gzip")
+		defer s.SetNarServeCompression("zstd")
+
+		ni := getNarinfo(t)
+		assert.Nil(t, ni.FileHash)
+		assert.Equal(t, uint64(0), ni.FileSize)
+
+		_, _, err := renditionStore.Stat(tdA.Narinfo.NarHash.Digest, "gzip")
+		assert.ErrorIs(t, err, os.ErrNotExist, "rendering the .narinfo shouldn't compress the NAR file")
+	})
+
+	t.Run("narinfo without compression", func(t *testing.T) {
+		s.SetNarServeCompression("none")
+		defer s.SetNarServeCompression("zstd")
+
+		ni := getNarinfo(t)
+		if assert.NotNil(t, ni.FileHash) {
+			assert.Equal(t, tdA.Narinfo.NarHash.Digest, ni.FileHash.Digest)
+		}
+
+		assert.Equal(t, tdA.Narinfo.NarSize, ni.FileSize)
+	})
+}
+
+func TestContentNegotiation(t *testing.T) {
+	s := server.NewServer(blobstore.NewMemoryStore(), metadatastore.NewMemoryStore(), "none", 40)
+	defer s.Close()
+
+	tdA, exists := test.GetTestDataTable()["a"]
+	if !exists {
+		panic("testData[a] doesn't exist")
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+
+	do := func(method, path, acceptEncoding string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	if resp := do("PUT", narPath, "", tdA.NarContents); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		resp := do("GET", narPath, "zstd", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Empty(t, resp.Header.Get("Vary"))
+
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tdA.NarContents, b)
+	})
+
+	s.SetNarContentEncodings([]string{"zstd", "br", "gzip"})
+
+	t.Run("no Accept-Encoding", func(t *testing.T) {
+		resp := do("GET", narPath, "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+		assert.Equal(t, fmt.Sprintf("%d", len(tdA.NarContents)), resp.Header.Get("Content-Length"))
+
+		b, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, tdA.NarContents, b)
+	})
+
+	for _, tc := range []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{acceptEncoding: "gzip, br, zstd", contentEncoding: "zstd"},
+		{acceptEncoding: "zstd;q=0, br", contentEncoding: "br"},
+		{acceptEncoding: "gzip", contentEncoding: "gzip"},
+	} {
+		tc := tc
+
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			resp := do("GET", narPath, tc.acceptEncoding, nil)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tc.contentEncoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+			dec, err := compression.NewDecompressor(resp.Body, tc.contentEncoding)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer dec.Close()
+
+			b, err := ioutil.ReadAll(dec)
+			assert.NoError(t, err)
+			assert.Equal(t, tdA.NarContents, b)
+		})
+	}
+
+	t.Run("suffixes are not affected", func(t *testing.T) {
+		resp := do("GET", narPath+".zst", "gzip", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	})
+}
+
+func TestCompressedUploads(t *testing.T) {
+	tdB, exists := test.GetTestDataTable()["b"]
+	if !exists {
+		panic("testData[b] doesn't exist")
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdB.Narinfo.NarHash.Digest) + ".nar"
+
+	for compressionType, compressed := range tdB.CompressedNarContents {
+		compressionType, compressed := compressionType, compressed
+
+		t.Run(compressionType, func(t *testing.T) {
+			s := server.NewServer(blobstore.NewMemoryStore(), metadatastore.NewMemoryStore(), "none", 40)
+			defer s.Close()
+
+			suffix, err := compression.TypeToSuffix(compressionType)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Nix doesn't add a suffix for all compression types, so these are detected.
+			for _, p := range []string{narPath + suffix, narPath} {
+				rr := httptest.NewRecorder()
+				req := httptest.NewRequest("PUT", p, bytes.NewReader(compressed))
+				s.Handler.ServeHTTP(rr, req)
+
+				if !assert.Equal(t, http.StatusOK, rr.Result().StatusCode, p) {
+					return
+				}
+
+				rr = httptest.NewRecorder()
+				req = httptest.NewRequest("GET", narPath, nil)
+				s.Handler.ServeHTTP(rr, req)
+
+				assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+				assert.Equal(t, tdB.NarContents, rr.Body.Bytes(), p)
+			}
+		})
+	}
+}
+
+// TestClosure tests reporting closure sizes.
+func TestClosure(t *testing.T) {
+	castrDir, err := ioutil.TempDir("", "castr")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(castrDir)
+	})
+
+	caidxDir, err := ioutil.TempDir("", "caidx")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(caidxDir)
+	})
+
+	blobStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, "", 65536, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		panic(err)
+	}
+
+	s := server.NewServer(blobStore, metadatastore.NewMemoryStore(), "zstd", 40)
+	defer s.Close()
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	testDataT := test.GetTestDataTable()
+	outputHashes := make(map[string]string)
+
+	// B refers to A, so A needs to be uploaded first.
+	for _, name := range []string{"a", "b", "c"} {
+		td := testDataT[name]
+
+		outputHash, err := util.GetHashFromStorePath(td.Narinfo.StorePath)
+		if err != nil {
+			panic(err)
+		}
+
+		outputHashes[name] = nixbase32.EncodeToString(outputHash)
+
+		narPath := "/nar/" + nixbase32.EncodeToString(td.Narinfo.NarHash.Digest) + ".nar"
+		if resp := do("PUT", narPath, td.NarContents); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		narinfoPath := "/" + outputHashes[name] + ".narinfo"
+		if resp := do("PUT", narinfoPath, []byte(td.Narinfo.String())); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+	}
+
+	type closureResponse struct {
+		StorePath string `json:"storePath"`
+		Paths     []struct {
+			StorePath string `json:"storePath"`
+			NarSize   uint64 `json:"narSize"`
+		} `json:"paths"`
+		Missing    []string `json:"missing"`
+		NarSize    uint64   `json:"narSize"`
+		ChunkBytes *uint64  `json:"chunkBytes"`
+		Diff       *struct {
+			StorePath         string   `json:"storePath"`
+			Added             []string `json:"added"`
+			Removed           []string `json:"removed"`
+			AddedNarSize      uint64   `json:"addedNarSize"`
+			RemovedNarSize    uint64   `json:"removedNarSize"`
+			AddedChunkBytes   *uint64  `json:"addedChunkBytes"`
+			RemovedChunkBytes *uint64  `json:"removedChunkBytes"`
+		} `json:"diff"`
+	}
+
+	getClosure := func(t *testing.T, path string) *closureResponse {
+		t.Helper()
+
+		resp := do("GET", path, nil)
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			t.FailNow()
+		}
+
+		var closure closureResponse
+		if err := json.NewDecoder(resp.Body).Decode(&closure); err != nil {
+			t.Fatal(err)
+		}
+
+		return &closure
+	}
+
+	tdA, tdB, tdC := testDataT["a"], testDataT["b"], testDataT["c"]
+
+	t.Run("closure", func(t *testing.T) {
+		closure := getClosure(t, "/_closure/"+outputHashes["b"])
+
+		assert.Equal(t, tdB.Narinfo.StorePath, closure.StorePath)
+
+		if assert.Len(t, closure.Paths, 2) {
+			// sorted by store path
+			assert.Equal(t, tdB.Narinfo.StorePath, closure.Paths[0].StorePath)
+			assert.Equal(t, tdB.Narinfo.NarSize, closure.Paths[0].NarSize)
+			assert.Equal(t, tdA.Narinfo.StorePath, closure.Paths[1].StorePath)
+		}
+
+		assert.Empty(t, closure.Missing)
+		assert.Equal(t, tdA.Narinfo.NarSize+tdB.Narinfo.NarSize, closure.NarSize)
+
+		// both NAR files are smaller than the minimum chunk size, so each is a single chunk.
+		if assert.NotNil(t, closure.ChunkBytes) {
+			assert.Equal(t, tdA.Narinfo.NarSize+tdB.Narinfo.NarSize, *closure.ChunkBytes)
+		}
+
+		assert.Nil(t, closure.Diff)
+	})
+
+	t.Run("self-reference", func(t *testing.T) {
+		closure := getClosure(t, "/_closure/"+outputHashes["c"])
+		assert.Len(t, closure.Paths, 1)
+		assert.Equal(t, tdC.Narinfo.NarSize, closure.NarSize)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		closure := getClosure(t, "/_closure/"+outputHashes["b"]+"?diff="+outputHashes["a"])
+		if !assert.NotNil(t, closure.Diff) {
+			return
+		}
+
+		assert.Equal(t, tdA.Narinfo.StorePath, closure.Diff.StorePath)
+		assert.Equal(t, []string{tdB.Narinfo.StorePath}, closure.Diff.Added)
+		assert.Empty(t, closure.Diff.Removed)
+		assert.Equal(t, tdB.Narinfo.NarSize, closure.Diff.AddedNarSize)
+		assert.Equal(t, uint64(0), closure.Diff.RemovedNarSize)
+
+		if assert.NotNil(t, closure.Diff.AddedChunkBytes) && assert.NotNil(t, closure.Diff.RemovedChunkBytes) {
+			assert.Equal(t, tdB.Narinfo.NarSize, *closure.Diff.AddedChunkBytes)
+			assert.Equal(t, uint64(0), *closure.Diff.RemovedChunkBytes)
+		}
+	})
+
+	t.Run("diff disjoint", func(t *testing.T) {
+		closure := getClosure(t, "/_closure/"+outputHashes["a"]+"?diff="+outputHashes["c"])
+		if !assert.NotNil(t, closure.Diff) {
+			return
+		}
+
+		assert.Equal(t, []string{tdA.Narinfo.StorePath}, closure.Diff.Added)
+		assert.Equal(t, []string{tdC.Narinfo.StorePath}, closure.Diff.Removed)
+
+		if assert.NotNil(t, closure.Diff.RemovedChunkBytes) {
+			assert.Equal(t, tdC.Narinfo.NarSize, *closure.Diff.RemovedChunkBytes)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		resp := do("GET", "/_closure/"+nixbase32.EncodeToString(make([]byte, 20)), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp = do("GET", "/_closure/"+outputHashes["a"]+"?diff="+nixbase32.EncodeToString(make([]byte, 20)), nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("invalid diff", func(t *testing.T) {
+		resp := do("GET", "/_closure/"+outputHashes["a"]+"?diff=foo", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestChanges(t *testing.T) {
+	s := server.NewServer(blobstore.NewMemoryStore(), metadatastore.NewMemoryStore(), "none", 40)
+	srv := httptest.NewServer(s.Handler)
+
+	t.Cleanup(func() {
+		s.StopStreams()
+		srv.Close()
+		s.Close()
+	})
+
+	do := func(method, path string, body []byte, header http.Header) *http.Response {
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			resp.Body.Close()
+		})
+
+		return resp
+	}
+
+	getChanges := func(query string) (changes []map[string]interface{}, next uint64) {
+		resp := do("GET", "/_changes?"+query, nil, nil)
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return nil, 0
+		}
+
+		var body struct {
+			Changes []map[string]interface{} `json:"changes"`
+			Next    uint64                   `json:"next"`
+		}
+
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+		return body.Changes, body.Next
+	}
+
+	tdA := test.GetTestDataTable()["a"]
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+	narinfoPath := "/" + nixbase32.EncodeToString(tdAOutputHash) + ".narinfo"
+
+	t.Run("empty", func(t *testing.T) {
+		changes, next := getChanges("since=0")
+		assert.Empty(t, changes)
+		assert.Equal(t, uint64(0), next)
+	})
+
+	t.Run("invalid since", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do("GET", "/_changes?since=foo", nil, nil).StatusCode)
+	})
+
+	assert.Equal(t, http.StatusOK, do("PUT", narPath, tdA.NarContents, nil).StatusCode)
+	assert.Equal(t, http.StatusOK, do("PUT", narinfoPath, []byte(tdA.Narinfo.String()), nil).StatusCode)
+
+	t.Run("add", func(t *testing.T) {
+		changes, next := getChanges("since=0")
+		if assert.Len(t, changes, 1) {
+			assert.Equal(t, "add", changes[0]["type"])
+			assert.Equal(t, tdA.Narinfo.StorePath, changes[0]["storePath"])
+			assert.Equal(t, tdA.Narinfo.NarHash.String(), changes[0]["narHash"])
+		}
+
+		assert.Equal(t, uint64(1), next)
+
+		changes, next = getChanges("since=1")
+		assert.Empty(t, changes)
+		assert.Equal(t, uint64(1), next)
+	})
+
+	t.Run("DELETE .narinfo", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do("DELETE", narinfoPath, nil, nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do("GET", narinfoPath, nil, nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do("DELETE", narinfoPath, nil, nil).StatusCode)
+
+		changes, next := getChanges("since=1")
+		if assert.Len(t, changes, 1) {
+			assert.Equal(t, "delete", changes[0]["type"])
+			assert.Equal(t, tdA.Narinfo.StorePath, changes[0]["storePath"])
+		}
+
+		assert.Equal(t, uint64(2), next)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		changes, next := getChanges("since=0&limit=1")
+		assert.Len(t, changes, 1)
+		assert.Equal(t, uint64(1), next)
+	})
+
+	t.Run("long-poll", func(t *testing.T) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			do("PUT", narinfoPath, []byte(tdA.Narinfo.String()), nil)
+		}()
+
+		start := time.Now()
+		changes, next := getChanges("since=2&wait=30s")
+
+		assert.Less(t, time.Since(start), 10*time.Second, "should return as soon as there are changes")
+		assert.Len(t, changes, 1)
+		assert.Equal(t, uint64(3), next)
+
+		// without changes, it returns after the wait duration.
+		changes, _ = getChanges("since=3&wait=10ms")
+		assert.Empty(t, changes)
+	})
+
+	t.Run("event stream", func(t *testing.T) {
+		resp := do("GET", "/_changes", nil, http.Header{
+			"Accept":        []string{"text/event-stream"},
+			"Last-Event-ID": []string{"1"},
+		})
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			do("DELETE", narinfoPath, nil, nil)
+		}()
+
+		// seq 2 and 3 are already there, 4 is sent once it happens.
+		buf := make([]byte, 0, 4096)
+		for !bytes.Contains(buf, []byte("id: 4\n")) {
+			b := make([]byte, 1024)
+
+			n, err := resp.Body.Read(b)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			buf = append(buf, b[:n]...)
+		}
+
+		assert.NotContains(t, string(buf), "id: 1\n")
+		assert.Contains(t, string(buf), "id: 2\nevent: delete\ndata: {")
+		assert.Contains(t, string(buf), "id: 3\nevent: add\n")
+		assert.Contains(t, string(buf), "id: 4\nevent: delete\n")
+
+		// the stream ends on shutdown
+		s.StopStreams()
+
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		assert.NoError(t, err)
+	})
+}
+
+// TestChangesStreamWriteTimeout tests event streams outlive the write timeout of the HTTP server.
+func TestChangesStreamWriteTimeout(t *testing.T) {
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobstore.NewMemoryStore(), metadataStore, "none", 40)
+	srv := httptest.NewUnstartedServer(s.Handler)
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Config.ConnContext = server.ConnContext
+	srv.Start()
+
+	t.Cleanup(func() {
+		s.StopStreams()
+		srv.Close()
+		s.Close()
+	})
+
+	req, err := http.NewRequestWithContext(context.Background(), "GET", srv.URL+"/_changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	go func() {
+		time.Sleep(4 * srv.Config.WriteTimeout)
+
+		pathInfo, narMeta, err := metadatastore.ParseNarinfo(test.GetTestDataTable()["a"].Narinfo)
+		if err != nil {
+			panic(err)
+		}
+
+		_ = metadataStore.PutNarMeta(context.Background(), narMeta)
+		_ = metadataStore.PutPathInfo(context.Background(), pathInfo)
+	}()
+
+	buf := make([]byte, 0, 4096)
+	for !bytes.Contains(buf, []byte("id: 1\n")) {
+		b := make([]byte, 1024)
+
+		n, err := resp.Body.Read(b)
+		if !assert.NoError(t, err, "the stream shouldn't end at the write timeout") {
+			return
+		}
+
+		buf = append(buf, b[:n]...)
+	}
+
+	assert.Contains(t, string(buf), "id: 1\nevent: add\n")
+}
+
+func TestWebhooks(t *testing.T) {
+	castrDir, err := ioutil.TempDir("", "castr")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(castrDir)
+	})
+
+	caidxDir, err := ioutil.TempDir("", "caidx")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(caidxDir)
+	})
+
+	outboxDir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(outboxDir)
+	})
+
+	events := make(chan *webhook.Event, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e webhook.Event
+
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			panic(err)
+		}
+
+		events <- &e
+	}))
+	defer receiver.Close()
+
+	outbox, err := webhook.OpenOutbox(outboxDir, webhook.Options{
+		Endpoints: []*webhook.Endpoint{{URL: receiver.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outboxDone := make(chan struct{})
+
+	go func() {
+		outbox.Run(ctx)
+		close(outboxDone)
+	}()
+
+	defer func() {
+		cancel()
+		<-outboxDone
+	}()
+
+	blobStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, "", 192, blobstore.ChunkStoreOptions{})
+	if err != nil {
+		panic(err)
+	}
+
+	s := server.NewServer(blobStore, metadatastore.NewMemoryStore(), "none", 40)
+	defer s.Close()
+
+	s.SetWebhooks(outbox, "")
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	next := func() *webhook.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for event")
+		}
+
+		return nil
+	}
+
+	tdA := test.GetTestDataTable()["a"]
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+	narinfoPath := "/" + nixbase32.EncodeToString(tdAOutputHash) + ".narinfo"
+
+	t.Run("nar.ingest", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("PUT", narPath, tdA.NarContents).StatusCode)
+
+		e := next()
+		assert.Equal(t, webhook.EventNarIngest, e.Type)
+		assert.Equal(t, tdA.Narinfo.NarHash.String(), e.NarHash)
+		assert.Equal(t, tdA.Narinfo.NarSize, e.NarSize)
+
+		if assert.NotNil(t, e.Dedup) {
+			assert.Greater(t, e.Dedup.Chunks, uint64(0))
+			assert.Equal(t, e.Dedup.Chunks, e.Dedup.NewChunks, "all chunks should be new")
+			assert.Equal(t, tdA.Narinfo.NarSize, e.Dedup.NewChunkBytes)
+		}
+
+		// uploading it again doesn't add any chunks
+		assert.Equal(t, http.StatusOK, do("PUT", narPath, tdA.NarContents).StatusCode)
+
+		e = next()
+		if assert.NotNil(t, e.Dedup) {
+			assert.Greater(t, e.Dedup.Chunks, uint64(0))
+			assert.Equal(t, uint64(0), e.Dedup.NewChunks)
+		}
+	})
+
+	t.Run("narinfo.put", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("PUT", narinfoPath, []byte(tdA.Narinfo.String())).StatusCode)
+
+		e := next()
+		assert.Equal(t, webhook.EventNarinfoPut, e.Type)
+		assert.Equal(t, tdA.Narinfo.StorePath, e.StorePath)
+		assert.Equal(t, tdA.Narinfo.NarHash.String(), e.NarHash)
+		assert.Equal(t, tdA.Narinfo.NarSize, e.NarSize)
+	})
+
+	t.Run("narinfo.delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do("DELETE", narinfoPath, nil).StatusCode)
+
+		e := next()
+		assert.Equal(t, webhook.EventNarinfoDelete, e.Type)
+		assert.Equal(t, tdA.Narinfo.StorePath, e.StorePath)
+	})
+}
+
+func TestPins(t *testing.T) {
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobstore.NewMemoryStore(), metadataStore, "none", 40)
+
+	defer s.Close()
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	tdA := test.GetTestDataTable()["a"]
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	narPath := "/nar/" + nixbase32.EncodeToString(tdA.Narinfo.NarHash.Digest) + ".nar"
+	narinfoPath := "/" + nixbase32.EncodeToString(tdAOutputHash) + ".narinfo"
+
+	t.Run("pin non-existent store path", func(t *testing.T) {
+		resp := do("PUT", "/_pins/release", []byte(tdA.Narinfo.StorePath))
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	assert.Equal(t, http.StatusOK, do("PUT", narPath, tdA.NarContents).StatusCode)
+	assert.Equal(t, http.StatusOK, do("PUT", narinfoPath, []byte(tdA.Narinfo.String())).StatusCode)
+
+	t.Run("upload time", func(t *testing.T) {
+		pathInfo, err := metadataStore.GetPathInfo(context.Background(), tdAOutputHash)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.WithinDuration(t, time.Now(), pathInfo.UploadedAt, time.Minute)
+
+		// uploading again keeps it
+		uploadedAt := pathInfo.UploadedAt
+
+		assert.Equal(t, http.StatusOK, do("PUT", narinfoPath, []byte(tdA.Narinfo.String())).StatusCode)
+
+		pathInfo, err = metadataStore.GetPathInfo(context.Background(), tdAOutputHash)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uploadedAt, pathInfo.UploadedAt)
+		}
+	})
+
+	t.Run("PUT pin", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("PUT", "/_pins/release", []byte(tdA.Narinfo.StorePath+"\n")).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, do("PUT", "/_pins/release", []byte("foo")).StatusCode)
+		assert.Equal(t, http.StatusBadRequest, do("PUT", "/_pins/..", []byte(tdA.Narinfo.StorePath)).StatusCode)
+	})
+
+	t.Run("GET pins", func(t *testing.T) {
+		resp := do("GET", "/_pins/release", nil)
+		if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			var p map[string]string
+
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+			assert.Equal(t, tdA.Narinfo.StorePath, p["storePath"])
+		}
+
+		resp = do("GET", "/_pins", nil)
+		if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			var body struct {
+				Pins []map[string]string `json:"pins"`
+			}
+
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+			if assert.Len(t, body.Pins, 1) {
+				assert.Equal(t, "release", body.Pins[0]["name"])
+			}
+		}
+
+		assert.Equal(t, http.StatusNotFound, do("GET", "/_pins/other", nil).StatusCode)
+	})
+
+	t.Run("pinned store paths can't be deleted", func(t *testing.T) {
+		assert.Equal(t, http.StatusConflict, do("DELETE", narinfoPath, nil).StatusCode)
+	})
+
+	t.Run("DELETE pin", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do("DELETE", "/_pins/release", nil).StatusCode)
+		assert.Equal(t, http.StatusNotFound, do("DELETE", "/_pins/release", nil).StatusCode)
+		assert.Equal(t, http.StatusNoContent, do("DELETE", narinfoPath, nil).StatusCode)
+	})
+}
+
+func TestAccess(t *testing.T) {
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobstore.NewMemoryStore(), metadataStore, "none", 40)
+
+	defer s.Close()
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	upload := func(td test.Data) []byte {
+		outputHash, err := util.GetHashFromStorePath(td.Narinfo.StorePath)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.Equal(t, http.StatusOK, do("PUT", narPathFor(td), td.NarContents).StatusCode)
+		assert.Equal(t, http.StatusOK, do("PUT", narinfoPathFor(outputHash), []byte(td.Narinfo.String())).StatusCode)
+
+		return outputHash
+	}
+
+	getPathInfo := func(outputHash []byte) *metadatastore.PathInfo {
+		assert.NoError(t, s.FlushAccess(context.Background()))
+
+		pathInfo, err := metadataStore.GetPathInfo(context.Background(), outputHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pathInfo
+	}
+
+	tdA := test.GetTestDataTable()["a"]
+	tdB := test.GetTestDataTable()["b"]
+
+	tdAOutputHash := upload(tdA)
+
+	t.Run("not accessed yet", func(t *testing.T) {
+		pathInfo := getPathInfo(tdAOutputHash)
+		assert.True(t, pathInfo.LastAccessedAt.IsZero())
+		assert.Equal(t, uint64(0), pathInfo.Hits)
+	})
+
+	t.Run("narinfo", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("HEAD", narinfoPathFor(tdAOutputHash), nil).StatusCode)
+		assert.True(t, getPathInfo(tdAOutputHash).LastAccessedAt.IsZero(), "HEAD shouldn't count as access")
+
+		assert.Equal(t, http.StatusOK, do("GET", narinfoPathFor(tdAOutputHash), nil).StatusCode)
+
+		pathInfo := getPathInfo(tdAOutputHash)
+		assert.WithinDuration(t, time.Now(), pathInfo.LastAccessedAt, time.Minute)
+		assert.Equal(t, uint64(0), pathInfo.Hits, "only NAR downloads are hits")
+	})
+
+	t.Run("NAR", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("GET", narPathFor(tdA), nil).StatusCode)
+		assert.Equal(t, http.StatusOK, do("GET", narPathFor(tdA), nil).StatusCode)
+		assert.Equal(t, uint64(2), getPathInfo(tdAOutputHash).Hits)
+	})
+
+	t.Run("NAR uploaded later", func(t *testing.T) {
+		tdBOutputHash := upload(tdB)
+
+		assert.Equal(t, http.StatusOK, do("GET", narPathFor(tdB), nil).StatusCode)
+		assert.Equal(t, uint64(1), getPathInfo(tdBOutputHash).Hits)
+		assert.Equal(t, uint64(2), getPathInfo(tdAOutputHash).Hits)
+	})
+
+	t.Run("uploading again keeps accesses", func(t *testing.T) {
+		changes, err := metadataStore.Changes(context.Background(), 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload(tdA)
+		assert.Equal(t, uint64(2), getPathInfo(tdAOutputHash).Hits)
+
+		changesAfter, err := metadataStore.Changes(context.Background(), 0, 100)
+		if assert.NoError(t, err) {
+			assert.Len(t, changesAfter, len(changes), "uploading the same .narinfo again shouldn't be a change")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp := do("GET", "/_narinfos?details=1", nil)
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		var body struct {
+			StorePaths []string `json:"storePaths"`
+			Paths      []struct {
+				StorePath      string     `json:"storePath"`
+				UploadedAt     *time.Time `json:"uploadedAt"`
+				LastAccessedAt *time.Time `json:"lastAccessedAt"`
+				Hits           uint64     `json:"hits"`
+			} `json:"paths"`
+		}
+
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+		if assert.Len(t, body.Paths, 2) {
+			for _, p := range body.Paths {
+				assert.NotNil(t, p.UploadedAt)
+				assert.NotNil(t, p.LastAccessedAt)
+
+				if p.StorePath == tdA.Narinfo.StorePath {
+					assert.Equal(t, uint64(2), p.Hits)
+				}
+			}
+		}
+	})
+}
+
+func narPathFor(td test.Data) string {
+	return "/nar/" + nixbase32.EncodeToString(td.Narinfo.NarHash.Digest) + ".nar"
+}
+
+func narinfoPathFor(outputHash []byte) string {
+	return "/" + nixbase32.EncodeToString(outputHash) + ".narinfo"
+}
+
+func TestQuotas(t *testing.T) {
+	blobStore := blobstore.NewMemoryStore()
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobStore, metadataStore, "none", 40)
+
+	defer s.Close()
+
+	tdA := test.GetTestDataTable()["a"]
+	tdB := test.GetTestDataTable()["b"]
+
+	authenticator, err := auth.New([]*auth.Principal{
+		{Name: "team-a", Token: "secret-a"},
+		{Name: "team-b", Token: "secret-b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// team-a can upload a, but not b.
+	tracker := quota.NewTracker(map[string]uint64{"team-a": tdA.Narinfo.NarSize, "team-b": 0})
+
+	assert.NoError(t, s.SetQuotas(context.Background(), tracker))
+
+	handler := authenticator.Middleware(s.Handler)
+
+	do := func(method, path, token string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	usage := func() map[string]*quota.Usage {
+		resp := do("GET", "/_usage", "secret-b", nil)
+		if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			t.FailNow()
+		}
+
+		var body struct {
+			Principals map[string]*quota.Usage `json:"principals"`
+		}
+
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+		return body.Principals
+	}
+
+	tdAOutputHash, err := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	tdBOutputHash, err := util.GetHashFromStorePath(tdB.Narinfo.StorePath)
+	if err != nil {
+		panic(err)
+	}
+
+	t.Run("anonymous uploads", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do("PUT", narPathFor(tdA), "", tdA.NarContents).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do("GET", "/_usage", "", nil).StatusCode)
+	})
+
+	t.Run("upload within quota", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("PUT", narPathFor(tdA), "secret-a", tdA.NarContents).StatusCode)
+
+		// the NAR file counts before its .narinfo is uploaded, which then doesn't count again.
+		u := usage()
+		assert.Equal(t, tdA.Narinfo.NarSize, u["team-a"].Bytes)
+		assert.Equal(t, 0, u["team-a"].Paths)
+
+		assert.Equal(t, http.StatusOK,
+			do("PUT", narinfoPathFor(tdAOutputHash), "secret-a", []byte(tdA.Narinfo.String())).StatusCode)
+
+		pathInfo, err := metadataStore.GetPathInfo(context.Background(), tdAOutputHash)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "team-a", pathInfo.UploadedBy)
+		}
+
+		narMeta, err := metadataStore.GetNarMeta(context.Background(), tdA.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "team-a", narMeta.UploadedBy)
+		}
+
+		u = usage()
+		assert.Equal(t, tdA.Narinfo.NarSize, u["team-a"].Bytes)
+		assert.Equal(t, 1, u["team-a"].Paths)
+		assert.Equal(t, tdA.Narinfo.NarSize, u["team-a"].Quota)
+	})
+
+	t.Run("uploading again doesn't count", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK,
+			do("PUT", narinfoPathFor(tdAOutputHash), "secret-a", []byte(tdA.Narinfo.String())).StatusCode)
+		assert.Equal(t, tdA.Narinfo.NarSize, usage()["team-a"].Bytes)
+	})
+
+	t.Run("upload exceeding quota", func(t *testing.T) {
+		resp := do("PUT", narPathFor(tdB), "secret-a", tdB.NarContents)
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode, "team-a already used its quota")
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "quota exceeded")
+
+		// team-b is unlimited
+		assert.Equal(t, http.StatusOK, do("PUT", narPathFor(tdB), "secret-b", tdB.NarContents).StatusCode)
+
+		// the .narinfo would add to the usage of team-a
+		resp = do("PUT", narinfoPathFor(tdBOutputHash), "secret-a", []byte(tdB.Narinfo.String()))
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		_, err := metadataStore.GetPathInfo(context.Background(), tdBOutputHash)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		assert.Equal(t, http.StatusOK,
+			do("PUT", narinfoPathFor(tdBOutputHash), "secret-b", []byte(tdB.Narinfo.String())).StatusCode)
+		assert.Equal(t, tdB.Narinfo.NarSize, usage()["team-b"].Bytes)
+	})
+
+	t.Run("deleting and gc frees up space", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, do("DELETE", narinfoPathFor(tdAOutputHash), "secret-a", nil).StatusCode)
+
+		// the NAR file is still stored, until gc removes it.
+		u := usage()
+		assert.Equal(t, tdA.Narinfo.NarSize, u["team-a"].Bytes)
+		assert.Equal(t, 0, u["team-a"].Paths)
+
+		_, err := gc.Run(context.Background(), blobStore, []metadatastore.MetadataStore{metadataStore}, 0)
+		assert.NoError(t, err)
+
+		// pending NAR files are checked for removal at most once a minute.
+		assert.NoError(t, tracker.Reconcile(context.Background()))
+		assert.Equal(t, uint64(0), usage()["team-a"].Bytes)
+	})
+
+	t.Run("stream exceeding the remaining quota", func(t *testing.T) {
+		// without a Content-Length, the quota can only be enforced while receiving the NAR file.
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), "PUT", narPathFor(tdB), bytes.NewReader(tdB.NarContents))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.ContentLength = -1
+		req.Header.Set("Authorization", "Bearer secret-a")
+
+		handler.ServeHTTP(rr, req)
+
+		resp := rr.Result()
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "quota exceeded")
+
+		assert.Equal(t, uint64(0), usage()["team-a"].Bytes)
+	})
+
+	t.Run("NAR file exceeding the remaining quota", func(t *testing.T) {
+		resp := do("PUT", narPathFor(tdB), "secret-a", tdB.NarContents)
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		assert.Equal(t, http.StatusOK, do("PUT", narPathFor(tdA), "secret-a", tdA.NarContents).StatusCode)
+		assert.Equal(t, tdA.Narinfo.NarSize, usage()["team-a"].Bytes)
+	})
+}
+
+// TestUploadLimits tests uploads are rejected if they're too large, or there's not enough free space.
+func TestUploadLimits(t *testing.T) {
+	blobStore := blobstore.NewMemoryStore()
+	metadataStore := metadatastore.NewMemoryStore()
+
+	s := server.NewServer(blobStore, metadataStore, "none", 40)
+	defer s.Close()
+
+	tmpDir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	uploadStore, err := uploadstore.NewFileStore(tmpDir)
+	if err != nil {
+		panic(err)
+	}
+
+	err = s.RegisterUploadHandlers(uploadStore, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tdA := test.GetTestDataTable()["a"]
+
+	// do sends a request, with an unknown Content-Length unless sendContentLength is set.
+	do := func(method, path string, body []byte, sendContentLength bool, header http.Header) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !sendContentLength {
+			req.ContentLength = -1
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	s.SetUploadLimits(server.UploadLimits{MaxNarSize: tdA.Narinfo.NarSize - 1})
+
+	t.Run("Content-Length over the limit", func(t *testing.T) {
+		resp := do("PUT", narPathFor(tdA), tdA.NarContents, true, nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("stream over the limit", func(t *testing.T) {
+		resp := do("PUT", narPathFor(tdA), tdA.NarContents, false, nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+		_, _, err := blobStore.GetBlob(context.Background(), tdA.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist, "the partial upload shouldn't be stored")
+
+		_, err = metadataStore.GetNarMeta(context.Background(), tdA.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("upload session over the limit", func(t *testing.T) {
+		resp := do("POST", "/_upload", nil, true, nil)
+		if !assert.Equal(t, http.StatusCreated, resp.StatusCode) {
+			return
+		}
+
+		location := resp.Header.Get("Location")
+
+		resp = do("PATCH", location, tdA.NarContents, false, http.Header{"Upload-Offset": {"0"}})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("%d", tdA.Narinfo.NarSize-1), resp.Header.Get("Upload-Offset"),
+			"nothing beyond the limit should be stored")
+
+		resp = do("PATCH", location, []byte{0x00}, true, http.Header{"Upload-Offset": {resp.Header.Get("Upload-Offset")}})
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("within the limit", func(t *testing.T) {
+		s.SetUploadLimits(server.UploadLimits{MaxNarSize: tdA.Narinfo.NarSize})
+
+		assert.Equal(t, http.StatusOK, do("PUT", narPathFor(tdA), tdA.NarContents, false, nil).StatusCode)
+	})
+
+	t.Run("insufficient space", func(t *testing.T) {
+		s.SetUploadLimits(server.UploadLimits{MinFreeSpace: 1 << 62, Paths: []string{tmpDir}})
+
+		resp := do("PUT", narPathFor(tdA), tdA.NarContents, true, nil)
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+		resp = do("POST", "/_upload", nil, true, nil)
+		assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	})
+}
+
+// TestNarValidation tests only well-formed NAR files are accepted.
+func TestNarValidation(t *testing.T) {
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobstore.NewMemoryStore(), metadataStore, "none", 40)
+
+	defer s.Close()
+
+	put := func(body []byte) *http.Response {
+		sum := sha256.Sum256(body)
+
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(),
+			"PUT", "/nar/"+nixbase32.EncodeToString(sum[:])+".nar", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		for _, tc := range []struct {
+			name            string
+			nar             []byte
+			files           uint64
+			largestFile     string
+			largestFileSize uint64
+		}{
+			{name: "file", nar: test.EncodeNar(test.NarFile("hello")), files: 1, largestFile: "/", largestFileSize: 5},
+			{name: "directory", nar: test.EncodeNar(test.NarDirectory(
+				test.NarEntry{Name: "a", Node: test.NarFile("abc")},
+				test.NarEntry{Name: "b", Node: test.NarDirectory(
+					test.NarEntry{Name: "c", Node: test.NarFile("0123456789")},
+					test.NarEntry{Name: "d", Node: test.NarSymlink("../a")},
+				)},
+				test.NarEntry{Name: "b.txt", Node: test.NarFile("")},
+			)), files: 3, largestFile: "/b/c", largestFileSize: 10},
+			{name: "empty directory", nar: test.EncodeNar(test.NarDirectory()), files: 0},
+			{name: "test data", nar: test.GetTestDataTable()["a"].NarContents},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				resp := put(tc.nar)
+				if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+					body, _ := ioutil.ReadAll(resp.Body)
+					t.Log(string(body))
+
+					return
+				}
+
+				sum := sha256.Sum256(tc.nar)
+
+				narMeta, err := metadataStore.GetNarMeta(context.Background(), sum[:])
+				if assert.NoError(t, err) && tc.name != "test data" {
+					assert.Equal(t, tc.files, narMeta.Files)
+					assert.Equal(t, tc.largestFile, narMeta.LargestFile)
+					assert.Equal(t, tc.largestFileSize, narMeta.LargestFileSize)
+				}
+			})
+		}
+	})
+
+	validFile := test.EncodeNar(test.NarFile("abc"))
+
+	badPadding := test.EncodeNar(test.NarFile("abc"))
+	badPadding[bytes.Index(badPadding, []byte("abc"))+3] = 'x'
+
+	for _, tc := range []struct {
+		name string
+		nar  []byte
+	}{
+		{name: "empty", nar: []byte{}},
+		{name: "garbage", nar: []byte("this is not a nar file")},
+		{name: "wrong magic", nar: test.EncodeNar(test.NarFile("abc"))[8:]},
+		{name: "truncated", nar: validFile[:len(validFile)-8]},
+		{name: "trailing data", nar: append(test.EncodeNar(test.NarFile("abc")), test.EncodeNar(nil)...)},
+		{name: "bad padding", nar: badPadding},
+		{name: "unknown type", nar: test.EncodeNar([]string{"(", "type", "fifo", ")"})},
+		{name: "unsorted entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "b", Node: test.NarFile("b")},
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+		))},
+		{name: "unsorted nested entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarDirectory(
+				test.NarEntry{Name: "y", Node: test.NarFile("y")},
+				test.NarEntry{Name: "x", Node: test.NarFile("x")},
+			)},
+		))},
+		{name: "duplicate entries", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+			test.NarEntry{Name: "a", Node: test.NarFile("a")},
+		))},
+		{name: "empty name", nar: test.EncodeNar(test.NarDirectory(test.NarEntry{Name: "", Node: test.NarFile("a")}))},
+		{name: "name .", nar: test.EncodeNar(test.NarDirectory(test.NarEntry{Name: ".", Node: test.NarFile("a")}))},
+		{name: "name ..", nar: test.EncodeNar(test.NarDirectory(
+			test.NarEntry{Name: "a", Node: test.NarDirectory(test.NarEntry{Name: "..", Node: test.NarFile("a")})},
+		))},
+		{name: "name with slash", nar: test.EncodeNar(test.NarDirectory(test.NarEntry{Name: "a/b", Node: test.NarFile("a")}))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := put(tc.nar)
+			assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Contains(t, string(body), "invalid nar")
+
+			sum := sha256.Sum256(tc.nar)
+
+			_, err := metadataStore.GetNarMeta(context.Background(), sum[:])
+			assert.ErrorIs(t, err, os.ErrNotExist, "no NarMeta should be created")
+		})
+	}
+}
+
+func TestNarinfoValidation(t *testing.T) {
+	metadataStore := metadatastore.NewMemoryStore()
+	s := server.NewServer(blobstore.NewMemoryStore(), metadataStore, "none", 40)
+
+	defer s.Close()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	trustedKey, err := signing.ParsePublicKey("test-1:" + base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		panic(err)
+	}
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	s.SetTrustedKeys([]*signing.PublicKey{trustedKey})
+
+	do := func(method, path string, body []byte) *http.Response {
+		rr := httptest.NewRecorder()
+
+		req, err := http.NewRequestWithContext(context.Background(), method, path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Handler.ServeHTTP(rr, req)
+
+		return rr.Result()
+	}
+
+	testDataT := test.GetTestDataTable()
+	tdA, tdB, tdC := testDataT["a"], testDataT["b"], testDataT["c"]
+
+	// upload all NAR files, and the .narinfo of A, which B refers to.
+	for _, td := range []test.Data{tdA, tdB, tdC} {
+		if resp := do("PUT", narPathFor(td), td.NarContents); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+	}
+
+	outputHashA, _ := util.GetHashFromStorePath(tdA.Narinfo.StorePath)
+	outputHashB, _ := util.GetHashFromStorePath(tdB.Narinfo.StorePath)
+
+	if resp := do("PUT", narinfoPathFor(outputHashA), tdA.NarinfoContents); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// narinfoB returns a copy of the .narinfo of B, modified by f, and signed by key (if set) afterwards.
+	narinfoB := func(f func(ni *narinfo.NarInfo), key ed25519.PrivateKey) []byte {
+		ni := *tdB.Narinfo
+		ni.References = append([]string{}, ni.References...)
+
+		if f != nil {
+			f(&ni)
+		}
+
+		if key != nil {
+			ni.Signatures = append(ni.Signatures, &narinfo.Signature{
+				KeyName: "test-1",
+				Digest:  ed25519.Sign(key, []byte(signing.Fingerprint(&ni))),
+			})
+		}
+
+		return []byte(ni.String())
+	}
+
+	type violation struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+
+	// putRejected uploads body as .narinfo of B, and returns the fields of the violations listed.
+	putRejected := func(t *testing.T, body []byte) []string {
+		t.Helper()
+
+		resp := do("PUT", narinfoPathFor(outputHashB), body)
+		if !assert.Equal(t, http.StatusBadRequest, resp.StatusCode) {
+			return nil
+		}
+
+		var respBody struct {
+			Error      string      `json:"error"`
+			Violations []violation `json:"violations"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "invalid .narinfo", respBody.Error)
+
+		fields := make([]string, 0, len(respBody.Violations))
+		for _, v := range respBody.Violations {
+			assert.NotEmpty(t, v.Message)
+			fields = append(fields, v.Field)
+		}
+
+		return fields
+	}
+
+	sha256Base32 := nixbase32.EncodeToString(make([]byte, 32))
+	missingNarHash := sha256.Sum256([]byte("not uploaded"))
+
+	for _, tc := range []struct {
+		name   string
+		f      func(ni *narinfo.NarInfo)
+		key    ed25519.PrivateKey
+		fields []string
+	}{
+		{
+			name:   "StorePath of another store path",
+			f:      func(ni *narinfo.NarInfo) { ni.StorePath = tdC.Narinfo.StorePath },
+			fields: []string{"StorePath"},
+		},
+		{
+			name: "invalid StorePath",
+			f: func(ni *narinfo.NarInfo) {
+				ni.StorePath = "/nix/store/" + nixbase32.EncodeToString(outputHashB) + "-inv@lid"
+			},
+			fields: []string{"StorePath"},
+		},
+		{
+			name: "NarHash not sha256",
+			f: func(ni *narinfo.NarInfo) {
+				ni.NarHash = &hash.Hash{HashType: hash.HashTypeSha512, Digest: make([]byte, 64)}
+			},
+			fields: []string{"NarHash"},
+		},
+		{
+			name: "NarHash of a NAR file not uploaded",
+			f: func(ni *narinfo.NarInfo) {
+				ni.NarHash = &hash.Hash{HashType: hash.HashTypeSha256, Digest: missingNarHash[:]}
+			},
+			fields: []string{"NarHash"},
+		},
+		{
+			name:   "NarSize not matching the NAR file",
+			f:      func(ni *narinfo.NarInfo) { ni.NarSize++ },
+			fields: []string{"NarSize"},
+		},
+		{
+			name:   "CA without type",
+			f:      func(ni *narinfo.NarInfo) { ni.CA = "sha256:" + sha256Base32 },
+			fields: []string{"CA"},
+		},
+		{
+			name:   "CA with unsupported hash algorithm",
+			f:      func(ni *narinfo.NarInfo) { ni.CA = "fixed:r:sha3:" + sha256Base32 },
+			fields: []string{"CA"},
+		},
+		{
+			name:   "CA with wrong hash size",
+			f:      func(ni *narinfo.NarInfo) { ni.CA = "fixed:sha512:" + sha256Base32 },
+			fields: []string{"CA"},
+		},
+		{
+			name:   "text CA not using sha256",
+			f:      func(ni *narinfo.NarInfo) { ni.CA = "text:sha1:" + nixbase32.EncodeToString(make([]byte, 20)) },
+			fields: []string{"CA"},
+		},
+		{
+			name:   "invalid Deriver",
+			f:      func(ni *narinfo.NarInfo) { ni.Deriver = "hello.drv" },
+			fields: []string{"Deriver"},
+		},
+		{
+			name:   "Deriver not a derivation",
+			f:      func(ni *narinfo.NarInfo) { ni.Deriver = strings.TrimSuffix(ni.Deriver, ".drv") },
+			fields: []string{"Deriver"},
+		},
+		{
+			name:   "invalid reference",
+			f:      func(ni *narinfo.NarInfo) { ni.References = []string{"../../" + tdA.Narinfo.StorePath} },
+			fields: []string{"References"},
+		},
+		{
+			name: "reference not uploaded",
+			f: func(ni *narinfo.NarInfo) {
+				ni.References = append(ni.References, nixbase32.EncodeToString(make([]byte, 20))+"-missing")
+			},
+			fields: []string{"References"},
+		},
+		{
+			name:   "signature not matching",
+			key:    otherPriv,
+			fields: []string{"Sig"},
+		},
+		{
+			name: "signature not matching, after modifying",
+			f: func(ni *narinfo.NarInfo) {
+				ni.Signatures = []*narinfo.Signature{{
+					KeyName: "test-1",
+					Digest:  ed25519.Sign(priv, []byte(signing.Fingerprint(tdB.Narinfo))),
+				}}
+				ni.References = nil
+			},
+			fields: []string{"Sig"},
+		},
+		{
+			name: "signature without key name",
+			f: func(ni *narinfo.NarInfo) {
+				ni.Signatures = []*narinfo.Signature{{Digest: make([]byte, ed25519.SignatureSize)}}
+			},
+			fields: []string{"Sig"},
+		},
+		{
+			name: "multiple violations",
+			f: func(ni *narinfo.NarInfo) {
+				ni.NarSize = 1
+				ni.Deriver = "foo"
+				ni.CA = "bar"
+			},
+			key:    priv,
+			fields: []string{"NarSize", "Deriver", "CA"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.fields, putRejected(t, narinfoB(tc.f, tc.key)))
+
+			_, err := metadataStore.GetPathInfo(context.Background(), outputHashB)
+			assert.ErrorIs(t, err, os.ErrNotExist, "no PathInfo should be created")
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		body := narinfoB(func(ni *narinfo.NarInfo) {
+			ni.CA = "fixed:r:sha256:" + sha256Base32
+			// signatures by unknown keys can't be checked, and are kept
+			ni.Signatures = []*narinfo.Signature{{KeyName: "other-1", Digest: make([]byte, ed25519.SignatureSize)}}
+		}, priv)
+
+		if resp := do("PUT", narinfoPathFor(outputHashB), body); !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		pathInfo, err := metadataStore.GetPathInfo(context.Background(), outputHashB)
+		if assert.NoError(t, err) {
+			assert.Len(t, pathInfo.NarinfoSignatures, 2)
+		}
+	})
+
+	t.Run("references not matching the NAR file", func(t *testing.T) {
+		// B's NAR file was described with a reference to A before.
+		fields := putRejected(t, narinfoB(func(ni *narinfo.NarInfo) { ni.References = nil }, nil))
+		assert.Equal(t, []string{"References"}, fields)
+
+		narMeta, err := metadataStore.GetNarMeta(context.Background(), tdB.Narinfo.NarHash.Digest)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tdB.Narinfo.References, narMeta.ReferencesStr)
+		}
+	})
+}
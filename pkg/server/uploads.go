@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/auth"
+	"github.com/flokli/nix-casync/pkg/server/compression"
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/store/uploadstore"
+	"github.com/go-chi/chi/v5"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadExpiryInterval describes how often expired upload sessions are removed.
+const uploadExpiryInterval = 10 * time.Minute
+
+// uploadStatus is returned to clients describing the state of an upload session.
+type uploadStatus struct {
+	ID      string `json:"id"`
+	State   string `json:"state"`
+	Offset  uint64 `json:"offset"`
+	NarHash string `json:"narHash,omitempty"`
+	NarSize uint64 `json:"narSize,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RegisterUploadHandlers registers handlers for resumable uploads of (big) NAR files:
+//   - POST /_upload[?compression=$type] creates a new upload session, and returns its status,
+//     the location of the session is returned in the Location header.
+//   - PATCH /_upload/{id} appends the request body, at the offset passed in the Upload-Offset header,
+//     which needs to match the current size. The new size is returned in the Upload-Offset header.
+//   - HEAD /_upload/{id} returns the current size in the Upload-Offset header.
+//   - GET /_upload/{id} returns the status of the upload.
+//   - POST /_upload/{id}/commit ingests the uploaded NAR file in the background,
+//     the status can be polled until it's committed (or re-opened, with an error).
+//   - DELETE /_upload/{id} aborts the upload.
+//
+// Sessions not updated for longer than ttl are removed.
+func (s *Server) RegisterUploadHandlers(uploadStore *uploadstore.FileStore, ttl time.Duration) error {
+	// nothing can be committing yet, so re-open sessions left in that state by a previous run.
+	n, err := uploadStore.Recover()
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		log.Infof("Re-opened %d uploads with interrupted commits", n)
+	}
+
+	s.uploadStore = uploadStore
+
+	s.Handler.Post("/_upload", s.handleUploadCreate)
+	s.Handler.Head("/_upload/{id}", s.handleUpload)
+	s.Handler.Get("/_upload/{id}", s.handleUpload)
+	s.Handler.Patch("/_upload/{id}", s.handleUpload)
+	s.Handler.Delete("/_upload/{id}", s.handleUpload)
+	s.Handler.Post("/_upload/{id}/commit", s.handleUploadCommit)
+
+	s.bg.Add(1)
+
+	go func() {
+		defer s.bg.Done()
+
+		ticker := time.NewTicker(uploadExpiryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.bgCtx.Done():
+				return
+			case <-ticker.C:
+				n, err := uploadStore.Expire(ttl)
+				if err != nil {
+					log.Errorf("Error expiring uploads: %v", err)
+				} else if n > 0 {
+					log.Infof("Removed %d expired uploads", n)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func writeUploadStatus(w http.ResponseWriter, session *uploadstore.Session, status int) {
+	us := uploadStatus{
+		ID:      session.ID,
+		State:   session.State,
+		Offset:  session.Offset,
+		NarSize: session.NarSize,
+		Error:   session.Error,
+	}
+
+	if session.NarHash != nil {
+		us.NarHash = "sha256:" + nixbase32.EncodeToString(session.NarHash)
+	}
+
+	b, err := json.Marshal(us)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to serialize upload status: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Upload-Offset", strconv.FormatUint(session.Offset, 10))
+	w.WriteHeader(status)
+
+	_, err = w.Write(b)
+	if err != nil {
+		log.Errorf("Unable to write upload status: %v", err)
+	}
+}
+
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, uploadstore.ErrOffsetMismatch), errors.Is(err, uploadstore.ErrNotOpen):
+		return http.StatusConflict
+	default:
+		return ingestErrorStatus(err)
+	}
+}
+
+func (s *Server) handleUploadCreate(w http.ResponseWriter, r *http.Request) {
+	if !s.checkQuota(w, r, 0) || !s.admitUpload(w, 0) {
+		return
+	}
+
+	compressionType := r.URL.Query().Get("compression")
+	if compressionType == "" {
+		compressionType = "none"
+	}
+
+	if _, err := compression.TypeToSuffix(compressionType); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	session, err := s.uploadStore.Create(compressionType)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating upload: %v", err), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Add("Location", r.URL.Path+"/"+session.ID)
+	writeUploadStatus(w, session, http.StatusCreated)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		session, err := s.uploadStore.Get(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting upload: %v", err), uploadErrorStatus(err))
+
+			return
+		}
+
+		writeUploadStatus(w, session, http.StatusOK)
+	case http.MethodPatch:
+		offset, err := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid Upload-Offset header: %v", err), http.StatusBadRequest)
+
+			return
+		}
+
+		// the uploaded data is compressed, but it's usually smaller than the NAR file.
+		if !s.checkQuota(w, r, offset+contentLength(r)) || !s.admitUpload(w, offset+contentLength(r)) {
+			return
+		}
+
+		body, err := s.limitUpload(r.Context(), r.Body, offset)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		session, err := s.uploadStore.Append(id, offset, body)
+		if err != nil {
+			// let the client know where to resume
+			if session != nil {
+				w.Header().Add("Upload-Offset", strconv.FormatUint(session.Offset, 10))
+			}
+
+			http.Error(w, fmt.Sprintf("Error appending to upload: %v", err), uploadErrorStatus(err))
+
+			return
+		}
+
+		writeUploadStatus(w, session, http.StatusOK)
+	case http.MethodDelete:
+		err := s.uploadStore.Delete(id)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error deleting upload: %v", err), uploadErrorStatus(err))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleUploadCommit(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	session, data, err := s.uploadStore.StartCommit(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error committing upload: %v", err), uploadErrorStatus(err))
+
+		return
+	}
+
+	// Chunking big NAR files takes longer than a request may,
+	// so this happens in the background. Clients poll the status.
+	// It's still attributed to whoever committed the upload.
+	ctx := auth.WithPrincipal(s.bgCtx, auth.FromContext(r.Context()))
+
+	s.bg.Add(1)
+
+	go func() {
+		defer s.bg.Done()
+
+		narMeta, err := s.ingestUpload(ctx, session, data)
+		if err != nil {
+			log.Errorf("Error committing upload %v: %v", id, err)
+
+			_, err = s.uploadStore.FailCommit(id, err)
+			if err != nil {
+				log.Errorf("Error re-opening upload %v: %v", id, err)
+			}
+
+			return
+		}
+
+		_, err = s.uploadStore.FinishCommit(id, narMeta.NarHash, narMeta.Size)
+		if err != nil {
+			log.Errorf("Error finishing commit of upload %v: %v", id, err)
+		}
+	}()
+
+	writeUploadStatus(w, session, http.StatusAccepted)
+}
+
+// ingestUpload decompresses and ingests the data of an upload session, then closes it.
+func (s *Server) ingestUpload(
+	ctx context.Context,
+	session *uploadstore.Session,
+	data io.ReadCloser,
+) (*metadatastore.NarMeta, error) {
+	defer data.Close()
+
+	reader, err := compression.NewDecompressor(data, session.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return s.ingestNar(ctx, reader)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/flokli/nix-casync/pkg/store/metadatastore"
+	"github.com/flokli/nix-casync/pkg/webhook"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetWebhooks makes the server publish events (uploads and deletions) to outbox.
+// cache is the name of the tenant, or empty for the default cache.
+// It needs to be called before serving requests.
+func (s *Server) SetWebhooks(outbox *webhook.Outbox, cache string) {
+	s.webhooks = outbox
+	s.webhookCache = cache
+}
+
+// publish adds an event to the webhook outbox, if configured.
+// Errors are only logged, the change already happened.
+func (s *Server) publish(e *webhook.Event) {
+	if s.webhooks == nil {
+		return
+	}
+
+	e.Cache = s.webhookCache
+
+	err := s.webhooks.Publish(e)
+	if err != nil {
+		log.Errorf("Unable to publish %v event: %v", e.Type, err)
+	}
+}
+
+// publishPathInfo publishes an event about pathInfo, referring to the NAR described by narMeta.
+func (s *Server) publishPathInfo(eventType webhook.EventType, pathInfo *metadatastore.PathInfo, narMeta *metadatastore.NarMeta) {
+	e := &webhook.Event{
+		Type:      eventType,
+		StorePath: pathInfo.StorePath(),
+		NarHash:   "sha256:" + nixbase32.EncodeToString(pathInfo.NarHash),
+	}
+
+	if narMeta != nil {
+		e.NarSize = narMeta.Size
+	}
+
+	s.publish(e)
+}
@@ -0,0 +1,71 @@
+// Package signing parses the public keys .narinfo files are signed with, and verifies their signatures.
+package signing
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+)
+
+// PublicKey is a public key .narinfo files are signed with,
+// as used in trusted-public-keys in nix.conf.
+type PublicKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// ParsePublicKey parses a public key in the format of nix.conf (name:base64).
+func ParsePublicKey(s string) (*PublicKey, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected number of colons: %v", s)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode base64: %v", fields[1])
+	}
+
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key size: %d", len(key))
+	}
+
+	return &PublicKey{
+		Name: fields[0],
+		Key:  key,
+	}, nil
+}
+
+// Verify checks whether ni carries a valid signature by this key.
+func (k *PublicKey) Verify(ni *narinfo.NarInfo) bool {
+	for _, sig := range ni.Signatures {
+		if sig.KeyName == k.Name && ed25519.Verify(k.Key, []byte(Fingerprint(ni)), sig.Digest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fingerprint returns the part of ni covered by signatures.
+func Fingerprint(ni *narinfo.NarInfo) string {
+	storeDir := path.Dir(ni.StorePath)
+
+	references := make([]string, 0, len(ni.References))
+	for _, reference := range ni.References {
+		references = append(references, path.Join(storeDir, reference))
+	}
+
+	return strings.Join([]string{
+		"1",
+		ni.StorePath,
+		ni.NarHash.String(),
+		strconv.FormatUint(ni.NarSize, 10),
+		strings.Join(references, ","),
+	}, ";")
+}
@@ -0,0 +1,131 @@
+package signing_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flokli/nix-casync/pkg/signing"
+	"github.com/nix-community/go-nix/pkg/nar/narinfo"
+	"github.com/stretchr/testify/assert"
+)
+
+const cacheNixosOrgKey = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+
+// narinfoSigned is a .narinfo file as served by cache.nixos.org, signed by cacheNixosOrgKey.
+const narinfoSigned = `StorePath: /nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-net-tools-1.60_p20170221182432
+URL: nar/1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d.nar.xz
+Compression: xz
+FileHash: sha256:1094wph9z4nwlgvsd53abfz8i117ykiv5dwnq9nnhz846s7xqd7d
+FileSize: 114980
+NarHash: sha256:0lxjvvpr59c2mdram7ympy5ay741f180kv3349hvfc3f8nrmbqf6
+NarSize: 464152
+References: 7gx4kiv5m0i7d7qkixq2cwzbr10lvxwc-glibc-2.27
+Deriver: 10dx1q4ivjb115y3h90mipaaz533nr0d-net-tools-1.60_p20170221182432.drv
+Sig: cache.nixos.org-1:sn5s/RrqEI+YG6/PjwdbPjcAC7rcta7sJU4mFOawGvJBLsWkyLtBrT2EuFt/LJjWkTZ+ZWOI9NTtjo/woMdvAg==
+`
+
+func parseNarinfo(t *testing.T, s string) *narinfo.NarInfo {
+	t.Helper()
+
+	ni, err := narinfo.Parse(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ni
+}
+
+func TestParsePublicKey(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		key, err := signing.ParsePublicKey(cacheNixosOrgKey)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "cache.nixos.org-1", key.Name)
+			assert.Len(t, key.Key, 32)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		key  string
+	}{
+		{name: "empty", key: ""},
+		{name: "no name", key: "6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="},
+		{name: "too many colons", key: "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=:foo"},
+		{name: "invalid base64", key: "cache.nixos.org-1:not base64!"},
+		{name: "too short", key: "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPM"},
+		{name: "too long", key: "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjYAAAA="},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := signing.ParsePublicKey(tc.key)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	ni := parseNarinfo(t, narinfoSigned)
+
+	assert.Equal(t,
+		"1;/nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-net-tools-1.60_p20170221182432;"+
+			"sha256:0lxjvvpr59c2mdram7ympy5ay741f180kv3349hvfc3f8nrmbqf6;464152;"+
+			"/nix/store/7gx4kiv5m0i7d7qkixq2cwzbr10lvxwc-glibc-2.27",
+		signing.Fingerprint(ni),
+	)
+
+	t.Run("no references", func(t *testing.T) {
+		ni := parseNarinfo(t, strings.Replace(narinfoSigned, "References: 7gx4kiv5m0i7d7qkixq2cwzbr10lvxwc-glibc-2.27", "References: ", 1))
+
+		assert.Equal(t,
+			"1;/nix/store/00bgd045z0d4icpbc2yyz4gx48ak44la-net-tools-1.60_p20170221182432;"+
+				"sha256:0lxjvvpr59c2mdram7ympy5ay741f180kv3349hvfc3f8nrmbqf6;464152;",
+			signing.Fingerprint(ni),
+		)
+	})
+}
+
+func TestVerify(t *testing.T) {
+	key, err := signing.ParsePublicKey(cacheNixosOrgKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("good signature", func(t *testing.T) {
+		assert.True(t, key.Verify(parseNarinfo(t, narinfoSigned)))
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		// the key of a different cache, using the same name
+		otherKey, err := signing.ParsePublicKey("cache.nixos.org-1:8d6bhGvTnYlJBD8u5P+GhDrMcKD5y0F8N6mF0YBbO/Q=")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.False(t, otherKey.Verify(parseNarinfo(t, narinfoSigned)))
+	})
+
+	t.Run("wrong key name", func(t *testing.T) {
+		renamedKey := *key
+		renamedKey.Name = "cache.example.org-1"
+
+		assert.False(t, renamedKey.Verify(parseNarinfo(t, narinfoSigned)))
+	})
+
+	t.Run("modified narinfo", func(t *testing.T) {
+		assert.False(t, key.Verify(parseNarinfo(t, strings.Replace(narinfoSigned, "NarSize: 464152", "NarSize: 464153", 1))))
+	})
+
+	t.Run("malformed signature", func(t *testing.T) {
+		// a truncated digest
+		ni := parseNarinfo(t, narinfoSigned)
+		ni.Signatures[0].Digest = ni.Signatures[0].Digest[:32]
+
+		assert.False(t, key.Verify(ni))
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		ni := parseNarinfo(t, narinfoSigned)
+		ni.Signatures = nil
+
+		assert.False(t, key.Verify(ni))
+	})
+}
@@ -3,13 +3,18 @@ package blobstore_test
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/flokli/nix-casync/pkg/store/blobstore"
 	"github.com/flokli/nix-casync/test"
+	"github.com/folbricht/desync"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,8 +39,18 @@ func TestCasyncStore(t *testing.T) {
 		os.RemoveAll(caidxDir)
 	})
 
+	// populate tmp dir
+	tmpDir, err := ioutil.TempDir("", "tmp")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
 	// init casync store
-	caStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, 65536)
+	caStore, err := blobstore.NewCasyncStore(castrDir, caidxDir, tmpDir, 65536, blobstore.ChunkStoreOptions{})
 	if err != nil {
 		panic(err)
 	}
@@ -45,6 +60,444 @@ func TestCasyncStore(t *testing.T) {
 	})
 
 	testBlobStore(t, caStore)
+
+	t.Run("Uncompressed", func(t *testing.T) {
+		castrDir, err := ioutil.TempDir("", "castr")
+		if err != nil {
+			panic(err)
+		}
+
+		t.Cleanup(func() {
+			os.RemoveAll(castrDir)
+		})
+
+		caidxDir, err := ioutil.TempDir("", "caidx")
+		if err != nil {
+			panic(err)
+		}
+
+		t.Cleanup(func() {
+			os.RemoveAll(caidxDir)
+		})
+
+		uncompressedStore, err := blobstore.NewCasyncStore(
+			castrDir,
+			caidxDir,
+			tmpDir,
+			65536,
+			blobstore.ChunkStoreOptions{Uncompressed: true},
+		)
+		if err != nil {
+			panic(err)
+		}
+
+		t.Cleanup(func() {
+			uncompressedStore.Close()
+		})
+
+		testBlobStore(t, uncompressedStore)
+	})
+
+	t.Run("RemoveTempFiles", func(t *testing.T) {
+		// simulate a leftover from a crashed upload
+		f, err := ioutil.TempFile(tmpDir, "blob")
+		if err != nil {
+			panic(err)
+		}
+		f.Close()
+
+		// a blob being read, such as by a concurrent rechunk or recompress
+		w, err := caStore.PutBlob(context.Background())
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = w.Write(test.GetTestDataTable()["a"].NarContents)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		r, _, err := caStore.GetBlob(context.Background(), w.Sha256Sum())
+		if err != nil {
+			panic(err)
+		}
+		defer r.Close()
+
+		n, err := caStore.RemoveTempFiles()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.NoFileExists(t, f.Name())
+
+		tmpFiles, err := filepath.Glob(filepath.Join(tmpDir, "blob*"))
+		assert.NoError(t, err)
+		assert.Len(t, tmpFiles, 1, "the temp file of the blob being read should be kept")
+
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, test.GetTestDataTable()["a"].NarContents, b)
+	})
+}
+
+// TestCasyncStoreWriter tests blobs are chunked while they're written.
+func TestCasyncStoreWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casync")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	caStore, err := blobstore.NewCasyncStore(
+		filepath.Join(dir, "castr"),
+		filepath.Join(dir, "caibx"),
+		filepath.Join(dir, "tmp"),
+		4096,
+		blobstore.ChunkStoreOptions{},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		caStore.Close()
+	})
+
+	contents := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(contents) //nolint:gosec
+
+	t.Run("chunks are stored before Close", func(t *testing.T) {
+		w, err := caStore.PutBlob(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write(contents)
+		assert.NoError(t, err)
+
+		dedupStats := w.(blobstore.DedupStatser).DedupStats()
+		assert.Greater(t, dedupStats.NewChunks, uint64(0), "chunks should be stored while writing")
+
+		tmpFiles, err := filepath.Glob(filepath.Join(dir, "tmp", "*"))
+		assert.NoError(t, err)
+		assert.Empty(t, tmpFiles, "nothing should be written to the temp directory")
+
+		assert.NoError(t, w.Close())
+
+		dedupStats = w.(blobstore.DedupStatser).DedupStats()
+		assert.Equal(t, dedupStats.Chunks, dedupStats.NewChunks)
+		assert.Equal(t, uint64(len(contents)), dedupStats.NewChunkBytes)
+
+		r, n, err := caStore.GetBlob(context.Background(), w.Sha256Sum())
+		if assert.NoError(t, err) {
+			defer r.Close()
+
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(contents)), n)
+			assert.Equal(t, contents, b)
+		}
+	})
+
+	t.Run("context cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		w, err := caStore.PutBlob(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write(contents[:len(contents)/2])
+		assert.NoError(t, err)
+
+		cancel()
+
+		// writes either fail, or end up in the chunker's buffer.
+		_, _ = w.Write(contents[len(contents)/2:])
+
+		assert.ErrorIs(t, w.Close(), context.Canceled)
+
+		_, _, err = caStore.GetBlob(context.Background(), w.Sha256Sum())
+		assert.ErrorIs(t, err, os.ErrNotExist, "the index shouldn't be stored")
+	})
+}
+
+// TestCasyncStoreRecompress tests converting a chunk store between compressed and uncompressed chunks.
+func TestCasyncStoreRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casync")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	castrDir := filepath.Join(dir, "castr")
+
+	open := func(opts blobstore.ChunkStoreOptions) *blobstore.CasyncStore {
+		caStore, err := blobstore.NewCasyncStore(castrDir, filepath.Join(dir, "caibx"), filepath.Join(dir, "tmp"), 4096, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			caStore.Close()
+		})
+
+		return caStore
+	}
+
+	contents := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(contents) //nolint:gosec
+
+	caStore := open(blobstore.ChunkStoreOptions{})
+
+	w, err := caStore.PutBlob(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	sha256 := w.Sha256Sum()
+
+	countChunks := func(ext string) int {
+		matches, err := filepath.Glob(filepath.Join(castrDir, "*", "*"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(matches)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts blobstore.ChunkStoreOptions
+	}{
+		{name: "uncompressed", opts: blobstore.ChunkStoreOptions{Uncompressed: true}},
+		{name: "compressed, level 19", opts: blobstore.ChunkStoreOptions{CompressionLevel: 19}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			caStore := open(tc.opts)
+			numChunks := countChunks("")
+
+			stats, err := caStore.Recompress(context.Background())
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint64(numChunks), stats.Chunks)
+				assert.Equal(t, uint64(0), stats.ChunksInvalid)
+			}
+
+			if tc.opts.Uncompressed {
+				assert.Equal(t, 0, countChunks(desync.CompressedChunkExt))
+			} else {
+				assert.Equal(t, numChunks, countChunks(desync.CompressedChunkExt))
+			}
+
+			r, _, err := caStore.GetBlob(context.Background(), sha256)
+			if assert.NoError(t, err) {
+				defer r.Close()
+
+				b, err := ioutil.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, contents, b)
+			}
+		})
+	}
+}
+
+// TestCasyncStoreRechunk tests re-chunking blobs with a different chunk size.
+func TestCasyncStoreRechunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casync")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	open := func(avgChunkSize int) *blobstore.CasyncStore {
+		caStore, err := blobstore.NewCasyncStore(
+			filepath.Join(dir, "castr"),
+			filepath.Join(dir, "caibx"),
+			filepath.Join(dir, "tmp"),
+			avgChunkSize,
+			blobstore.ChunkStoreOptions{},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			caStore.Close()
+		})
+
+		return caStore
+	}
+
+	contents := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(contents) //nolint:gosec
+
+	caStore := open(4096)
+
+	w, err := caStore.PutBlob(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(contents)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	sha256 := w.Sha256Sum()
+
+	caStore = open(16384)
+
+	t.Run("Rechunk", func(t *testing.T) {
+		stats, err := caStore.Rechunk(context.Background(), 0, 0)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(1), stats.BlobsRechunked)
+			assert.Equal(t, uint64(len(contents)), stats.BytesRechunked)
+			assert.Equal(t, uint64(0), stats.GC.BlobsRemoved)
+			assert.Greater(t, stats.GC.ChunksRemoved, uint64(0), "old chunks should be removed")
+		}
+
+		index, err := caStore.GetIndex(context.Background(), sha256)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(16384), index.Index.ChunkSizeAvg)
+		}
+
+		r, _, err := caStore.GetBlob(context.Background(), sha256)
+		if assert.NoError(t, err) {
+			defer r.Close()
+
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, contents, b)
+		}
+	})
+
+	t.Run("Rechunk again", func(t *testing.T) {
+		stats, err := caStore.Rechunk(context.Background(), 0, 0)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(0), stats.BlobsRechunked)
+			assert.Equal(t, uint64(1), stats.BlobsSkipped)
+			assert.Equal(t, uint64(0), stats.GC.ChunksRemoved)
+		}
+	})
+}
+
+// TestCasyncStoreSeeds tests assembling blobs using previously assembled ones as seeds.
+func TestCasyncStoreSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "casync")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	castrDir := filepath.Join(dir, "castr")
+	seedsDir := filepath.Join(dir, "seeds")
+
+	caStore, err := blobstore.NewCasyncStore(
+		castrDir,
+		filepath.Join(dir, "caibx"),
+		filepath.Join(dir, "tmp"),
+		4096,
+		blobstore.ChunkStoreOptions{},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		caStore.Close()
+	})
+
+	// b is a "new version" of a, sharing most of its contents.
+	a := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(a) //nolint:gosec
+
+	b := append(append([]byte{}, a...), []byte("some more contents")...)
+
+	// the cache can only hold one of both
+	err = caStore.EnableSeedCache(seedsDir, int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(contents []byte) []byte {
+		w, err := caStore.PutBlob(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write(contents)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		return w.Sha256Sum()
+	}
+
+	get := func(sha256 []byte) []byte {
+		r, _, err := caStore.GetBlob(context.Background(), sha256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		contents, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+
+		return contents
+	}
+
+	aHash := put(a)
+	bHash := put(b)
+
+	assert.Equal(t, a, get(aHash))
+	assert.FileExists(t, filepath.Join(seedsDir, hex.EncodeToString(aHash)))
+
+	// remove all chunks b shares with a from the chunk store.
+	// Assembling b only works if they're taken from the seed.
+	aIndex, err := caStore.GetIndex(context.Background(), aHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bIndex, err := caStore.GetIndex(context.Background(), bHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aChunks := make(map[desync.ChunkID]struct{})
+	for _, chunk := range aIndex.Chunks {
+		aChunks[chunk.ID] = struct{}{}
+	}
+
+	removed := 0
+
+	for _, chunk := range bIndex.Chunks {
+		if _, ok := aChunks[chunk.ID]; ok {
+			sID := chunk.ID.String()
+			if err := os.Remove(filepath.Join(castrDir, sID[0:4], sID+desync.CompressedChunkExt)); err == nil {
+				removed++
+			}
+		}
+	}
+
+	assert.Greater(t, removed, 0, "a and b should share chunks")
+
+	assert.Equal(t, b, get(bHash))
+
+	// a was evicted to make room for b
+	assert.NoFileExists(t, filepath.Join(seedsDir, hex.EncodeToString(aHash)))
+	assert.FileExists(t, filepath.Join(seedsDir, hex.EncodeToString(bHash)))
 }
 
 func TestMemoryStore(t *testing.T) {
@@ -114,6 +567,25 @@ func testBlobStore(t *testing.T, blobStore blobstore.BlobStore) {
 		assert.NoError(t, w.Close())
 	})
 
+	t.Run("PutBlob, then Abort", func(t *testing.T) {
+		tdB := testDataT["b"]
+
+		w, err := blobStore.PutBlob(context.Background())
+		assert.NoError(t, err)
+
+		aborter, ok := w.(blobstore.Aborter)
+		if !ok {
+			t.Skip("blob store doesn't support aborting")
+		}
+
+		_, err = io.Copy(w, bytes.NewReader(tdB.NarContents))
+		assert.NoError(t, err)
+		assert.NoError(t, aborter.Abort())
+
+		_, _, err = blobStore.GetBlob(context.Background(), tdB.Narinfo.NarHash.Digest)
+		assert.ErrorIs(t, err, os.ErrNotExist, "an aborted blob shouldn't be stored")
+	})
+
 	t.Run("GetBlob", func(t *testing.T) {
 		r, n, err := blobStore.GetBlob(context.Background(), tdANarHash)
 
@@ -123,6 +595,7 @@ func testBlobStore(t *testing.T, blobStore blobstore.BlobStore) {
 		actualContents, err := io.ReadAll(r)
 		assert.NoError(t, err)
 		assert.Equal(t, tdA.NarContents, actualContents)
+		assert.NoError(t, r.Close())
 	})
 
 	t.Run("GetNar,then abort", func(t *testing.T) {
@@ -131,4 +604,42 @@ func testBlobStore(t *testing.T, blobStore blobstore.BlobStore) {
 		assert.NoError(t, err)
 		assert.NoError(t, r.Close())
 	})
+
+	t.Run("CollectGarbage within grace period", func(t *testing.T) {
+		stats, err := blobStore.CollectGarbage(context.Background(), map[string]struct{}{}, time.Hour)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(0), stats.BlobsRemoved, "recently written blobs should be kept")
+		}
+
+		r, _, err := blobStore.GetBlob(context.Background(), tdANarHash)
+		if assert.NoError(t, err) {
+			assert.NoError(t, r.Close())
+		}
+	})
+
+	t.Run("CollectGarbage keeping blob", func(t *testing.T) {
+		keep := map[string]struct{}{hex.EncodeToString(tdANarHash): {}}
+
+		// this removes the empty blob from the aborted upload above
+		_, err := blobStore.CollectGarbage(context.Background(), keep, 0)
+		assert.NoError(t, err)
+
+		r, _, err := blobStore.GetBlob(context.Background(), tdANarHash)
+		if assert.NoError(t, err) {
+			actualContents, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, tdA.NarContents, actualContents)
+			assert.NoError(t, r.Close())
+		}
+	})
+
+	t.Run("CollectGarbage removing blob", func(t *testing.T) {
+		stats, err := blobStore.CollectGarbage(context.Background(), map[string]struct{}{}, 0)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(1), stats.BlobsRemoved)
+		}
+
+		_, _, err = blobStore.GetBlob(context.Background(), tdANarHash)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
 }
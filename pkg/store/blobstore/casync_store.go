@@ -3,9 +3,12 @@ package blobstore
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"syscall"
 
 	"github.com/folbricht/desync"
 )
@@ -13,10 +16,21 @@ import (
 var _ BlobStore = &CasyncStore{}
 
 type CasyncStore struct {
-	localStore      desync.WriteStore
+	localStore      localChunkStore
 	localIndexStore desync.IndexWriteStore
 	concurrency     int
 
+	localStoreDir      string
+	localIndexStoreDir string
+
+	// tmpDir is used for temporary files while assembling blobs.
+	// Empty means the system default.
+	tmpDir string
+
+	// seedCache keeps recently assembled blobs, to speed up assembling similar ones.
+	// nil if disabled.
+	seedCache *seedCache
+
 	chunkSizeAvgDefault uint64
 	chunkSizeMinDefault uint64
 	chunkSizeMaxDefault uint64
@@ -24,14 +38,18 @@ type CasyncStore struct {
 	// TODO: remote store(s)?
 }
 
-func NewCasyncStore(localStoreDir, localIndexStoreDir string, avgChunkSize int) (*CasyncStore, error) {
+func NewCasyncStore(
+	localStoreDir, localIndexStoreDir, tmpDir string,
+	avgChunkSize int,
+	chunkStoreOptions ChunkStoreOptions,
+) (*CasyncStore, error) {
 	// TODO: maybe use MultiStoreWithCache?
 	err := os.MkdirAll(localStoreDir, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	localStore, err := desync.NewLocalStore(localStoreDir, desync.StoreOptions{})
+	localStore, err := newLocalChunkStore(localStoreDir, chunkStoreOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +64,13 @@ func NewCasyncStore(localStoreDir, localIndexStoreDir string, avgChunkSize int)
 		return nil, err
 	}
 
+	if tmpDir != "" {
+		err = os.MkdirAll(tmpDir, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	concurrency := runtime.NumCPU()
 	if concurrency > 4 {
 		concurrency = 4
@@ -56,6 +81,10 @@ func NewCasyncStore(localStoreDir, localIndexStoreDir string, avgChunkSize int)
 		localIndexStore: localIndexStore,
 		concurrency:     concurrency,
 
+		localStoreDir:      localStoreDir,
+		localIndexStoreDir: localIndexStoreDir,
+		tmpDir:             tmpDir,
+
 		// values stolen from chunker_test.go
 		chunkSizeAvgDefault: uint64(avgChunkSize),
 		chunkSizeMinDefault: uint64(avgChunkSize) / 4,
@@ -85,14 +114,36 @@ func (c *CasyncStore) GetBlob(ctx context.Context, sha256 []byte) (io.ReadCloser
 		[]desync.Seed{},
 		1,
 		nil,
+		c.tmpDir,
 	)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	csnr.seedCache = c.seedCache
+	csnr.sha256 = sha256
+
 	return csnr, caidx.Length(), nil
 }
 
+// EnableSeedCache keeps recently assembled blobs in dir, up to maxSize bytes.
+// They're used as seeds when assembling other blobs, so data they share
+// is copied (or reflinked, if the filesystem supports it) instead of
+// read from the chunk store and decompressed.
+// dir should be on the same filesystem as the temp directory,
+// as blobs are hardlinked from there.
+// It must be called before any blobs are read.
+func (c *CasyncStore) EnableSeedCache(dir string, maxSize int64) error {
+	seedCache, err := newSeedCache(dir, maxSize, c.localIndexStore)
+	if err != nil {
+		return err
+	}
+
+	c.seedCache = seedCache
+
+	return nil
+}
+
 func (c *CasyncStore) PutBlob(ctx context.Context) (WriteCloseHasher, error) { //nolint:ireturn
 	return NewCasyncStoreWriter(
 		ctx,
@@ -106,3 +157,70 @@ func (c *CasyncStore) PutBlob(ctx context.Context) (WriteCloseHasher, error) { /
 		c.chunkSizeMaxDefault,
 	)
 }
+
+// RemoveTempFiles removes temporary files left behind in the temp directory,
+// for example by a previous process that crashed while handling uploads.
+// Files still in use (by this or another process, such as rechunk or recompress
+// sharing the temp directory) are locked, and skipped.
+// If no dedicated temp directory was configured, nothing is removed,
+// as the system temp directory is shared with others.
+func (c *CasyncStore) RemoveTempFiles() (int, error) {
+	if c.tmpDir == "" {
+		return 0, nil
+	}
+
+	tmpFiles, err := filepath.Glob(filepath.Join(c.tmpDir, "blob*"))
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, tmpFile := range tmpFiles {
+		removed, err := removeUnlockedFile(tmpFile)
+		if err != nil {
+			return n, err
+		}
+
+		if removed {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// removeUnlockedFile removes the file at p, unless another open file holds a lock on it.
+// It returns whether the file was removed.
+func removeUnlockedFile(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+	// closing the file releases the lock
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Remove(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,204 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/folbricht/desync"
+)
+
+var _ ChunkedBlobStore = &CasyncStore{}
+
+// MissingChunks returns the IDs of all chunks referenced by index that aren't in the store.
+// Chunks that do exist get their mtime refreshed,
+// so CollectGarbage won't remove them while the client uploads the missing ones.
+func (c *CasyncStore) MissingChunks(ctx context.Context, index desync.Index) ([]desync.ChunkID, error) {
+	seen := make(map[desync.ChunkID]struct{}, len(index.Chunks))
+	missing := []desync.ChunkID{}
+
+	for _, chunk := range index.Chunks {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[chunk.ID]; ok {
+			continue
+		}
+
+		seen[chunk.ID] = struct{}{}
+
+		hasChunk, err := c.localStore.HasChunk(chunk.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasChunk {
+			missing = append(missing, chunk.ID)
+		}
+	}
+
+	return missing, nil
+}
+
+// PutChunk adds a compressed chunk to the store, after ensuring its contents match id.
+func (c *CasyncStore) PutChunk(ctx context.Context, id desync.ChunkID, compressed []byte) error {
+	chunk, err := desync.NewChunkWithID(id, nil, compressed, false)
+	if err != nil {
+		return err
+	}
+
+	return c.localStore.StoreChunk(chunk)
+}
+
+// PutIndex adds a blob described by index.
+// All chunks are read from the store, and the assembled contents are compared against sha256
+// before storing the index.
+func (c *CasyncStore) PutIndex(ctx context.Context, sha256Sum []byte, index desync.Index) (uint64, error) {
+	missing, err := c.MissingChunks(ctx, index)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(missing) > 0 {
+		return 0, fmt.Errorf("%w: %d chunks referenced by the index are not in the store", ErrChunksMissing, len(missing))
+	}
+
+	h := sha256.New()
+
+	var size uint64
+
+	for _, indexChunk := range index.Chunks {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if indexChunk.Start != size {
+			return 0, fmt.Errorf("%w: chunk %v starts at %d, expected %d", ErrBlobMismatch, indexChunk.ID, indexChunk.Start, size)
+		}
+
+		// this verifies the chunk contents match its ID
+		chunk, err := c.localStore.GetChunk(indexChunk.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		b, err := chunk.Uncompressed()
+		if err != nil {
+			return 0, err
+		}
+
+		if uint64(len(b)) != indexChunk.Size {
+			return 0, fmt.Errorf("%w: chunk %v has size %d, expected %d", ErrBlobMismatch, indexChunk.ID, len(b), indexChunk.Size)
+		}
+
+		h.Write(b)
+		size += indexChunk.Size
+	}
+
+	if sum := h.Sum(nil); !bytes.Equal(sum, sha256Sum) {
+		return 0, fmt.Errorf("%w: assembled blob has hash %x, expected %x", ErrBlobMismatch, sum, sha256Sum)
+	}
+
+	err = c.localIndexStore.StoreIndex(hex.EncodeToString(sha256Sum), index)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// ReadIndex returns a reader for the blob described by index, assembled chunk by chunk.
+// The contents of the chunks are verified to match their ID, but not their size or position.
+func (c *CasyncStore) ReadIndex(ctx context.Context, index desync.Index) io.Reader {
+	return &indexReader{
+		ctx:    ctx,
+		store:  c.localStore,
+		chunks: index.Chunks,
+	}
+}
+
+// indexReader reads the chunks of an index from a local chunk store, in order.
+type indexReader struct {
+	ctx    context.Context
+	store  localChunkStore
+	chunks []desync.IndexChunk
+
+	// buf contains the rest of the current chunk.
+	buf []byte
+}
+
+func (r *indexReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		chunk, err := r.store.GetChunk(r.chunks[0].ID)
+		if err != nil {
+			var missing desync.ChunkMissing
+			if errors.As(err, &missing) {
+				return 0, fmt.Errorf("%w: %v", ErrChunksMissing, err)
+			}
+
+			return 0, err
+		}
+
+		r.buf, err = chunk.Uncompressed()
+		if err != nil {
+			return 0, err
+		}
+
+		r.chunks = r.chunks[1:]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// GetChunk returns a reader for a compressed chunk, and its size.
+// Chunks are served as they're stored, without verifying their contents.
+// If chunks are stored uncompressed, they're compressed on the fly.
+func (c *CasyncStore) GetChunk(ctx context.Context, id desync.ChunkID) (io.ReadCloser, int64, error) {
+	if c.localStore.uncompressed {
+		b, err := ioutil.ReadFile(c.localStore.chunkPath(id))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		compressed := c.localStore.compress(b)
+
+		return ioutil.NopCloser(bytes.NewReader(compressed)), int64(len(compressed)), nil
+	}
+
+	f, err := os.Open(c.localStore.chunkPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+
+		return nil, 0, err
+	}
+
+	return f, fi.Size(), nil
+}
+
+// GetIndex returns the index describing a blob.
+func (c *CasyncStore) GetIndex(ctx context.Context, sha256Sum []byte) (desync.Index, error) {
+	return c.localIndexStore.GetIndex(hex.EncodeToString(sha256Sum))
+}
@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+)
+
+// CollectGarbage removes all indexes not mentioned in keep,
+// then all chunks not referenced by any of the remaining indexes.
+func (c *CasyncStore) CollectGarbage(
+	ctx context.Context,
+	keep map[string]struct{},
+	gracePeriod time.Duration,
+) (*GCStats, error) {
+	cutoff := time.Now().Add(-gracePeriod)
+	stats := &GCStats{}
+	liveChunks := make(map[desync.ChunkID]struct{})
+
+	entries, err := ioutil.ReadDir(c.localIndexStoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		name := entry.Name()
+
+		// skip temporary files, such as the ones written by Rechunk
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if _, ok := keep[name]; !ok && entry.ModTime().Before(cutoff) {
+			err := os.Remove(path.Join(c.localIndexStoreDir, name))
+			if err != nil {
+				return stats, err
+			}
+
+			stats.BlobsRemoved++
+
+			continue
+		}
+
+		// this index is kept, so are all of its chunks
+		caidx, err := c.localIndexStore.GetIndex(name)
+		if err != nil {
+			return stats, err
+		}
+
+		for _, chunk := range caidx.Chunks {
+			liveChunks[chunk.ID] = struct{}{}
+		}
+	}
+
+	err = filepath.Walk(c.localStoreDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		id, _, ok := chunkIDFromPath(p)
+		if !ok {
+			// not a chunk, leave it alone
+			return nil
+		}
+
+		if _, ok := liveChunks[id]; ok || info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+
+		stats.ChunksRemoved++
+		stats.BytesFreed += uint64(info.Size())
+
+		return nil
+	})
+
+	return stats, err
+}
@@ -0,0 +1,148 @@
+package blobstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ChunkStoreOptions describes how chunks are stored in the local chunk store.
+type ChunkStoreOptions struct {
+	// Uncompressed stores chunks without compression.
+	// This needs more disk space, but saves decompressing chunks when assembling blobs.
+	Uncompressed bool
+
+	// CompressionLevel is the zstd level chunks are compressed with (1-22),
+	// mapped to the closest level supported by the encoder.
+	// 0 uses the default level.
+	CompressionLevel int
+
+	// SkipVerify skips checking chunk contents match their ID when assembling blobs.
+	// Chunks received from clients are always verified.
+	SkipVerify bool
+}
+
+// localChunkStore wraps a desync.LocalStore.
+// HasChunk refreshes the mtime of chunks it reports as existing:
+// desync.ChunkStream doesn't store chunks that already exist,
+// so without this, a chunk only referenced by an upload in progress
+// could look old enough to be removed by CollectGarbage.
+// StoreChunk compresses chunks with the configured compression level.
+type localChunkStore struct {
+	desync.LocalStore
+
+	uncompressed bool
+	encoder      *zstd.Encoder // nil uses the desync default
+}
+
+func newLocalChunkStore(dir string, opts ChunkStoreOptions) (localChunkStore, error) {
+	if opts.CompressionLevel < 0 || opts.CompressionLevel > 22 {
+		return localChunkStore{}, fmt.Errorf("invalid compression level: %d", opts.CompressionLevel)
+	}
+
+	localStore, err := desync.NewLocalStore(dir, desync.StoreOptions{
+		Uncompressed: opts.Uncompressed,
+		SkipVerify:   opts.SkipVerify,
+	})
+	if err != nil {
+		return localChunkStore{}, err
+	}
+
+	s := localChunkStore{
+		LocalStore:   localStore,
+		uncompressed: opts.Uncompressed,
+	}
+
+	if opts.CompressionLevel != 0 {
+		s.encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.CompressionLevel)))
+		if err != nil {
+			return localChunkStore{}, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s localChunkStore) HasChunk(id desync.ChunkID) (bool, error) {
+	hasChunk, err := s.LocalStore.HasChunk(id)
+	if err != nil || !hasChunk {
+		return hasChunk, err
+	}
+
+	now := time.Now()
+
+	err = os.Chtimes(s.chunkPath(id), now, now)
+	if err != nil {
+		// the chunk might have been removed in the meantime
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s localChunkStore) StoreChunk(chunk *desync.Chunk) error {
+	if s.encoder == nil || s.uncompressed {
+		return s.LocalStore.StoreChunk(chunk)
+	}
+
+	b, err := chunk.Uncompressed()
+	if err != nil {
+		return err
+	}
+
+	// chunk was already verified (or created from b)
+	chunk, err = desync.NewChunkWithID(chunk.ID(), b, s.compress(b), true)
+	if err != nil {
+		return err
+	}
+
+	return s.LocalStore.StoreChunk(chunk)
+}
+
+// compress compresses b with the configured compression level.
+func (s localChunkStore) compress(b []byte) []byte {
+	if s.encoder == nil {
+		compressed, _ := desync.Compress(b)
+
+		return compressed
+	}
+
+	return s.encoder.EncodeAll(b, make([]byte, 0, len(b)))
+}
+
+// chunkPath returns the path of a chunk inside the store.
+func (s localChunkStore) chunkPath(id desync.ChunkID) string {
+	sID := id.String()
+
+	p := filepath.Join(s.Base, sID[0:4], sID)
+	if s.uncompressed {
+		return p + desync.UncompressedChunkExt
+	}
+
+	return p + desync.CompressedChunkExt
+}
+
+// chunkIDFromPath returns the ID of the chunk at p, and whether it's compressed.
+// Both compressed and uncompressed chunks are recognized, as the store
+// might contain both while being converted.
+// ok is false if p isn't a chunk, such as a temporary file.
+func chunkIDFromPath(p string) (id desync.ChunkID, compressed bool, ok bool) {
+	name := filepath.Base(p)
+	compressed = strings.HasSuffix(name, desync.CompressedChunkExt)
+
+	id, err := desync.ChunkIDFromString(strings.TrimSuffix(name, desync.CompressedChunkExt))
+	if err != nil {
+		return desync.ChunkID{}, false, false
+	}
+
+	return id, compressed, true
+}
@@ -2,11 +2,14 @@ package blobstore
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"syscall"
 
 	"github.com/folbricht/desync"
+	log "github.com/sirupsen/logrus"
 )
 
 // CasyncStoreReader provides a io.ReadCloser
@@ -24,6 +27,11 @@ type CasyncStoreReader struct {
 
 	f             *os.File
 	fileAssembled bool // whether AssembleFile was already run
+
+	// if set, seeds are taken from seedCache,
+	// and the assembled file is added to it (as sha256).
+	seedCache *seedCache
+	sha256    []byte
 }
 
 // NewCasyncStoreReader returns a properly initialized casyncStoreReader.
@@ -34,8 +42,9 @@ func NewCasyncStoreReader(
 	seeds []desync.Seed,
 	concurrency int,
 	pb desync.ProgressBar,
+	tmpDir string,
 ) (*CasyncStoreReader, error) {
-	tmpFile, err := ioutil.TempFile("", "blob")
+	tmpFile, err := createLockedTempFile(tmpDir)
 	if err != nil {
 		return nil, err
 	}
@@ -52,17 +61,64 @@ func NewCasyncStoreReader(
 	}, nil
 }
 
+// createLockedTempFile creates a temporary file in tmpDir, holding a shared lock on it until it's closed,
+// so RemoveTempFiles (of this or another process) leaves it alone.
+func createLockedTempFile(tmpDir string) (*os.File, error) {
+	for {
+		f, err := ioutil.TempFile(tmpDir, "blob")
+		if err != nil {
+			return nil, err
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+
+			return nil, fmt.Errorf("unable to lock temporary file: %w", err)
+		}
+
+		// RemoveTempFiles might have removed the file before it was locked,
+		// in which case we need to try again with a new one.
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+
+			return nil, err
+		}
+
+		if fiName, err := os.Stat(f.Name()); err == nil && os.SameFile(fi, fiName) {
+			return f, nil
+		}
+
+		f.Close()
+	}
+}
+
 func (csnr *CasyncStoreReader) Read(p []byte) (n int, err error) {
 	// if this is the first read, we need to run AssembleFile into f
 	// if there's any error, we return it.
 	// It's up to the caller to also run Close(), which will clean up the tmpfile
 	if !csnr.fileAssembled {
+		seeds := csnr.seeds
+
+		if csnr.seedCache != nil {
+			cachedSeeds, release, err := csnr.seedCache.acquire(csnr.f.Name(), csnr.caidx)
+			if err != nil {
+				return 0, err
+			}
+			defer release()
+
+			seeds = append(append([]desync.Seed{}, seeds...), cachedSeeds...)
+		}
+
 		_, err = desync.AssembleFile(
 			csnr.ctx,
 			csnr.f.Name(),
 			csnr.caidx,
 			csnr.desyncStore,
-			csnr.seeds,
+			seeds,
 			csnr.concurrency,
 			csnr.pb,
 		)
@@ -82,6 +138,14 @@ func (csnr *CasyncStoreReader) Read(p []byte) (n int, err error) {
 		}
 		// we successfully went till here
 		csnr.fileAssembled = true
+
+		if csnr.seedCache != nil {
+			err = csnr.seedCache.add(csnr.sha256, csnr.f.Name(), csnr.caidx)
+			if err != nil {
+				// not being able to keep this as a seed only makes future assemblies slower.
+				log.Warnf("Unable to add assembled blob to seed cache: %v", err)
+			}
+		}
 	}
 
 	return csnr.f.Read(p)
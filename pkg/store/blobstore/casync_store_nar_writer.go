@@ -4,41 +4,77 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"hash"
 	"io"
-	"io/ioutil"
 	"os"
+	"sync/atomic"
 
 	"github.com/folbricht/desync"
 )
 
-// CasyncStoreWriter implements WriteCloseHasher.
-var _ WriteCloseHasher = &CasyncStoreWriter{}
+// CasyncStoreWriter implements WriteCloseHasher, DedupStatser and Aborter.
+var (
+	_ WriteCloseHasher = &CasyncStoreWriter{}
+	_ DedupStatser     = &CasyncStoreWriter{}
+	_ Aborter          = &CasyncStoreWriter{}
+)
 
 // CasyncStoreWriter provides a io.WriteClose[Hashe]r interface
 // The whole content of the blob is written to it.
-// Internally, it'll write it to a temporary file.
-// On close, its contents will be chunked,
-// the index added to the index store, and the chunks added to the chunk store.
+// Internally, it's chunked while being written,
+// and new chunks are added to the chunk store right away, so only the current chunking window is kept in memory.
+// On close, the index is added to the index store, named after the sha256 of the blob.
 type CasyncStoreWriter struct {
 	io.WriteCloser
 
-	ctx context.Context
-
-	desyncStore      desync.WriteStore
+	desyncStore      *countingWriteStore
 	desyncIndexStore desync.IndexWriteStore
 
-	concurrency         int
-	chunkSizeMinDefault uint64
-	chunkSizeAvgDefault uint64
-	chunkSizeMaxDefault uint64
+	// pw is read by the chunker.
+	pw *io.PipeWriter
+	// done is closed once chunking finished, index and err are set then.
+	done  chan struct{}
+	index desync.Index
+	err   error
 
-	f            *os.File
 	bytesWritten uint64
 	hash         hash.Hash
+
+	chunks uint64
 }
 
+// countingWriteStore counts the chunks stored in a desync.WriteStore.
+// desync.ChunkStream only stores chunks the store doesn't have yet.
+type countingWriteStore struct {
+	desync.WriteStore
+
+	chunks uint64
+	bytes  uint64
+}
+
+func (s *countingWriteStore) StoreChunk(chunk *desync.Chunk) error {
+	b, err := chunk.Uncompressed()
+	if err != nil {
+		return err
+	}
+
+	err = s.WriteStore.StoreChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&s.chunks, 1)
+	atomic.AddUint64(&s.bytes, uint64(len(b)))
+
+	return nil
+}
+
+// errAborted is returned by the chunker if writing a blob was aborted.
+var errAborted = errors.New("aborted")
+
 // NewCasyncStoreWriter returns a properly initialized casyncStoreWriter.
+// Chunking happens in the background, until the writer is closed (or aborted), or ctx is cancelled.
 func NewCasyncStoreWriter(
 	ctx context.Context,
 	desyncStore desync.WriteStore,
@@ -48,44 +84,66 @@ func NewCasyncStoreWriter(
 	chunkSizeAvgDefault uint64,
 	chunkSizeMaxDefault uint64,
 ) (*CasyncStoreWriter, error) {
-	tmpFile, err := ioutil.TempFile("", "blob")
+	pr, pw := io.Pipe()
+
+	chunker, err := desync.NewChunker(pr, chunkSizeMinDefault, chunkSizeAvgDefault, chunkSizeMaxDefault)
 	if err != nil {
 		return nil, err
 	}
-	// Cleanup is handled in Close()
-
-	return &CasyncStoreWriter{
-		ctx: ctx,
 
-		desyncStore:      desyncStore,
+	csw := &CasyncStoreWriter{
+		desyncStore:      &countingWriteStore{WriteStore: desyncStore},
 		desyncIndexStore: desyncIndexStore,
 
-		concurrency:         concurrency,
-		chunkSizeMinDefault: chunkSizeMinDefault,
-		chunkSizeAvgDefault: chunkSizeAvgDefault,
-		chunkSizeMaxDefault: chunkSizeMaxDefault,
+		pw:   pw,
+		done: make(chan struct{}),
 
-		f:    tmpFile,
 		hash: sha256.New(),
-	}, nil
+	}
+
+	go func() {
+		defer close(csw.done)
+
+		// upload all chunks into the store, while they're written
+		index, err := desync.ChunkStream(ctx, chunker, csw.desyncStore, concurrency)
+		if err == nil {
+			// ChunkStream stops early if ctx is cancelled, returning an incomplete index.
+			err = ctx.Err()
+		}
+
+		// If chunking stopped early, writes fail with its error, instead of blocking.
+		pr.CloseWithError(err)
+
+		csw.index, csw.err = index, err
+	}()
+
+	return csw, nil
 }
 
 func (csw *CasyncStoreWriter) Write(p []byte) (int, error) {
-	csw.hash.Write(p)
-	csw.bytesWritten += uint64(len(p))
+	n, err := csw.pw.Write(p)
 
-	return csw.f.Write(p)
+	csw.hash.Write(p[:n])
+	csw.bytesWritten += uint64(n)
+
+	return n, err
 }
 
+// Close waits for all chunks to be stored, then stores the index.
 func (csw *CasyncStoreWriter) Close() error {
-	// at the end, we want to remove the tempfile
-	defer os.Remove(csw.f.Name())
+	// let the chunker know there's no more data, and wait for it to finish.
+	csw.pw.Close()
+	<-csw.done
+
+	if csw.err != nil {
+		return csw.err
+	}
 
 	// calculate how the file will be called
 	indexName := hex.EncodeToString(csw.Sha256Sum())
 
 	// check if that same file has already been uploaded.
-	_, err := csw.desyncIndexStore.GetIndex(indexName)
+	existing, err := csw.desyncIndexStore.GetIndex(indexName)
 
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -93,47 +151,28 @@ func (csw *CasyncStoreWriter) Close() error {
 
 	if err == nil {
 		// if the file already exists in the index, we're done.
-		return nil
-	}
+		csw.chunks = uint64(len(existing.Chunks))
 
-	// flush the tempfile and seek to the start
-	err = csw.f.Sync()
-	if err != nil {
-		return err
+		return nil
 	}
 
-	_, err = csw.f.Seek(0, 0)
+	// upload index into the index store
+	// name it after the hash
+	err = csw.desyncIndexStore.StoreIndex(indexName, csw.index)
 	if err != nil {
 		return err
 	}
 
-	// Run the chunker on the tempfile
-	chunker, err := desync.NewChunker(
-		csw.f,
-		csw.chunkSizeMinDefault,
-		csw.chunkSizeAvgDefault,
-		csw.chunkSizeMaxDefault,
-	)
-	if err != nil {
-		return err
-	}
+	csw.chunks = uint64(len(csw.index.Chunks))
 
-	// upload all chunks into the store
-	caidx, err := desync.ChunkStream(csw.ctx,
-		chunker,
-		csw.desyncStore,
-		csw.concurrency,
-	)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	// upload index into the index store
-	// name it after the hash
-	err = csw.desyncIndexStore.StoreIndex(indexName, caidx)
-	if err != nil {
-		return err
-	}
+// Abort stops chunking, without storing the index.
+// Chunks already stored are removed by the next garbage collection, if not used by other blobs.
+func (csw *CasyncStoreWriter) Abort() error {
+	csw.pw.CloseWithError(errAborted)
+	<-csw.done
 
 	return nil
 }
@@ -145,3 +184,11 @@ func (csw *CasyncStoreWriter) Sha256Sum() []byte {
 func (csw *CasyncStoreWriter) BytesWritten() uint64 {
 	return csw.bytesWritten
 }
+
+func (csw *CasyncStoreWriter) DedupStats() DedupStats {
+	return DedupStats{
+		Chunks:        csw.chunks,
+		NewChunks:     atomic.LoadUint64(&csw.desyncStore.chunks),
+		NewChunkBytes: atomic.LoadUint64(&csw.desyncStore.bytes),
+	}
+}
@@ -0,0 +1,200 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/folbricht/desync"
+	log "github.com/sirupsen/logrus"
+)
+
+// rechunkTmpPrefix is the prefix of temporary index files written while rechunking.
+const rechunkTmpPrefix = ".rechunk"
+
+// RechunkStats describes the results of a Rechunk run.
+type RechunkStats struct {
+	BlobsRechunked uint64
+	BlobsSkipped   uint64 // blobs already using the current chunk sizes
+	BytesRechunked uint64
+
+	GC *GCStats
+}
+
+// Rechunk re-chunks all blobs whose index was created with other chunk sizes than the ones
+// this store was configured with, so they deduplicate against new uploads again.
+// Each blob is assembled, chunked again, and its index atomically replaced.
+// Chunks no longer referenced by any index are removed afterwards,
+// unless they were touched within gracePeriod.
+//
+// Blobs already using the current chunk sizes are skipped,
+// so an interrupted run can simply be started again.
+// bytesPerSecond limits how fast blobs are read, to not starve a cache being served.
+// 0 means unlimited.
+func (c *CasyncStore) Rechunk(ctx context.Context, bytesPerSecond int64, gracePeriod time.Duration) (*RechunkStats, error) {
+	stats := &RechunkStats{}
+
+	// remove temporary index files of a previous interrupted run
+	tmpFiles, err := filepath.Glob(filepath.Join(c.localIndexStoreDir, rechunkTmpPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tmpFile := range tmpFiles {
+		if err := os.Remove(tmpFile); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(c.localIndexStoreDir)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]struct{}, len(entries))
+
+	for i, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		keep[name] = struct{}{}
+
+		index, err := c.localIndexStore.GetIndex(name)
+		if err != nil {
+			return stats, err
+		}
+
+		if index.Index.ChunkSizeMin == c.chunkSizeMinDefault &&
+			index.Index.ChunkSizeAvg == c.chunkSizeAvgDefault &&
+			index.Index.ChunkSizeMax == c.chunkSizeMaxDefault {
+			stats.BlobsSkipped++
+
+			continue
+		}
+
+		err = c.rechunkBlob(ctx, name, index, bytesPerSecond)
+		if err != nil {
+			return stats, fmt.Errorf("error rechunking %v: %w", name, err)
+		}
+
+		stats.BlobsRechunked++
+		stats.BytesRechunked += uint64(index.Length())
+
+		log.Infof("Re-chunked %v (%d/%d)", name, i+1, len(entries))
+	}
+
+	// keep all blobs, only remove chunks no longer referenced
+	stats.GC, err = c.CollectGarbage(ctx, keep, gracePeriod)
+
+	return stats, err
+}
+
+// rechunkBlob assembles the blob described by index, chunks it with the current chunk sizes,
+// and replaces its index.
+func (c *CasyncStore) rechunkBlob(ctx context.Context, name string, index desync.Index, bytesPerSecond int64) error {
+	expectedSum, err := hex.DecodeString(name)
+	if err != nil {
+		return err
+	}
+
+	csnr, err := NewCasyncStoreReader(ctx, index, c.localStore, []desync.Seed{}, c.concurrency, nil, c.tmpDir)
+	if err != nil {
+		return err
+	}
+	defer csnr.Close()
+
+	var r io.Reader = csnr
+	if bytesPerSecond > 0 {
+		r = &rateLimitedReader{ctx: ctx, r: csnr, bytesPerSecond: bytesPerSecond, start: time.Now()}
+	}
+
+	h := sha256.New()
+
+	chunker, err := desync.NewChunker(io.TeeReader(r, h), c.chunkSizeMinDefault, c.chunkSizeAvgDefault, c.chunkSizeMaxDefault)
+	if err != nil {
+		return err
+	}
+
+	newIndex, err := desync.ChunkStream(ctx, chunker, c.localStore, c.concurrency)
+	if err != nil {
+		return err
+	}
+
+	// ChunkStream stops early if ctx is cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if sum := h.Sum(nil); !bytes.Equal(sum, expectedSum) {
+		return fmt.Errorf("%w: assembled blob has hash %x", ErrBlobMismatch, sum)
+	}
+
+	return c.replaceIndex(name, newIndex)
+}
+
+// replaceIndex atomically replaces the index stored as name.
+func (c *CasyncStore) replaceIndex(name string, index desync.Index) error {
+	f, err := ioutil.TempFile(c.localIndexStoreDir, rechunkTmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = index.WriteTo(f)
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(c.localIndexStoreDir, name))
+}
+
+// rateLimitedReader limits reading from r to bytesPerSecond on average.
+type rateLimitedReader struct {
+	ctx            context.Context
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	n              int64
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	// don't read more than a second worth of data at once
+	if int64(len(p)) > rl.bytesPerSecond {
+		p = p[:rl.bytesPerSecond]
+	}
+
+	n, err := rl.r.Read(p)
+	rl.n += int64(n)
+
+	expected := time.Duration(float64(rl.n) / float64(rl.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Since(rl.start); wait > 0 {
+		select {
+		case <-rl.ctx.Done():
+			return n, rl.ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	return n, err
+}
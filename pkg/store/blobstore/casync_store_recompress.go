@@ -0,0 +1,131 @@
+package blobstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/folbricht/desync"
+	log "github.com/sirupsen/logrus"
+)
+
+// RecompressStats describes the results of a Recompress run,
+// to compare the disk space and CPU time of different chunk store options.
+type RecompressStats struct {
+	Chunks        uint64
+	ChunksInvalid uint64 // chunks not matching their ID, which were left untouched
+
+	BytesBefore uint64
+	BytesAfter  uint64
+
+	// CompressTime is the time spent compressing chunks.
+	CompressTime time.Duration
+	// DecompressTime is the time needed to decompress all chunks once,
+	// which is roughly what assembling all blobs costs.
+	DecompressTime time.Duration
+}
+
+// Recompress rewrites all chunks in the store using the configured ChunkStoreOptions,
+// converting between compressed and uncompressed chunks if necessary.
+// Chunks are replaced atomically, but switching between compressed and uncompressed
+// chunks must not happen while the store is being used with the old options.
+func (c *CasyncStore) Recompress(ctx context.Context) (*RecompressStats, error) {
+	stats := &RecompressStats{}
+
+	err := filepath.Walk(c.localStoreDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		id, compressed, ok := chunkIDFromPath(p)
+		if !ok {
+			return nil
+		}
+
+		return c.recompressChunk(p, id, compressed, info.Size(), stats)
+	})
+
+	return stats, err
+}
+
+func (c *CasyncStore) recompressChunk(p string, id desync.ChunkID, compressed bool, size int64, stats *RecompressStats) error {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	uncompressed := b
+
+	if compressed {
+		uncompressed, err = desync.Decompress(nil, b)
+		if err != nil {
+			log.Warnf("Unable to decompress chunk %v, leaving it alone: %v", p, err)
+
+			stats.ChunksInvalid++
+
+			return nil
+		}
+	}
+
+	if desync.Digest.Sum(uncompressed) != id {
+		log.Warnf("Chunk %v doesn't match its ID, leaving it alone", p)
+
+		stats.ChunksInvalid++
+
+		return nil
+	}
+
+	var chunk *desync.Chunk
+
+	if c.localStore.uncompressed {
+		chunk, err = desync.NewChunkWithID(id, uncompressed, nil, true)
+		stats.BytesAfter += uint64(len(uncompressed))
+	} else {
+		start := time.Now()
+		newCompressed := c.localStore.compress(uncompressed)
+		stats.CompressTime += time.Since(start)
+
+		start = time.Now()
+		_, err = desync.Decompress(nil, newCompressed)
+		stats.DecompressTime += time.Since(start)
+
+		if err != nil {
+			return err
+		}
+
+		chunk, err = desync.NewChunkWithID(id, uncompressed, newCompressed, true)
+		stats.BytesAfter += uint64(len(newCompressed))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// bypass localChunkStore.StoreChunk, the chunk is already compressed with the right level
+	err = c.localStore.LocalStore.StoreChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	// remove the chunk in the old format
+	if newPath := c.localStore.chunkPath(id); newPath != p {
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	stats.Chunks++
+	stats.BytesBefore += uint64(size)
+
+	return nil
+}
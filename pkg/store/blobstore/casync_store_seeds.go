@@ -0,0 +1,230 @@
+package blobstore
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/folbricht/desync"
+	log "github.com/sirupsen/logrus"
+)
+
+// seedCache keeps recently assembled blobs around, to be used as seeds when assembling other blobs.
+// Byte ranges they share with the blob being assembled are copied (or reflinked) from there,
+// instead of being read from the chunk store and decompressed.
+// This helps a lot when serving a new version of a big store path, which mostly consists of
+// the same chunks as the previous one.
+type seedCache struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	seeds map[string]*seedEntry // by hex-encoded sha256
+	size  int64
+}
+
+type seedEntry struct {
+	index    desync.Index
+	size     int64
+	lastUsed time.Time
+	inUse    int // number of assemblies currently reading from this seed
+}
+
+// newSeedCache initializes a seed cache in dir, keeping at most maxSize bytes.
+// Blobs already in dir are picked up, if their index can still be found in indexStore.
+func newSeedCache(dir string, maxSize int64, indexStore desync.IndexStore) (*seedCache, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &seedCache{
+		dir:     dir,
+		maxSize: maxSize,
+		seeds:   make(map[string]*seedEntry),
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		index, err := indexStore.GetIndex(name)
+		if err != nil {
+			// the blob was removed (or this isn't a seed), so this seed is useless.
+			log.Debugf("Removing seed %v without an index: %v", name, err)
+
+			err = os.Remove(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		sc.seeds[name] = &seedEntry{
+			index:    index,
+			size:     entry.Size(),
+			lastUsed: entry.ModTime(),
+		}
+		sc.size += entry.Size()
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc, sc.evict()
+}
+
+// acquire returns seeds for assembling index into dstFile,
+// which are all seeds sharing at least one chunk with index.
+// release needs to be called once assembly is done.
+func (sc *seedCache) acquire(dstFile string, index desync.Index) ([]desync.Seed, func(), error) {
+	chunkIDs := make(map[desync.ChunkID]struct{}, len(index.Chunks))
+	for _, chunk := range index.Chunks {
+		chunkIDs[chunk.ID] = struct{}{}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	var (
+		seeds    []desync.Seed
+		acquired []*seedEntry
+	)
+
+	for name, entry := range sc.seeds {
+		if !sharesChunks(entry.index, chunkIDs) {
+			continue
+		}
+
+		seed, err := desync.NewIndexSeed(dstFile, filepath.Join(sc.dir, name), entry.index)
+		if err != nil {
+			sc.releaseLocked(acquired)
+
+			return nil, nil, err
+		}
+
+		entry.inUse++
+		entry.lastUsed = time.Now()
+
+		seeds = append(seeds, seed)
+		acquired = append(acquired, entry)
+	}
+
+	release := func() {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+
+		sc.releaseLocked(acquired)
+
+		if err := sc.evict(); err != nil {
+			log.Errorf("Error evicting seeds: %v", err)
+		}
+	}
+
+	return seeds, release, nil
+}
+
+func (sc *seedCache) releaseLocked(entries []*seedEntry) {
+	for _, entry := range entries {
+		entry.inUse--
+	}
+}
+
+// add adds the assembled blob at p as a seed, by hardlinking it into the seed cache.
+// It's called while the seeds returned by acquire are still in use,
+// the cache is trimmed to maxSize when they're released.
+func (sc *seedCache) add(sha256 []byte, p string, index desync.Index) error {
+	name := hex.EncodeToString(sha256)
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	// a blob bigger than the whole cache would be evicted right away
+	if fi.Size() > sc.maxSize {
+		return nil
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if entry, ok := sc.seeds[name]; ok {
+		entry.lastUsed = time.Now()
+
+		return nil
+	}
+
+	err = os.Link(p, filepath.Join(sc.dir, name))
+	if err != nil {
+		return err
+	}
+
+	sc.seeds[name] = &seedEntry{
+		index:    index,
+		size:     fi.Size(),
+		lastUsed: time.Now(),
+	}
+	sc.size += fi.Size()
+
+	// Seeds used for assembling this blob are still in use, and can't be evicted yet.
+	// Eviction happens once they're released.
+	return nil
+}
+
+// evict removes the least recently used seeds not in use, until the cache isn't bigger than maxSize.
+// sc.mu needs to be held.
+func (sc *seedCache) evict() error {
+	if sc.size <= sc.maxSize {
+		return nil
+	}
+
+	names := make([]string, 0, len(sc.seeds))
+	for name := range sc.seeds {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return sc.seeds[names[i]].lastUsed.Before(sc.seeds[names[j]].lastUsed)
+	})
+
+	for _, name := range names {
+		if sc.size <= sc.maxSize {
+			break
+		}
+
+		entry := sc.seeds[name]
+		if entry.inUse > 0 {
+			continue
+		}
+
+		err := os.Remove(filepath.Join(sc.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		delete(sc.seeds, name)
+		sc.size -= entry.size
+	}
+
+	return nil
+}
+
+func sharesChunks(index desync.Index, chunkIDs map[desync.ChunkID]struct{}) bool {
+	for _, chunk := range index.Chunks {
+		if _, ok := chunkIDs[chunk.ID]; ok {
+			return true
+		}
+	}
+
+	return false
+}
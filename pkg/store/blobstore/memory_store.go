@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 // MemoryStore implements BlobStore.
@@ -17,12 +18,14 @@ var _ BlobStore = &MemoryStore{}
 type MemoryStore struct {
 	// Go can't use []bytes as a map key
 	blobs   map[string][]byte
+	mtimes  map[string]time.Time
 	muBlobs sync.Mutex
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		blobs: make(map[string][]byte),
+		blobs:  make(map[string][]byte),
+		mtimes: make(map[string]time.Time),
 	}
 }
 
@@ -49,8 +52,37 @@ func (m *MemoryStore) GetBlob(ctx context.Context, sha256 []byte) (io.ReadCloser
 	return nil, 0, os.ErrNotExist
 }
 
-// memoryStoreWriter implements WriteCloseHasher.
-var _ WriteCloseHasher = &memoryStoreWriter{}
+func (m *MemoryStore) CollectGarbage(
+	ctx context.Context,
+	keep map[string]struct{},
+	gracePeriod time.Duration,
+) (*GCStats, error) {
+	m.muBlobs.Lock()
+	defer m.muBlobs.Unlock()
+
+	cutoff := time.Now().Add(-gracePeriod)
+	stats := &GCStats{}
+
+	for k, v := range m.blobs {
+		if _, ok := keep[k]; ok || m.mtimes[k].After(cutoff) {
+			continue
+		}
+
+		delete(m.blobs, k)
+		delete(m.mtimes, k)
+
+		stats.BlobsRemoved++
+		stats.BytesFreed += uint64(len(v))
+	}
+
+	return stats, nil
+}
+
+// memoryStoreWriter implements WriteCloseHasher and Aborter.
+var (
+	_ WriteCloseHasher = &memoryStoreWriter{}
+	_ Aborter          = &memoryStoreWriter{}
+)
 
 type memoryStoreWriter struct {
 	memoryStore  *MemoryStore
@@ -68,13 +100,22 @@ func (msw *memoryStoreWriter) Write(p []byte) (n int, err error) {
 }
 
 func (msw *memoryStoreWriter) Close() error {
+	k := hex.EncodeToString(msw.hash.Sum([]byte{}))
+
 	msw.memoryStore.muBlobs.Lock()
-	msw.memoryStore.blobs[hex.EncodeToString(msw.hash.Sum([]byte{}))] = msw.contents
+	msw.memoryStore.blobs[k] = msw.contents
+	msw.memoryStore.mtimes[k] = time.Now()
 	msw.memoryStore.muBlobs.Unlock()
 
 	return nil
 }
 
+func (msw *memoryStoreWriter) Abort() error {
+	msw.contents = nil
+
+	return nil
+}
+
 func (msw *memoryStoreWriter) Sha256Sum() []byte {
 	return msw.hash.Sum([]byte{})
 }
@@ -4,16 +4,90 @@ package blobstore
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
+
+	"github.com/folbricht/desync"
 )
 
 // BlobStore describes the interface of a blob store.
 type BlobStore interface {
 	PutBlob(ctx context.Context) (WriteCloseHasher, error)
 	GetBlob(ctx context.Context, sha256 []byte) (io.ReadCloser, int64, error)
+
+	// CollectGarbage removes all blobs whose (hex-encoded) sha256 isn't in keep,
+	// as well as all data that was only used by them.
+	// Blobs and data touched within gracePeriod are always kept,
+	// so uploads in progress aren't affected.
+	CollectGarbage(ctx context.Context, keep map[string]struct{}, gracePeriod time.Duration) (*GCStats, error)
 	io.Closer
 }
 
+// ChunkedBlobStore is a BlobStore storing blobs as chunks, described by an index.
+// It allows clients to chunk blobs themselves, and only send chunks not already in the store.
+type ChunkedBlobStore interface {
+	BlobStore
+
+	// MissingChunks returns the IDs of all chunks referenced by index that aren't in the store.
+	// Each ID is only returned once.
+	MissingChunks(ctx context.Context, index desync.Index) ([]desync.ChunkID, error)
+
+	// PutChunk adds a (compressed) chunk to the store, after ensuring its contents match id.
+	PutChunk(ctx context.Context, id desync.ChunkID, compressed []byte) error
+
+	// PutIndex adds a blob described by index, and returns its size.
+	// The blob is assembled from the chunks in the store first, to verify it matches sha256.
+	// If chunks referenced by index are not in the store, ErrChunksMissing is returned.
+	PutIndex(ctx context.Context, sha256 []byte, index desync.Index) (uint64, error)
+
+	// ReadIndex returns a reader for the blob described by index, assembled from the chunks in the store,
+	// without storing index, so its contents can be checked before.
+	// If chunks referenced by index are not in the store, reading fails with ErrChunksMissing.
+	ReadIndex(ctx context.Context, index desync.Index) io.Reader
+
+	// GetChunk returns a reader for a (compressed) chunk, and its size.
+	GetChunk(ctx context.Context, id desync.ChunkID) (io.ReadCloser, int64, error)
+
+	// GetIndex returns the index describing a blob.
+	GetIndex(ctx context.Context, sha256 []byte) (desync.Index, error)
+}
+
+var (
+	// ErrChunksMissing is returned if an index references chunks not in the store.
+	ErrChunksMissing = errors.New("chunks missing")
+	// ErrBlobMismatch is returned if an assembled blob doesn't match the expected hash.
+	ErrBlobMismatch = errors.New("blob mismatch")
+)
+
+// GCStats describes what was removed during a CollectGarbage run.
+type GCStats struct {
+	BlobsRemoved  uint64 `json:"blobsRemoved"`
+	ChunksRemoved uint64 `json:"chunksRemoved"`
+	BytesFreed    uint64 `json:"bytesFreed"`
+	// NarMetasRemoved is set by gc.Run, which removes NarMeta before collecting garbage in the blob store.
+	NarMetasRemoved uint64 `json:"narMetasRemoved"`
+}
+
+// DedupStats describes how much of a blob written to a chunked blob store was already there.
+type DedupStats struct {
+	Chunks        uint64 `json:"chunks"`        // chunks in the blob
+	NewChunks     uint64 `json:"newChunks"`     // chunks that weren't in the store yet
+	NewChunkBytes uint64 `json:"newChunkBytes"` // uncompressed bytes of the new chunks
+}
+
+// DedupStatser is implemented by writers of chunked blob stores.
+// DedupStats can be called after Close.
+type DedupStatser interface {
+	DedupStats() DedupStats
+}
+
+// Aborter is implemented by writers of blob stores that can discard everything written so far,
+// for example if receiving the blob failed half-way. Close must not be called after Abort.
+type Aborter interface {
+	Abort() error
+}
+
 // WriteWriteCloserHashSum is a io.WriteCloser, which you can ask for a checksum.
 type WriteCloseHasher interface {
 	io.WriteCloser
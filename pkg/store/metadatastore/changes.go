@@ -0,0 +1,273 @@
+package metadatastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/util"
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// ChangeType describes what happened to a PathInfo.
+type ChangeType string
+
+const (
+	ChangeAdd    ChangeType = "add"    // a PathInfo was added (or replaced with a different one)
+	ChangeDelete ChangeType = "delete" // a PathInfo was deleted
+)
+
+// Change records a PathInfo being added or deleted.
+// Seq is assigned by the MetadataStore, starts at 1, and increases by one with each change.
+type Change struct {
+	Seq  uint64     `json:"seq"`
+	Type ChangeType `json:"type"`
+	Time time.Time  `json:"time"`
+
+	OutputHash []byte `json:"outputHash"`
+	Name       string `json:"name"`
+	NarHash    []byte `json:"narHash"`
+}
+
+// StorePath returns the store path the change is about.
+func (c *Change) StorePath() string {
+	return util.StoreDir + "/" + nixbase32.EncodeToString(c.OutputHash) + "-" + c.Name
+}
+
+func newChange(changeType ChangeType, pathInfo *PathInfo) *Change {
+	return &Change{
+		Type:       changeType,
+		Time:       time.Now().UTC(),
+		OutputHash: pathInfo.OutputHash,
+		Name:       pathInfo.Name,
+		NarHash:    pathInfo.NarHash,
+	}
+}
+
+// notifier hands out channels that are closed on the next call to notify.
+type notifier struct {
+	ch chan struct{}
+	mu sync.Mutex
+}
+
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+
+	return n.ch
+}
+
+func (n *notifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// journal is an append-only file containing one JSON-serialized Change per line.
+// Multiple processes can append to the same journal, appends are serialized with flock,
+// and the sequence number of a change is its line number.
+type journal struct {
+	path string
+
+	// offsets[i] is the offset of the change with Seq i+1.
+	offsets []int64
+	// size is the number of bytes indexed in offsets, up to the end of the last complete line.
+	size int64
+	mu   sync.Mutex
+
+	notifier
+}
+
+func openJournal(p string) (*journal, error) {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{path: p}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err = j.catchUp()
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// catchUp indexes all complete lines added to the journal file since the last call,
+// possibly by other processes. j.mu needs to be held.
+func (j *journal) catchUp() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(j.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF { //nolint:errorlint
+			// an incomplete line is still being written, it's picked up on the next call.
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		j.offsets = append(j.offsets, j.size)
+		j.size += int64(len(line))
+	}
+}
+
+// append assigns the next sequence number to c, and adds it to the journal.
+func (j *journal) append(c *Change) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("unable to lock journal: %w", err)
+	}
+
+	// pick up changes appended by other processes, so the sequence number is the next free one.
+	err = j.catchUp()
+	if err != nil {
+		return err
+	}
+
+	c.Seq = uint64(len(j.offsets)) + 1
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	_, err = f.Write(b)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	j.offsets = append(j.offsets, j.size)
+	j.size += int64(len(b))
+
+	j.notify()
+
+	return nil
+}
+
+// changes returns up to limit changes with a sequence number bigger than since.
+func (j *journal) changes(since uint64, limit int) ([]*Change, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.catchUp()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*Change{}
+
+	if since >= uint64(len(j.offsets)) || limit <= 0 {
+		return changes, nil
+	}
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(j.offsets[since], io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, j.size-j.offsets[since]))
+
+	for len(changes) < limit {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF { //nolint:errorlint
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		var c Change
+
+		err = json.Unmarshal(bytes.TrimSpace(line), &c)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse journal entry %d: %w", since+uint64(len(changes))+1, err)
+		}
+
+		changes = append(changes, &c)
+	}
+
+	return changes, nil
+}
+
+// LatestSeq returns the sequence number of the latest change in metadataStore, or 0 if there's none.
+// Listing PathInfo after calling it, then following the changes after the returned sequence number,
+// doesn't miss any changes made while listing.
+func LatestSeq(ctx context.Context, metadataStore MetadataStore) (uint64, error) {
+	const pageSize = 1000
+
+	var seq uint64
+
+	for {
+		changes, err := metadataStore.Changes(ctx, seq, pageSize)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(changes) == 0 {
+			return seq, nil
+		}
+
+		seq = changes[len(changes)-1].Seq
+	}
+}
@@ -0,0 +1,87 @@
+package metadatastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/nix-community/go-nix/pkg/nixbase32"
+)
+
+// ClosureEntry is a single store path in a closure.
+type ClosureEntry struct {
+	PathInfo *PathInfo
+	NarMeta  *NarMeta
+}
+
+// Closure returns the store path with the passed outputHash,
+// and all store paths it references, recursively, sorted by store path.
+// References without a PathInfo in the store are returned in missing,
+// as they appear in ReferencesStr.
+// If there's no PathInfo for outputHash itself, an error wrapping os.ErrNotExist is returned.
+func Closure(ctx context.Context, metadataStore MetadataStore, outputHash []byte) ([]*ClosureEntry, []string, error) {
+	rootPathInfo, err := metadataStore.GetPathInfo(ctx, outputHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := []*ClosureEntry{}
+	missing := []string{}
+
+	seen := map[string]struct{}{string(outputHash): {}}
+	queue := []*PathInfo{rootPathInfo}
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+
+		pathInfo := queue[0]
+		queue = queue[1:]
+
+		narMeta, err := metadataStore.GetNarMeta(ctx, pathInfo.NarHash)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"unable to get NarMeta %v referenced by %v: %w",
+				nixbase32.EncodeToString(pathInfo.NarHash),
+				pathInfo.StorePath(),
+				err,
+			)
+		}
+
+		entries = append(entries, &ClosureEntry{
+			PathInfo: pathInfo,
+			NarMeta:  narMeta,
+		})
+
+		for i, reference := range narMeta.References {
+			if _, ok := seen[string(reference)]; ok {
+				continue
+			}
+
+			seen[string(reference)] = struct{}{}
+
+			referencePathInfo, err := metadataStore.GetPathInfo(ctx, reference)
+			if errors.Is(err, os.ErrNotExist) {
+				missing = append(missing, narMeta.ReferencesStr[i])
+
+				continue
+			}
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			queue = append(queue, referencePathInfo)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PathInfo.StorePath() < entries[j].PathInfo.StorePath()
+	})
+	sort.Strings(missing)
+
+	return entries, missing, nil
+}
@@ -1,6 +1,7 @@
 package metadatastore
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,6 +10,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/nix-community/go-nix/pkg/nixbase32"
 )
@@ -19,6 +23,11 @@ var _ MetadataStore = &FileStore{}
 type FileStore struct {
 	pathInfoDirectory string
 	narMetaDirectory  string
+	pinsDirectory     string
+	lockPath          string
+
+	// journal records all PathInfo changes.
+	journal *journal
 }
 
 func NewFileStore(baseDirectory string) (*FileStore, error) {
@@ -36,9 +45,24 @@ func NewFileStore(baseDirectory string) (*FileStore, error) {
 		return nil, err
 	}
 
+	pinsDirectory := path.Join(baseDirectory, "pins")
+
+	err = os.MkdirAll(pinsDirectory, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := openJournal(path.Join(baseDirectory, "journal"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal: %w", err)
+	}
+
 	return &FileStore{
 		pathInfoDirectory: pathInfoDirectory,
 		narMetaDirectory:  narMetaDirectory,
+		pinsDirectory:     pinsDirectory,
+		lockPath:          path.Join(baseDirectory, "pathinfo.lock"),
+		journal:           journal,
 	}, nil
 }
 
@@ -94,16 +118,61 @@ func (fs *FileStore) PutPathInfo(ctx context.Context, pathinfo *PathInfo) error
 		return err
 	}
 
-	p := fs.pathInfoPath(pathinfo.OutputHash)
-	dir := path.Dir(p)
+	unlock, err := fs.lockPathInfo()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	err = os.MkdirAll(dir, os.ModePerm)
+	// uploading the same .narinfo again is a no-op, and doesn't show up as a change,
+	// even if it was accessed since.
+	existing, err := fs.GetPathInfo(ctx, pathinfo.OutputHash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	p := *pathinfo
+
+	if existing != nil {
+		if equalJSON(existing.withoutAccess(), p.withoutAccess()) {
+			return nil
+		}
+
+		p.keepAccess(existing)
+	}
+
+	// serialize the pathinfo to json
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	err = writePathInfoFile(fs.pathInfoPath(p.OutputHash), b, true)
+	if err != nil {
+		return err
+	}
+
+	return fs.journal.append(newChange(ChangeAdd, &p))
+}
+
+// equalJSON returns true if a and b serialize to the same JSON,
+// which compares timestamps regardless of their location, unlike reflect.DeepEqual.
+func equalJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// writePathInfoFile atomically replaces the file at p with b,
+// by writing to a tempfile (in the same directory) and moving it to p.
+// With sync, it's fsync'ed before.
+func writePathInfoFile(p string, b []byte, sync bool) error {
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	// create a tempfile (in the same directory), write to it, then move it to where we want it to be
-	// this is to ensure an atomic write/replacement.
 	tmpFile, err := ioutil.TempFile(path.Dir(p), "narinfo")
 	if err != nil {
 		return err
@@ -112,28 +181,107 @@ func (fs *FileStore) PutPathInfo(ctx context.Context, pathinfo *PathInfo) error
 	defer tmpFile.Close()
 	defer os.Remove(tmpFile.Name())
 
-	// serialize the pathinfo to json
-	b, err := json.Marshal(pathinfo)
+	_, err = tmpFile.Write(b)
 	if err != nil {
 		return err
 	}
 
-	_, err = tmpFile.Write(b)
+	if sync {
+		err = tmpFile.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tmpFile.Close()
 	if err != nil {
 		return err
 	}
 
-	err = tmpFile.Sync()
+	return os.Rename(tmpFile.Name(), p)
+}
+
+// lockPathInfo takes an exclusive lock (shared with other processes using the same store)
+// held while modifying PathInfo, so RecordAccess doesn't overwrite PathInfo updated
+// or bring back PathInfo deleted at the same time. The returned function releases it.
+func (fs *FileStore) lockPathInfo() (func(), error) {
+	f, err := os.OpenFile(fs.lockPath, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+
+		return nil, fmt.Errorf("unable to lock PathInfo: %w", err)
+	}
+
+	// closing the file releases the lock
+	return func() { f.Close() }, nil
+}
+
+func (fs *FileStore) DeletePathInfo(ctx context.Context, outputHash []byte) error {
+	unlock, err := fs.lockPathInfo()
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	err = tmpFile.Close()
+	pathInfo, err := fs.GetPathInfo(ctx, outputHash)
 	if err != nil {
 		return err
 	}
 
-	return os.Rename(tmpFile.Name(), p)
+	err = os.Remove(fs.pathInfoPath(outputHash))
+	if err != nil {
+		return err
+	}
+
+	return fs.journal.append(newChange(ChangeDelete, pathInfo))
+}
+
+// RecordAccess rewrites the PathInfo in accesses, without fsync'ing them,
+// as losing some accesses on a crash is preferable to syncing on every one of them.
+func (fs *FileStore) RecordAccess(ctx context.Context, accesses []*Access) error {
+	unlock, err := fs.lockPathInfo()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, access := range accesses {
+		pathInfo, err := fs.GetPathInfo(ctx, access.OutputHash)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		access.apply(pathInfo)
+
+		b, err := json.Marshal(pathInfo)
+		if err != nil {
+			return err
+		}
+
+		err = writePathInfoFile(fs.pathInfoPath(access.OutputHash), b, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *FileStore) Changes(ctx context.Context, since uint64, limit int) ([]*Change, error) {
+	return fs.journal.changes(since, limit)
+}
+
+func (fs *FileStore) ChangesNotify() <-chan struct{} {
+	return fs.journal.wait()
 }
 
 func (fs *FileStore) GetNarMeta(ctx context.Context, narHash []byte) (*NarMeta, error) {
@@ -221,12 +369,181 @@ func (fs *FileStore) PutNarMeta(ctx context.Context, narMeta *NarMeta) error {
 	return os.Rename(tmpFile.Name(), p)
 }
 
+func (fs *FileStore) ListPathInfo(ctx context.Context) ([]*PathInfo, error) {
+	var pathInfos []*PathInfo
+
+	err := listHashes(fs.pathInfoDirectory, func(outputHash []byte) error {
+		pathInfo, err := fs.GetPathInfo(ctx, outputHash)
+		if err != nil {
+			return err
+		}
+
+		pathInfos = append(pathInfos, pathInfo)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pathInfos, nil
+}
+
+func (fs *FileStore) ListNarMeta(ctx context.Context) ([]*NarMeta, error) {
+	var narMetas []*NarMeta
+
+	err := listHashes(fs.narMetaDirectory, func(narHash []byte) error {
+		narMeta, err := fs.GetNarMeta(ctx, narHash)
+		if err != nil {
+			return err
+		}
+
+		narMetas = append(narMetas, narMeta)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return narMetas, nil
+}
+
+func (fs *FileStore) DeleteNarMeta(ctx context.Context, narHash []byte) error {
+	return os.Remove(fs.narMetaPath(narHash))
+}
+
+func (fs *FileStore) PutPin(ctx context.Context, name string, outputHash []byte) error {
+	err := CheckPinName(name)
+	if err != nil {
+		return err
+	}
+
+	// foreign key constraint: the PathInfo needs to exist
+	_, err = fs.GetPathInfo(ctx, outputHash)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("pinned PathInfo doesn't exist: %w", err)
+		}
+
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(fs.pinsDirectory, ".pin")
+	if err != nil {
+		return err
+	}
+
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(nixbase32.EncodeToString(outputHash) + "\n")
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path.Join(fs.pinsDirectory, name))
+}
+
+func (fs *FileStore) DeletePin(ctx context.Context, name string) error {
+	err := CheckPinName(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path.Join(fs.pinsDirectory, name))
+}
+
+func (fs *FileStore) ListPins(ctx context.Context) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(fs.pinsDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string][]byte, len(entries))
+
+	for _, entry := range entries {
+		// skip leftover tempfiles
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(path.Join(fs.pinsDirectory, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		outputHash, err := nixbase32.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode pin %v: %w", entry.Name(), err)
+		}
+
+		pins[entry.Name()] = outputHash
+	}
+
+	return pins, nil
+}
+
+// listHashes calls fn with the hash of each .json file below directory.
+func listHashes(directory string, fn func(hash []byte) error) error {
+	return filepath.Walk(directory, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// skip directories and leftover tempfiles
+		if info.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+
+		hash, err := nixbase32.DecodeString(strings.TrimSuffix(path.Base(p), ".json"))
+		if err != nil {
+			return fmt.Errorf("unable to decode hash from filename %v: %w", p, err)
+		}
+
+		return fn(hash)
+	})
+}
+
 func (fs *FileStore) Close() error {
 	return nil
 }
 
 func (fs *FileStore) DropAll(ctx context.Context) error {
-	err := os.RemoveAll(fs.narMetaDirectory)
+	// record the deletion of all PathInfo, so sequence numbers keep increasing.
+	pathInfos, err := fs.ListPathInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, pathInfo := range pathInfos {
+		err = fs.DeletePathInfo(ctx, pathInfo.OutputHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.RemoveAll(fs.narMetaDirectory)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(fs.pinsDirectory)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(fs.pinsDirectory, os.ModePerm)
 	if err != nil {
 		return err
 	}
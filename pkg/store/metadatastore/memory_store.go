@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"sync"
 )
 
@@ -17,12 +18,18 @@ type MemoryStore struct {
 	muPathInfo sync.Mutex
 	narMeta    map[string]NarMeta
 	muNarMeta  sync.Mutex
+
+	// changes and pins are guarded by muPathInfo.
+	changes []*Change
+	pins    map[string][]byte
+	notifier
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		pathInfo: make(map[string]PathInfo),
 		narMeta:  make(map[string]NarMeta),
+		pins:     make(map[string][]byte),
 	}
 }
 
@@ -59,12 +66,84 @@ func (ms *MemoryStore) PutPathInfo(ctx context.Context, pathinfo *PathInfo) erro
 	}
 
 	ms.muPathInfo.Lock()
-	ms.pathInfo[hex.EncodeToString(pathinfo.OutputHash)] = *pathinfo
-	ms.muPathInfo.Unlock()
+	defer ms.muPathInfo.Unlock()
+
+	// uploading the same .narinfo again is a no-op, and doesn't show up as a change,
+	// even if it was accessed since.
+	k := hex.EncodeToString(pathinfo.OutputHash)
+	p := *pathinfo
+
+	if existing, ok := ms.pathInfo[k]; ok {
+		if reflect.DeepEqual(existing.withoutAccess(), p.withoutAccess()) {
+			return nil
+		}
+
+		p.keepAccess(&existing)
+	}
+
+	ms.pathInfo[k] = p
+	ms.addChange(newChange(ChangeAdd, &p))
 
 	return nil
 }
 
+// addChange assigns the next sequence number to c, and records it.
+// muPathInfo needs to be held.
+func (ms *MemoryStore) addChange(c *Change) {
+	c.Seq = uint64(len(ms.changes)) + 1
+	ms.changes = append(ms.changes, c)
+	ms.notify()
+}
+
+func (ms *MemoryStore) DeletePathInfo(ctx context.Context, outputHash []byte) error {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	k := hex.EncodeToString(outputHash)
+
+	pathInfo, ok := ms.pathInfo[k]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	delete(ms.pathInfo, k)
+	ms.addChange(newChange(ChangeDelete, &pathInfo))
+
+	return nil
+}
+
+func (ms *MemoryStore) Changes(ctx context.Context, since uint64, limit int) ([]*Change, error) {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	changes := []*Change{}
+
+	for i := since; i < uint64(len(ms.changes)) && len(changes) < limit; i++ {
+		c := *ms.changes[i]
+		changes = append(changes, &c)
+	}
+
+	return changes, nil
+}
+
+func (ms *MemoryStore) ChangesNotify() <-chan struct{} {
+	return ms.wait()
+}
+
+func (ms *MemoryStore) ListPathInfo(ctx context.Context) ([]*PathInfo, error) {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	pathInfos := make([]*PathInfo, 0, len(ms.pathInfo))
+
+	for _, v := range ms.pathInfo {
+		pathInfo := v
+		pathInfos = append(pathInfos, &pathInfo)
+	}
+
+	return pathInfos, nil
+}
+
 func (ms *MemoryStore) GetNarMeta(ctx context.Context, narHash []byte) (*NarMeta, error) {
 	ms.muNarMeta.Lock()
 	v, ok := ms.narMeta[hex.EncodeToString(narHash)]
@@ -102,6 +181,98 @@ func (ms *MemoryStore) PutNarMeta(ctx context.Context, narMeta *NarMeta) error {
 	return nil
 }
 
+func (ms *MemoryStore) ListNarMeta(ctx context.Context) ([]*NarMeta, error) {
+	ms.muNarMeta.Lock()
+	defer ms.muNarMeta.Unlock()
+
+	narMetas := make([]*NarMeta, 0, len(ms.narMeta))
+
+	for _, v := range ms.narMeta {
+		narMeta := v
+		narMetas = append(narMetas, &narMeta)
+	}
+
+	return narMetas, nil
+}
+
+func (ms *MemoryStore) DeleteNarMeta(ctx context.Context, narHash []byte) error {
+	ms.muNarMeta.Lock()
+	defer ms.muNarMeta.Unlock()
+
+	k := hex.EncodeToString(narHash)
+
+	if _, ok := ms.narMeta[k]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(ms.narMeta, k)
+
+	return nil
+}
+
+func (ms *MemoryStore) PutPin(ctx context.Context, name string, outputHash []byte) error {
+	err := CheckPinName(name)
+	if err != nil {
+		return err
+	}
+
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	// foreign key constraint: the PathInfo needs to exist
+	if _, ok := ms.pathInfo[hex.EncodeToString(outputHash)]; !ok {
+		return fmt.Errorf("pinned PathInfo doesn't exist: %w", os.ErrNotExist)
+	}
+
+	ms.pins[name] = outputHash
+
+	return nil
+}
+
+func (ms *MemoryStore) DeletePin(ctx context.Context, name string) error {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	if _, ok := ms.pins[name]; !ok {
+		return os.ErrNotExist
+	}
+
+	delete(ms.pins, name)
+
+	return nil
+}
+
+func (ms *MemoryStore) ListPins(ctx context.Context) (map[string][]byte, error) {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	pins := make(map[string][]byte, len(ms.pins))
+	for name, outputHash := range ms.pins {
+		pins[name] = outputHash
+	}
+
+	return pins, nil
+}
+
+func (ms *MemoryStore) RecordAccess(ctx context.Context, accesses []*Access) error {
+	ms.muPathInfo.Lock()
+	defer ms.muPathInfo.Unlock()
+
+	for _, access := range accesses {
+		k := hex.EncodeToString(access.OutputHash)
+
+		pathInfo, ok := ms.pathInfo[k]
+		if !ok {
+			continue
+		}
+
+		access.apply(&pathInfo)
+		ms.pathInfo[k] = pathInfo
+	}
+
+	return nil
+}
+
 func (ms *MemoryStore) DropAll(ctx context.Context) error {
 	ms.muNarMeta.Lock()
 	ms.muPathInfo.Lock()
@@ -110,8 +281,16 @@ func (ms *MemoryStore) DropAll(ctx context.Context) error {
 		delete(ms.narMeta, k)
 	}
 
-	for k := range ms.pathInfo {
+	// record the deletion of all PathInfo, so sequence numbers keep increasing.
+	for k, pathInfo := range ms.pathInfo {
+		pathInfo := pathInfo
+
 		delete(ms.pathInfo, k)
+		ms.addChange(newChange(ChangeDelete, &pathInfo))
+	}
+
+	for name := range ms.pins {
+		delete(ms.pins, name)
 	}
 
 	ms.muNarMeta.Unlock()
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/flokli/nix-casync/pkg/store/metadatastore"
 	"github.com/flokli/nix-casync/test"
@@ -43,6 +44,64 @@ func TestFileStore(t *testing.T) {
 	testMetadataStore(t, fileStore)
 }
 
+func TestFileStoreJournal(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "narinfo")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	tdAPathInfo, tdANarMeta, err := metadatastore.ParseNarinfo(test.GetTestDataTable()["a"].Narinfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileStore1, err := metadatastore.NewFileStore(tmpDir)
+	if err != nil {
+		panic(err)
+	}
+
+	// another store using the same directory, like another process would
+	fileStore2, err := metadatastore.NewFileStore(tmpDir)
+	if err != nil {
+		panic(err)
+	}
+
+	assert.NoError(t, fileStore1.PutNarMeta(context.Background(), tdANarMeta))
+	assert.NoError(t, fileStore1.PutPathInfo(context.Background(), tdAPathInfo))
+	assert.NoError(t, fileStore2.DeletePathInfo(context.Background(), tdAPathInfo.OutputHash))
+	assert.NoError(t, fileStore1.PutPathInfo(context.Background(), tdAPathInfo))
+
+	for _, fileStore := range []*metadatastore.FileStore{fileStore1, fileStore2} {
+		changes, err := fileStore.Changes(context.Background(), 0, 10)
+		if assert.NoError(t, err) && assert.Len(t, changes, 3) {
+			for i, change := range changes {
+				assert.Equal(t, uint64(i+1), change.Seq)
+			}
+
+			assert.Equal(t, metadatastore.ChangeDelete, changes[1].Type)
+		}
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		fileStore, err := metadatastore.NewFileStore(tmpDir)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.NoError(t, fileStore.DeletePathInfo(context.Background(), tdAPathInfo.OutputHash))
+
+		changes, err := fileStore.Changes(context.Background(), 2, 10)
+		if assert.NoError(t, err) && assert.Len(t, changes, 2) {
+			assert.Equal(t, uint64(4), changes[1].Seq)
+			assert.Equal(t, metadatastore.ChangeDelete, changes[1].Type)
+		}
+	})
+}
+
 // testMetadataStore runs all metadata store tests against the passed store.
 func testMetadataStore(t *testing.T, metadataStore metadatastore.MetadataStore) {
 	testDataT := test.GetTestDataTable()
@@ -95,6 +154,13 @@ func testMetadataStore(t *testing.T, metadataStore metadatastore.MetadataStore)
 			assert.NoError(t, err)
 			assert.Equal(t, *tdANarMeta, *narMeta)
 		})
+
+		t.Run("ListNarMeta", func(t *testing.T) {
+			narMetas, err := metadataStore.ListNarMeta(context.Background())
+			if assert.NoError(t, err) && assert.Len(t, narMetas, 1) {
+				assert.Equal(t, *tdANarMeta, *narMetas[0])
+			}
+		})
 	})
 
 	t.Run("PathInfo", func(t *testing.T) {
@@ -126,6 +192,142 @@ func testMetadataStore(t *testing.T, metadataStore metadatastore.MetadataStore)
 				assert.Equal(t, *tdAPathInfo, *pathInfo)
 			}
 		})
+
+		t.Run("ListPathInfo", func(t *testing.T) {
+			pathInfos, err := metadataStore.ListPathInfo(context.Background())
+			if assert.NoError(t, err) && assert.Len(t, pathInfos, 1) {
+				assert.Equal(t, *tdAPathInfo, *pathInfos[0])
+			}
+		})
+
+		t.Run("Changes", func(t *testing.T) {
+			notify := metadataStore.ChangesNotify()
+
+			// putting the same PathInfo twice is only recorded once
+			changes, err := metadataStore.Changes(context.Background(), 0, 10)
+			if assert.NoError(t, err) && assert.Len(t, changes, 1) {
+				assert.Equal(t, uint64(1), changes[0].Seq)
+				assert.Equal(t, metadatastore.ChangeAdd, changes[0].Type)
+				assert.Equal(t, tdA.Narinfo.StorePath, changes[0].StorePath())
+				assert.Equal(t, tdAPathInfo.NarHash, changes[0].NarHash)
+			}
+
+			err = metadataStore.DeletePathInfo(context.Background(), tdAPathInfo.OutputHash)
+			assert.NoError(t, err)
+
+			select {
+			case <-notify:
+			default:
+				assert.Fail(t, "deleting should notify")
+			}
+
+			_, err = metadataStore.GetPathInfo(context.Background(), tdAPathInfo.OutputHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			err = metadataStore.DeletePathInfo(context.Background(), tdAPathInfo.OutputHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			err = metadataStore.PutPathInfo(context.Background(), tdAPathInfo)
+			assert.NoError(t, err)
+
+			changes, err = metadataStore.Changes(context.Background(), 1, 10)
+			if assert.NoError(t, err) && assert.Len(t, changes, 2) {
+				assert.Equal(t, uint64(2), changes[0].Seq)
+				assert.Equal(t, metadatastore.ChangeDelete, changes[0].Type)
+				assert.Equal(t, uint64(3), changes[1].Seq)
+				assert.Equal(t, metadatastore.ChangeAdd, changes[1].Type)
+			}
+
+			changes, err = metadataStore.Changes(context.Background(), 0, 1)
+			if assert.NoError(t, err) && assert.Len(t, changes, 1) {
+				assert.Equal(t, uint64(1), changes[0].Seq)
+			}
+
+			changes, err = metadataStore.Changes(context.Background(), 3, 10)
+			if assert.NoError(t, err) {
+				assert.Empty(t, changes)
+			}
+		})
+
+		t.Run("Pins", func(t *testing.T) {
+			err := metadataStore.PutPin(context.Background(), "release", tdAPathInfo.OutputHash)
+			assert.NoError(t, err)
+
+			err = metadataStore.PutPin(context.Background(), "../release", tdAPathInfo.OutputHash)
+			assert.Error(t, err, "invalid pin names should be rejected")
+
+			err = metadataStore.PutPin(context.Background(), "missing", tdBPathInfo.OutputHash)
+			assert.ErrorIs(t, err, os.ErrNotExist, "pinning a non-existent PathInfo should fail")
+
+			pins, err := metadataStore.ListPins(context.Background())
+			if assert.NoError(t, err) {
+				assert.Equal(t, map[string][]byte{"release": tdAPathInfo.OutputHash}, pins)
+			}
+
+			assert.NoError(t, metadataStore.DeletePin(context.Background(), "release"))
+			assert.ErrorIs(t, metadataStore.DeletePin(context.Background(), "release"), os.ErrNotExist)
+
+			pins, err = metadataStore.ListPins(context.Background())
+			if assert.NoError(t, err) {
+				assert.Empty(t, pins)
+			}
+		})
+
+		t.Run("RecordAccess", func(t *testing.T) {
+			changes, err := metadataStore.Changes(context.Background(), 0, 100)
+			if err != nil {
+				panic(err)
+			}
+
+			accessedAt := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+			err = metadataStore.RecordAccess(context.Background(), []*metadatastore.Access{
+				{OutputHash: tdAPathInfo.OutputHash, Time: accessedAt, Hits: 2},
+				{OutputHash: tdAPathInfo.OutputHash, Time: accessedAt.Add(-time.Hour), Hits: 1},
+				// doesn't exist, and is skipped
+				{OutputHash: tdBPathInfo.OutputHash, Time: accessedAt, Hits: 1},
+			})
+			assert.NoError(t, err)
+
+			pathInfo, err := metadataStore.GetPathInfo(context.Background(), tdAPathInfo.OutputHash)
+			if assert.NoError(t, err) {
+				assert.Equal(t, accessedAt, pathInfo.LastAccessedAt)
+				assert.Equal(t, uint64(3), pathInfo.Hits)
+				assert.Equal(t, tdAPathInfo.NarHash, pathInfo.NarHash)
+			}
+
+			_, err = metadataStore.GetPathInfo(context.Background(), tdBPathInfo.OutputHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			changesAfter, err := metadataStore.Changes(context.Background(), 0, 100)
+			if assert.NoError(t, err) {
+				assert.Len(t, changesAfter, len(changes), "accesses shouldn't show up as changes")
+			}
+
+			// putting the same PathInfo again (without the access) is still a no-op, and keeps the access.
+			assert.NoError(t, metadataStore.PutPathInfo(context.Background(), tdAPathInfo))
+
+			changesAfter, err = metadataStore.Changes(context.Background(), 0, 100)
+			if assert.NoError(t, err) {
+				assert.Len(t, changesAfter, len(changes), "putting the same PathInfo after an access shouldn't be a change")
+			}
+
+			pathInfo, err = metadataStore.GetPathInfo(context.Background(), tdAPathInfo.OutputHash)
+			if assert.NoError(t, err) {
+				assert.Equal(t, uint64(3), pathInfo.Hits)
+			}
+		})
+
+		t.Run("DeleteNarMeta", func(t *testing.T) {
+			assert.NoError(t, metadataStore.PutNarMeta(context.Background(), tdBNarMeta))
+			assert.NoError(t, metadataStore.DeleteNarMeta(context.Background(), tdBNarMeta.NarHash))
+
+			_, err := metadataStore.GetNarMeta(context.Background(), tdBNarMeta.NarHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+
+			err = metadataStore.DeleteNarMeta(context.Background(), tdBNarMeta.NarHash)
+			assert.ErrorIs(t, err, os.ErrNotExist)
+		})
 	})
 
 	t.Run("Integrity Tests", func(t *testing.T) {
@@ -4,9 +4,13 @@ package metadatastore
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/flokli/nix-casync/pkg/server/compression"
 	"github.com/flokli/nix-casync/pkg/util"
@@ -15,13 +19,56 @@ import (
 	"github.com/nix-community/go-nix/pkg/nixbase32"
 )
 
+// pinNameRegexp describes the allowed names for pins.
+var pinNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`) //nolint:gochecknoglobals
+
+// CheckPinName returns an error if name can't be used as the name of a pin.
+func CheckPinName(name string) error {
+	if !pinNameRegexp.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid pin name: %v", name)
+	}
+
+	return nil
+}
+
 type MetadataStore interface {
 	GetPathInfo(ctx context.Context, outputHash []byte) (*PathInfo, error)
 	PutPathInfo(ctx context.Context, pathInfo *PathInfo) error
+	// ListPathInfo returns all PathInfo in the store, in no particular order.
+	ListPathInfo(ctx context.Context) ([]*PathInfo, error)
+	// DeletePathInfo removes the PathInfo with the passed outputHash.
+	// The NarMeta it refers to is kept (until gc removes it, if no other PathInfo refers to it).
+	DeletePathInfo(ctx context.Context, outputHash []byte) error
+
+	// Changes returns up to limit PathInfo additions and deletions
+	// with a sequence number bigger than since, oldest first.
+	Changes(ctx context.Context, since uint64, limit int) ([]*Change, error)
+	// ChangesNotify returns a channel that's closed on the next change made through this store.
+	// Changes made by other processes sharing the same store are only seen by polling Changes.
+	ChangesNotify() <-chan struct{}
 
 	// TODO: once we have reference scanning, it shouldn't be possible to mutate existing NarMetas
 	GetNarMeta(ctx context.Context, narHash []byte) (*NarMeta, error)
 	PutNarMeta(ctx context.Context, narMeta *NarMeta) error
+	// ListNarMeta returns all NarMeta in the store, in no particular order.
+	ListNarMeta(ctx context.Context) ([]*NarMeta, error)
+	// DeleteNarMeta removes the NarMeta with the passed narHash.
+	// It's up to the caller to ensure no PathInfo refers to it anymore.
+	DeleteNarMeta(ctx context.Context, narHash []byte) error
+
+	// PutPin points the pin with the passed name at the PathInfo with outputHash, which needs to exist.
+	// Pinned store paths (and their closures) are never removed by retention.
+	PutPin(ctx context.Context, name string, outputHash []byte) error
+	// DeletePin removes the pin with the passed name.
+	DeletePin(ctx context.Context, name string) error
+	// ListPins returns all pins, mapping from their name to the outputHash they point to.
+	ListPins(ctx context.Context) (map[string][]byte, error)
+
+	// RecordAccess updates LastAccessedAt and Hits of the PathInfo in accesses.
+	// PathInfo that don't exist (anymore) are skipped.
+	// Unlike PutPathInfo, this doesn't show up in Changes, and might not be persisted durably.
+	RecordAccess(ctx context.Context, accesses []*Access) error
+
 	DropAll(ctx context.Context) error
 	io.Closer
 }
@@ -37,6 +84,93 @@ type PathInfo struct {
 	NarinfoSignatures []*narinfo.Signature
 
 	CA string
+
+	// UploadedAt is when the .narinfo was first uploaded,
+	// LastAccessedAt when it or the NAR file was last requested.
+	// Both are zero if unknown.
+	UploadedAt     time.Time
+	LastAccessedAt time.Time
+	// Hits counts how often the NAR file was downloaded.
+	Hits uint64
+
+	// UploadedBy is the name of the principal that first uploaded the .narinfo,
+	// or empty if unknown.
+	UploadedBy string
+}
+
+// Access describes requests for a store path, to be added to its PathInfo by RecordAccess.
+type Access struct {
+	OutputHash []byte
+	// Time is when it was last requested.
+	Time time.Time
+	// Hits is the number of NAR file downloads.
+	Hits uint64
+}
+
+// apply adds access to pathInfo.
+func (a *Access) apply(pathInfo *PathInfo) {
+	if a.Time.After(pathInfo.LastAccessedAt) {
+		pathInfo.LastAccessedAt = a.Time.UTC()
+	}
+
+	pathInfo.Hits += a.Hits
+}
+
+// withoutAccess returns a copy of pi without LastAccessedAt and Hits.
+// RecordAccess updates them without it being a change, so they're ignored when comparing PathInfo.
+func (pi PathInfo) withoutAccess() PathInfo {
+	pi.LastAccessedAt = time.Time{}
+	pi.Hits = 0
+
+	return pi
+}
+
+// keepAccess sets LastAccessedAt and Hits of pi to the ones of existing, if they're more recent,
+// so accesses recorded since pi was based on existing aren't lost.
+func (pi *PathInfo) keepAccess(existing *PathInfo) {
+	if existing.LastAccessedAt.After(pi.LastAccessedAt) {
+		pi.LastAccessedAt = existing.LastAccessedAt
+	}
+
+	if existing.Hits > pi.Hits {
+		pi.Hits = existing.Hits
+	}
+}
+
+// SetTimestamps sets UploadedAt of pathInfo to now, unless there's already a PathInfo
+// for the same store path in metadataStore, whose timestamps (as well as Hits and UploadedBy) are kept instead.
+// This way, uploading the same .narinfo again doesn't reset them.
+func SetTimestamps(ctx context.Context, metadataStore MetadataStore, pathInfo *PathInfo, now time.Time) error {
+	existing, err := metadataStore.GetPathInfo(ctx, pathInfo.OutputHash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	pathInfo.UploadedAt = now.UTC()
+
+	if existing != nil {
+		if !existing.UploadedAt.IsZero() {
+			pathInfo.UploadedAt = existing.UploadedAt
+		}
+
+		pathInfo.LastAccessedAt = existing.LastAccessedAt
+		pathInfo.Hits = existing.Hits
+
+		if existing.UploadedBy != "" {
+			pathInfo.UploadedBy = existing.UploadedBy
+		}
+	}
+
+	return nil
+}
+
+// LastUsed returns when the PathInfo was last uploaded or accessed, whatever is later.
+func (pi *PathInfo) LastUsed() time.Time {
+	if pi.LastAccessedAt.After(pi.UploadedAt) {
+		return pi.LastAccessedAt
+	}
+
+	return pi.UploadedAt
 }
 
 // ParseNarinfo parses a narinfo.NarInfo struct
@@ -92,7 +226,15 @@ func ParseNarinfo(narinfo *narinfo.NarInfo) (*PathInfo, *NarMeta, error) {
 
 // RenderNarinfo renders a minimal .narinfo from a PathInfo and NarMeta.
 // The URL is synthesized to /nar/$narhash.nar[$compressionSuffix].
-func RenderNarinfo(pathInfo *PathInfo, narMeta *NarMeta, compressionType string) (string, error) {
+// fileHash (sha256) and fileSize describe the file at that URL, they're omitted if fileHash is nil.
+// Without compression, NarHash and NarSize are used.
+func RenderNarinfo(
+	pathInfo *PathInfo,
+	narMeta *NarMeta,
+	compressionType string,
+	fileHash []byte,
+	fileSize uint64,
+) (string, error) {
 	// render the narinfo
 	narHash := &hash.Hash{
 		HashType: hash.HashTypeSha256,
@@ -118,6 +260,19 @@ func RenderNarinfo(pathInfo *PathInfo, narMeta *NarMeta, compressionType string)
 		CA: pathInfo.CA,
 	}
 
+	if compressionType == "none" {
+		fileHash = narMeta.NarHash
+		fileSize = narMeta.Size
+	}
+
+	if fileHash != nil {
+		narInfo.FileHash = &hash.Hash{
+			HashType: hash.HashTypeSha256,
+			Digest:   fileHash,
+		}
+		narInfo.FileSize = fileSize
+	}
+
 	suffix, err := compression.TypeToSuffix(compressionType)
 	if err != nil {
 		return "", err
@@ -160,6 +315,19 @@ type NarMeta struct {
 
 	References    [][]byte // this refers to multiple PathInfo.OutputHash
 	ReferencesStr []string // we still keep the strings around, so we don't need to look up all other PathInfo objects
+
+	// UploadedBy is the name of the principal that first uploaded the NAR file, or empty if unknown.
+	UploadedBy string
+	// UploadedAt is when the NAR file was first uploaded, or zero if unknown.
+	// NarMeta no PathInfo refers to are removed by gc once they're old enough.
+	UploadedAt time.Time
+
+	// Files is the number of regular files in the NAR file,
+	// LargestFile the path of the biggest one (inside the NAR file), and LargestFileSize its size.
+	// They're unknown (and empty) for NAR files uploaded via an index, or before they were recorded.
+	Files           uint64
+	LargestFile     string
+	LargestFileSize uint64
 }
 
 // Check provides some sanity checking on values in the NarMeta struct.
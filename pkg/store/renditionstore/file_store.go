@@ -0,0 +1,304 @@
+// Package renditionstore keeps compressed renditions of NAR files on disk,
+// so popular NAR files don't need to be compressed again on every request.
+package renditionstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmpPrefix is the prefix of renditions currently being written.
+const tmpPrefix = ".tmp-"
+
+// ErrInProgress is returned by Create if the same rendition is already being written.
+var ErrInProgress = errors.New("rendition is already being written")
+
+// FileStore keeps compressed renditions of NAR files in a directory,
+// keyed by NarHash and compression type.
+// The least recently used renditions are removed once the store grows beyond maxSize bytes.
+type FileStore struct {
+	directory string
+	maxSize   int64
+
+	mu         sync.Mutex
+	renditions map[string]*rendition
+	inProgress map[string]struct{}
+	size       int64
+}
+
+type rendition struct {
+	size     int64
+	lastUsed time.Time
+
+	// fileHash is the sha256 of the rendition.
+	// It's calculated on first use for renditions picked up on startup.
+	fileHash []byte
+}
+
+// NewFileStore initializes a FileStore in directory, keeping at most maxSize bytes.
+// Renditions already in directory are picked up,
+// leftovers of renditions that were being written are removed.
+func NewFileStore(directory string, maxSize int64) (*FileStore, error) {
+	err := os.MkdirAll(directory, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		directory:  directory,
+		maxSize:    maxSize,
+		renditions: make(map[string]*rendition),
+		inProgress: make(map[string]struct{}),
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tmpPrefix) {
+			err = os.Remove(path.Join(directory, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		fs.renditions[entry.Name()] = &rendition{
+			size:     entry.Size(),
+			lastUsed: entry.ModTime(),
+		}
+		fs.size += entry.Size()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs, fs.evict()
+}
+
+func renditionName(narHash []byte, compressionType string) string {
+	return hex.EncodeToString(narHash) + "." + compressionType
+}
+
+// Get opens the rendition of the NAR file with the passed NarHash, compressed with compressionType.
+// If there's no such rendition, an error wrapping os.ErrNotExist is returned.
+// It's the callers responsibility to close the file.
+func (fs *FileStore) Get(narHash []byte, compressionType string) (*os.File, int64, error) {
+	name := renditionName(narHash, compressionType)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	r, ok := fs.renditions[name]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+
+	// Even if the rendition is evicted while being read, the file stays readable until closed.
+	f, err := os.Open(path.Join(fs.directory, name))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r.lastUsed = time.Now()
+
+	return f, r.size, nil
+}
+
+// Stat returns the sha256 and size of the rendition of the NAR file with the passed NarHash,
+// compressed with compressionType.
+// If there's no such rendition, an error wrapping os.ErrNotExist is returned.
+func (fs *FileStore) Stat(narHash []byte, compressionType string) ([]byte, int64, error) {
+	name := renditionName(narHash, compressionType)
+
+	fs.mu.Lock()
+
+	r, ok := fs.renditions[name]
+	if !ok {
+		fs.mu.Unlock()
+
+		return nil, 0, os.ErrNotExist
+	}
+
+	if r.fileHash != nil {
+		defer fs.mu.Unlock()
+
+		return r.fileHash, r.size, nil
+	}
+
+	// hash the file without holding the lock.
+	f, err := os.Open(path.Join(fs.directory, name))
+	fs.mu.Unlock()
+
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fileHash := h.Sum(nil)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// only keep it if the rendition wasn't replaced in the meantime
+	if fs.renditions[name] == r {
+		r.fileHash = fileHash
+	}
+
+	return fileHash, size, nil
+}
+
+// Create returns a Writer for a new rendition.
+// It only becomes visible once committed.
+// If the same rendition is already being written, ErrInProgress is returned.
+func (fs *FileStore) Create(narHash []byte, compressionType string) (*Writer, error) {
+	name := renditionName(narHash, compressionType)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.inProgress[name]; ok {
+		return nil, ErrInProgress
+	}
+
+	f, err := ioutil.TempFile(fs.directory, tmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.inProgress[name] = struct{}{}
+
+	return &Writer{
+		fs:   fs,
+		name: name,
+		f:    f,
+		h:    sha256.New(),
+	}, nil
+}
+
+// evict removes the least recently used renditions, until the store isn't bigger than maxSize.
+// fs.mu needs to be held.
+func (fs *FileStore) evict() error {
+	if fs.size <= fs.maxSize {
+		return nil
+	}
+
+	names := make([]string, 0, len(fs.renditions))
+	for name := range fs.renditions {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return fs.renditions[names[i]].lastUsed.Before(fs.renditions[names[j]].lastUsed)
+	})
+
+	for _, name := range names {
+		if fs.size <= fs.maxSize {
+			break
+		}
+
+		err := os.Remove(path.Join(fs.directory, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		fs.size -= fs.renditions[name].size
+		delete(fs.renditions, name)
+	}
+
+	return nil
+}
+
+// Writer writes a new rendition.
+// Either Commit or Abort need to be called.
+type Writer struct {
+	fs   *FileStore
+	name string
+	f    *os.File
+	h    hash.Hash
+	size int64
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.h.Write(p[:n])
+	w.size += int64(n)
+
+	// stop writing once this can't be kept anyways
+	if err == nil && w.size > w.fs.maxSize {
+		return n, errors.New("rendition exceeds the size of the store")
+	}
+
+	return n, err
+}
+
+// Commit makes the rendition visible, and evicts others if necessary.
+func (w *Writer) Commit() error {
+	defer w.done()
+
+	err := w.f.Close()
+	if err != nil {
+		os.Remove(w.f.Name())
+
+		return err
+	}
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	err = os.Rename(w.f.Name(), filepath.Join(w.fs.directory, w.name))
+	if err != nil {
+		os.Remove(w.f.Name())
+
+		return err
+	}
+
+	if old, ok := w.fs.renditions[w.name]; ok {
+		w.fs.size -= old.size
+	}
+
+	w.fs.renditions[w.name] = &rendition{
+		size:     w.size,
+		lastUsed: time.Now(),
+		fileHash: w.h.Sum(nil),
+	}
+	w.fs.size += w.size
+
+	return w.fs.evict()
+}
+
+// Abort discards the rendition.
+func (w *Writer) Abort() {
+	defer w.done()
+
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+func (w *Writer) done() {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	delete(w.fs.inProgress, w.name)
+}
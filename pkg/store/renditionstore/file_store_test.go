@@ -0,0 +1,163 @@
+package renditionstore_test
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/renditionstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "renditions")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// there's room for two renditions of 10 bytes each
+	fileStore, err := renditionstore.NewFileStore(tmpDir, 25)
+	if err != nil {
+		panic(err)
+	}
+
+	narHashA := []byte{0x0a}
+	narHashB := []byte{0x0b}
+	narHashC := []byte{0x0c}
+
+	put := func(narHash []byte, contents string) error {
+		w, err := fileStore.Create(narHash, "zstd")
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write([]byte(contents))
+		if err != nil {
+			w.Abort()
+
+			return err
+		}
+
+		return w.Commit()
+	}
+
+	get := func(narHash []byte) (string, error) {
+		f, size, err := fileStore.Get(narHash, "zstd")
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+
+		assert.Equal(t, int64(len(b)), size)
+
+		return string(b), nil
+	}
+
+	t.Run("Get not found", func(t *testing.T) {
+		_, err := get(narHashA)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Create and Commit", func(t *testing.T) {
+		assert.NoError(t, put(narHashA, "aaaaaaaaaa"))
+
+		contents, err := get(narHashA)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "aaaaaaaaaa", contents)
+		}
+
+		_, _, err = fileStore.Get(narHashA, "br")
+		assert.ErrorIs(t, err, os.ErrNotExist, "other compression types should be separate")
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		fileHash, size, err := fileStore.Stat(narHashA, "zstd")
+		if assert.NoError(t, err) {
+			expectedHash := sha256.Sum256([]byte("aaaaaaaaaa"))
+			assert.Equal(t, expectedHash[:], fileHash)
+			assert.Equal(t, int64(10), size)
+		}
+
+		_, _, err = fileStore.Stat(narHashA, "br")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Create while in progress", func(t *testing.T) {
+		w, err := fileStore.Create(narHashB, "zstd")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = fileStore.Create(narHashB, "zstd")
+		assert.ErrorIs(t, err, renditionstore.ErrInProgress)
+
+		w.Abort()
+
+		_, err = get(narHashB)
+		assert.ErrorIs(t, err, os.ErrNotExist, "aborted renditions should not be visible")
+	})
+
+	t.Run("too big", func(t *testing.T) {
+		assert.Error(t, put(narHashB, "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"))
+	})
+
+	t.Run("evict least recently used", func(t *testing.T) {
+		assert.NoError(t, put(narHashB, "bbbbbbbbbb"))
+
+		time.Sleep(10 * time.Millisecond)
+
+		// use A, so B is the least recently used
+		_, err := get(narHashA)
+		assert.NoError(t, err)
+
+		assert.NoError(t, put(narHashC, "cccccccccc"))
+
+		_, err = get(narHashA)
+		assert.NoError(t, err)
+
+		_, err = get(narHashB)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = get(narHashC)
+		assert.NoError(t, err)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		// simulate a leftover from a crash
+		f, err := ioutil.TempFile(tmpDir, ".tmp-")
+		if err != nil {
+			panic(err)
+		}
+		f.Close()
+
+		fileStore, err := renditionstore.NewFileStore(tmpDir, 25)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		rf, _, err := fileStore.Get(narHashC, "zstd")
+		if assert.NoError(t, err) {
+			rf.Close()
+		}
+
+		// the hash of renditions picked up on startup is calculated on demand
+		fileHash, _, err := fileStore.Stat(narHashC, "zstd")
+		if assert.NoError(t, err) {
+			expectedHash := sha256.Sum256([]byte("cccccccccc"))
+			assert.Equal(t, expectedHash[:], fileHash)
+		}
+
+		assert.NoFileExists(t, f.Name())
+	})
+}
@@ -0,0 +1,479 @@
+// Package uploadstore keeps upload sessions,
+// which allow uploading big NAR files in multiple requests, resuming after failures.
+package uploadstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ErrOffsetMismatch is returned when appending at an offset that's not the current end of the upload.
+var ErrOffsetMismatch = errors.New("offset doesn't match current size of upload")
+
+// ErrNotOpen is returned when appending to or committing an upload that's not open.
+var ErrNotOpen = errors.New("upload is not open")
+
+const (
+	// StateOpen means data can be appended, or the upload can be committed.
+	StateOpen = "open"
+	// StateCommitting means the upload is currently being ingested.
+	StateCommitting = "committing"
+	// StateCommitted means the upload was ingested, and its data removed.
+	StateCommitted = "committed"
+)
+
+// Session describes an upload session.
+type Session struct {
+	ID string
+
+	// Compression describes the compression type the uploaded data is compressed with.
+	Compression string
+
+	State string
+	// Offset is the number of bytes uploaded so far.
+	Offset uint64
+
+	// NarHash and NarSize are populated once committed.
+	NarHash []byte
+	NarSize uint64
+
+	// Error contains the error of the last failed commit, if any.
+	Error string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// FileStore keeps upload sessions in a directory,
+// so they survive restarts.
+// Each session consists of a .json file describing the session, and a .data file
+// with the data uploaded so far.
+type FileStore struct {
+	directory string
+
+	// mu protects sessions, and is held while walking all sessions (such as on Expire),
+	// but not while modifying a single one.
+	mu sync.Mutex
+	// sessions contains the locks of all sessions currently in use, keyed by their ID.
+	sessions map[string]*sessionLock
+}
+
+// sessionLock serializes all modifications to a session.
+type sessionLock struct {
+	mu sync.Mutex
+	// refs is the number of callers holding or waiting for mu.
+	refs int
+}
+
+func NewFileStore(directory string) (*FileStore, error) {
+	err := os.MkdirAll(directory, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		directory: directory,
+		sessions:  make(map[string]*sessionLock),
+	}, nil
+}
+
+func (fs *FileStore) sessionPath(id string) string {
+	return path.Join(fs.directory, id+".json")
+}
+
+func (fs *FileStore) dataPath(id string) string {
+	return path.Join(fs.directory, id+".data")
+}
+
+// lock locks the session with id, and returns a function unlocking it.
+// Sessions locked (or waiting to be) are skipped by Expire and Recover.
+func (fs *FileStore) lock(id string) func() {
+	fs.mu.Lock()
+
+	l, ok := fs.sessions[id]
+	if !ok {
+		l = &sessionLock{}
+		fs.sessions[id] = l
+	}
+
+	l.refs++
+	fs.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+
+		l.refs--
+		if l.refs == 0 {
+			delete(fs.sessions, id)
+		}
+	}
+}
+
+// checkID ensures id looks like something returned by Create,
+// as it's used to construct paths.
+func checkID(id string) error {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return fmt.Errorf("invalid upload id %v: %w", id, os.ErrNotExist)
+	}
+
+	return nil
+}
+
+// Create creates a new, empty upload session.
+func (fs *FileStore) Create(compression string) (*Session, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:          hex.EncodeToString(b),
+		Compression: compression,
+		State:       StateOpen,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	defer fs.lock(session.ID)()
+
+	f, err := os.Create(fs.dataPath(session.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.writeSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Get returns an upload session, or an error containing os.ErrNotExist.
+func (fs *FileStore) Get(id string) (*Session, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(fs.sessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+
+	err = json.Unmarshal(b, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// writeSession atomically persists a session. Its lock (or fs.mu, while walking) needs to be held.
+func (fs *FileStore) writeSession(session *Session) error {
+	tmpFile, err := ioutil.TempFile(fs.directory, "session")
+	if err != nil {
+		return err
+	}
+
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(b)
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), fs.sessionPath(session.ID))
+}
+
+// Append appends the contents of r to the upload, which needs to be open.
+// offset needs to match the number of bytes uploaded so far,
+// or ErrOffsetMismatch is returned.
+// If reading from r fails, everything read until then is kept,
+// and the upload can be resumed from the returned offset.
+// Only the session itself is locked while reading from r,
+// so appending to other sessions isn't blocked by a slow client.
+func (fs *FileStore) Append(id string, offset uint64, r io.Reader) (*Session, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	defer fs.lock(id)()
+
+	session, err := fs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.State != StateOpen {
+		return session, ErrNotOpen
+	}
+
+	if offset != session.Offset {
+		return session, ErrOffsetMismatch
+	}
+
+	f, err := os.OpenFile(fs.dataPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// truncate anything written after the last persisted offset,
+	// for example if we crashed in the middle of a previous append.
+	err = f.Truncate(int64(session.Offset))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(int64(session.Offset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	n, copyErr := io.Copy(f, r)
+
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	session.Offset += uint64(n)
+	session.UpdatedAt = time.Now()
+
+	err = fs.writeSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, copyErr
+}
+
+// StartCommit marks an open upload as being committed,
+// and returns a reader for the uploaded data.
+// Once done, either FinishCommit or FailCommit needs to be called.
+func (fs *FileStore) StartCommit(id string) (*Session, io.ReadCloser, error) {
+	if err := checkID(id); err != nil {
+		return nil, nil, err
+	}
+
+	defer fs.lock(id)()
+
+	session, err := fs.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session.State != StateOpen {
+		return session, nil, ErrNotOpen
+	}
+
+	f, err := os.Open(fs.dataPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.State = StateCommitting
+	session.Error = ""
+	session.UpdatedAt = time.Now()
+
+	err = fs.writeSession(session)
+	if err != nil {
+		f.Close()
+
+		return nil, nil, err
+	}
+
+	// only return what was persisted, in case a previous append didn't finish
+	return session, struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, int64(session.Offset)), f}, nil
+}
+
+// FinishCommit marks an upload as committed, and removes its data.
+func (fs *FileStore) FinishCommit(id string, narHash []byte, narSize uint64) (*Session, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	defer fs.lock(id)()
+
+	session, err := fs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	session.State = StateCommitted
+	session.NarHash = narHash
+	session.NarSize = narSize
+	session.UpdatedAt = time.Now()
+
+	err = fs.writeSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(fs.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// FailCommit re-opens an upload after a failed commit, recording the error.
+func (fs *FileStore) FailCommit(id string, commitErr error) (*Session, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+
+	defer fs.lock(id)()
+
+	session, err := fs.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	session.State = StateOpen
+	session.Error = commitErr.Error()
+	session.UpdatedAt = time.Now()
+
+	err = fs.writeSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// Delete removes an upload session, and its data.
+func (fs *FileStore) Delete(id string) error {
+	if err := checkID(id); err != nil {
+		return err
+	}
+
+	defer fs.lock(id)()
+
+	return fs.delete(id)
+}
+
+func (fs *FileStore) delete(id string) error {
+	err := os.Remove(fs.dataPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Remove(fs.sessionPath(id))
+}
+
+// Expire removes all sessions that weren't updated within ttl,
+// and returns how many were removed.
+// Sessions currently being committed or appended to are kept.
+func (fs *FileStore) Expire(ttl time.Duration) (int, error) {
+	return fs.walk(func(session *Session) (bool, error) {
+		if session.State == StateCommitting || time.Since(session.UpdatedAt) < ttl {
+			return false, nil
+		}
+
+		return true, fs.delete(session.ID)
+	})
+}
+
+// Recover re-opens all sessions that were being committed,
+// for example when the process was stopped during a commit.
+// It must not be called while commits are in progress.
+func (fs *FileStore) Recover() (int, error) {
+	return fs.walk(func(session *Session) (bool, error) {
+		if session.State != StateCommitting {
+			return false, nil
+		}
+
+		session.State = StateOpen
+		session.Error = "commit interrupted"
+
+		return true, fs.writeSession(session)
+	})
+}
+
+// walk calls fn for each session not currently locked while holding fs.mu,
+// and returns the number of times it returned true.
+func (fs *FileStore) walk(fn func(session *Session) (bool, error)) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(fs.directory)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if path.Ext(name) != ".json" || checkID(name[:len(name)-len(".json")]) != nil {
+			continue
+		}
+
+		id := name[:len(name)-len(".json")]
+		if _, ok := fs.sessions[id]; ok {
+			continue
+		}
+
+		session, err := fs.Get(id)
+		if err != nil {
+			return n, err
+		}
+
+		ok, err := fn(session)
+		if err != nil {
+			return n, err
+		}
+
+		if ok {
+			n++
+		}
+	}
+
+	return n, nil
+}
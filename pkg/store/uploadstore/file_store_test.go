@@ -0,0 +1,176 @@
+package uploadstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/uploadstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	fileStore, err := uploadstore.NewFileStore(tmpDir)
+	if err != nil {
+		panic(err)
+	}
+
+	session, err := fileStore.Create("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := session.ID
+
+	t.Run("Get", func(t *testing.T) {
+		s, err := fileStore.Get(id)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uploadstore.StateOpen, s.State)
+			assert.Equal(t, uint64(0), s.Offset)
+		}
+
+		_, err = fileStore.Get("00000000000000000000000000000000")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = fileStore.Get("../../etc/passwd")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		s, err := fileStore.Append(id, 0, bytes.NewReader([]byte("hello ")))
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(6), s.Offset)
+		}
+
+		_, err = fileStore.Append(id, 0, bytes.NewReader([]byte("hello ")))
+		assert.ErrorIs(t, err, uploadstore.ErrOffsetMismatch)
+
+		s, err = fileStore.Append(id, 6, bytes.NewReader([]byte("world")))
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(11), s.Offset)
+		}
+	})
+
+	t.Run("Commit, fail, then recommit", func(t *testing.T) {
+		_, r, err := fileStore.StartCommit(id)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		contents, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello world"), contents)
+		assert.NoError(t, r.Close())
+
+		_, err = fileStore.Append(id, 11, bytes.NewReader([]byte("!")))
+		assert.ErrorIs(t, err, uploadstore.ErrNotOpen, "appending while committing should fail")
+
+		_, _, err = fileStore.StartCommit(id)
+		assert.ErrorIs(t, err, uploadstore.ErrNotOpen, "committing twice should fail")
+
+		s, err := fileStore.FailCommit(id, io.ErrUnexpectedEOF)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uploadstore.StateOpen, s.State)
+			assert.Equal(t, io.ErrUnexpectedEOF.Error(), s.Error)
+		}
+
+		_, r, err = fileStore.StartCommit(id)
+		if assert.NoError(t, err) {
+			assert.NoError(t, r.Close())
+		}
+
+		s, err = fileStore.FinishCommit(id, []byte{0x01}, 11)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uploadstore.StateCommitted, s.State)
+			assert.Equal(t, uint64(11), s.NarSize)
+		}
+	})
+
+	t.Run("Recover", func(t *testing.T) {
+		session, err := fileStore.Create("none")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, r, err := fileStore.StartCommit(session.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+
+		n, err := fileStore.Recover()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		s, err := fileStore.Get(session.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uploadstore.StateOpen, s.State)
+		}
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		n, err := fileStore.Expire(time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		n, err = fileStore.Expire(0)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		_, err = fileStore.Get(id)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("Append doesn't block other sessions", func(t *testing.T) {
+		slow, err := fileStore.Create("none")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		other, err := fileStore.Create("none")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		pr, pw := io.Pipe()
+		done := make(chan *uploadstore.Session)
+
+		go func() {
+			s, _ := fileStore.Append(slow.ID, 0, pr)
+			done <- s
+		}()
+
+		_, err = pw.Write([]byte("slow"))
+		assert.NoError(t, err)
+
+		// the slow client is still sending, but other sessions can be appended to.
+		s, err := fileStore.Append(other.ID, 0, bytes.NewReader([]byte("fast")))
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(4), s.Offset)
+		}
+
+		// and it's not expired while being appended to.
+		n, err := fileStore.Expire(0)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		pw.Close()
+
+		s = <-done
+		if assert.NotNil(t, s) {
+			assert.Equal(t, uint64(4), s.Offset)
+		}
+	})
+}
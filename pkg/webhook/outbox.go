@@ -0,0 +1,415 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options configure where and how events in an Outbox are delivered.
+type Options struct {
+	Endpoints []*Endpoint
+
+	// MaxAttempts is how often a delivery is tried before giving up. Defaults to 10.
+	MaxAttempts int
+	// MinBackoff is the delay after the first failed attempt, doubling with every further one.
+	// Defaults to a second.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to an hour.
+	MaxBackoff time.Duration
+	// Timeout is the timeout of a single request. Defaults to 10 seconds.
+	Timeout time.Duration
+	// ScanInterval is how often the outbox is checked for events published by other processes
+	// (such as gc). Defaults to 10 seconds.
+	ScanInterval time.Duration
+
+	HTTPClient *http.Client
+}
+
+//nolint:gomnd
+func (o *Options) setDefaults() {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 10
+	}
+
+	if o.MinBackoff == 0 {
+		o.MinBackoff = time.Second
+	}
+
+	if o.MaxBackoff == 0 {
+		o.MaxBackoff = time.Hour
+	}
+
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+
+	if o.ScanInterval == 0 {
+		o.ScanInterval = 10 * time.Second
+	}
+
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+}
+
+// Outbox persists events in a directory, and delivers them to the configured endpoints.
+// Published events are written to incoming/, and split into one delivery per endpoint (in pending/)
+// by Run. Deliveries that failed MaxAttempts times are moved to failed/.
+//
+// Multiple processes can publish events to the same outbox, but only one should Run it.
+type Outbox struct {
+	dir  string
+	opts Options
+
+	wake chan struct{}
+}
+
+// delivery is an event to be sent to a single endpoint.
+type delivery struct {
+	URL         string          `json:"url"`
+	EventType   EventType       `json:"eventType"`
+	EventID     string          `json:"eventID"`
+	Event       json.RawMessage `json:"event"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// OpenOutbox opens the outbox in dir, creating it if it doesn't exist yet.
+func OpenOutbox(dir string, opts Options) (*Outbox, error) {
+	opts.setDefaults()
+
+	for _, sub := range []string{"incoming", "pending", "failed"} {
+		err := os.MkdirAll(path.Join(dir, sub), os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Outbox{
+		dir:  dir,
+		opts: opts,
+		wake: make(chan struct{}, 1),
+	}, nil
+}
+
+// Publish adds an event to the outbox. ID and Time are set if empty.
+// It's delivered by Run, possibly in another process.
+func (o *Outbox) Publish(e *Event) error {
+	if e.ID == "" {
+		id, err := newEventID()
+		if err != nil {
+			return err
+		}
+
+		e.ID = id
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// names sort by time, so events are delivered in order.
+	err = writeFileAtomic(path.Join(o.dir, "incoming"), fmt.Sprintf("%020d-%s.json", e.Time.UnixNano(), e.ID), b)
+	if err != nil {
+		return fmt.Errorf("unable to persist event: %w", err)
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Run delivers events until ctx is cancelled.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		next := o.process(ctx)
+
+		wait := o.opts.ScanInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+// process splits new events into deliveries, and attempts all deliveries that are due.
+// It returns when the next delivery is due, or the zero time if there's none.
+func (o *Outbox) process(ctx context.Context) time.Time {
+	err := o.fanOut()
+	if err != nil {
+		log.Errorf("Error processing webhook events: %v", err)
+	}
+
+	names, err := listJSON(path.Join(o.dir, "pending"))
+	if err != nil {
+		log.Errorf("Error listing webhook deliveries: %v", err)
+
+		return time.Time{}
+	}
+
+	var next time.Time
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return time.Time{}
+		}
+
+		due, err := o.attempt(ctx, name)
+		if err != nil {
+			log.Errorf("Error processing webhook delivery %v: %v", name, err)
+
+			continue
+		}
+
+		if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+
+	return next
+}
+
+// fanOut turns each event in incoming/ into a delivery for each endpoint interested in it.
+func (o *Outbox) fanOut() error {
+	names, err := listJSON(path.Join(o.dir, "incoming"))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		p := path.Join(o.dir, "incoming", name)
+
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		var e Event
+
+		err = json.Unmarshal(b, &e)
+		if err != nil {
+			log.Errorf("Dropping invalid webhook event %v: %v", name, err)
+
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, endpoint := range o.opts.Endpoints {
+			if !endpoint.wants(e.Type) {
+				continue
+			}
+
+			err = o.writeDelivery(deliveryName(name, endpoint.URL), &delivery{
+				URL:       endpoint.URL,
+				EventType: e.Type,
+				EventID:   e.ID,
+				Event:     b,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// if we crash before this, the deliveries are written again, which is harmless.
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attempt sends the delivery in pending/name if it's due.
+// It returns when the next attempt is due, or the zero time if there's none.
+func (o *Outbox) attempt(ctx context.Context, name string) (time.Time, error) {
+	p := path.Join(o.dir, "pending", name)
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var d delivery
+
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if time.Now().Before(d.NextAttempt) {
+		return d.NextAttempt, nil
+	}
+
+	endpoint := o.endpoint(d.URL)
+	if endpoint == nil {
+		log.Warnf("Dropping webhook delivery %v to %v, which is no longer configured", d.EventID, d.URL)
+
+		return time.Time{}, os.Remove(p)
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, o.opts.Timeout)
+	defer cancel()
+
+	err = send(reqCtx, o.opts.HTTPClient, endpoint, d.EventType, d.EventID, d.Event)
+	if err == nil {
+		log.Debugf("Delivered webhook %v (%v) to %v", d.EventID, d.EventType, d.URL)
+
+		return time.Time{}, os.Remove(p)
+	}
+
+	if ctx.Err() != nil {
+		// shutting down, this isn't the endpoint's fault.
+		return time.Time{}, nil
+	}
+
+	d.Attempts++
+	d.LastError = err.Error()
+
+	if d.Attempts >= o.opts.MaxAttempts {
+		log.Errorf("Giving up delivering webhook %v to %v after %d attempts: %v", d.EventID, d.URL, d.Attempts, err)
+
+		err = o.writeDelivery(name, &d)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return time.Time{}, os.Rename(p, path.Join(o.dir, "failed", name))
+	}
+
+	d.NextAttempt = time.Now().Add(o.backoff(d.Attempts))
+
+	log.Warnf("Error delivering webhook %v to %v (attempt %d, retrying at %v): %v",
+		d.EventID, d.URL, d.Attempts, d.NextAttempt.Format(time.RFC3339), err)
+
+	return d.NextAttempt, o.writeDelivery(name, &d)
+}
+
+// backoff returns the delay after the passed number of failed attempts,
+// doubling with each one, with up to 10% jitter.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.opts.MinBackoff
+
+	for i := 1; i < attempts && d < o.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > o.opts.MaxBackoff {
+		d = o.opts.MaxBackoff
+	}
+
+	//nolint:gosec,gomnd
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+func (o *Outbox) endpoint(url string) *Endpoint {
+	for _, endpoint := range o.opts.Endpoints {
+		if endpoint.URL == url {
+			return endpoint
+		}
+	}
+
+	return nil
+}
+
+func (o *Outbox) writeDelivery(name string, d *delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(o.dir, "pending"), name, b)
+}
+
+// deliveryName returns the file name of the delivery of the event in eventName to url.
+func deliveryName(eventName, url string) string {
+	h := sha256.Sum256([]byte(url))
+
+	return strings.TrimSuffix(eventName, ".json") + "-" + hex.EncodeToString(h[:4]) + ".json"
+}
+
+// listJSON returns the names of all .json files in dir, sorted.
+func listJSON(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		// skip leftover tempfiles
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// writeFileAtomic writes b to dir/name, by writing to a tempfile and renaming it.
+func writeFileAtomic(dir, name string, b []byte) error {
+	tmpFile, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return err
+	}
+
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(b)
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path.Join(dir, name))
+}
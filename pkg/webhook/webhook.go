@@ -0,0 +1,153 @@
+// Package webhook notifies other services about changes to a cache, by sending events as HTTP POST requests.
+// Events are persisted in an outbox before being delivered, so they survive restarts,
+// and deliveries that failed are retried with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+)
+
+// EventType describes what happened.
+type EventType string
+
+const (
+	EventNarinfoPut    EventType = "narinfo.put"    // a .narinfo was uploaded
+	EventNarinfoDelete EventType = "narinfo.delete" // a .narinfo was deleted
+	EventNarIngest     EventType = "nar.ingest"     // a NAR file was uploaded
+	EventGC            EventType = "gc"             // garbage collection ran
+)
+
+// EventTypes contains all event types.
+var EventTypes = []EventType{EventNarinfoPut, EventNarinfoDelete, EventNarIngest, EventGC} //nolint:gochecknoglobals
+
+// Event is sent as the JSON body of a webhook request.
+type Event struct {
+	// ID is unique for each event, and stays the same when a delivery is retried,
+	// so receivers can ignore events they already processed.
+	ID   string    `json:"id"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Cache is the name of the tenant, or empty for the default cache.
+	Cache string `json:"cache,omitempty"`
+
+	StorePath string                `json:"storePath,omitempty"`
+	NarHash   string                `json:"narHash,omitempty"`
+	NarSize   uint64                `json:"narSize,omitempty"`
+	Dedup     *blobstore.DedupStats `json:"dedup,omitempty"`
+
+	GC *blobstore.GCStats `json:"gc,omitempty"`
+}
+
+// Endpoint is a URL events are sent to.
+type Endpoint struct {
+	URL string
+	// Secret is used to sign requests, if not empty.
+	Secret string
+	// Events are the event types sent to the endpoint. All are sent if empty.
+	Events []EventType
+}
+
+func (e *Endpoint) wants(eventType EventType) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseEventType returns the EventType named s.
+func ParseEventType(s string) (EventType, error) {
+	for _, t := range EventTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown event type: %v", s)
+}
+
+const (
+	// HeaderEvent contains the event type.
+	HeaderEvent = "X-Nix-Casync-Event"
+	// HeaderDelivery contains the event ID.
+	HeaderDelivery = "X-Nix-Casync-Delivery"
+	// HeaderSignature contains "sha256=" and the hex-encoded HMAC-SHA256 of the body,
+	// keyed with the secret of the endpoint.
+	HeaderSignature = "X-Nix-Casync-Signature"
+)
+
+// Sign returns the value of HeaderSignature for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature (the value of HeaderSignature) matches body.
+// It can be used by receivers written in Go.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// newEventID returns a random event ID.
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// send posts body (a serialized Event of type eventType) to endpoint.
+// Any response other than 2xx is an error.
+func send(ctx context.Context, httpClient *http.Client, endpoint *Endpoint, eventType EventType, eventID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(eventType))
+	req.Header.Set(HeaderDelivery, eventID)
+
+	if endpoint.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(endpoint.Secret, body))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v: %v", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flokli/nix-casync/pkg/store/blobstore"
+	"github.com/flokli/nix-casync/pkg/webhook"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver records the events sent to it,
+// failing the first failures requests.
+type receiver struct {
+	secret   string
+	failures int
+
+	requests int
+	events   []*webhook.Event
+	mu       sync.Mutex
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, secret string, failures int) (*receiver, *httptest.Server) {
+	t.Helper()
+
+	rcv := &receiver{
+		secret:   secret,
+		failures: failures,
+		received: make(chan struct{}, 100),
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		rcv.requests++
+
+		if rcv.requests <= rcv.failures {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		if rcv.secret != "" && !webhook.Verify(rcv.secret, body, r.Header.Get(webhook.HeaderSignature)) {
+			http.Error(w, "invalid signature", http.StatusForbidden)
+
+			return
+		}
+
+		var e webhook.Event
+
+		err = json.Unmarshal(body, &e)
+		if err != nil {
+			panic(err)
+		}
+
+		if r.Header.Get(webhook.HeaderEvent) != string(e.Type) || r.Header.Get(webhook.HeaderDelivery) != e.ID {
+			http.Error(w, "header mismatch", http.StatusBadRequest)
+
+			return
+		}
+
+		rcv.events = append(rcv.events, &e)
+		rcv.received <- struct{}{}
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return rcv, srv
+}
+
+func (rcv *receiver) wait(t *testing.T, n int) []*webhook.Event {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-rcv.received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i+1)
+		}
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return rcv.events
+}
+
+func newOutboxDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		panic(err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+// run runs outbox until the test finishes.
+func run(t *testing.T, outbox *webhook.Outbox) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		outbox.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	t.Run("deliver", func(t *testing.T) {
+		rcv, srv := newReceiver(t, "s3cret", 0)
+
+		outbox, err := webhook.OpenOutbox(newOutboxDir(t), webhook.Options{
+			Endpoints: []*webhook.Endpoint{{URL: srv.URL, Secret: "s3cret"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run(t, outbox)
+
+		assert.NoError(t, outbox.Publish(&webhook.Event{
+			Type:      webhook.EventNarIngest,
+			NarHash:   "sha256:foo",
+			NarSize:   128,
+			Dedup:     &blobstore.DedupStats{Chunks: 3, NewChunks: 1, NewChunkBytes: 42},
+			StorePath: "/nix/store/foo",
+		}))
+		assert.NoError(t, outbox.Publish(&webhook.Event{Type: webhook.EventGC, GC: &blobstore.GCStats{BlobsRemoved: 1}}))
+
+		events := rcv.wait(t, 2)
+		if assert.Len(t, events, 2) {
+			assert.Equal(t, webhook.EventNarIngest, events[0].Type)
+			assert.NotEmpty(t, events[0].ID)
+			assert.Equal(t, uint64(128), events[0].NarSize)
+			assert.Equal(t, uint64(1), events[0].Dedup.NewChunks)
+			assert.Equal(t, webhook.EventGC, events[1].Type)
+			assert.Equal(t, uint64(1), events[1].GC.BlobsRemoved)
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		assert.False(t, webhook.Verify("other", []byte("{}"), webhook.Sign("s3cret", []byte("{}"))))
+		assert.True(t, webhook.Verify("s3cret", []byte("{}"), webhook.Sign("s3cret", []byte("{}"))))
+	})
+
+	t.Run("event filter", func(t *testing.T) {
+		rcvAll, srvAll := newReceiver(t, "", 0)
+		rcvGC, srvGC := newReceiver(t, "", 0)
+
+		outbox, err := webhook.OpenOutbox(newOutboxDir(t), webhook.Options{
+			Endpoints: []*webhook.Endpoint{
+				{URL: srvAll.URL},
+				{URL: srvGC.URL, Events: []webhook.EventType{webhook.EventGC}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run(t, outbox)
+
+		assert.NoError(t, outbox.Publish(&webhook.Event{Type: webhook.EventNarinfoPut}))
+		assert.NoError(t, outbox.Publish(&webhook.Event{Type: webhook.EventGC}))
+
+		assert.Len(t, rcvAll.wait(t, 2), 2)
+
+		events := rcvGC.wait(t, 1)
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, webhook.EventGC, events[0].Type)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		rcv, srv := newReceiver(t, "", 2)
+
+		outbox, err := webhook.OpenOutbox(newOutboxDir(t), webhook.Options{
+			Endpoints:  []*webhook.Endpoint{{URL: srv.URL}},
+			MinBackoff: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run(t, outbox)
+
+		e := &webhook.Event{Type: webhook.EventNarinfoPut}
+		assert.NoError(t, outbox.Publish(e))
+
+		events := rcv.wait(t, 1)
+		if assert.Len(t, events, 1) {
+			assert.Equal(t, e.ID, events[0].ID, "retries should keep the event ID")
+		}
+
+		assert.Equal(t, 3, rcv.requests)
+	})
+
+	t.Run("give up", func(t *testing.T) {
+		_, srv := newReceiver(t, "", 100)
+		dir := newOutboxDir(t)
+
+		outbox, err := webhook.OpenOutbox(dir, webhook.Options{
+			Endpoints:   []*webhook.Endpoint{{URL: srv.URL}},
+			MaxAttempts: 2,
+			MinBackoff:  10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run(t, outbox)
+
+		assert.NoError(t, outbox.Publish(&webhook.Event{Type: webhook.EventNarinfoPut}))
+
+		assert.Eventually(t, func() bool {
+			failed, _ := ioutil.ReadDir(path.Join(dir, "failed"))
+
+			return len(failed) == 1
+		}, 10*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("survives restarts", func(t *testing.T) {
+		rcv, srv := newReceiver(t, "", 0)
+		dir := newOutboxDir(t)
+		opts := webhook.Options{Endpoints: []*webhook.Endpoint{{URL: srv.URL}}}
+
+		// published, but not delivered, like by gc, or before a crash.
+		outbox, err := webhook.OpenOutbox(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, outbox.Publish(&webhook.Event{Type: webhook.EventGC}))
+
+		outbox, err = webhook.OpenOutbox(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run(t, outbox)
+
+		assert.Len(t, rcv.wait(t, 1), 1)
+	})
+}
@@ -2,12 +2,34 @@ package test
 
 import (
 	"bytes"
-	_ "embed"
+	"embed"
+	"errors"
 	"fmt"
+	"io/fs"
 
 	"github.com/nix-community/go-nix/pkg/nar/narinfo"
 )
 
+// compressedNars contains NAR files compressed with various compression types,
+// named like the NAR file, with the suffix of the compression type.
+//
+//go:embed nar/*.nar.*
+var compressedNars embed.FS
+
+// compressedNarSuffixes maps the compression types compressedNars contains to their suffixes.
+var compressedNarSuffixes = map[string]string{ //nolint:gochecknoglobals
+	"compress": ".Z",
+	"lzip":     ".lzip",
+	"lzma":     ".lzma",
+	"lzop":     ".lzo",
+}
+
+// compressedLargeNars contains LargeNar compressed with the compression types in compressedNarSuffixes,
+// named large.nar, with the suffix of the compression type.
+//
+//go:embed compressed/large.nar.*
+var compressedLargeNars embed.FS
+
 //go:embed x236iz9shqypbnm64qgqisz0jr4wmj2b.narinfo
 var aNarinfoContents []byte
 
@@ -30,6 +52,10 @@ type Data struct {
 	NarinfoContents []byte
 	Narinfo         *narinfo.NarInfo
 	NarContents     []byte
+
+	// CompressedNarContents contains NarContents compressed with various compression types,
+	// keyed by compression type.
+	CompressedNarContents map[string][]byte
 }
 
 type DataTable map[string]Data
@@ -57,12 +83,45 @@ func GetTestDataTable() DataTable {
 			panic(fmt.Errorf("error parsing narinfo contents: %w", err))
 		}
 
+		compressedNarContents := make(map[string][]byte, len(compressedNarSuffixes))
+
+		for compressionType, suffix := range compressedNarSuffixes {
+			b, err := compressedNars.ReadFile(narinfo.URL + suffix)
+			if err != nil {
+				panic(fmt.Errorf("error reading compressed nar contents: %w", err))
+			}
+
+			compressedNarContents[compressionType] = b
+		}
+
 		testDataT[item.name] = Data{
-			NarinfoContents: item.narinfoContents,
-			Narinfo:         narinfo,
-			NarContents:     item.narContents,
+			NarinfoContents:       item.narinfoContents,
+			Narinfo:               narinfo,
+			NarContents:           item.narContents,
+			CompressedNarContents: compressedNarContents,
 		}
 	}
 
 	return testDataT
 }
+
+// GetCompressedLargeNar returns LargeNar compressed with various compression types, keyed by compression type.
+// It only contains the compression types generated by //test/generator/compress-nars.sh so far.
+func GetCompressedLargeNar() map[string][]byte {
+	compressedContents := make(map[string][]byte, len(compressedNarSuffixes))
+
+	for compressionType, suffix := range compressedNarSuffixes {
+		b, err := compressedLargeNars.ReadFile("compressed/large.nar" + suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			panic(fmt.Errorf("error reading compressed large nar contents: %w", err))
+		}
+
+		compressedContents[compressionType] = b
+	}
+
+	return compressedContents
+}
@@ -0,0 +1,22 @@
+#!/usr/bin/env nix-shell
+#!nix-shell -i bash -p go lzip xz lzop ncompress
+# This creates the compressed NAR files in //test/nar,
+# and the compressed variants of test.LargeNar in //test/compressed,
+# which are used to test decompression.
+set -euo pipefail
+
+cd "$(dirname "$0")/.."
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+go run ./generator/large-nar > "$tmp/large.nar"
+
+for nar in nar/*.nar "$tmp/large.nar"; do
+  lzip -c "$nar" > "$nar.lzip"
+  lzma -c "$nar" > "$nar.lzma"
+  lzop -c "$nar" > "$nar.lzo"
+  compress -c "$nar" > "$nar.Z"
+done
+
+mv "$tmp"/large.nar.* compressed/
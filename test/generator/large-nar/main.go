@@ -0,0 +1,15 @@
+// large-nar writes test.LargeNar to stdout, for compress-nars.sh.
+package main
+
+import (
+	"os"
+
+	"github.com/flokli/nix-casync/test"
+)
+
+func main() {
+	_, err := os.Stdout.Write(test.LargeNar())
+	if err != nil {
+		panic(err)
+	}
+}
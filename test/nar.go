@@ -0,0 +1,73 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strconv"
+)
+
+// NarEntry is an entry of a directory in a NAR file.
+type NarEntry struct {
+	Name string
+	Node []string
+}
+
+// NarFile returns the tokens of a regular file in a NAR file.
+func NarFile(contents string) []string {
+	return []string{"(", "type", "regular", "contents", contents, ")"}
+}
+
+// NarSymlink returns the tokens of a symlink in a NAR file.
+func NarSymlink(target string) []string {
+	return []string{"(", "type", "symlink", "target", target, ")"}
+}
+
+// NarDirectory returns the tokens of a directory in a NAR file, with entries in the order passed.
+func NarDirectory(entries ...NarEntry) []string {
+	tokens := []string{"(", "type", "directory"}
+
+	for _, entry := range entries {
+		tokens = append(tokens, "entry", "(", "name", entry.Name, "node")
+		tokens = append(tokens, entry.Node...)
+		tokens = append(tokens, ")")
+	}
+
+	return append(tokens, ")")
+}
+
+// EncodeNar returns a NAR file with the tokens of the root node.
+// Each token is prefixed by its length, and padded with null bytes to a multiple of 8 bytes.
+// It doesn't check the tokens, so it can be used to create invalid NAR files.
+func EncodeNar(root []string) []byte {
+	var buf bytes.Buffer
+
+	for _, token := range append([]string{"nix-archive-1"}, root...) {
+		var n [8]byte
+
+		binary.LittleEndian.PutUint64(n[:], uint64(len(token)))
+		buf.Write(n[:])
+		buf.WriteString(token)
+		buf.Write(make([]byte, (8-len(token)%8)%8))
+	}
+
+	return buf.Bytes()
+}
+
+// LargeNar returns a NAR file of a single regular file, big enough for lzop to split it into multiple blocks
+// (of 256 KiB), and for compress to grow its codes to the maximum width,
+// and to clear its table once the compression ratio drops in the random part.
+// The variants of it compressed by //test/generator/compress-nars.sh are in //test/compressed.
+func LargeNar() []byte {
+	var contents bytes.Buffer
+
+	for i := 0; contents.Len() < 128<<10; i++ {
+		contents.WriteString(strconv.Itoa(i) + "\n")
+	}
+
+	random := make([]byte, 384<<10)
+	rand.New(rand.NewSource(1)).Read(random) //nolint:gosec
+	contents.Write(random)
+
+	return EncodeNar(NarFile(contents.String()))
+}